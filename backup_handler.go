@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/metrics"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
@@ -68,6 +72,14 @@ func retryNotify(err error, wait time.Duration) {
 	klog.Infof("Retrying after %.2f seconds with error : %s", wait.Seconds(), err.Error())
 }
 
+// retryNotifyCounted returns retryNotify counting up retries of the operation
+func retryNotifyCounted(operation string) backoff.Notify {
+	return func(err error, wait time.Duration) {
+		metrics.SnapshotRetries.WithLabelValues(operation).Inc()
+		retryNotify(err, wait)
+	}
+}
+
 // snapshotSyncHandler compares the actual state with the desired, and attempts to
 // converge the two. It then updates the Status block of the Snapshot resource
 // with the current status of the resource.
@@ -110,16 +122,54 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		}
 	}
 
+	// cancelled before started
+	if snapshot.Spec.Cancel && snapshot.Status.Phase == "InQueue" {
+		snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Cancelled", "Cancelled before started")
+		if err != nil {
+			return err
+		}
+	}
+
+	// paused snapshot is kept in queue
+	if !queueonly && snapshot.Status.Phase == "InQueue" && snapshot.Spec.Paused {
+		klog.Infof("snapshot:%s paused", name)
+		return nil
+	}
+
 	// do snapshot
 	if !queueonly && snapshot.Status.Phase == "InQueue" {
+
+		// incremental snapshot needs the completed parent
+		if snapshot.Spec.ParentSnapshot != "" {
+			parent, err := c.snapshotLister.Snapshots(namespace).Get(snapshot.Spec.ParentSnapshot)
+			if err != nil || parent.Status.Phase == "Failed" || parent.Status.Phase == "Cancelled" {
+				reason := "Parent snapshot " + snapshot.Spec.ParentSnapshot + " not available"
+				if err != nil && !errors.IsNotFound(err) {
+					return err
+				}
+				_, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", reason)
+				return err
+			}
+			if parent.Status.Phase != "Completed" {
+				klog.Infof("snapshot:%s waiting for parent snapshot %s", name, parent.ObjectMeta.Name)
+				return nil
+			}
+		}
+
 		snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "InProgress", "")
 		if err != nil {
 			return err
 		}
+		start := time.Now()
+
+		// context cancelled with the cancel flag
+		runCtx, done := c.startRunning(runningSnapshot, key, func() bool { return c.snapshotCancelRequested(namespace, name) })
+		defer done()
 
 		// bucket
 		bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
 		if err != nil {
+			metrics.ObserveSince(metrics.SnapshotDuration, "Failed", start)
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -135,10 +185,14 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		b.Multiplier = 2.0
 		b.InitialInterval = 2 * time.Second
 		operationSnapshot := func() error {
-			return c.clusterCmd.Snapshot(ctx, snapshot)
+			return c.clusterCmd.Snapshot(runCtx, snapshot, bucket)
+		}
+		err = backoff.RetryNotify(operationSnapshot, backoff.WithContext(b, runCtx), retryNotifyCounted("snapshot"))
+		if err != nil && runCtx.Err() != nil {
+			return c.snapshotCancelled(ctx, snapshot, "Cancelled while taking the snapshot", start)
 		}
-		err = backoff.RetryNotify(operationSnapshot, b, retryNotify)
 		if err != nil {
+			metrics.ObserveSince(metrics.SnapshotDuration, "Failed", start)
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -149,10 +203,14 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		// upload snapshot with backoff retry
 		b.Reset()
 		operationUpload := func() error {
-			return c.clusterCmd.UploadSnapshot(snapshot, bucket)
+			return c.clusterCmd.UploadSnapshot(runCtx, snapshot, bucket)
+		}
+		err = backoff.RetryNotify(operationUpload, backoff.WithContext(b, runCtx), retryNotifyCounted("upload"))
+		if err != nil && runCtx.Err() != nil {
+			return c.snapshotCancelled(ctx, snapshot, "Cancelled while uploading the snapshot", start)
 		}
-		err = backoff.RetryNotify(operationUpload, b, retryNotify)
 		if err != nil {
+			metrics.ObserveSince(metrics.SnapshotDuration, "Failed", start)
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -160,6 +218,7 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 			return nil
 		}
 
+		metrics.ObserveSince(metrics.SnapshotDuration, "Completed", start)
 		snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Completed", "")
 		if err != nil {
 			return err
@@ -190,8 +249,8 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		}
 	}
 
-	// expiration for failed snapshot
-	if snapshot.Status.Phase == "Failed" && snapshot.Status.AvailableUntil.IsZero() {
+	// expiration for failed or cancelled snapshot
+	if (snapshot.Status.Phase == "Failed" || snapshot.Status.Phase == "Cancelled") && snapshot.Status.AvailableUntil.IsZero() {
 		if !snapshot.Spec.AvailableUntil.IsZero() {
 			snapshot.Status.AvailableUntil = snapshot.Spec.AvailableUntil
 			snapshot.Status.TTL.Duration = snapshot.Status.AvailableUntil.Time.Sub(snapshot.ObjectMeta.CreationTimestamp.Time)
@@ -206,7 +265,7 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 	}
 
 	// expiration edited
-	if snapshot.Status.Phase == "Completed" || snapshot.Status.Phase == "Failed" {
+	if snapshot.Status.Phase == "Completed" || snapshot.Status.Phase == "Failed" || snapshot.Status.Phase == "Cancelled" {
 		if !snapshot.Spec.AvailableUntil.IsZero() && !snapshot.Spec.AvailableUntil.Equal(&snapshot.Status.AvailableUntil) {
 			snapshot.Status.AvailableUntil = snapshot.Spec.AvailableUntil
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, snapshot.Status.Phase, snapshot.Status.Reason)
@@ -218,7 +277,21 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 
 	// delete expired
 	if !snapshot.Status.AvailableUntil.IsZero() && snapshot.Status.AvailableUntil.Before(&nowTime) {
-		err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		// keep parents of incremental snapshots
+		children, err := c.childSnapshots(namespace, name)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			reason := "Expired but kept as the parent of " + strings.Join(children, ",")
+			if snapshot.Status.Reason != reason {
+				klog.Infof("snapshot:%s expired - kept for incremental snapshots %s", name, strings.Join(children, ","))
+				_, err = c.updateSnapshotStatus(ctx, snapshot, snapshot.Status.Phase, reason)
+				return err
+			}
+			return nil
+		}
+		err = c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Delete(ctx, name, metav1.DeleteOptions{})
 		if err != nil {
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
 			if err != nil {
@@ -234,6 +307,29 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 	return nil
 }
 
+// snapshotCancelled sets phase Cancelled to the snapshot stopped on cancel
+func (c *Controller) snapshotCancelled(ctx context.Context, snapshot *cbv1alpha1.Snapshot, reason string, start time.Time) error {
+	metrics.ObserveSince(metrics.SnapshotDuration, "Cancelled", start)
+	_, err := c.updateSnapshotStatus(ctx, snapshot, "Cancelled", reason)
+	return err
+}
+
+// childSnapshots returns names of snapshots which have the snapshot as their parent
+func (c *Controller) childSnapshots(namespace, name string) ([]string, error) {
+	snapshots, err := c.snapshotLister.Snapshots(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("List snapshots error : %s", err.Error())
+	}
+	children := make([]string, 0)
+	for _, s := range snapshots {
+		if s.Spec.ParentSnapshot == name {
+			children = append(children, s.ObjectMeta.Name)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
 func (c *Controller) updateSnapshotStatus(ctx context.Context, snapshot *cbv1alpha1.Snapshot, phase, reason string) (*cbv1alpha1.Snapshot, error) {
 	snapshotCopy := snapshot.DeepCopy()
 	snapshotCopy.Status.Phase = phase
@@ -271,7 +367,7 @@ func (c *Controller) enqueueSnapshot(obj interface{}) {
 	c.snapshotQueue.AddRateLimited(key)
 }
 
-// Delete snapshot files on objectstore when Snapshot resource deleted
+// Delete snapshot files on objectstore and VolumeSnapshots when Snapshot resource deleted
 func (c *Controller) deleteSnapshot(obj interface{}) {
 
 	// convert object into Snapshot and get info for deleting
@@ -289,6 +385,15 @@ func (c *Controller) deleteSnapshot(obj interface{}) {
 	// context for delete snapshot
 	ctx := context.TODO()
 
+	// Delete VolumeSnapshots in the cluster, their contents are deleted by their deletion policy
+	if snapshot.Spec.VolumeSnapshots != nil {
+		klog.Infof("Deleting snapshot %s VolumeSnapshots", snapshot.ObjectMeta.Name)
+		err := c.clusterCmd.DeleteVolumeSnapshots(ctx, snapshot)
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}
+
 	bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
 	if err != nil {
 		runtime.HandleError(err)
@@ -16,6 +16,8 @@ import (
 	"k8s.io/apimachinery/pkg/util/runtime"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+	"github.com/ryo-watanabe/k8s-snap/pkg/metrics"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
 )
@@ -43,7 +45,7 @@ func (c *Controller) getObjectList(ctx context.Context) ([]objectstore.ObjectInf
 		// Get bucket
 		bucket, err := c.getBucket(ctx, c.namespace, os.ObjectMeta.Name, c.kubeclientset, c.cbclientset, c.insecure)
 		if err != nil {
-			fmt.Errorf("Get bucket error for ObjectstoreConfig %s * %s", os.ObjectMeta.Name, err.Error())
+			return nil, fmt.Errorf("Get bucket error for ObjectstoreConfig %s * %s", os.ObjectMeta.Name, err.Error())
 		}
 
 		// Append objects list
@@ -72,6 +74,10 @@ func (c *Controller) restoreSnapshotFromObject(ctx context.Context, object objec
 	}
 	snapshotFile.Close()
 
+	err = objectstore.CheckNotEncryptedFile("/tmp/" + object.Name)
+	if err != nil {
+		return err
+	}
 	return c.restoreSnapshotFromObjectFile(ctx, object)
 }
 
@@ -154,6 +160,13 @@ func (c *Controller) restoreSnapshotFromObjectFile(ctx context.Context, object o
 	}
 	snapshot.Status.StoredFileSize = object.Size
 	snapshot.Status.StoredTimestamp = metav1.NewTime(object.Timestamp)
+	if snapshot.Status.Checksum == "" {
+		checksum, err := cluster.FileChecksum("/tmp/" + object.Name)
+		if err != nil {
+			return err
+		}
+		snapshot.Status.Checksum = checksum
+	}
 	tmpAvailableUntil := metav1.NewTime(time.Now().Add(24 * 30 * time.Hour))
 	if snapshot.Status.AvailableUntil.Before(&tmpAvailableUntil) {
 		snapshot.Status.AvailableUntil = tmpAvailableUntil
@@ -195,14 +208,44 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 		return fmt.Errorf("List snapshots error : %s", err.Error())
 	}
 
+	// Get restore list for reports
+	restores, err := c.cbclientset.ClustersnapshotV1alpha1().Restores(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("List restores error : %s", err.Error())
+	}
+
+	// Get diff list for reports
+	diffs, err := c.cbclientset.ClustersnapshotV1alpha1().SnapshotDiffs(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("List snapshot diffs error : %s", err.Error())
+	}
+
 	// Compare to find orphan objects
 	orphanObjects := make([]objectstore.ObjectInfo, 0)
 	for _, object := range objectList {
 		found := false
-		for _, snap := range snapshots.Items {
-			if snap.ObjectMeta.Name+".tgz" == object.Name {
-				found = true
-				break
+		if cluster.IsRestoreReportObject(object.Name) {
+			// Reports are orphaned when the restore is deleted
+			for _, restore := range restores.Items {
+				if restore.Status.Report == object.Name {
+					found = true
+					break
+				}
+			}
+		} else if cluster.IsDiffReportObject(object.Name) {
+			// Reports are orphaned when the diff is deleted
+			for _, diff := range diffs.Items {
+				if diff.Status.Report == object.Name {
+					found = true
+					break
+				}
+			}
+		} else {
+			for _, snap := range snapshots.Items {
+				if snap.ObjectMeta.Name+".tgz" == object.Name {
+					found = true
+					break
+				}
 			}
 		}
 		if !found {
@@ -255,6 +298,10 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 		}
 	}
 
+	metrics.Orphans.WithLabelValues("object").Set(float64(len(orphanObjects)))
+	metrics.Orphans.WithLabelValues("snapshot_object_not_found").Set(float64(len(objectNotFoundSnaps)))
+	metrics.Orphans.WithLabelValues("snapshot_object_invalid").Set(float64(len(objectInvalidSnaps)))
+
 	// Delete orphan objects
 	if deleteOrphanObjects {
 		for _, object := range orphanObjects {
@@ -272,6 +319,9 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 		// Or restore orphaned snapshots
 	} else if restoreOrphanedSnapshots {
 		for _, object := range orphanObjects {
+			if cluster.IsRestoreReportObject(object.Name) || cluster.IsDiffReportObject(object.Name) {
+				continue
+			}
 			slog.Infof("Restoring orphaned snapshot from %s", object.Name)
 			err = c.restoreSnapshotFromObject(ctx, object)
 			if err != nil {
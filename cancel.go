@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Kinds of running items keyed with namespace/name
+const (
+	runningSnapshot = "snapshot"
+	runningRestore  = "restore"
+)
+
+// startRunning returns the context for the running item cancelled by cancelRunning, and the func to call on finished.
+// The context is cancelled at once when cancel has been requested before registered
+func (c *Controller) startRunning(kind, key string, cancelRequested func() bool) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.runningMu.Lock()
+	c.running[kind+":"+key] = cancel
+	c.runningMu.Unlock()
+	if cancelRequested() {
+		cancel()
+	}
+	return ctx, func() {
+		c.runningMu.Lock()
+		delete(c.running, kind+":"+key)
+		c.runningMu.Unlock()
+		cancel()
+	}
+}
+
+// cancelRunning cancels the context of the running item
+func (c *Controller) cancelRunning(kind, key string) {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	if cancel, ok := c.running[kind+":"+key]; ok {
+		klog.Infof("%s:%s cancel requested", kind, key)
+		cancel()
+	}
+}
+
+// cancelSnapshotIfRequested cancels the running snapshot when the cancel flag is set
+func (c *Controller) cancelSnapshotIfRequested(obj interface{}) {
+	snapshot, ok := obj.(*cbv1alpha1.Snapshot)
+	if !ok || !snapshot.Spec.Cancel {
+		return
+	}
+	if key, err := cache.MetaNamespaceKeyFunc(snapshot); err == nil {
+		c.cancelRunning(runningSnapshot, key)
+	}
+}
+
+// cancelRestoreIfRequested cancels the running restore when the cancel flag is set
+func (c *Controller) cancelRestoreIfRequested(obj interface{}) {
+	restore, ok := obj.(*cbv1alpha1.Restore)
+	if !ok || !restore.Spec.Cancel {
+		return
+	}
+	if key, err := cache.MetaNamespaceKeyFunc(restore); err == nil {
+		c.cancelRunning(runningRestore, key)
+	}
+}
+
+// snapshotCancelRequested checks the cancel flag of the latest snapshot
+func (c *Controller) snapshotCancelRequested(namespace, name string) bool {
+	snapshot, err := c.snapshotLister.Snapshots(namespace).Get(name)
+	return err == nil && snapshot.Spec.Cancel
+}
+
+// restoreCancelRequested checks the cancel flag of the latest restore
+func (c *Controller) restoreCancelRequested(namespace, name string) bool {
+	restore, err := c.restoreLister.Restores(namespace).Get(name)
+	return err == nil && restore.Spec.Cancel
+}
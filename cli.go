@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+// cliCommands are subcommands working with the objectstore and archives directly,
+// without the controller and k8s-snap CRDs
+var cliCommands = map[string]func(args []string, out io.Writer) error{
+	"list":     cliList,
+	"download": cliDownload,
+	"contents": cliContents,
+	"get":      cliGet,
+	"restore":  cliRestore,
+	"export":   cliExport,
+}
+
+// runCLI runs the subcommand in args, returns false when args[0] is not a subcommand
+func runCLI(args []string, out io.Writer) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	return true, cmd(args[1:], out)
+}
+
+// cliObjectstore holds objectstore flags of subcommands
+type cliObjectstore struct {
+	config            objectstore.Config
+	encryptionKeyFile string
+}
+
+func (o *cliObjectstore) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.config.Type, "type", objectstore.TypeS3, "Objectstore type")
+	fs.StringVar(&o.config.Endpoint, "endpoint", "", "Objectstore endpoint")
+	fs.StringVar(&o.config.Region, "region", "", "Objectstore region")
+	fs.StringVar(&o.config.Bucket, "bucket", "", "Bucket name")
+	fs.StringVar(&o.config.Path, "path", "", "Directory of the local objectstore")
+	fs.StringVar(&o.config.AccessKey, "accesskey", os.Getenv("AWS_ACCESS_KEY_ID"), "Access key, default to $AWS_ACCESS_KEY_ID")
+	fs.StringVar(&o.config.SecretKey, "secretkey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret key, default to $AWS_SECRET_ACCESS_KEY")
+	fs.BoolVar(&o.config.Insecure, "insecure", false, "Skip ssl certificate verification on connecting object store")
+	fs.StringVar(&o.encryptionKeyFile, "encryptionkeyfile", "", "File of the encryption key for an encrypted objectstore")
+}
+
+func (o *cliObjectstore) bucket() (objectstore.Objectstore, error) {
+	o.config.Name = "cli"
+	bucket, err := objectstore.New(&o.config)
+	if err != nil {
+		return nil, err
+	}
+	if o.encryptionKeyFile != "" {
+		key, err := ioutil.ReadFile(o.encryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Reading encryption key failed : %s", err.Error())
+		}
+		bucket = objectstore.NewEncrypted(bucket, key)
+	}
+	return bucket, nil
+}
+
+// cliList lists objects in the objectstore
+func cliList(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	store := &cliObjectstore{}
+	store.addFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	bucket, err := store.bucket()
+	if err != nil {
+		return err
+	}
+	objInfos, err := bucket.ListObjectInfo()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tTIMESTAMP")
+	for _, obj := range objInfos {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", obj.Name, obj.Size, obj.Timestamp.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// cliDownload downloads the snapshot archive from the objectstore
+func cliDownload(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	store := &cliObjectstore{}
+	store.addFlags(fs)
+	name := fs.String("snapshot", "", "Snapshot name")
+	file := fs.String("out", "", "Output file, default to [snapshot].tgz")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("-snapshot must be given")
+	}
+	if *file == "" {
+		*file = *name + ".tgz"
+	}
+	bucket, err := store.bucket()
+	if err != nil {
+		return err
+	}
+	err = cluster.DownloadArchive(*name, *file, bucket)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Snapshot %s downloaded to %s\n", *name, *file)
+	return nil
+}
+
+// cliContents prints the snapshot and paths of resources in the archive
+func cliContents(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("contents", flag.ContinueOnError)
+	file := fs.String("archive", "", "Snapshot archive file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-archive must be given")
+	}
+	snapshot, paths, err := cluster.ArchiveContents(*file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Snapshot: %s\n", snapshot.ObjectMeta.Name)
+	fmt.Fprintf(out, "Cluster: %s\n", snapshot.Spec.ClusterName)
+	fmt.Fprintf(out, "Timestamp: %s\n", snapshot.Status.SnapshotTimestamp.Format(time.RFC3339))
+	if snapshot.Spec.ParentSnapshot != "" {
+		fmt.Fprintf(out, "Parent: %s\n", snapshot.Spec.ParentSnapshot)
+	}
+	fmt.Fprintf(out, "Resources: %d\n", len(paths))
+	for _, path := range paths {
+		fmt.Fprintln(out, path)
+	}
+	return nil
+}
+
+// cliGet prints the resource of the path in the archive as YAML
+func cliGet(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	file := fs.String("archive", "", "Snapshot archive file")
+	path := fs.String("resource", "", "Resource path printed by contents")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" || *path == "" {
+		return fmt.Errorf("-archive and -resource must be given")
+	}
+	item, err := cluster.ArchiveResource(*file, *path)
+	if err != nil {
+		return err
+	}
+	bytes, err := yaml.Marshal(item.Object)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(bytes)
+	return err
+}
+
+// cliRestoreFlags holds flags of subcommands working with the restore preference
+type cliRestoreFlags struct {
+	cliObjectstore
+	name        string
+	archiveDir  string
+	prefFile    string
+	restoreName string
+	mappings    string
+}
+
+func (r *cliRestoreFlags) addFlags(fs *flag.FlagSet) {
+	r.cliObjectstore.addFlags(fs)
+	fs.StringVar(&r.name, "snapshot", "", "Snapshot name")
+	fs.StringVar(&r.archiveDir, "archivedir", "", "Directory of downloaded snapshot archives, download from the objectstore when empty")
+	fs.StringVar(&r.prefFile, "preference", "", "RestorePreference YAML file")
+	fs.StringVar(&r.restoreName, "name", "", "Name used for logs and the report, default to [snapshot]-"+fs.Name())
+	fs.StringVar(&r.mappings, "namespacemappings", "", "Namespace mappings as from=to,from=to")
+}
+
+// restore returns the restore and the preference from flags
+func (r *cliRestoreFlags) restore(suffix string) (*cbv1alpha1.Restore, *cbv1alpha1.RestorePreference, error) {
+	if r.restoreName == "" {
+		r.restoreName = r.name + "-" + suffix
+	}
+
+	pref := &cbv1alpha1.RestorePreference{}
+	if r.prefFile != "" {
+		bytes, err := ioutil.ReadFile(r.prefFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Reading preference failed : %s", err.Error())
+		}
+		err = yaml.Unmarshal(bytes, pref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Parsing preference failed : %s", err.Error())
+		}
+	}
+
+	restore := &cbv1alpha1.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: r.restoreName,
+		},
+		Spec: cbv1alpha1.RestoreSpec{
+			SnapshotName:          r.name,
+			RestorePreferenceName: pref.ObjectMeta.Name,
+		},
+	}
+	if r.mappings != "" {
+		restore.Spec.NamespaceMappings = make(map[string]string)
+		for _, m := range strings.Split(r.mappings, ",") {
+			sp := strings.SplitN(m, "=", 2)
+			if len(sp) != 2 || sp[0] == "" || sp[1] == "" {
+				return nil, nil, fmt.Errorf("Invalid namespace mapping %s", m)
+			}
+			restore.Spec.NamespaceMappings[sp[0]] = sp[1]
+		}
+	}
+	return restore, pref, nil
+}
+
+// loadArchives loads the snapshot archives from the archive dir or the objectstore into /tmp
+func (r *cliRestoreFlags) loadArchives() error {
+	if r.archiveDir != "" {
+		return cluster.LoadArchives(r.name, r.archiveDir)
+	}
+	bucket, err := r.bucket()
+	if err != nil {
+		return err
+	}
+	return cluster.DownloadArchives(r.name, bucket)
+}
+
+// printReport prints the local report file path if exists
+func printReport(restore *cbv1alpha1.Restore, out io.Writer) {
+	if _, err := os.Stat(cluster.RestoreReportFile(restore)); err == nil {
+		fmt.Fprintf(out, "Report: %s\n", cluster.RestoreReportFile(restore))
+	}
+}
+
+// cliRestore restores the snapshot on the cluster of the kubeconfig
+func cliRestore(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags := &cliRestoreFlags{}
+	flags.addFlags(fs)
+	kubeconfigFile := fs.String("kubeconfig", "", "Kubeconfig of the cluster to restore")
+	dryRun := fs.Bool("dryrun", false, "Restore with server side dry-run")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if flags.name == "" || *kubeconfigFile == "" {
+		return fmt.Errorf("-snapshot and -kubeconfig must be given")
+	}
+
+	kubeconfig, err := ioutil.ReadFile(*kubeconfigFile)
+	if err != nil {
+		return fmt.Errorf("Reading kubeconfig failed : %s", err.Error())
+	}
+	restore, pref, err := flags.restore("restore")
+	if err != nil {
+		return err
+	}
+	restore.Spec.Kubeconfig = string(kubeconfig)
+	restore.Spec.DryRun = *dryRun
+
+	err = flags.loadArchives()
+	if err != nil {
+		return err
+	}
+
+	// interrupt stops the restore between resources
+	ctx, stop := interruptContext()
+	defer stop()
+	err = cluster.RestoreOffline(ctx, restore, pref)
+	fmt.Fprintf(out, "Restore %s : created %d, updated %d, already existed %d, excluded %d, failed %d\n",
+		restore.ObjectMeta.Name, restore.Status.NumCreated, restore.Status.NumUpdated, restore.Status.NumAlreadyExisted,
+		restore.Status.NumPreferenceExcluded+restore.Status.NumExcluded, restore.Status.NumFailed)
+	for _, failed := range restore.Status.Failed {
+		fmt.Fprintf(out, "Failed: %s\n", failed)
+	}
+	printReport(restore, out)
+	return err
+}
+
+// cliExport writes the snapshot as applyable YAML manifests
+func cliExport(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags := &cliRestoreFlags{}
+	flags.addFlags(fs)
+	outDir := fs.String("outdir", "", "Output directory")
+	layout := fs.String("layout", cluster.ExportLayoutFiles, "Layout of the output : files / kustomize")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if flags.name == "" || *outDir == "" {
+		return fmt.Errorf("-snapshot and -outdir must be given")
+	}
+
+	restore, pref, err := flags.restore("export")
+	if err != nil {
+		return err
+	}
+
+	err = flags.loadArchives()
+	if err != nil {
+		return err
+	}
+
+	exported, err := cluster.Export(restore, pref, *outDir, *layout)
+	fmt.Fprintf(out, "Export %s : exported %d, excluded %d, failed %d\n",
+		restore.ObjectMeta.Name, exported,
+		restore.Status.NumPreferenceExcluded+restore.Status.NumExcluded, restore.Status.NumFailed)
+	printReport(restore, out)
+	return err
+}
+
+// interruptContext returns the context cancelled on interrupt and the func to stop watching signals
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigCh)
+		cancel()
+	}
+}
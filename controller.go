@@ -19,11 +19,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	//"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -41,13 +43,15 @@ import (
 	informers "github.com/ryo-watanabe/k8s-snap/pkg/client/informers/externalversions/clustersnapshot/v1alpha1"
 	listers "github.com/ryo-watanabe/k8s-snap/pkg/client/listers/clustersnapshot/v1alpha1"
 
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
 	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+	"github.com/ryo-watanabe/k8s-snap/pkg/metrics"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 )
 
 const controllerAgentName = "k8s-snapshot"
 
-// Controller is the controller implementation for Snapshot and Restore resources
+// Controller is the controller implementation for Snapshot, Restore and SnapshotDiff resources
 type Controller struct {
 	kubeclientset kubernetes.Interface
 	dynamic       dynamic.Interface
@@ -57,9 +61,14 @@ type Controller struct {
 	snapshotsSynced cache.InformerSynced
 	restoreLister   listers.RestoreLister
 	restoresSynced  cache.InformerSynced
+	scheduleLister  listers.SnapshotScheduleLister
+	schedulesSynced cache.InformerSynced
+	diffLister      listers.SnapshotDiffLister
+	diffsSynced     cache.InformerSynced
 
 	snapshotQueue workqueue.RateLimitingInterface
 	restoreQueue  workqueue.RateLimitingInterface
+	diffQueue     workqueue.RateLimitingInterface
 	recorder      record.EventRecorder
 
 	housekeepstore   bool
@@ -69,10 +78,20 @@ type Controller struct {
 	createbucket     bool
 
 	maxretryelapsedsec int
+	verifyintervalsec  int
 
 	namespace string
 	labels    map[string]string
 
+	// objectstore check results for readiness
+	healthMu           sync.RWMutex
+	objectstoreChecked bool
+	objectstoreErrors  map[string]string
+
+	// cancel funcs of running snapshots and restores
+	runningMu sync.Mutex
+	running   map[string]context.CancelFunc
+
 	clusterCmd cluster.Cluster
 	getBucket  func(ctx context.Context, namespace, objectstoreConfig string, kubeclient kubernetes.Interface, client clientset.Interface, insecure bool) (objectstore.Objectstore, error)
 }
@@ -84,9 +103,11 @@ func NewController(
 	cbclientset clientset.Interface,
 	snapshotInformer informers.SnapshotInformer,
 	restoreInformer informers.RestoreInformer,
+	scheduleInformer informers.SnapshotScheduleInformer,
+	diffInformer informers.SnapshotDiffInformer,
 	namespace string,
 	housekeepstore, restoresnapshots, validatefileinfo, insecure, createbucket bool,
-	maxretryelapsedsec int,
+	maxretryelapsedsec, verifyintervalsec int,
 	clusterCmd cluster.Cluster) *Controller {
 	//bucket *objectstore.Bucket) *Controller {
 
@@ -108,8 +129,13 @@ func NewController(
 		snapshotsSynced:    snapshotInformer.Informer().HasSynced,
 		restoreLister:      restoreInformer.Lister(),
 		restoresSynced:     restoreInformer.Informer().HasSynced,
+		scheduleLister:     scheduleInformer.Lister(),
+		schedulesSynced:    scheduleInformer.Informer().HasSynced,
+		diffLister:         diffInformer.Lister(),
+		diffsSynced:        diffInformer.Informer().HasSynced,
 		snapshotQueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Snapshots"),
 		restoreQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Restores"),
+		diffQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "SnapshotDiffs"),
 		recorder:           recorder,
 		housekeepstore:     housekeepstore,
 		restoresnapshots:   restoresnapshots,
@@ -117,11 +143,13 @@ func NewController(
 		insecure:           insecure,
 		createbucket:       createbucket,
 		maxretryelapsedsec: maxretryelapsedsec,
+		verifyintervalsec:  verifyintervalsec,
 		namespace:          namespace,
 		labels: map[string]string{
 			"app":        "k8s-snap",
 			"controller": "k8s-snap-controller",
 		},
+		running:    make(map[string]context.CancelFunc),
 		clusterCmd: clusterCmd,
 		getBucket:  getBucketFunc,
 	}
@@ -132,6 +160,7 @@ func NewController(
 	snapshotInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: controller.enqueueSnapshot,
 		UpdateFunc: func(old, new interface{}) {
+			controller.cancelSnapshotIfRequested(new)
 			controller.enqueueSnapshot(new)
 		},
 		DeleteFunc: controller.deleteSnapshot,
@@ -141,14 +170,45 @@ func NewController(
 	restoreInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: controller.enqueueRestore,
 		UpdateFunc: func(old, new interface{}) {
+			controller.cancelRestoreIfRequested(new)
 			controller.enqueueRestore(new)
 		},
 		//DeleteFunc: controller.enqueueRestore,
 	})
 
+	// Set up an event handler for when SnapshotDiff resources change
+	diffInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.enqueueDiff,
+		UpdateFunc: func(old, new interface{}) {
+			controller.enqueueDiff(new)
+		},
+	})
+
+	// Controller state exposed on scraping metrics
+	metrics.SetSource(controller)
+
 	return controller
 }
 
+// ListSnapshots lists snapshots for metrics
+func (c *Controller) ListSnapshots() ([]*cbv1alpha1.Snapshot, error) {
+	return c.snapshotLister.Snapshots(c.namespace).List(labels.Everything())
+}
+
+// ListRestores lists restores for metrics
+func (c *Controller) ListRestores() ([]*cbv1alpha1.Restore, error) {
+	return c.restoreLister.Restores(c.namespace).List(labels.Everything())
+}
+
+// QueueDepths returns numbers of items in the work queues for metrics
+func (c *Controller) QueueDepths() map[string]int {
+	return map[string]int{
+		"snapshot": c.snapshotQueue.Len(),
+		"restore":  c.restoreQueue.Len(),
+		"diff":     c.diffQueue.Len(),
+	}
+}
+
 // Run will set up the event handlers for types we are interested in, as well
 // as syncing informer caches and starting workers. It will block until stopCh
 // is closed, at which point it will shutdown the workqueue and wait for
@@ -157,6 +217,7 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 	defer runtime.HandleCrash()
 	defer c.snapshotQueue.ShutDown()
 	defer c.restoreQueue.ShutDown()
+	defer c.diffQueue.ShutDown()
 
 	// context for controller run
 	ctx := context.TODO()
@@ -164,49 +225,22 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 	klog.Info("Checking namespace")
 	_, err := c.kubeclientset.CoreV1().Namespaces().Get(ctx, c.namespace, metav1.GetOptions{})
 	if err != nil {
-		klog.Fatalf("Namespace %s not exist", c.namespace)
+		return fmt.Errorf("Namespace %s not exist : %s", c.namespace, err.Error())
 	}
 
 	// TO DO : Check CRDs are existing here.
 	//klog.Info("Checking CRDs")
 
+	// Objectstore problems are reported by readiness, not to crash the controller
 	klog.Info("Checking objectstore buckets")
-	osConfigs, err := c.cbclientset.ClustersnapshotV1alpha1().ObjectstoreConfigs(c.namespace).List(ctx, metav1.ListOptions{})
+	err = c.checkObjectstores(ctx, true)
 	if err != nil {
-		klog.Fatalf("List Objectstore Config error : %s", err.Error())
-	}
-	for _, os := range osConfigs.Items {
-
-		bucket, err := c.getBucket(ctx, c.namespace, os.ObjectMeta.Name, c.kubeclientset, c.cbclientset, c.insecure)
-		if err != nil {
-			klog.Fatalf("Get bucket error for ObjectstoreConfig %s * %s", os.ObjectMeta.Name, err.Error())
-		}
-		klog.Infof("- Objectstore Config name:%s endpoint:%s bucket:%s", bucket.GetName(), bucket.GetEndpoint(), bucket.GetBucketName())
-
-		found, err := bucket.ChkBucket()
-		if err != nil {
-			klog.Fatalf("Check bucket error : %s", err.Error())
-		}
-		if !found {
-			if c.createbucket {
-				klog.Infof("Creating bucket %s", bucket.GetBucketName())
-				err = bucket.CreateBucket()
-				if err != nil {
-					klog.Fatalf("Create bucket error : %s", err.Error())
-				}
-			} else {
-				klog.Fatalf("Bucket %s not found", bucket.GetBucketName())
-			}
-		}
-
-		objList, err := bucket.ListObjectInfo()
-		if err != nil {
-			klog.Fatalf("List objects error : %s", err.Error())
-		}
-		klog.Infof("-- Objects in bucket %s:", bucket.GetBucketName())
-		for _, obj := range objList {
-			klog.Infof("--- filename:%s size:%d timestamp:%s", obj.Name, obj.Size, obj.Timestamp)
+		klog.Errorf("Objectstore check error : %s", err.Error())
+		c.healthMu.RLock()
+		for name, msg := range c.objectstoreErrors {
+			klog.Errorf("- ObjectstoreConfig %s : %s", name, msg)
 		}
+		c.healthMu.RUnlock()
 	}
 
 	// Start the informer factories to begin populating the informer caches
@@ -214,7 +248,7 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.snapshotsSynced, c.restoresSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.snapshotsSynced, c.restoresSynced, c.schedulesSynced, c.diffsSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -233,13 +267,20 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 		go wait.Until(c.runSnapshotWorker, time.Second, stopCh)
 	}
 	go wait.Until(c.runSnapshotQueuer, time.Second, stopCh)
+	go wait.Until(c.runSnapshotScheduler, time.Duration(30)*time.Second, stopCh)
 	for i := 0; i < restorethreads; i++ {
 		go wait.Until(c.runRestoreWorker, time.Second, stopCh)
+		go wait.Until(c.runDiffWorker, time.Second, stopCh)
 	}
 
 	// Start object syncer
 	go wait.Until(c.runObjectSyncer, time.Duration(300)*time.Second, stopCh)
 
+	// Start snapshot verifier
+	if c.verifyintervalsec > 0 {
+		go wait.Until(c.runSnapshotVerifier, verifierPeriod(c.verifyintervalsec), stopCh)
+	}
+
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
@@ -254,13 +295,44 @@ func getBucketFunc(ctx context.Context, namespace, objectstoreConfig string, kub
 		return nil, err
 	}
 
-	// cloud credentials secret
-	cred, err := kubeclient.CoreV1().Secrets(namespace).Get(ctx, osConfig.Spec.CloudCredentialSecret, metav1.GetOptions{})
+	config := &objectstore.Config{
+		Name:     osConfig.ObjectMeta.Name,
+		Type:     osConfig.Spec.Type,
+		Endpoint: osConfig.Spec.Endpoint,
+		Region:   osConfig.Spec.Region,
+		Bucket:   osConfig.Spec.Bucket,
+		Path:     osConfig.Spec.Path,
+		Insecure: insecure,
+	}
+
+	// cloud credentials secret, optional for local objectstore
+	if osConfig.Spec.CloudCredentialSecret != "" || osConfig.Spec.Type != objectstore.TypeLocal {
+		cred, err := kubeclient.CoreV1().Secrets(namespace).Get(ctx, osConfig.Spec.CloudCredentialSecret, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		config.AccessKey = string(cred.Data["accesskey"])
+		config.SecretKey = string(cred.Data["secretkey"])
+	}
+
+	bucket, err := objectstore.New(config)
 	if err != nil {
 		return nil, err
 	}
-	bucket := objectstore.NewBucket(osConfig.ObjectMeta.Name, string(cred.Data["accesskey"]),
-		string(cred.Data["secretkey"]), osConfig.Spec.Endpoint, osConfig.Spec.Region, osConfig.Spec.Bucket, insecure)
+	bucket = metrics.InstrumentObjectstore(bucket)
+
+	// encryption key secret, optional
+	if osConfig.Spec.EncryptionKeySecret != "" {
+		secret, err := kubeclient.CoreV1().Secrets(namespace).Get(ctx, osConfig.Spec.EncryptionKeySecret, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("%s : getting encryption key secret %s failed : %s", objectstore.EncryptionErrorPrefix, osConfig.Spec.EncryptionKeySecret, err.Error())
+		}
+		key, ok := secret.Data["encryptionkey"]
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("%s : encryptionkey not found in secret %s", objectstore.EncryptionErrorPrefix, osConfig.Spec.EncryptionKeySecret)
+		}
+		bucket = objectstore.NewEncrypted(bucket, key)
+	}
 
 	return bucket, nil
 }
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -31,6 +39,7 @@ import (
 	clientset "github.com/ryo-watanabe/k8s-snap/pkg/client/clientset/versioned"
 	"github.com/ryo-watanabe/k8s-snap/pkg/client/clientset/versioned/fake"
 	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+	"github.com/ryo-watanabe/k8s-snap/pkg/metrics"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 )
 
@@ -55,6 +64,8 @@ type Case struct {
 	restoreerror     error
 	snaperror        error
 	uploaderror      error
+	rollbackerror    error
+	cancelRunning    bool
 }
 
 func newSnapshotCase(resultStatus, reason string) Case {
@@ -184,6 +195,66 @@ func TestSnapshot(t *testing.T) {
 		Case{handleKey: "test1"},
 		// 14:Invalid key
 		Case{handleKey: "test1/test1"},
+		// 15:Expired parent of incremental snapshot kept
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "Completed"),
+				newConfiguredSnapshot("test2", "Completed"),
+			},
+			updatedSnapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "Completed"),
+			},
+			handleKey: "test1",
+		},
+		// 16:Incremental snapshot waits for parent in progress
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "InProgress"),
+				newConfiguredSnapshot("test2", "InQueue"),
+			},
+			handleKey: "test2",
+		},
+		// 17:InQueue > Failed - parent snapshot not found
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test2", "InQueue"),
+			},
+			updatedSnapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test2", "Failed"),
+			},
+			handleKey: "test2",
+		},
+		// 18:InQueue > Cancelled - cancelled before started
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "InQueue"),
+			},
+			updatedSnapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "Cancelled"),
+				newConfiguredSnapshot("test1", "Cancelled"),
+			},
+			handleKey: "test1",
+		},
+		// 19:Paused snapshot kept in queue
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "InQueue"),
+			},
+			handleKey: "test1",
+		},
+		// 20:InQueue > InProgress > Cancelled - cancelled while taking the snapshot
+		newSnapshotCase("Cancelled", "Cancelled while taking the snapshot"),
+		// 21:InQueue > Failed - parent snapshot cancelled
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "Cancelled"),
+				newConfiguredSnapshot("test2", "InQueue"),
+			},
+			updatedSnapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test2", "Failed"),
+			},
+			handleKey: "test2",
+		},
 	}
 
 	// Additional test data:
@@ -232,6 +303,36 @@ func TestSnapshot(t *testing.T) {
 	cases[12].uploaderror = fmt.Errorf("Mock cluster upload returns not perm error")
 	// 13:Key not found (not error)
 	// 14:Invalid key (not error)
+	// 15:Expired parent of incremental snapshot kept
+	cases[15].snapshots[0].Status.AvailableUntil = past
+	cases[15].snapshots[1].Spec.ParentSnapshot = "test1"
+	cases[15].updatedSnapshots[0].Status.AvailableUntil = past
+	cases[15].updatedSnapshots[0].Status.Reason = "Expired but kept as the parent of test2"
+	// 16:Incremental snapshot waits for parent in progress
+	cases[16].snapshots[0].ObjectMeta.CreationTimestamp = metav1.Now()
+	cases[16].snapshots[1].Spec.ParentSnapshot = "test1"
+	// 17:InQueue > Failed - parent snapshot not found
+	cases[17].snapshots[0].Spec.ParentSnapshot = "test1"
+	cases[17].updatedSnapshots[0].Spec.ParentSnapshot = "test1"
+	cases[17].updatedSnapshots[0].Status.Reason = "Parent snapshot test1 not available"
+	// 18:InQueue > Cancelled - cancelled before started
+	cases[18].snapshots[0].Spec.Cancel = true
+	cases[18].snapshots[0].Spec.AvailableUntil = future
+	for _, s := range cases[18].updatedSnapshots {
+		s.Spec.Cancel = true
+		s.Spec.AvailableUntil = future
+		s.Status.Reason = "Cancelled before started"
+	}
+	cases[18].updatedSnapshots[1].Status.AvailableUntil = future
+	cases[18].updatedSnapshots[1].Status.TTL.Duration = future.Time.Sub(cases[18].snapshots[0].ObjectMeta.CreationTimestamp.Time)
+	// 19:Paused snapshot kept in queue
+	cases[19].snapshots[0].Spec.Paused = true
+	// 20:InQueue > InProgress > Cancelled - cancelled while taking the snapshot
+	cases[20].cancelRunning = true
+	// 21:InQueue > Failed - parent snapshot cancelled
+	cases[21].snapshots[1].Spec.ParentSnapshot = "test1"
+	cases[21].updatedSnapshots[0].Spec.ParentSnapshot = "test1"
+	cases[21].updatedSnapshots[0].Status.Reason = "Parent snapshot test1 not available"
 
 	for _, c := range cases {
 		SnapshotTestCase(&c, t)
@@ -347,6 +448,47 @@ func TestRestore(t *testing.T) {
 		Case{handleKey: "test1"},
 		// 13:Invalid key
 		Case{handleKey: "test1/test1"},
+		// 14:InQueue > Cancelled - cancelled before started
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "InQueue"),
+			},
+			updatedRestores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Cancelled"),
+				newConfiguredRestore("test1", "Cancelled"),
+			},
+			handleKey: "test1",
+		},
+		// 15:Paused restore kept in queue
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "InQueue"),
+			},
+			handleKey: "test1",
+		},
+		// 16:InQueue > InProgress > Cancelled - stopped between resources
+		newRestoreCase("Cancelled", "Cancelled after 1 resources created and 0 updated"),
+		// 17:Rollback InProgress > Completed for completed restore
+		newRollbackCase("Completed", ""),
+		// 18:Rollback InProgress > Failed with rollback error
+		newRollbackCase("Failed", "Mock cluster resturns a error"),
+		// 19:Rollback Failed for dry-run restore
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Completed"),
+			},
+			updatedRestores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Completed"),
+			},
+			handleKey: "test1",
+		},
+		// 20:Rollback already completed
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Completed"),
+			},
+			handleKey: "test1",
+		},
 	}
 
 	dur, _ := time.ParseDuration("168h0m0s")
@@ -390,6 +532,37 @@ func TestRestore(t *testing.T) {
 	cases[11].updatedRestores[0].Status.AvailableUntil = past
 	// 12:Key not found (not error)
 	// 13:Invalid key (not error)
+	// 14:InQueue > Cancelled - cancelled before started
+	cases[14].restores[0].Spec.Cancel = true
+	cases[14].restores[0].Spec.AvailableUntil = future
+	for _, r := range cases[14].updatedRestores {
+		r.Spec.Cancel = true
+		r.Spec.AvailableUntil = future
+		r.Status.Reason = "Cancelled before started"
+	}
+	cases[14].updatedRestores[1].Status.AvailableUntil = future
+	cases[14].updatedRestores[1].Status.TTL.Duration = future.Time.Sub(cases[14].restores[0].ObjectMeta.CreationTimestamp.Time)
+	// 15:Paused restore kept in queue
+	cases[15].restores[0].Spec.Paused = true
+	// 16:InQueue > InProgress > Cancelled - stopped between resources
+	cases[16].cancelRunning = true
+	cases[16].updatedRestores[1].Status.NumCreated = 1
+	// 17:Rollback InProgress > Completed for completed restore
+	cases[17].updatedRestores[1].Status.Rollback.NumDeleted = 1
+	// 18:Rollback InProgress > Failed with rollback error
+	cases[18].rollbackerror = fmt.Errorf("Mock cluster resturns a error")
+	// 19:Rollback Failed for dry-run restore
+	cases[19].restores[0].Spec.DryRun = true
+	cases[19].restores[0].Spec.Rollback = true
+	cases[19].updatedRestores[0].Spec.DryRun = true
+	cases[19].updatedRestores[0].Spec.Rollback = true
+	cases[19].updatedRestores[0].Status.Rollback = &clustersnapshot.RestoreRollbackStatus{
+		Phase:  "Failed",
+		Reason: "Dry-run restore has nothing to roll back",
+	}
+	// 20:Rollback already completed
+	cases[20].restores[0].Spec.Rollback = true
+	cases[20].restores[0].Status.Rollback = &clustersnapshot.RestoreRollbackStatus{Phase: "Completed"}
 
 	for _, c := range cases {
 		RestoreTestCase(&c, t)
@@ -405,6 +578,8 @@ type fixture struct {
 	// Objects to put in the store.
 	snapshotLister []*clustersnapshot.Snapshot
 	restoreLister  []*clustersnapshot.Restore
+	scheduleLister []*clustersnapshot.SnapshotSchedule
+	diffLister     []*clustersnapshot.SnapshotDiff
 	// Actions expected to happen on the client.
 	kubeactions []core.Action
 	actions     []core.Action
@@ -507,24 +682,78 @@ type mockCluster struct {
 // Snapshot for fake cluster interface
 var snapshotErr error
 
-func (c *mockCluster) Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
+func (c *mockCluster) Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	if cancelOnRun != nil {
+		cancelOnRun()
+		return ctx.Err()
+	}
 	return snapshotErr
 }
 
 // UploadSnapshot for fake cluster interface
 var uploadErr error
 
-func (c *mockCluster) UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+func (c *mockCluster) UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
 	return uploadErr
 }
 
 // Restore for fake cluster interface
 var restoreErr error
 
-func (c *mockCluster) Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error {
+func (c *mockCluster) Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error {
+	if cancelOnRun != nil {
+		restore.Status.NumCreated = 1
+		cancelOnRun()
+		return ctx.Err()
+	}
 	return restoreErr
 }
 
+// Rollback for fake cluster interface
+var rollbackErr error
+
+func (c *mockCluster) Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+	if rollbackErr != nil {
+		return rollbackErr
+	}
+	restore.Status.Rollback.NumDeleted = 1
+	return nil
+}
+
+// cancelOnRun cancels the running item in Snapshot or Restore of fake cluster interface
+var cancelOnRun func()
+
+// VerifySnapshot for fake cluster interface, errors by snapshot name
+var verifyErrs map[string]error
+var verified []string
+
+func (c *mockCluster) VerifySnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	verified = append(verified, snapshot.ObjectMeta.Name)
+	return verifyErrs[snapshot.ObjectMeta.Name]
+}
+
+// Diff for fake cluster interface
+var diffErr error
+var diffTargetBucket objectstore.Objectstore
+
+func (c *mockCluster) Diff(diff *cbv1alpha1.SnapshotDiff, bucket, targetBucket objectstore.Objectstore) error {
+	diffTargetBucket = targetBucket
+	if diffErr != nil {
+		return diffErr
+	}
+	diff.Status.NumChanged = 1
+	diff.Status.Report = cluster.DiffReportObjectName(diff)
+	return nil
+}
+
+// DeleteVolumeSnapshots for fake cluster interface
+var volumeSnapshotsDeleted []string
+
+func (c *mockCluster) DeleteVolumeSnapshots(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
+	volumeSnapshotsDeleted = append(volumeSnapshotsDeleted, snapshot.ObjectMeta.Name)
+	return nil
+}
+
 //func (f *fixture) newController() (*Controller, informers.SharedInformerFactory, kubeinformers.SharedInformerFactory) {
 func (f *fixture) newController() (*Controller, informers.SharedInformerFactory, kubeinformers.SharedInformerFactory) {
 	f.client = fake.NewSimpleClientset(f.objects...)
@@ -538,12 +767,16 @@ func (f *fixture) newController() (*Controller, informers.SharedInformerFactory,
 		f.kubeclient, f.dynamic, f.client,
 		i.Clustersnapshot().V1alpha1().Snapshots(),
 		i.Clustersnapshot().V1alpha1().Restores(),
-		snapshotNamespace, true, true, true, false, true, 5,
+		i.Clustersnapshot().V1alpha1().SnapshotSchedules(),
+		i.Clustersnapshot().V1alpha1().SnapshotDiffs(),
+		snapshotNamespace, true, true, true, false, true, 5, 3600,
 		&mockCluster{},
 	)
 
 	c.snapshotsSynced = alwaysReady
 	c.restoresSynced = alwaysReady
+	c.schedulesSynced = alwaysReady
+	c.diffsSynced = alwaysReady
 	c.recorder = &record.FakeRecorder{}
 
 	return c, i, k8sI
@@ -557,6 +790,14 @@ func (f *fixture) initInformers(i informers.SharedInformerFactory, k8sI kubeinfo
 	for _, p := range f.restoreLister {
 		i.Clustersnapshot().V1alpha1().Restores().Informer().GetIndexer().Add(p)
 	}
+
+	for _, p := range f.scheduleLister {
+		i.Clustersnapshot().V1alpha1().SnapshotSchedules().Informer().GetIndexer().Add(p)
+	}
+
+	for _, p := range f.diffLister {
+		i.Clustersnapshot().V1alpha1().SnapshotDiffs().Informer().GetIndexer().Add(p)
+	}
 }
 
 func (f *fixture) startInformers(i informers.SharedInformerFactory, k8sI kubeinformers.SharedInformerFactory) {
@@ -612,6 +853,38 @@ func (f *fixture) runTest(c *Controller, name, res string, expectError, queueOnl
 
 // checkAction verifies that expected and actual actions are equal and both have
 // same attached resources
+// newRollbackCase returns the case of the rollback for the completed restore with the report
+func newRollbackCase(resultStatus, reason string) Case {
+	c := Case{
+		snapshots: []*clustersnapshot.Snapshot{
+			newConfiguredSnapshot("snapshot", "Completed"),
+		},
+		restores: []*clustersnapshot.Restore{
+			newConfiguredRestore("test1", "Completed"),
+		},
+		updatedRestores: []*clustersnapshot.Restore{
+			newConfiguredRestore("test1", "Completed"),
+			newConfiguredRestore("test1", "Completed"),
+		},
+		configs: []*clustersnapshot.ObjectstoreConfig{
+			newObjectstoreConfig(),
+		},
+		secrets: []*corev1.Secret{
+			newCloudCredentialSecret(),
+		},
+		handleKey: "test1",
+	}
+	c.restores[0].Spec.Rollback = true
+	c.restores[0].Status.Report = "snapshot.restore.test1.ndjson"
+	for _, r := range c.updatedRestores {
+		r.Spec.Rollback = true
+		r.Status.Report = "snapshot.restore.test1.ndjson"
+	}
+	c.updatedRestores[0].Status.Rollback = &clustersnapshot.RestoreRollbackStatus{Phase: "InProgress"}
+	c.updatedRestores[1].Status.Rollback = &clustersnapshot.RestoreRollbackStatus{Phase: resultStatus, Reason: reason}
+	return c
+}
+
 func checkAction(expected, actual core.Action, t *testing.T) {
 	if !(expected.Matches(actual.GetVerb(), actual.GetResource().Resource) && actual.GetSubresource() == expected.GetSubresource()) {
 		t.Errorf("Expected\n\t%#v\ngot\n\t%#v", expected, actual)
@@ -732,6 +1005,9 @@ func SnapshotTestCase(c *Case, t *testing.T) {
 
 	snapshotErr = c.snaperror
 	uploadErr = c.uploaderror
+	if c.cancelRunning {
+		cancelOnRun = func() { cntl.cancelRunning(runningSnapshot, "default/"+c.handleKey) }
+	}
 
 	f.initInformers(i, k8sI)
 	f.startInformers(i, k8sI)
@@ -744,6 +1020,7 @@ func SnapshotTestCase(c *Case, t *testing.T) {
 
 	snapshotErr = nil
 	uploadErr = nil
+	cancelOnRun = nil
 }
 
 func RestoreTestCase(c *Case, t *testing.T) {
@@ -777,6 +1054,10 @@ func RestoreTestCase(c *Case, t *testing.T) {
 	}
 
 	restoreErr = c.restoreerror
+	rollbackErr = c.rollbackerror
+	if c.cancelRunning {
+		cancelOnRun = func() { cntl.cancelRunning(runningRestore, "default/"+c.handleKey) }
+	}
 
 	f.initInformers(i, k8sI)
 	f.startInformers(i, k8sI)
@@ -788,6 +1069,8 @@ func RestoreTestCase(c *Case, t *testing.T) {
 	}
 
 	restoreErr = nil
+	rollbackErr = nil
+	cancelOnRun = nil
 }
 
 func TestQueues(t *testing.T) {
@@ -908,6 +1191,18 @@ func TestBucket(t *testing.T) {
 	if deleteFilename != "test1.tgz" {
 		t.Errorf("Error in delete file name")
 	}
+	if len(volumeSnapshotsDeleted) != 0 {
+		t.Errorf("Error VolumeSnapshots deleted without volumeSnapshots : %v", volumeSnapshotsDeleted)
+	}
+
+	// Delete VolumeSnapshots with object
+	snapshots = []*clustersnapshot.Snapshot{newConfiguredSnapshot("test2", "Completed")}
+	snapshots[0].Spec.VolumeSnapshots = &clustersnapshot.VolumeSnapshotSpec{}
+	cntl = newBucketTestController(t, snapshots)
+	cntl.deleteSnapshot(snapshots[0])
+	if deleteFilename != "test2.tgz" || !reflect.DeepEqual(volumeSnapshotsDeleted, []string{"test2"}) {
+		t.Errorf("Error in delete VolumeSnapshots : %s %v", deleteFilename, volumeSnapshotsDeleted)
+	}
 
 	// Do nothing in syncObjects
 	snapshots = []*clustersnapshot.Snapshot{}
@@ -949,6 +1244,29 @@ func TestBucket(t *testing.T) {
 		t.Errorf("Error in delete orphan object")
 	}
 
+	// syncObjects keeps reports of existing restores and deletes orphaned ones
+	restore := newConfiguredRestore("restore1", "Completed")
+	restore.Status.Report = "test1.restore.restore1.ndjson"
+	objectInfoList = []objectstore.ObjectInfo{
+		objectstore.ObjectInfo{Name: "test1.restore.restore1.ndjson", BucketConfigName: "bucket"},
+		objectstore.ObjectInfo{Name: "test1.restore.deleted.ndjson", BucketConfigName: "bucket"},
+	}
+	cntl = newBucketTestController(t, snapshots)
+	_, err := cntl.cbclientset.ClustersnapshotV1alpha1().Restores(cntl.namespace).Create(context.TODO(), restore, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Error creating restore : %s", err.Error())
+	}
+	deleteFilename = ""
+	doSyncObjects(t, cntl, true, false, false)
+	if deleteFilename != "test1.restore.deleted.ndjson" {
+		t.Errorf("Error in delete orphan report : %s", deleteFilename)
+	}
+	downloadFilename = ""
+	doSyncObjects(t, cntl, false, true, false)
+	if downloadFilename != "" {
+		t.Errorf("Error report downloaded to restore snapshot : %s", downloadFilename)
+	}
+
 	// syncObjects find snapshot without object and set Failed
 	snapshots = []*clustersnapshot.Snapshot{
 		newConfiguredSnapshot("test1", "Completed"),
@@ -1034,7 +1352,7 @@ func TestBucket(t *testing.T) {
 	kubeClient := k8sfake.NewSimpleClientset(kubeobjects...)
 	sch := runtime.NewScheme()
 	dynamicClient := dynamicfake.NewSimpleDynamicClient(sch, ukubeobjects...)
-	err := cluster.SnapshotWithClient(context.TODO(), snapshots[0], kubeClient, dynamicClient)
+	err = cluster.SnapshotWithClient(context.TODO(), snapshots[0], kubeClient, dynamicClient, nil)
 	if err != nil {
 		t.Errorf("Error in snapshotWithClient : %s", err.Error())
 	}
@@ -1099,4 +1417,551 @@ func TestControllerRun(t *testing.T) {
 	}
 }
 
+func TestHealthChecks(t *testing.T) {
+	ctx := context.TODO()
+	cntl := newBucketTestController(t, nil)
+
+	if err := cntl.Healthz(); err != nil {
+		t.Errorf("Error in Healthz : %s", err.Error())
+	}
+
+	// not ready before objectstores checked
+	if err := cntl.Readyz(); err == nil {
+		t.Error("Error ready before objectstores checked")
+	}
+
+	// bucket found
+	bucketFound = true
+	if err := cntl.checkObjectstores(ctx, false); err != nil {
+		t.Errorf("Error in checkObjectstores : %s", err.Error())
+	}
+	if err := cntl.Readyz(); err != nil {
+		t.Errorf("Error in Readyz : %s", err.Error())
+	}
+
+	// bucket not found, not created on regular checks
+	bucketFound = false
+	if err := cntl.checkObjectstores(ctx, false); err == nil {
+		t.Error("Error bucket not found not reported")
+	}
+	err := cntl.Readyz()
+	if err == nil || !strings.Contains(err.Error(), "objectstoreConfig : Bucket bucket not found") {
+		t.Errorf("Error bucket not found not in Readyz : %v", err)
+	}
+
+	// bucket created on the initial check
+	if err := cntl.checkObjectstores(ctx, true); err != nil {
+		t.Errorf("Error in initial checkObjectstores : %s", err.Error())
+	}
+	if err := cntl.Readyz(); err != nil {
+		t.Errorf("Error in Readyz after bucket created : %s", err.Error())
+	}
+
+	// informer caches not synced
+	cntl.snapshotsSynced = func() bool { return false }
+	if err := cntl.Readyz(); err == nil {
+		t.Error("Error ready with informer caches not synced")
+	}
+	cntl.snapshotsSynced = alwaysReady
+	cntl.diffsSynced = func() bool { return false }
+	if err := cntl.Readyz(); err == nil {
+		t.Error("Error ready with diff informer cache not synced")
+	}
+}
+
+func TestSnapshotVerifier(t *testing.T) {
+	now := time.Now()
+	ctx := context.TODO()
+
+	recent := newConfiguredSnapshot("recent", "Completed")
+	recent.Status.VerifiedTimestamp = metav1.NewTime(now.Add(-10 * time.Minute))
+	old := newConfiguredSnapshot("old", "Completed")
+	old.Status.VerifiedTimestamp = metav1.NewTime(now.Add(-2 * time.Hour))
+	corrupted := newConfiguredSnapshot("corrupted", "Completed")
+	failed := newConfiguredSnapshot("failed", "Failed")
+	cntl := newBucketTestController(t, []*clustersnapshot.Snapshot{recent, old, corrupted, failed})
+
+	corruptedErr := &cluster.CorruptedError{Name: "corrupted", Reason: "checksum not matched"}
+	verifyErrs = map[string]error{"corrupted": corruptedErr}
+	verified = nil
+	err := cntl.verifySnapshots(now)
+	if err != nil {
+		t.Errorf("Error in verifySnapshots : %s", err.Error())
+	}
+	sort.Strings(verified)
+	if !reflect.DeepEqual(verified, []string{"corrupted", "old"}) {
+		t.Errorf("Error verified snapshots : %v", verified)
+	}
+	chkSnapshot(t, cntl, "corrupted", "Failed", corruptedErr.Error())
+	chkSnapshot(t, cntl, "old", "Completed", "")
+	snap, err := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(ctx, "old", metav1.GetOptions{})
+	if err != nil || snap.Status.VerifiedTimestamp.Unix() != now.Unix() {
+		t.Errorf("Error verified timestamp not updated : %v %v", err, snap)
+	}
+
+	// restore fails with the corrupted parent snapshot
+	child := newConfiguredSnapshot("snapshot", "Completed")
+	child.Spec.ParentSnapshot = "parent"
+	parent := newConfiguredSnapshot("parent", "Completed")
+	restore := newConfiguredRestore("test1", "InQueue")
+	f := newFixture(t)
+	f.objects = append(f.objects, newObjectstoreConfig(), newRestorePreference(), child, parent, restore)
+	f.kubeobjects = append(f.kubeobjects, newCloudCredentialSecret())
+	f.restoreLister = append(f.restoreLister, restore)
+	cntl, i, k8sI := f.newController()
+	cntl.getBucket = getBucketMock
+	f.initInformers(i, k8sI)
+
+	parentErr := &cluster.CorruptedError{Name: "parent", Reason: "reading archive failed"}
+	verifyErrs = map[string]error{"parent": parentErr}
+	verified = nil
+	err = cntl.restoreSyncHandler("default/test1", false)
+	if err != nil {
+		t.Errorf("Error in restoreSyncHandler : %s", err.Error())
+	}
+	if !reflect.DeepEqual(verified, []string{"snapshot", "parent"}) {
+		t.Errorf("Error verified snapshots : %v", verified)
+	}
+	chkSnapshot(t, cntl, "parent", "Failed", parentErr.Error())
+	r, err := cntl.cbclientset.ClustersnapshotV1alpha1().Restores(cntl.namespace).Get(ctx, "test1", metav1.GetOptions{})
+	if err != nil || r.Status.Phase != "Failed" || r.Status.Reason != "Snapshot verification failed : "+parentErr.Error() {
+		t.Errorf("Error restore not failed with corrupted snapshot : %v %v", err, r)
+	}
+	verifyErrs = nil
+}
+
+func newSnapshotDiff(name, phase string) *clustersnapshot.SnapshotDiff {
+	return &clustersnapshot.SnapshotDiff{
+		TypeMeta: metav1.TypeMeta{APIVersion: clustersnapshot.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: clustersnapshot.SnapshotDiffSpec{
+			SnapshotName:       "snapshot",
+			TargetSnapshotName: "target",
+		},
+		Status: clustersnapshot.SnapshotDiffStatus{
+			Phase: phase,
+		},
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	ctx := context.TODO()
+
+	newDiffController := func(diffs ...*clustersnapshot.SnapshotDiff) *Controller {
+		f := newFixture(t)
+		f.objects = append(f.objects, newObjectstoreConfig(),
+			newConfiguredSnapshot("snapshot", "Completed"), newConfiguredSnapshot("target", "InProgress"))
+		f.kubeobjects = append(f.kubeobjects, newCloudCredentialSecret())
+		for _, diff := range diffs {
+			f.objects = append(f.objects, diff)
+			f.diffLister = append(f.diffLister, diff)
+		}
+		cntl, i, k8sI := f.newController()
+		cntl.getBucket = getBucketMock
+		f.initInformers(i, k8sI)
+		return cntl
+	}
+	chkDiff := func(cntl *Controller, name, phase, reason string) *clustersnapshot.SnapshotDiff {
+		diff, err := cntl.cbclientset.ClustersnapshotV1alpha1().SnapshotDiffs(cntl.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Error getting diff %s : %s", name, err.Error())
+		}
+		if diff.Status.Phase != phase || diff.Status.Reason != reason {
+			t.Errorf("Error diff %s status %s : %s", name, diff.Status.Phase, diff.Status.Reason)
+		}
+		return diff
+	}
+
+	// Test01 : new diff queued with default TTL
+	cntl := newDiffController(newSnapshotDiff("diff1", ""))
+	err := cntl.diffSyncHandler("default/diff1")
+	if err != nil {
+		t.Errorf("Error in diffSyncHandler : %s", err.Error())
+	}
+	diff := chkDiff(cntl, "diff1", "InQueue", "")
+	if diff.Spec.TTL.Duration != 24*7*time.Hour {
+		t.Errorf("Error diff TTL : %s", diff.Spec.TTL.Duration)
+	}
+
+	// Test02 : target snapshot not completed
+	cntl = newDiffController(newSnapshotDiff("diff1", "InQueue"))
+	err = cntl.diffSyncHandler("default/diff1")
+	if err != nil {
+		t.Errorf("Error in diffSyncHandler : %s", err.Error())
+	}
+	chkDiff(cntl, "diff1", "Failed", "Snapshot target is not in status 'Completed'")
+
+	// Test03 : compared with the live cluster
+	live := newSnapshotDiff("diff1", "InQueue")
+	live.Spec.TargetSnapshotName = ""
+	live.Spec.Kubeconfig = "kubeconfig"
+	live.ObjectMeta.CreationTimestamp = metav1.Now()
+	live.Spec.TTL.Duration = time.Hour
+	cntl = newDiffController(live)
+	diffTargetBucket = nil
+	err = cntl.diffSyncHandler("default/diff1")
+	if err != nil {
+		t.Errorf("Error in diffSyncHandler : %s", err.Error())
+	}
+	diff = chkDiff(cntl, "diff1", "Completed", "")
+	if diff.Status.NumChanged != 1 || diff.Status.Report != "snapshot.diff.diff1.ndjson" || diffTargetBucket == nil {
+		t.Errorf("Error diff status : %#v", diff.Status)
+	}
+	if diff.Status.AvailableUntil.IsZero() || diff.Status.TTL.Duration != time.Hour {
+		t.Errorf("Error diff expiration : %#v", diff.Status)
+	}
+
+	// Test04 : neither target snapshot nor kubeconfig
+	live.Spec.Kubeconfig = ""
+	cntl = newDiffController(live)
+	err = cntl.diffSyncHandler("default/diff1")
+	if err != nil {
+		t.Errorf("Error in diffSyncHandler : %s", err.Error())
+	}
+	chkDiff(cntl, "diff1", "Failed", "Neither targetSnapshotName nor kubeconfig given")
+
+	// Test05 : diff error
+	diffErr = fmt.Errorf("Mock cluster returns a diff error")
+	live.Spec.Kubeconfig = "kubeconfig"
+	cntl = newDiffController(live)
+	err = cntl.diffSyncHandler("default/diff1")
+	if err != nil {
+		t.Errorf("Error in diffSyncHandler : %s", err.Error())
+	}
+	chkDiff(cntl, "diff1", "Failed", "Mock cluster returns a diff error")
+	diffErr = nil
+
+	// Test06 : expired diff deleted
+	expired := newSnapshotDiff("diff1", "Completed")
+	expired.Status.AvailableUntil = metav1.NewTime(time.Now().Add(-time.Hour))
+	expired.Status.Report = "snapshot.diff.diff1.ndjson"
+	cntl = newDiffController(expired)
+	err = cntl.diffSyncHandler("default/diff1")
+	if err != nil {
+		t.Errorf("Error in diffSyncHandler : %s", err.Error())
+	}
+	_, err = cntl.cbclientset.ClustersnapshotV1alpha1().SnapshotDiffs(cntl.namespace).Get(ctx, "diff1", metav1.GetOptions{})
+	if !errors.IsNotFound(err) {
+		t.Errorf("Error expired diff not deleted : %v", err)
+	}
+}
+
+func newSnapshotSchedule(name, schedule string, maxSnapshots int32) *clustersnapshot.SnapshotSchedule {
+	return &clustersnapshot.SnapshotSchedule{
+		TypeMeta: metav1.TypeMeta{APIVersion: clustersnapshot.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: clustersnapshot.SnapshotScheduleSpec{
+			Schedule:          schedule,
+			ClusterName:       "cluster1",
+			Kubeconfig:        "kubeconfig",
+			ObjectstoreConfig: "objectstoreConfig",
+			MaxSnapshots:      maxSnapshots,
+		},
+	}
+}
+
+func newScheduledTestSnapshot(schedule, name, phase string, created time.Time) *clustersnapshot.Snapshot {
+	snap := newConfiguredSnapshot(name, phase)
+	snap.ObjectMeta.Labels = map[string]string{scheduleLabel: schedule}
+	snap.ObjectMeta.CreationTimestamp = metav1.NewTime(created)
+	return snap
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+
+	now := time.Date(2021, 2, 1, 10, 30, 0, 0, time.UTC)
+	ctx := context.TODO()
+
+	// Create a snapshot and prune the oldest one
+	schedule := newSnapshotSchedule("sched1", "0 * * * *", 2)
+	schedule.ObjectMeta.CreationTimestamp = metav1.NewTime(now.Add(-3 * time.Hour))
+	f := newFixture(t)
+	f.objects = append(f.objects, schedule)
+	f.scheduleLister = append(f.scheduleLister, schedule)
+	for i, phase := range []string{"Completed", "Completed", "Failed"} {
+		snap := newScheduledTestSnapshot("sched1", fmt.Sprintf("sched1-%d", i), phase, now.Add(-time.Duration(i+1)*time.Hour))
+		f.objects = append(f.objects, snap)
+		f.snapshotLister = append(f.snapshotLister, snap)
+	}
+	cntl, i, k8sI := f.newController()
+	f.initInformers(i, k8sI)
+
+	err := cntl.scheduleSyncHandler(schedule, now)
+	if err != nil {
+		t.Errorf("Error in scheduleSyncHandler : %s", err.Error())
+	}
+	snap, err := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(ctx, "sched1-20210201-100000", metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Error scheduled snapshot not created : %s", err.Error())
+	} else if snap.Spec.ClusterName != "cluster1" || snap.ObjectMeta.Labels[scheduleLabel] != "sched1" {
+		t.Errorf("Error scheduled snapshot not match : %v", snap)
+	}
+	_, err = cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(ctx, "sched1-2", metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("Error oldest snapshot not pruned")
+	}
+	updated, _ := cntl.cbclientset.ClustersnapshotV1alpha1().SnapshotSchedules(cntl.namespace).Get(ctx, "sched1", metav1.GetOptions{})
+	if updated.Status.LastSnapshotName != "sched1-20210201-100000" {
+		t.Errorf("Error last snapshot name not match : %s", updated.Status.LastSnapshotName)
+	}
+	if !updated.Status.LastScheduleTime.Time.Equal(time.Date(2021, 2, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Error last schedule time not match : %s", updated.Status.LastScheduleTime)
+	}
+	if !updated.Status.NextScheduleTime.Time.Equal(time.Date(2021, 2, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("Error next schedule time not match : %s", updated.Status.NextScheduleTime)
+	}
+
+	// Parents of incremental snapshots kept, a parent with the children pruned is pruned
+	schedule = newSnapshotSchedule("sched3", "0 * * * *", 1)
+	schedule.ObjectMeta.CreationTimestamp = metav1.NewTime(now.Add(-5 * time.Hour))
+	f = newFixture(t)
+	f.objects = append(f.objects, schedule)
+	f.scheduleLister = append(f.scheduleLister, schedule)
+	parents := []string{"sched3-1", "", "sched3-3", ""}
+	for i, parent := range parents {
+		snap := newScheduledTestSnapshot("sched3", fmt.Sprintf("sched3-%d", i), "Completed", now.Add(-time.Duration(i+1)*time.Hour))
+		snap.Spec.ParentSnapshot = parent
+		f.objects = append(f.objects, snap)
+		f.snapshotLister = append(f.snapshotLister, snap)
+	}
+	cntl, i, k8sI = f.newController()
+	f.initInformers(i, k8sI)
+	err = cntl.pruneScheduledSnapshots(ctx, schedule)
+	if err != nil {
+		t.Errorf("Error in pruneScheduledSnapshots : %s", err.Error())
+	}
+	for i, kept := range []bool{true, true, false, false} {
+		name := fmt.Sprintf("sched3-%d", i)
+		_, err = cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(ctx, name, metav1.GetOptions{})
+		if kept != (err == nil) {
+			t.Errorf("Error snapshot %s kept %t : %v", name, kept, err)
+		}
+	}
+
+	// Not due yet
+	schedule = updated
+	f = newFixture(t)
+	f.objects = append(f.objects, schedule)
+	f.scheduleLister = append(f.scheduleLister, schedule)
+	cntl, i, k8sI = f.newController()
+	f.initInformers(i, k8sI)
+	err = cntl.scheduleSyncHandler(schedule, now.Add(10*time.Minute))
+	if err != nil {
+		t.Errorf("Error in scheduleSyncHandler : %s", err.Error())
+	}
+	snapshots, _ := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).List(ctx, metav1.ListOptions{})
+	if len(snapshots.Items) != 0 {
+		t.Errorf("Error snapshot created before schedule : %v", snapshots.Items)
+	}
+
+	// Invalid schedule
+	schedule = newSnapshotSchedule("sched2", "invalid", 0)
+	f = newFixture(t)
+	f.objects = append(f.objects, schedule)
+	cntl, i, k8sI = f.newController()
+	f.initInformers(i, k8sI)
+	err = cntl.scheduleSyncHandler(schedule, now)
+	if err != nil {
+		t.Errorf("Error in scheduleSyncHandler : %s", err.Error())
+	}
+	updated, _ = cntl.cbclientset.ClustersnapshotV1alpha1().SnapshotSchedules(cntl.namespace).Get(ctx, "sched2", metav1.GetOptions{})
+	if updated.Status.Reason == "" {
+		t.Errorf("Error invalid schedule not reported")
+	}
+}
+
 func int32Ptr(i int32) *int32 { return &i }
+
+func TestGetBucketFunc(t *testing.T) {
+	ctx := context.TODO()
+
+	// s3 objectstore with credentials
+	osConfig := newObjectstoreConfig()
+	client := fake.NewSimpleClientset(osConfig)
+	kubeclient := k8sfake.NewSimpleClientset(newCloudCredentialSecret())
+	bucket, err := getBucketFunc(ctx, "default", "objectstoreConfig", kubeclient, client, false)
+	if err != nil {
+		t.Fatalf("Error getting s3 bucket : %s", err.Error())
+	}
+	instrumented, ok := bucket.(*metrics.Instrumented)
+	if !ok {
+		t.Fatalf("Bucket not instrumented : %T", bucket)
+	}
+	if _, ok := instrumented.Objectstore.(*objectstore.Bucket); !ok {
+		t.Errorf("Bucket type is %T", instrumented.Objectstore)
+	}
+
+	// local objectstore without credentials
+	osConfig.Spec.Type = objectstore.TypeLocal
+	osConfig.Spec.Path = "/tmp"
+	osConfig.Spec.CloudCredentialSecret = ""
+	client = fake.NewSimpleClientset(osConfig)
+	bucket, err = getBucketFunc(ctx, "default", "objectstoreConfig", k8sfake.NewSimpleClientset(), client, false)
+	if err != nil {
+		t.Fatalf("Error getting local objectstore : %s", err.Error())
+	}
+	if _, ok := bucket.(*metrics.Instrumented).Objectstore.(*objectstore.Local); !ok || bucket.GetBucketName() != "/tmp" {
+		t.Errorf("Local objectstore not returned : %#v", bucket)
+	}
+
+	// encrypted objectstore
+	osConfig.Spec.EncryptionKeySecret = "encryption-key"
+	client = fake.NewSimpleClientset(osConfig)
+	_, err = getBucketFunc(ctx, "default", "objectstoreConfig", k8sfake.NewSimpleClientset(), client, false)
+	if err == nil || !strings.Contains(err.Error(), objectstore.EncryptionErrorPrefix) {
+		t.Errorf("Error missing encryption key secret not reported : %v", err)
+	}
+	keySecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "encryption-key", Namespace: "default"},
+		Data:       map[string][]byte{"encryptionkey": []byte("secret key")},
+	}
+	bucket, err = getBucketFunc(ctx, "default", "objectstoreConfig", k8sfake.NewSimpleClientset(keySecret), client, false)
+	if err != nil {
+		t.Fatalf("Error getting encrypted objectstore : %s", err.Error())
+	}
+	if _, ok := bucket.(*objectstore.Encrypted); !ok {
+		t.Errorf("Encrypted objectstore not returned : %T", bucket)
+	}
+	osConfig.Spec.EncryptionKeySecret = ""
+
+	// unknown type
+	osConfig.Spec.Type = "unknown"
+	client = fake.NewSimpleClientset(osConfig)
+	_, err = getBucketFunc(ctx, "default", "objectstoreConfig", kubeclient, client, false)
+	if err == nil {
+		t.Error("Error unknown objectstore type not reported")
+	}
+}
+
+func writeTestArchive(t *testing.T, file, name string, contents map[string]string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("Error creating archive : %s", err.Error())
+	}
+	defer f.Close()
+	gzipWriter := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for path, content := range contents {
+		hdr := &tar.Header{
+			Name:     name + path,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+			Mode:     0755,
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+}
+
+func TestCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatalf("Error making dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	cmPath := "/api/v1/namespaces/app1/configmaps/cm1"
+	writeTestArchive(t, filepath.Join(dir, "cli-snap.tgz"), "cli-snap", map[string]string{
+		"/snapshot.json": `{"metadata":{"name":"cli-snap"},"spec":{"clusterName":"cluster01"}}`,
+		cmPath + ".json": `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm1","namespace":"app1"},"data":{"key":"value"}}`,
+	})
+	run := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		ok, err := runCLI(args, out)
+		if !ok {
+			t.Fatalf("%s is not a subcommand", args[0])
+		}
+		return out.String(), err
+	}
+
+	// not a subcommand
+	if ok, _ := runCLI([]string{"-kubeconfig", "config"}, os.Stdout); ok {
+		t.Error("Controller flags run as a subcommand")
+	}
+
+	// list objects in the local objectstore
+	out, err := run("list", "-type", "local", "-path", dir)
+	if err != nil || !strings.Contains(out, "cli-snap.tgz") {
+		t.Errorf("Error in list : %s %v", out, err)
+	}
+
+	// download the archive
+	file := filepath.Join(dir, "downloaded.tgz")
+	_, err = run("download", "-type", "local", "-path", dir, "-snapshot", "cli-snap", "-out", file)
+	if err != nil {
+		t.Fatalf("Error in download : %s", err.Error())
+	}
+	_, err = run("download", "-type", "local", "-path", dir)
+	if err == nil {
+		t.Error("Error download without snapshot name not reported")
+	}
+
+	// contents and a resource as YAML
+	out, err = run("contents", "-archive", file)
+	if err != nil || !strings.Contains(out, "Snapshot: cli-snap") || !strings.Contains(out, "Cluster: cluster01") || !strings.Contains(out, cmPath+"\n") {
+		t.Errorf("Error in contents : %s %v", out, err)
+	}
+	out, err = run("get", "-archive", file, "-resource", cmPath)
+	if err != nil || !strings.Contains(out, "name: cm1\n") || !strings.Contains(out, "key: value\n") {
+		t.Errorf("Error in get : %s %v", out, err)
+	}
+	_, err = run("get", "-archive", file, "-resource", "/api/v1/namespaces/app1/configmaps/cm2")
+	if err == nil {
+		t.Error("Error getting missing resource not reported")
+	}
+
+	// restore
+	_, err = run("restore", "-snapshot", "cli-snap")
+	if err == nil || !strings.Contains(err.Error(), "-kubeconfig") {
+		t.Errorf("Error restore without kubeconfig not reported : %v", err)
+	}
+	kubeconfigFile := filepath.Join(dir, "kubeconfig")
+	prefFile := filepath.Join(dir, "preference.yaml")
+	_ = ioutil.WriteFile(kubeconfigFile, []byte("invalid kubeconfig"), 0644)
+	_ = ioutil.WriteFile(prefFile, []byte("spec: [\n"), 0644)
+	_, err = run("restore", "-snapshot", "cli-snap", "-kubeconfig", kubeconfigFile, "-preference", prefFile, "-archivedir", dir)
+	if err == nil || !strings.Contains(err.Error(), "Parsing preference failed") {
+		t.Errorf("Error invalid preference not reported : %v", err)
+	}
+	_ = ioutil.WriteFile(prefFile, []byte("kind: RestorePreference\nmetadata:\n  name: pref\nspec:\n  excludeNamespaces: [\"kube-system\"]\n"), 0644)
+	_, err = run("restore", "-snapshot", "cli-snap", "-kubeconfig", kubeconfigFile, "-preference", prefFile, "-archivedir", dir, "-namespacemappings", "app1")
+	if err == nil || !strings.Contains(err.Error(), "Invalid namespace mapping") {
+		t.Errorf("Error invalid namespace mapping not reported : %v", err)
+	}
+	_, err = run("restore", "-snapshot", "cli-snap", "-kubeconfig", kubeconfigFile, "-preference", prefFile, "-archivedir", dir)
+	if err == nil {
+		t.Error("Error invalid kubeconfig not reported")
+	}
+	if _, statErr := os.Stat("/tmp/cli-snap.tgz"); statErr != nil {
+		t.Errorf("Archive not loaded : %s", statErr.Error())
+	}
+
+	// export
+	outDir := filepath.Join(dir, "export")
+	_, err = run("export", "-snapshot", "cli-snap", "-archivedir", dir)
+	if err == nil || !strings.Contains(err.Error(), "-outdir") {
+		t.Errorf("Error export without outdir not reported : %v", err)
+	}
+	out, err = run("export", "-snapshot", "cli-snap", "-archivedir", dir, "-outdir", outDir, "-layout", "kustomize", "-preference", prefFile)
+	if err != nil || !strings.Contains(out, "Export cli-snap-export : exported 1, excluded 0, failed 0") {
+		t.Errorf("Error in export : %s %v", out, err)
+	}
+	exported, err := ioutil.ReadFile(filepath.Join(outDir, "namespaces", "app1", "configmap-cm1.yaml"))
+	if err != nil || string(exported) != "apiVersion: v1\ndata:\n  key: value\nkind: ConfigMap\nmetadata:\n  name: cm1\n  namespace: app1\n" {
+		t.Errorf("Error exported configmap : %s %v", string(exported), err)
+	}
+	if _, statErr := os.Stat(filepath.Join(outDir, "kustomization.yaml")); statErr != nil {
+		t.Errorf("Kustomization not exported : %s", statErr.Error())
+	}
+}
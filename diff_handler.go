@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+// runDiffWorker is a long-running function that will continually call the
+// processNextDiffItem function in order to read and process a message on the
+// workqueue.
+func (c *Controller) runDiffWorker() {
+	for c.processNextDiffItem() {
+	}
+}
+
+// processNextDiffItem will read a single work item off the workqueue and
+// attempt to process it, by calling the syncHandler.
+func (c *Controller) processNextDiffItem() bool {
+	obj, shutdown := c.diffQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := func(obj interface{}) error {
+		defer c.diffQueue.Done(obj)
+		var key string
+		var ok bool
+		if key, ok = obj.(string); !ok {
+			c.diffQueue.Forget(obj)
+			runtime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+			return nil
+		}
+		if err := c.diffSyncHandler(key); err != nil {
+			c.diffQueue.AddRateLimited(key)
+			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
+		}
+		c.diffQueue.Forget(obj)
+		klog.V(4).Infof("Successfully synced '%s'", key)
+		return nil
+	}(obj)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+
+	return true
+}
+
+// diffSyncHandler compares the snapshot with the target snapshot or the live cluster
+// and updates the Status block of the SnapshotDiff resource with the differences.
+func (c *Controller) diffSyncHandler(key string) error {
+
+	// context for diff
+	ctx := context.TODO()
+
+	// Convert the namespace/name string into a distinct namespace and name
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return nil
+	}
+
+	// Get the SnapshotDiff resource with this namespace/name.
+	diff, err := c.diffLister.SnapshotDiffs(namespace).Get(name)
+
+	// if deleted.
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// if deleted ok, exit sync handler here.
+			return nil
+		}
+		return err
+	}
+
+	if diff.Status.Phase == "InQueue" {
+		diff, err = c.updateDiffStatus(ctx, diff, "InProgress", "")
+		if err != nil {
+			return err
+		}
+		reason := c.doDiff(ctx, diff)
+		phase := "Completed"
+		if reason != "" {
+			phase = "Failed"
+		}
+		diff, err = c.updateDiffStatus(ctx, diff, phase, reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	nowTime := metav1.NewTime(time.Now())
+
+	if diff.Status.Phase == "" {
+		// Chack AvailableUntil
+		if diff.Spec.AvailableUntil.IsZero() {
+			// Check TTL string
+			if diff.Spec.TTL.Duration == 0 {
+				diff.Spec.TTL.Duration = 24 * 7 * time.Hour
+			}
+		} else if diff.Spec.AvailableUntil.Before(&nowTime) {
+			diff, err = c.updateDiffStatus(ctx, diff, "Failed", "AvailableUntil is set as past.")
+			if err != nil {
+				return err
+			}
+			// When the diff failed, exit sync handler here.
+			return nil
+		}
+		diff, err = c.updateDiffStatus(ctx, diff, "InQueue", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	// expiration for finished diff
+	if (diff.Status.Phase == "Completed" || diff.Status.Phase == "Failed") && diff.Status.AvailableUntil.IsZero() {
+		if !diff.Spec.AvailableUntil.IsZero() {
+			diff.Status.AvailableUntil = diff.Spec.AvailableUntil
+			diff.Status.TTL.Duration = diff.Status.AvailableUntil.Time.Sub(diff.ObjectMeta.CreationTimestamp.Time)
+		} else {
+			diff.Status.AvailableUntil = metav1.NewTime(diff.ObjectMeta.CreationTimestamp.Add(diff.Spec.TTL.Duration))
+			diff.Status.TTL = diff.Spec.TTL
+		}
+		diff, err = c.updateDiffStatus(ctx, diff, diff.Status.Phase, diff.Status.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	// delete expired
+	if !diff.Status.AvailableUntil.IsZero() && diff.Status.AvailableUntil.Before(&nowTime) {
+		c.deleteDiffReport(ctx, diff)
+		err := c.cbclientset.ClustersnapshotV1alpha1().SnapshotDiffs(c.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil {
+			diff, err = c.updateDiffStatus(ctx, diff, "Failed", err.Error())
+			if err != nil {
+				return err
+			}
+		}
+		klog.Infof("diff:%s expired - deleted", name)
+		// When the diff deleted, exit sync handler here.
+		return nil
+	}
+
+	c.recorder.Event(diff, corev1.EventTypeNormal, "Synced", "SnapshotDiff synced successfully")
+	return nil
+}
+
+// doDiff runs the diff and returns the reason of failure, empty when succeeded
+func (c *Controller) doDiff(ctx context.Context, diff *cbv1alpha1.SnapshotDiff) string {
+	snapshot, bucket, err := c.completedSnapshotBucket(ctx, diff.Spec.SnapshotName)
+	if err != nil {
+		return err.Error()
+	}
+	targetBucket := bucket
+	if diff.Spec.TargetSnapshotName != "" {
+		_, targetBucket, err = c.completedSnapshotBucket(ctx, diff.Spec.TargetSnapshotName)
+		if err != nil {
+			return err.Error()
+		}
+	} else if diff.Spec.Kubeconfig == "" && diff.Spec.KubeconfigSecretRef == nil {
+		return "Neither targetSnapshotName nor kubeconfig given"
+	}
+
+	err = c.clusterCmd.Diff(diff, bucket, targetBucket)
+	if err != nil {
+		return err.Error()
+	}
+	klog.Infof("diff:%s snapshot %s compared", diff.ObjectMeta.Name, snapshot.ObjectMeta.Name)
+	return ""
+}
+
+// completedSnapshotBucket returns the completed and verified snapshot and its bucket
+func (c *Controller) completedSnapshotBucket(ctx context.Context, name string) (*cbv1alpha1.Snapshot, objectstore.Objectstore, error) {
+	snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshot.Status.Phase != "Completed" {
+		return nil, nil, fmt.Errorf("Snapshot %s is not in status 'Completed'", name)
+	}
+	bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = c.verifySnapshotChain(ctx, snapshot, bucket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Snapshot verification failed : %s", err.Error())
+	}
+	return snapshot, bucket, nil
+}
+
+// deleteDiffReport deletes the report object of the diff next to the snapshot
+func (c *Controller) deleteDiffReport(ctx context.Context, diff *cbv1alpha1.SnapshotDiff) {
+	if diff.Status.Report == "" {
+		return
+	}
+	snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, diff.Spec.SnapshotName, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("diff:%s cannot delete report %s : %s", diff.ObjectMeta.Name, diff.Status.Report, err.Error())
+		return
+	}
+	bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		klog.Warningf("diff:%s cannot delete report %s : %s", diff.ObjectMeta.Name, diff.Status.Report, err.Error())
+		return
+	}
+	klog.Infof("Deleting diff report %s from objectstore %s", diff.Status.Report, snapshot.Spec.ObjectstoreConfig)
+	err = bucket.Delete(diff.Status.Report)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+}
+
+func (c *Controller) updateDiffStatus(ctx context.Context, diff *cbv1alpha1.SnapshotDiff, phase, reason string) (*cbv1alpha1.SnapshotDiff, error) {
+	diffCopy := diff.DeepCopy()
+	diffCopy.Status.Phase = phase
+	diffCopy.Status.Reason = reason
+	klog.Infof("diff:%s status %s => %s : %s", diff.ObjectMeta.Name, diff.Status.Phase, phase, reason)
+	diff, err := c.cbclientset.ClustersnapshotV1alpha1().SnapshotDiffs(diff.Namespace).Update(ctx, diffCopy, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to update diff status for " + diffCopy.ObjectMeta.Name + " : " + err.Error())
+	}
+	return diff, err
+}
+
+// enqueueDiff takes a SnapshotDiff resource and converts it into a namespace/name
+// string which is then put onto the work queue. This method should *not* be
+// passed resources of any type other than SnapshotDiff.
+func (c *Controller) enqueueDiff(obj interface{}) {
+	var key string
+	var err error
+
+	// queue only diffs in our namespace
+	meta, err := meta.Accessor(obj)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("object has no meta: %v", err))
+		return
+	}
+	if meta.GetNamespace() != c.namespace {
+		return
+	}
+
+	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.diffQueue.AddRateLimited(key)
+}
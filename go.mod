@@ -6,6 +6,8 @@ require (
 	github.com/aws/aws-sdk-go v1.36.30
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/imdario/mergo v0.3.11 // indirect
+	github.com/prometheus/client_golang v1.7.0
+	github.com/robfig/cron/v3 v3.0.1
 	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
 	k8s.io/api v0.20.1
 	k8s.io/apimachinery v0.20.2
@@ -13,4 +15,5 @@ require (
 	k8s.io/code-generator v0.20.2 // indirect
 	k8s.io/klog v1.0.0
 	k8s.io/utils v0.0.0-20210111153108-fddb29f9d009 // indirect
+	sigs.k8s.io/yaml v1.2.0
 )
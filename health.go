@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Healthz reports the controller process is alive
+func (c *Controller) Healthz() error {
+	return nil
+}
+
+// Readyz reports informer caches are synced and objectstores are reachable
+func (c *Controller) Readyz() error {
+	if !c.snapshotsSynced() || !c.restoresSynced() || !c.schedulesSynced() || !c.diffsSynced() {
+		return fmt.Errorf("Informer caches not synced")
+	}
+
+	c.healthMu.RLock()
+	defer c.healthMu.RUnlock()
+	if !c.objectstoreChecked {
+		return fmt.Errorf("Objectstores not checked yet")
+	}
+	if len(c.objectstoreErrors) > 0 {
+		msgs := make([]string, 0, len(c.objectstoreErrors))
+		for name, msg := range c.objectstoreErrors {
+			msgs = append(msgs, name+" : "+msg)
+		}
+		sort.Strings(msgs)
+		return fmt.Errorf("Objectstores not reachable : %s", strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// RunHealthChecker checks objectstores regularly for readiness
+func (c *Controller) RunHealthChecker() {
+	err := c.checkObjectstores(context.TODO(), false)
+	if err != nil {
+		klog.Warningf("Objectstore check error : %s", err.Error())
+	}
+}
+
+// checkObjectstores checks buckets of all objectstore configs and records the results.
+// On the initial check buckets are created if configured and objects are listed.
+func (c *Controller) checkObjectstores(ctx context.Context, initial bool) error {
+	osConfigs, err := c.cbclientset.ClustersnapshotV1alpha1().ObjectstoreConfigs(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("List Objectstore Config error : %s", err.Error())
+	}
+
+	errs := make(map[string]string)
+	for _, os := range osConfigs.Items {
+		err := c.checkObjectstore(ctx, os.ObjectMeta.Name, initial)
+		if err != nil {
+			errs[os.ObjectMeta.Name] = err.Error()
+		}
+	}
+
+	c.healthMu.Lock()
+	c.objectstoreErrors = errs
+	c.objectstoreChecked = true
+	c.healthMu.Unlock()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d objectstores not available", len(errs), len(osConfigs.Items))
+	}
+	return nil
+}
+
+func (c *Controller) checkObjectstore(ctx context.Context, name string, initial bool) error {
+	bucket, err := c.getBucket(ctx, c.namespace, name, c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		return fmt.Errorf("Get bucket error : %s", err.Error())
+	}
+	if initial {
+		klog.Infof("- Objectstore Config name:%s endpoint:%s bucket:%s", bucket.GetName(), bucket.GetEndpoint(), bucket.GetBucketName())
+	}
+
+	found, err := bucket.ChkBucket()
+	if err != nil {
+		return fmt.Errorf("Check bucket error : %s", err.Error())
+	}
+	if !found {
+		if !initial || !c.createbucket {
+			return fmt.Errorf("Bucket %s not found", bucket.GetBucketName())
+		}
+		klog.Infof("Creating bucket %s", bucket.GetBucketName())
+		err = bucket.CreateBucket()
+		if err != nil {
+			return fmt.Errorf("Create bucket error : %s", err.Error())
+		}
+	}
+
+	if initial {
+		objList, err := bucket.ListObjectInfo()
+		if err != nil {
+			return fmt.Errorf("List objects error : %s", err.Error())
+		}
+		klog.Infof("-- Objects in bucket %s:", bucket.GetBucketName())
+		for _, obj := range objList {
+			klog.Infof("--- filename:%s size:%d timestamp:%s", obj.Name, obj.Size, obj.Timestamp)
+		}
+	}
+	return nil
+}
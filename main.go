@@ -17,12 +17,20 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
 	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog"
 
 	// Uncomment the following line to load the gcp plugin (only required to authenticate against GKE clusters).
@@ -31,6 +39,7 @@ import (
 	clientset "github.com/ryo-watanabe/k8s-snap/pkg/client/clientset/versioned"
 	informers "github.com/ryo-watanabe/k8s-snap/pkg/client/informers/externalversions"
 	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+	"github.com/ryo-watanabe/k8s-snap/pkg/metrics"
 	"github.com/ryo-watanabe/k8s-snap/pkg/signals"
 )
 
@@ -46,12 +55,25 @@ var (
 	insecure           bool
 	createbucket       bool
 	maxretryelapsedsec int
+	verifyintervalsec  int
+	metricsaddr        string
+	leaderelect        bool
+	leasename          string
 	version            string
 	revision           string
 )
 
 func main() {
 
+	// subcommands run without the controller
+	if ok, err := runCLI(os.Args[1:], os.Stdout); ok {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	////// For client-go <= 8.0.0 must sync flags glog and klog.
 	//flag.Set("logtostderr", "true")
 	//klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
@@ -103,19 +125,84 @@ func main() {
 	controller := NewController(kubeClient, dynamicClient, cbClient,
 		cbInformerFactory.Clustersnapshot().V1alpha1().Snapshots(),
 		cbInformerFactory.Clustersnapshot().V1alpha1().Restores(),
+		cbInformerFactory.Clustersnapshot().V1alpha1().SnapshotSchedules(),
+		cbInformerFactory.Clustersnapshot().V1alpha1().SnapshotDiffs(),
 		namespace,
 		housekeepstore, restoresnapshots, validatefileinfo, insecure, createbucket,
-		maxretryelapsedsec,
-		cluster.NewClusterCmd(),
+		maxretryelapsedsec, verifyintervalsec,
+		cluster.NewClusterCmd(kubeClient),
 	)
 
 	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 	cbInformerFactory.Start(stopCh)
 
-	if err = controller.Run(snapshotthreads, restorethreads, stopCh); err != nil {
-		klog.Fatalf("Error running controller: %s", err.Error())
+	// metrics and health check endpoints
+	if metricsaddr != "" {
+		metrics.Serve(metricsaddr, controller, stopCh)
 	}
+	go wait.Until(controller.RunHealthChecker, time.Duration(60)*time.Second, stopCh)
+
+	if !leaderelect {
+		if err = controller.Run(snapshotthreads, restorethreads, stopCh); err != nil {
+			klog.Fatalf("Error running controller: %s", err.Error())
+		}
+		return
+	}
+
+	// leader election with a lease in the controller namespace
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("Error getting hostname: %s", err.Error())
+	}
+	id := hostname + "_" + string(uuid.NewUUID())
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leasename,
+			Namespace: namespace,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	klog.Infof("Leader election with lease %s/%s as %s", namespace, leasename, id)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				if err := controller.Run(snapshotthreads, restorethreads, ctx.Done()); err != nil {
+					klog.Fatalf("Error running controller: %s", err.Error())
+				}
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					klog.Info("Leader lease released")
+				default:
+					// another replica may take over, stop to avoid processing snapshots twice
+					klog.Fatalf("Leader lease lost")
+				}
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					klog.Infof("Current leader : %s", identity)
+				}
+			},
+		},
+	})
 }
 
 func init() {
@@ -130,4 +217,8 @@ func init() {
 	flag.BoolVar(&insecure, "insecure", false, "Skip ssl certificate verification on connecting object store")
 	flag.BoolVar(&createbucket, "createbucket", false, "Create bucket if not exists")
 	flag.IntVar(&maxretryelapsedsec, "maxretryelapsedsec", 300, "Max elaspsed seconds to retry snapshot")
+	flag.IntVar(&verifyintervalsec, "verifyintervalsec", 86400, "Interval seconds to verify stored snapshots, 0 to disable")
+	flag.StringVar(&metricsaddr, "metricsaddr", ":8080", "Address to serve Prometheus metrics on /metrics and health checks on /healthz and /readyz, empty to disable")
+	flag.BoolVar(&leaderelect, "leaderelect", true, "Run the controller only while holding the leader lease")
+	flag.StringVar(&leasename, "leasename", "k8s-snap-controller", "Name of the lease for leader election in the controller namespace")
 }
@@ -55,6 +55,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		&ObjectstoreConfigList{},
 		&RestorePreference{},
 		&RestorePreferenceList{},
+		&SnapshotSchedule{},
+		&SnapshotScheduleList{},
+		&SnapshotDiff{},
+		&SnapshotDiffList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
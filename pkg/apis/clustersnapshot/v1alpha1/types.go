@@ -18,25 +18,105 @@ type Snapshot struct {
 
 // SnapshotSpec is the spec for a Snapshot resource
 type SnapshotSpec struct {
-	ClusterName       string          `json:"clusterName"`
-	Kubeconfig        string          `json:"kubeconfig"`
-	ObjectstoreConfig string          `json:"objectstoreConfig"`
-	AvailableUntil    metav1.Time     `json:"availableUntil"`
-	TTL               metav1.Duration `json:"ttl"`
+	ClusterName         string                `json:"clusterName"`
+	Kubeconfig          string                `json:"kubeconfig"`
+	KubeconfigSecretRef *KubeconfigSecretRef  `json:"kubeconfigSecretRef,omitempty"`
+	ObjectstoreConfig   string                `json:"objectstoreConfig"`
+	AvailableUntil      metav1.Time           `json:"availableUntil"`
+	TTL                 metav1.Duration       `json:"ttl"`
+	ParentSnapshot      string                `json:"parentSnapshot,omitempty"`
+	IncludeNamespaces   []string              `json:"includeNamespaces,omitempty"`
+	ExcludeNamespaces   []string              `json:"excludeNamespaces,omitempty"`
+	LabelSelector       *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	IncludeResources    []string              `json:"includeResources,omitempty"`
+	ExcludeResources    []string              `json:"excludeResources,omitempty"`
+	VolumeSnapshots     *VolumeSnapshotSpec   `json:"volumeSnapshots,omitempty"`
+	PreHooks            []SnapshotHook        `json:"preHooks,omitempty"`
+	PostHooks           []SnapshotHook        `json:"postHooks,omitempty"`
+	// Cancel stops the snapshot in queue or in progress
+	Cancel bool `json:"cancel,omitempty"`
+	// Paused keeps the snapshot in queue until unpaused
+	Paused bool `json:"paused,omitempty"`
+}
+
+// SnapshotHook is a command executed in containers of selected pods before or after taking the snapshot
+type SnapshotHook struct {
+	Name        string                `json:"name"`
+	Namespace   string                `json:"namespace"`
+	PodSelector *metav1.LabelSelector `json:"podSelector"`
+	Container   string                `json:"container,omitempty"`
+	Command     []string              `json:"command"`
+	Timeout     *metav1.Duration      `json:"timeout,omitempty"`
+	// OnError is Fail (default) or Continue
+	OnError string `json:"onError,omitempty"`
+}
+
+// VolumeSnapshotSpec selects PVCs to take CSI VolumeSnapshots with the snapshot
+type VolumeSnapshotSpec struct {
+	StorageClasses          []string              `json:"storageClasses,omitempty"`
+	LabelSelector           *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	VolumeSnapshotClassName string                `json:"volumeSnapshotClassName,omitempty"`
+	ReadyTimeout            *metav1.Duration      `json:"readyTimeout,omitempty"`
+}
+
+// KubeconfigSecretRef is a reference to a kubeconfig stored in a secret
+type KubeconfigSecretRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
 }
 
 // SnapshotStatus is the status for a Snapshot resource
 type SnapshotStatus struct {
-	Phase                   string          `json:"phase"`
-	Reason                  string          `json:"reason"`
-	SnapshotResourceVersion string          `json:"snapshotResourceVersion"`
-	SnapshotTimestamp       metav1.Time     `json:"snapshotTimestamp"`
-	AvailableUntil          metav1.Time     `json:"availableUntil"`
-	TTL                     metav1.Duration `json:"ttl"`
-	Contents                []string        `json:"contents"`
-	StoredFileSize          int64           `json:"storedFileSize"`
-	StoredTimestamp         metav1.Time     `json:"storedTimestamp"`
-	NumberOfContents        int32           `json:"numberOfContents"`
+	Phase                   string                 `json:"phase"`
+	Reason                  string                 `json:"reason"`
+	SnapshotResourceVersion string                 `json:"snapshotResourceVersion"`
+	SnapshotTimestamp       metav1.Time            `json:"snapshotTimestamp"`
+	AvailableUntil          metav1.Time            `json:"availableUntil"`
+	TTL                     metav1.Duration        `json:"ttl"`
+	Contents                []string               `json:"contents"`
+	StoredFileSize          int64                  `json:"storedFileSize"`
+	StoredTimestamp         metav1.Time            `json:"storedTimestamp"`
+	NumberOfContents        int32                  `json:"numberOfContents"`
+	NumberOfStoredContents  int32                  `json:"numberOfStoredContents"`
+	Deleted                 []string               `json:"deleted"`
+	Scope                   *SnapshotScope         `json:"scope,omitempty"`
+	Checksum                string                 `json:"checksum,omitempty"`
+	VerifiedTimestamp       metav1.Time            `json:"verifiedTimestamp,omitempty"`
+	VolumeSnapshots         []VolumeSnapshotRecord `json:"volumeSnapshots,omitempty"`
+	Hooks                   []HookResult           `json:"hooks,omitempty"`
+}
+
+// HookResult is a result of a hook executed in a container
+type HookResult struct {
+	Name      string      `json:"name"`
+	Phase     string      `json:"phase"`
+	Pod       string      `json:"pod,omitempty"`
+	Container string      `json:"container,omitempty"`
+	Result    string      `json:"result"`
+	Output    string      `json:"output,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Timestamp metav1.Time `json:"timestamp"`
+}
+
+// VolumeSnapshotRecord is a CSI VolumeSnapshot taken for a PVC
+type VolumeSnapshotRecord struct {
+	Namespace                 string `json:"namespace"`
+	PVCName                   string `json:"pvcName"`
+	VolumeSnapshotName        string `json:"volumeSnapshotName"`
+	VolumeSnapshotContentName string `json:"volumeSnapshotContentName"`
+	VolumeSnapshotClassName   string `json:"volumeSnapshotClassName,omitempty"`
+	Driver                    string `json:"driver"`
+	SnapshotHandle            string `json:"snapshotHandle"`
+	RestoreSize               string `json:"restoreSize,omitempty"`
+}
+
+// SnapshotScope is the scope of resources in a partial snapshot
+type SnapshotScope struct {
+	IncludeNamespaces []string `json:"includeNamespaces,omitempty"`
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	LabelSelector     string   `json:"labelSelector,omitempty"`
+	IncludeResources  []string `json:"includeResources,omitempty"`
+	ExcludeResources  []string `json:"excludeResources,omitempty"`
 }
 
 // +genclient
@@ -53,12 +133,22 @@ type Restore struct {
 
 // RestoreSpec is the spec for a Restore resource
 type RestoreSpec struct {
-	ClusterName           string          `json:"clusterName"`
-	SnapshotName          string          `json:"snapshotName"`
-	Kubeconfig            string          `json:"kubeconfig"`
-	RestorePreferenceName string          `json:"restorePreferenceName"`
-	AvailableUntil        metav1.Time     `json:"availableUntil"`
-	TTL                   metav1.Duration `json:"ttl"`
+	ClusterName           string               `json:"clusterName"`
+	SnapshotName          string               `json:"snapshotName"`
+	Kubeconfig            string               `json:"kubeconfig"`
+	KubeconfigSecretRef   *KubeconfigSecretRef `json:"kubeconfigSecretRef,omitempty"`
+	RestorePreferenceName string               `json:"restorePreferenceName"`
+	NamespaceMappings     map[string]string    `json:"namespaceMappings,omitempty"`
+	DryRun                bool                 `json:"dryRun,omitempty"`
+	CRDEstablishedTimeout *metav1.Duration     `json:"crdEstablishedTimeout,omitempty"`
+	AvailableUntil        metav1.Time          `json:"availableUntil"`
+	TTL                   metav1.Duration      `json:"ttl"`
+	// Cancel stops the restore in queue or in progress between resources
+	Cancel bool `json:"cancel,omitempty"`
+	// Paused keeps the restore in queue until unpaused
+	Paused bool `json:"paused,omitempty"`
+	// Rollback deletes resources created by the finished restore and reverts overwritten ones
+	Rollback bool `json:"rollback,omitempty"`
 }
 
 // RestoreStatus is the status for a Restore resource
@@ -71,16 +161,34 @@ type RestoreStatus struct {
 	TTL                    metav1.Duration `json:"ttl"`
 	NumSnapshotContents    int32           `json:"numSnapshotContents"`
 	NumPreferenceExcluded  int32           `json:"numPreferenceExcluded"`
-	Excluded               []string        `json:"excluded"`
 	NumExcluded            int32           `json:"numExcluded"`
-	Created                []string        `json:"created"`
 	NumCreated             int32           `json:"numCreated"`
-	Updated                []string        `json:"updated"`
 	NumUpdated             int32           `json:"numUpdated"`
-	AlreadyExisted         []string        `json:"alreadyExisted"`
 	NumAlreadyExisted      int32           `json:"numAlreadyExisted"`
-	Failed                 []string        `json:"failed"`
 	NumFailed              int32           `json:"numFailed"`
+	// Failed lists up to 20 failures with messages cut at 300 characters
+	Failed []string `json:"failed"`
+	Report string   `json:"report,omitempty"`
+	// Deprecated: listed in the report object, no longer set
+	Excluded       []string `json:"excluded,omitempty"`
+	Created        []string `json:"created,omitempty"`
+	Updated        []string `json:"updated,omitempty"`
+	AlreadyExisted []string `json:"alreadyExisted,omitempty"`
+	// Rollback is set after the rollback started
+	Rollback *RestoreRollbackStatus `json:"rollback,omitempty"`
+}
+
+// RestoreRollbackStatus is the status of the rollback of a restore
+type RestoreRollbackStatus struct {
+	Phase             string      `json:"phase"`
+	Reason            string      `json:"reason"`
+	RollbackTimestamp metav1.Time `json:"rollbackTimestamp"`
+	NumDeleted        int32       `json:"numDeleted"`
+	NumReverted       int32       `json:"numReverted"`
+	NumNotFound       int32       `json:"numNotFound"`
+	NumFailed         int32       `json:"numFailed"`
+	// Failed lists up to 20 resources failed to delete or revert, with the error
+	Failed []string `json:"failed,omitempty"`
 }
 
 // +genclient
@@ -96,12 +204,25 @@ type RestorePreference struct {
 
 // RestorePreferenceSpec is the spec for a RestorePreference resource
 type RestorePreferenceSpec struct {
-	ExcludeNamespaces        []string `json:"excludeNamespaces"`
-	ExcludeCRDs              []string `json:"excludeCRDs"`
-	ExcludeAPIPathes         []string `json:"excludeApiPathes"`
-	RestoreAppAPIPathes      []string `json:"restoreAppApiPathes"`
-	RestoreNfsStorageClasses []string `json:"restoreNfsStorageClasses"`
-	RestoreOptions           []string `json:"restoreOptions"`
+	ExcludeNamespaces        []string              `json:"excludeNamespaces"`
+	ExcludeCRDs              []string              `json:"excludeCRDs"`
+	ExcludeAPIPathes         []string              `json:"excludeApiPathes"`
+	IncludeNamespaces        []string              `json:"includeNamespaces,omitempty"`
+	IncludeAPIPathes         []string              `json:"includeApiPathes,omitempty"`
+	LabelSelector            *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	RestoreAppAPIPathes      []string              `json:"restoreAppApiPathes"`
+	RestoreNfsStorageClasses []string              `json:"restoreNfsStorageClasses"`
+	RestoreOptions           []string              `json:"restoreOptions"`
+	PVBindTimeout            *metav1.Duration      `json:"pvBindTimeout,omitempty"`
+	PVParallelism            int32                 `json:"pvParallelism,omitempty"`
+	StorageClassPolicies     []StorageClassPolicy  `json:"storageClassPolicies,omitempty"`
+	StorageClassMappings     map[string]string     `json:"storageClassMappings,omitempty"`
+}
+
+// StorageClassPolicy is a policy to restore PVs/PVCs of a storage class : rebind, reprovision or skip
+type StorageClassPolicy struct {
+	StorageClassName string `json:"storageClassName"`
+	Policy           string `json:"policy"`
 }
 
 // +genclient
@@ -117,10 +238,87 @@ type ObjectstoreConfig struct {
 
 // ObjectstoreConfigSpec is the spec for a ObjectstoreConfig resource
 type ObjectstoreConfigSpec struct {
+	Type                  string `json:"type,omitempty"`
 	Region                string `json:"region"`
 	Endpoint              string `json:"endpoint"`
 	CloudCredentialSecret string `json:"cloudCredentialSecret"`
 	Bucket                string `json:"bucket"`
+	Path                  string `json:"path,omitempty"`
+	EncryptionKeySecret   string `json:"encryptionKeySecret,omitempty"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SnapshotSchedule is a specification for a SnapshotSchedule resource
+type SnapshotSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SnapshotScheduleSpec   `json:"spec"`
+	Status SnapshotScheduleStatus `json:"status"`
+}
+
+// SnapshotScheduleSpec is the spec for a SnapshotSchedule resource
+type SnapshotScheduleSpec struct {
+	Schedule            string               `json:"schedule"`
+	ClusterName         string               `json:"clusterName"`
+	Kubeconfig          string               `json:"kubeconfig"`
+	KubeconfigSecretRef *KubeconfigSecretRef `json:"kubeconfigSecretRef,omitempty"`
+	ObjectstoreConfig   string               `json:"objectstoreConfig"`
+	TTL                 metav1.Duration      `json:"ttl"`
+	MaxSnapshots        int32                `json:"maxSnapshots"`
+	Suspend             bool                 `json:"suspend"`
+}
+
+// SnapshotScheduleStatus is the status for a SnapshotSchedule resource
+type SnapshotScheduleStatus struct {
+	Reason            string      `json:"reason"`
+	LastScheduleTime  metav1.Time `json:"lastScheduleTime"`
+	NextScheduleTime  metav1.Time `json:"nextScheduleTime"`
+	LastSnapshotName  string      `json:"lastSnapshotName"`
+	LastSnapshotPhase string      `json:"lastSnapshotPhase"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SnapshotDiff is a specification for a SnapshotDiff resource
+type SnapshotDiff struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SnapshotDiffSpec   `json:"spec"`
+	Status SnapshotDiffStatus `json:"status"`
+}
+
+// SnapshotDiffSpec is the spec for a SnapshotDiff resource,
+// the snapshot is compared with the target snapshot or the live cluster of the kubeconfig
+type SnapshotDiffSpec struct {
+	SnapshotName        string               `json:"snapshotName"`
+	TargetSnapshotName  string               `json:"targetSnapshotName,omitempty"`
+	Kubeconfig          string               `json:"kubeconfig,omitempty"`
+	KubeconfigSecretRef *KubeconfigSecretRef `json:"kubeconfigSecretRef,omitempty"`
+	AvailableUntil      metav1.Time          `json:"availableUntil"`
+	TTL                 metav1.Duration      `json:"ttl"`
+}
+
+// SnapshotDiffStatus is the status for a SnapshotDiff resource
+type SnapshotDiffStatus struct {
+	Phase          string          `json:"phase"`
+	Reason         string          `json:"reason"`
+	DiffTimestamp  metav1.Time     `json:"diffTimestamp"`
+	AvailableUntil metav1.Time     `json:"availableUntil"`
+	TTL            metav1.Duration `json:"ttl"`
+	NumAdded       int32           `json:"numAdded"`
+	NumRemoved     int32           `json:"numRemoved"`
+	NumChanged     int32           `json:"numChanged"`
+	NumUnchanged   int32           `json:"numUnchanged"`
+	// Added, Removed and Changed list up to 20 resource paths each
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	Report  string   `json:"report,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -162,3 +360,23 @@ type ObjectstoreConfigList struct {
 
 	Items []ObjectstoreConfig `json:"items"`
 }
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SnapshotScheduleList is a list of SnapshotSchedule resources
+type SnapshotScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []SnapshotSchedule `json:"items"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SnapshotDiffList is a list of SnapshotDiff resources
+type SnapshotDiffList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []SnapshotDiff `json:"items"`
+}
@@ -30,6 +30,8 @@ type ClustersnapshotV1alpha1Interface interface {
 	RestoresGetter
 	RestorePreferencesGetter
 	SnapshotsGetter
+	SnapshotDiffsGetter
+	SnapshotSchedulesGetter
 }
 
 // ClustersnapshotV1alpha1Client is used to interact with features provided by the clustersnapshot.rywt.io group.
@@ -53,6 +55,14 @@ func (c *ClustersnapshotV1alpha1Client) Snapshots(namespace string) SnapshotInte
 	return newSnapshots(c, namespace)
 }
 
+func (c *ClustersnapshotV1alpha1Client) SnapshotDiffs(namespace string) SnapshotDiffInterface {
+	return newSnapshotDiffs(c, namespace)
+}
+
+func (c *ClustersnapshotV1alpha1Client) SnapshotSchedules(namespace string) SnapshotScheduleInterface {
+	return newSnapshotSchedules(c, namespace)
+}
+
 // NewForConfig creates a new ClustersnapshotV1alpha1Client for the given config.
 func NewForConfig(c *rest.Config) (*ClustersnapshotV1alpha1Client, error) {
 	config := *c
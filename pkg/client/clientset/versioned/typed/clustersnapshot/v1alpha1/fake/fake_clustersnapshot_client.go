@@ -44,6 +44,14 @@ func (c *FakeClustersnapshotV1alpha1) Snapshots(namespace string) v1alpha1.Snaps
 	return &FakeSnapshots{c, namespace}
 }
 
+func (c *FakeClustersnapshotV1alpha1) SnapshotDiffs(namespace string) v1alpha1.SnapshotDiffInterface {
+	return &FakeSnapshotDiffs{c, namespace}
+}
+
+func (c *FakeClustersnapshotV1alpha1) SnapshotSchedules(namespace string) v1alpha1.SnapshotScheduleInterface {
+	return &FakeSnapshotSchedules{c, namespace}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeClustersnapshotV1alpha1) RESTClient() rest.Interface {
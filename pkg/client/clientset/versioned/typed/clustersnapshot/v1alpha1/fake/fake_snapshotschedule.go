@@ -0,0 +1,142 @@
+/*
+Copyright The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by client-gen. DO NOT EDIT.
+
+package fake
+
+import (
+	"context"
+
+	v1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	labels "k8s.io/apimachinery/pkg/labels"
+	schema "k8s.io/apimachinery/pkg/runtime/schema"
+	types "k8s.io/apimachinery/pkg/types"
+	watch "k8s.io/apimachinery/pkg/watch"
+	testing "k8s.io/client-go/testing"
+)
+
+// FakeSnapshotSchedules implements SnapshotScheduleInterface
+type FakeSnapshotSchedules struct {
+	Fake *FakeClustersnapshotV1alpha1
+	ns   string
+}
+
+var snapshotschedulesResource = schema.GroupVersionResource{Group: "clustersnapshot.rywt.io", Version: "v1alpha1", Resource: "snapshotschedules"}
+
+var snapshotschedulesKind = schema.GroupVersionKind{Group: "clustersnapshot.rywt.io", Version: "v1alpha1", Kind: "SnapshotSchedule"}
+
+// Get takes name of the snapshotSchedule, and returns the corresponding snapshotSchedule object, and an error if there is any.
+func (c *FakeSnapshotSchedules) Get(ctx context.Context, name string, options v1.GetOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewGetAction(snapshotschedulesResource, c.ns, name), &v1alpha1.SnapshotSchedule{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.SnapshotSchedule), err
+}
+
+// List takes label and field selectors, and returns the list of SnapshotSchedules that match those selectors.
+func (c *FakeSnapshotSchedules) List(ctx context.Context, opts v1.ListOptions) (result *v1alpha1.SnapshotScheduleList, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewListAction(snapshotschedulesResource, snapshotschedulesKind, c.ns, opts), &v1alpha1.SnapshotScheduleList{})
+
+	if obj == nil {
+		return nil, err
+	}
+
+	label, _, _ := testing.ExtractFromListOptions(opts)
+	if label == nil {
+		label = labels.Everything()
+	}
+	list := &v1alpha1.SnapshotScheduleList{ListMeta: obj.(*v1alpha1.SnapshotScheduleList).ListMeta}
+	for _, item := range obj.(*v1alpha1.SnapshotScheduleList).Items {
+		if label.Matches(labels.Set(item.Labels)) {
+			list.Items = append(list.Items, item)
+		}
+	}
+	return list, err
+}
+
+// Watch returns a watch.Interface that watches the requested snapshotSchedules.
+func (c *FakeSnapshotSchedules) Watch(ctx context.Context, opts v1.ListOptions) (watch.Interface, error) {
+	return c.Fake.
+		InvokesWatch(testing.NewWatchAction(snapshotschedulesResource, c.ns, opts))
+
+}
+
+// Create takes the representation of a snapshotSchedule and creates it.  Returns the server's representation of the snapshotSchedule, and an error, if there is any.
+func (c *FakeSnapshotSchedules) Create(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.CreateOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewCreateAction(snapshotschedulesResource, c.ns, snapshotSchedule), &v1alpha1.SnapshotSchedule{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.SnapshotSchedule), err
+}
+
+// Update takes the representation of a snapshotSchedule and updates it. Returns the server's representation of the snapshotSchedule, and an error, if there is any.
+func (c *FakeSnapshotSchedules) Update(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.UpdateOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateAction(snapshotschedulesResource, c.ns, snapshotSchedule), &v1alpha1.SnapshotSchedule{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.SnapshotSchedule), err
+}
+
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeSnapshotSchedules) UpdateStatus(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.UpdateOptions) (*v1alpha1.SnapshotSchedule, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(snapshotschedulesResource, "status", c.ns, snapshotSchedule), &v1alpha1.SnapshotSchedule{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.SnapshotSchedule), err
+}
+
+// Delete takes name of the snapshotSchedule and deletes it. Returns an error if one occurs.
+func (c *FakeSnapshotSchedules) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
+	_, err := c.Fake.
+		Invokes(testing.NewDeleteAction(snapshotschedulesResource, c.ns, name), &v1alpha1.SnapshotSchedule{})
+
+	return err
+}
+
+// DeleteCollection deletes a collection of objects.
+func (c *FakeSnapshotSchedules) DeleteCollection(ctx context.Context, opts v1.DeleteOptions, listOpts v1.ListOptions) error {
+	action := testing.NewDeleteCollectionAction(snapshotschedulesResource, c.ns, listOpts)
+
+	_, err := c.Fake.Invokes(action, &v1alpha1.SnapshotScheduleList{})
+	return err
+}
+
+// Patch applies the patch and returns the patched snapshotSchedule.
+func (c *FakeSnapshotSchedules) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts v1.PatchOptions, subresources ...string) (result *v1alpha1.SnapshotSchedule, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewPatchSubresourceAction(snapshotschedulesResource, c.ns, name, pt, data, subresources...), &v1alpha1.SnapshotSchedule{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.SnapshotSchedule), err
+}
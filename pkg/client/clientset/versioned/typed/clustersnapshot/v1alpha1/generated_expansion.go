@@ -25,3 +25,7 @@ type RestoreExpansion interface{}
 type RestorePreferenceExpansion interface{}
 
 type SnapshotExpansion interface{}
+
+type SnapshotDiffExpansion interface{}
+
+type SnapshotScheduleExpansion interface{}
@@ -0,0 +1,195 @@
+/*
+Copyright The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by client-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	"context"
+	"time"
+
+	v1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	scheme "github.com/ryo-watanabe/k8s-snap/pkg/client/clientset/versioned/scheme"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	types "k8s.io/apimachinery/pkg/types"
+	watch "k8s.io/apimachinery/pkg/watch"
+	rest "k8s.io/client-go/rest"
+)
+
+// SnapshotSchedulesGetter has a method to return a SnapshotScheduleInterface.
+// A group's client should implement this interface.
+type SnapshotSchedulesGetter interface {
+	SnapshotSchedules(namespace string) SnapshotScheduleInterface
+}
+
+// SnapshotScheduleInterface has methods to work with SnapshotSchedule resources.
+type SnapshotScheduleInterface interface {
+	Create(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.CreateOptions) (*v1alpha1.SnapshotSchedule, error)
+	Update(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.UpdateOptions) (*v1alpha1.SnapshotSchedule, error)
+	UpdateStatus(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.UpdateOptions) (*v1alpha1.SnapshotSchedule, error)
+	Delete(ctx context.Context, name string, opts v1.DeleteOptions) error
+	DeleteCollection(ctx context.Context, opts v1.DeleteOptions, listOpts v1.ListOptions) error
+	Get(ctx context.Context, name string, opts v1.GetOptions) (*v1alpha1.SnapshotSchedule, error)
+	List(ctx context.Context, opts v1.ListOptions) (*v1alpha1.SnapshotScheduleList, error)
+	Watch(ctx context.Context, opts v1.ListOptions) (watch.Interface, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts v1.PatchOptions, subresources ...string) (result *v1alpha1.SnapshotSchedule, err error)
+	SnapshotScheduleExpansion
+}
+
+// snapshotSchedules implements SnapshotScheduleInterface
+type snapshotSchedules struct {
+	client rest.Interface
+	ns     string
+}
+
+// newSnapshotSchedules returns a SnapshotSchedules
+func newSnapshotSchedules(c *ClustersnapshotV1alpha1Client, namespace string) *snapshotSchedules {
+	return &snapshotSchedules{
+		client: c.RESTClient(),
+		ns:     namespace,
+	}
+}
+
+// Get takes name of the snapshotSchedule, and returns the corresponding snapshotSchedule object, and an error if there is any.
+func (c *snapshotSchedules) Get(ctx context.Context, name string, options v1.GetOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	result = &v1alpha1.SnapshotSchedule{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		Name(name).
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+// List takes label and field selectors, and returns the list of SnapshotSchedules that match those selectors.
+func (c *snapshotSchedules) List(ctx context.Context, opts v1.ListOptions) (result *v1alpha1.SnapshotScheduleList, err error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	result = &v1alpha1.SnapshotScheduleList{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Timeout(timeout).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+// Watch returns a watch.Interface that watches the requested snapshotSchedules.
+func (c *snapshotSchedules) Watch(ctx context.Context, opts v1.ListOptions) (watch.Interface, error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	opts.Watch = true
+	return c.client.Get().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Timeout(timeout).
+		Watch(ctx)
+}
+
+// Create takes the representation of a snapshotSchedule and creates it.  Returns the server's representation of the snapshotSchedule, and an error, if there is any.
+func (c *snapshotSchedules) Create(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.CreateOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	result = &v1alpha1.SnapshotSchedule{}
+	err = c.client.Post().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(snapshotSchedule).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+// Update takes the representation of a snapshotSchedule and updates it. Returns the server's representation of the snapshotSchedule, and an error, if there is any.
+func (c *snapshotSchedules) Update(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.UpdateOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	result = &v1alpha1.SnapshotSchedule{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		Name(snapshotSchedule.Name).
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(snapshotSchedule).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *snapshotSchedules) UpdateStatus(ctx context.Context, snapshotSchedule *v1alpha1.SnapshotSchedule, opts v1.UpdateOptions) (result *v1alpha1.SnapshotSchedule, err error) {
+	result = &v1alpha1.SnapshotSchedule{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		Name(snapshotSchedule.Name).
+		SubResource("status").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(snapshotSchedule).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+// Delete takes name of the snapshotSchedule and deletes it. Returns an error if one occurs.
+func (c *snapshotSchedules) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
+	return c.client.Delete().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		Name(name).
+		Body(&opts).
+		Do(ctx).
+		Error()
+}
+
+// DeleteCollection deletes a collection of objects.
+func (c *snapshotSchedules) DeleteCollection(ctx context.Context, opts v1.DeleteOptions, listOpts v1.ListOptions) error {
+	var timeout time.Duration
+	if listOpts.TimeoutSeconds != nil {
+		timeout = time.Duration(*listOpts.TimeoutSeconds) * time.Second
+	}
+	return c.client.Delete().
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		VersionedParams(&listOpts, scheme.ParameterCodec).
+		Timeout(timeout).
+		Body(&opts).
+		Do(ctx).
+		Error()
+}
+
+// Patch applies the patch and returns the patched snapshotSchedule.
+func (c *snapshotSchedules) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts v1.PatchOptions, subresources ...string) (result *v1alpha1.SnapshotSchedule, err error) {
+	result = &v1alpha1.SnapshotSchedule{}
+	err = c.client.Patch(pt).
+		Namespace(c.ns).
+		Resource("snapshotschedules").
+		Name(name).
+		SubResource(subresources...).
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(data).
+		Do(ctx).
+		Into(result)
+	return
+}
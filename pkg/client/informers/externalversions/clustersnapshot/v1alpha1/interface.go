@@ -32,6 +32,10 @@ type Interface interface {
 	RestorePreferences() RestorePreferenceInformer
 	// Snapshots returns a SnapshotInformer.
 	Snapshots() SnapshotInformer
+	// SnapshotDiffs returns a SnapshotDiffInformer.
+	SnapshotDiffs() SnapshotDiffInformer
+	// SnapshotSchedules returns a SnapshotScheduleInformer.
+	SnapshotSchedules() SnapshotScheduleInformer
 }
 
 type version struct {
@@ -64,3 +68,13 @@ func (v *version) RestorePreferences() RestorePreferenceInformer {
 func (v *version) Snapshots() SnapshotInformer {
 	return &snapshotInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// SnapshotDiffs returns a SnapshotDiffInformer.
+func (v *version) SnapshotDiffs() SnapshotDiffInformer {
+	return &snapshotDiffInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// SnapshotSchedules returns a SnapshotScheduleInformer.
+func (v *version) SnapshotSchedules() SnapshotScheduleInformer {
+	return &snapshotScheduleInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by informer-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	"context"
+	time "time"
+
+	clustersnapshotv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	versioned "github.com/ryo-watanabe/k8s-snap/pkg/client/clientset/versioned"
+	internalinterfaces "github.com/ryo-watanabe/k8s-snap/pkg/client/informers/externalversions/internalinterfaces"
+	v1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/client/listers/clustersnapshot/v1alpha1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	watch "k8s.io/apimachinery/pkg/watch"
+	cache "k8s.io/client-go/tools/cache"
+)
+
+// SnapshotDiffInformer provides access to a shared informer and lister for
+// SnapshotDiffs.
+type SnapshotDiffInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() v1alpha1.SnapshotDiffLister
+}
+
+type snapshotDiffInformer struct {
+	factory          internalinterfaces.SharedInformerFactory
+	tweakListOptions internalinterfaces.TweakListOptionsFunc
+	namespace        string
+}
+
+// NewSnapshotDiffInformer constructs a new informer for SnapshotDiff type.
+// Always prefer using an informer factory to get a shared informer instead of getting an independent
+// one. This reduces memory footprint and number of connections to the server.
+func NewSnapshotDiffInformer(client versioned.Interface, namespace string, resyncPeriod time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	return NewFilteredSnapshotDiffInformer(client, namespace, resyncPeriod, indexers, nil)
+}
+
+// NewFilteredSnapshotDiffInformer constructs a new informer for SnapshotDiff type.
+// Always prefer using an informer factory to get a shared informer instead of getting an independent
+// one. This reduces memory footprint and number of connections to the server.
+func NewFilteredSnapshotDiffInformer(client versioned.Interface, namespace string, resyncPeriod time.Duration, indexers cache.Indexers, tweakListOptions internalinterfaces.TweakListOptionsFunc) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options v1.ListOptions) (runtime.Object, error) {
+				if tweakListOptions != nil {
+					tweakListOptions(&options)
+				}
+				return client.ClustersnapshotV1alpha1().SnapshotDiffs(namespace).List(context.TODO(), options)
+			},
+			WatchFunc: func(options v1.ListOptions) (watch.Interface, error) {
+				if tweakListOptions != nil {
+					tweakListOptions(&options)
+				}
+				return client.ClustersnapshotV1alpha1().SnapshotDiffs(namespace).Watch(context.TODO(), options)
+			},
+		},
+		&clustersnapshotv1alpha1.SnapshotDiff{},
+		resyncPeriod,
+		indexers,
+	)
+}
+
+func (f *snapshotDiffInformer) defaultInformer(client versioned.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return NewFilteredSnapshotDiffInformer(client, f.namespace, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, f.tweakListOptions)
+}
+
+func (f *snapshotDiffInformer) Informer() cache.SharedIndexInformer {
+	return f.factory.InformerFor(&clustersnapshotv1alpha1.SnapshotDiff{}, f.defaultInformer)
+}
+
+func (f *snapshotDiffInformer) Lister() v1alpha1.SnapshotDiffLister {
+	return v1alpha1.NewSnapshotDiffLister(f.Informer().GetIndexer())
+}
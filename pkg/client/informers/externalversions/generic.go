@@ -61,6 +61,10 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().RestorePreferences().Informer()}, nil
 	case v1alpha1.SchemeGroupVersion.WithResource("snapshots"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().Snapshots().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("snapshotdiffs"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().SnapshotDiffs().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("snapshotschedules"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().SnapshotSchedules().Informer()}, nil
 
 	}
 
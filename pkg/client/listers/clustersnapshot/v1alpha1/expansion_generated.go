@@ -49,3 +49,19 @@ type SnapshotListerExpansion interface{}
 // SnapshotNamespaceListerExpansion allows custom methods to be added to
 // SnapshotNamespaceLister.
 type SnapshotNamespaceListerExpansion interface{}
+
+// SnapshotDiffListerExpansion allows custom methods to be added to
+// SnapshotDiffLister.
+type SnapshotDiffListerExpansion interface{}
+
+// SnapshotDiffNamespaceListerExpansion allows custom methods to be added to
+// SnapshotDiffNamespaceLister.
+type SnapshotDiffNamespaceListerExpansion interface{}
+
+// SnapshotScheduleListerExpansion allows custom methods to be added to
+// SnapshotScheduleLister.
+type SnapshotScheduleListerExpansion interface{}
+
+// SnapshotScheduleNamespaceListerExpansion allows custom methods to be added to
+// SnapshotScheduleNamespaceLister.
+type SnapshotScheduleNamespaceListerExpansion interface{}
@@ -0,0 +1,99 @@
+/*
+Copyright The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by lister-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	v1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// SnapshotDiffLister helps list SnapshotDiffs.
+// All objects returned here must be treated as read-only.
+type SnapshotDiffLister interface {
+	// List lists all SnapshotDiffs in the indexer.
+	// Objects returned here must be treated as read-only.
+	List(selector labels.Selector) (ret []*v1alpha1.SnapshotDiff, err error)
+	// SnapshotDiffs returns an object that can list and get SnapshotDiffs.
+	SnapshotDiffs(namespace string) SnapshotDiffNamespaceLister
+	SnapshotDiffListerExpansion
+}
+
+// snapshotDiffLister implements the SnapshotDiffLister interface.
+type snapshotDiffLister struct {
+	indexer cache.Indexer
+}
+
+// NewSnapshotDiffLister returns a new SnapshotDiffLister.
+func NewSnapshotDiffLister(indexer cache.Indexer) SnapshotDiffLister {
+	return &snapshotDiffLister{indexer: indexer}
+}
+
+// List lists all SnapshotDiffs in the indexer.
+func (s *snapshotDiffLister) List(selector labels.Selector) (ret []*v1alpha1.SnapshotDiff, err error) {
+	err = cache.ListAll(s.indexer, selector, func(m interface{}) {
+		ret = append(ret, m.(*v1alpha1.SnapshotDiff))
+	})
+	return ret, err
+}
+
+// SnapshotDiffs returns an object that can list and get SnapshotDiffs.
+func (s *snapshotDiffLister) SnapshotDiffs(namespace string) SnapshotDiffNamespaceLister {
+	return snapshotDiffNamespaceLister{indexer: s.indexer, namespace: namespace}
+}
+
+// SnapshotDiffNamespaceLister helps list and get SnapshotDiffs.
+// All objects returned here must be treated as read-only.
+type SnapshotDiffNamespaceLister interface {
+	// List lists all SnapshotDiffs in the indexer for a given namespace.
+	// Objects returned here must be treated as read-only.
+	List(selector labels.Selector) (ret []*v1alpha1.SnapshotDiff, err error)
+	// Get retrieves the SnapshotDiff from the indexer for a given namespace and name.
+	// Objects returned here must be treated as read-only.
+	Get(name string) (*v1alpha1.SnapshotDiff, error)
+	SnapshotDiffNamespaceListerExpansion
+}
+
+// snapshotDiffNamespaceLister implements the SnapshotDiffNamespaceLister
+// interface.
+type snapshotDiffNamespaceLister struct {
+	indexer   cache.Indexer
+	namespace string
+}
+
+// List lists all SnapshotDiffs in the indexer for a given namespace.
+func (s snapshotDiffNamespaceLister) List(selector labels.Selector) (ret []*v1alpha1.SnapshotDiff, err error) {
+	err = cache.ListAllByNamespace(s.indexer, s.namespace, selector, func(m interface{}) {
+		ret = append(ret, m.(*v1alpha1.SnapshotDiff))
+	})
+	return ret, err
+}
+
+// Get retrieves the SnapshotDiff from the indexer for a given namespace and name.
+func (s snapshotDiffNamespaceLister) Get(name string) (*v1alpha1.SnapshotDiff, error) {
+	obj, exists, err := s.indexer.GetByKey(s.namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(v1alpha1.Resource("snapshotdiff"), name)
+	}
+	return obj.(*v1alpha1.SnapshotDiff), nil
+}
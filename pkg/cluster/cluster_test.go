@@ -1,37 +1,50 @@
 package cluster
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	corev1 "k8s.io/api/core/v1"
 	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	discoveryfake "k8s.io/client-go/discovery/fake"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
 	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
 
 	clustersnapshot "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
 )
 
 var kubeobjects []runtime.Object
@@ -154,9 +167,15 @@ func TestCluster(t *testing.T) {
 
 	snapstart = false
 	snap := newConfiguredSnapshot("test1", "InProgress")
+	snap.Spec.Kubeconfig = "apiVersion: v1\nkind: Config\nusers: [{name: admin, user: {token: secret-token}}]"
+	applied, _ := json.Marshal(snap)
+	snap.ObjectMeta.Annotations = map[string]string{lastAppliedAnnotation: string(applied)}
+	snap.ObjectMeta.ManagedFields = []metav1.ManagedFieldsEntry{
+		metav1.ManagedFieldsEntry{Manager: "kubectl", FieldsV1: &metav1.FieldsV1{Raw: applied}},
+	}
 
 	// TEST1 : Get a snapshot
-	err := SnapshotWithClient(context.TODO(), snap, kubeClient, dynamicClient)
+	err := SnapshotWithClient(context.TODO(), snap, kubeClient, dynamicClient, nil)
 	if err != nil {
 		t.Errorf("Error in snapshotWithClient : %s", err.Error())
 	}
@@ -168,207 +187,2007 @@ func TestCluster(t *testing.T) {
 		)
 	}
 
-	// TEST2 : Uplaod the snapshot file
-	bucket := &bucketMock{}
-	objSize := int64(131072)
-	objTime := time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC)
-	objectInfo = &objectstore.ObjectInfo{Name: "test1.tgz", Size: objSize, Timestamp: objTime, BucketConfigName: "bucket"}
-	err = UploadSnapshot(snap, bucket)
+	snapshotJSON := readSnapshotJSON(t, "test1")
+	if strings.Contains(snapshotJSON, "secret-token") {
+		t.Errorf("Error kubeconfig stored in snapshot.json : %s", snapshotJSON)
+	}
+
+	// TEST2 : Uplaod the snapshot file
+	bucket := &bucketMock{}
+	objSize := int64(131072)
+	objTime := time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC)
+	objectInfo = &objectstore.ObjectInfo{Name: "test1.tgz", Size: objSize, Timestamp: objTime, BucketConfigName: "bucket"}
+	err = UploadSnapshot(context.TODO(), snap, bucket)
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+	}
+	if uploadFilename != "test1.tgz" {
+		t.Error("Error upload filename not match")
+	}
+	if getObjectInfoFilename != "test1.tgz" {
+		t.Error("Error GetObjectInfo filename not match")
+	}
+	if snap.Status.StoredFileSize != objSize {
+		t.Error("Error file size not match")
+	}
+	metav1ObjTime := metav1.NewTime(objTime)
+	if !snap.Status.StoredTimestamp.Equal(&metav1ObjTime) {
+		t.Error("Error timestamp not match")
+	}
+
+	// TEST2-1 : Get an incremental snapshot
+	err = dynamicTracker.Add(convertToUnstructured(t, newConfiguredSecret("incremental1", corev1.SecretTypeOpaque)))
+	if err != nil {
+		t.Errorf("Error in create secret : %s", err.Error())
+	}
+	err = dynamicTracker.Delete(schema.GroupVersionResource{Version: "v1", Resource: "services"}, "default", "svc1")
+	if err != nil {
+		t.Errorf("Error in delete service : %s", err.Error())
+	}
+	snapstart = false
+	incSnap := newConfiguredSnapshot("test2", "InProgress")
+	incSnap.Spec.ParentSnapshot = "test1"
+	err = SnapshotWithClient(context.TODO(), incSnap, kubeClient, dynamicClient, nil)
+	if err != nil {
+		t.Errorf("Error in incremental snapshotWithClient : %s", err.Error())
+	}
+	if incSnap.Status.NumberOfContents != int32(len(ukubeobjects)) {
+		t.Errorf("Number of incremental snapshot contents %d not equals to number of objects %d",
+			incSnap.Status.NumberOfContents,
+			len(ukubeobjects),
+		)
+	}
+	if incSnap.Status.NumberOfStoredContents != 1 {
+		t.Errorf("Number of stored contents %d not equals to 1", incSnap.Status.NumberOfStoredContents)
+	}
+	chkResourceList(t, incSnap.Status.Deleted, []string{"/api/v1/namespaces/default/services/svc1"})
+	err = UploadSnapshot(context.TODO(), incSnap, bucket)
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+	}
+	err = dynamicTracker.Delete(schema.GroupVersionResource{Version: "v1", Resource: "secrets"}, "default", "incremental1")
+	if err != nil {
+		t.Errorf("Error in delete secret : %s", err.Error())
+	}
+	err = dynamicTracker.Add(unstrctrdResource("", "v1", "default", "svc1", "Service", "services"))
+	if err != nil {
+		t.Errorf("Error in create service : %s", err.Error())
+	}
+
+	pref := newRestorePreference("pref1")
+	restore := newConfiguredRestore("test1", "test2", "pref1", "InProgress")
+
+	// TEST3 : Download snapshot tgz and its parent
+	downloadFilenames = nil
+	err = downloadSnapshot(restore, bucket)
+	if err != nil {
+		t.Errorf("Error in downloadSnapshot : %s", err.Error())
+	}
+	if !reflect.DeepEqual(downloadFilenames, []string{"test2.tgz", "test1.tgz"}) {
+		t.Errorf("Error download filenames not match : %v", downloadFilenames)
+	}
+
+	// TEST3-1 : Verify stored snapshots with checksums and manifests
+	if !strings.HasPrefix(snap.Status.Checksum, "sha256:") {
+		t.Errorf("Error checksum not set : %s", snap.Status.Checksum)
+	}
+	for _, s := range []*clustersnapshot.Snapshot{snap, incSnap} {
+		err = VerifySnapshot(s, bucket)
+		if err != nil {
+			t.Errorf("Error in VerifySnapshot %s : %s", s.ObjectMeta.Name, err.Error())
+		}
+	}
+	stored := uploadedObjects["test2.tgz"]
+	uploadedObjects["test2.tgz"] = rewriteTestArchive(t, stored, "test2", "/api/v1/namespaces/default/secrets/incremental1.json")
+	err = VerifySnapshot(incSnap, bucket)
+	if !IsCorruptedError(err) || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Error checksum mismatch not detected : %v", err)
+	}
+	checksum := incSnap.Status.Checksum
+	incSnap.Status.Checksum = ""
+	err = VerifySnapshot(incSnap, bucket)
+	if !IsCorruptedError(err) || !strings.Contains(err.Error(), "1 entries not matched with manifest : [/api/v1/namespaces/default/secrets/incremental1.json]") {
+		t.Errorf("Error manifest mismatch not detected : %v", err)
+	}
+	uploadedObjects["test2.tgz"] = stored[0 : len(stored)/2]
+	err = VerifySnapshot(incSnap, bucket)
+	if !IsCorruptedError(err) {
+		t.Errorf("Error truncated archive not detected : %v", err)
+	}
+	uploadedObjects["test2.tgz"] = stored
+	incSnap.Status.Checksum = checksum
+
+	// Delete PV/PVCs and Reactor for getting PVC to test restoring
+	err = dynamicTracker.Delete(schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"}, "", "pv1")
+	if err != nil {
+		t.Errorf("Error in delete pv : %s", err.Error())
+	}
+	err = dynamicTracker.Delete(schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}, "default", "pvc1")
+	if err != nil {
+		t.Errorf("Error in delete pvc : %s", err.Error())
+	}
+	waitcnt := 1
+	dynamicClient.Fake.PrependReactor("get", "persistentvolumes", func(action core.Action) (bool, runtime.Object, error) {
+		if waitcnt > 0 {
+			waitcnt--
+		} else {
+			err = dynamicTracker.Update(
+				schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"},
+				convertToUnstructured(t, newPV("pv1", "include-nfs-storage", "default", "pvc1")),
+				"",
+			)
+			if err != nil {
+				t.Errorf("Error in update pv status : %s", err.Error())
+			}
+		}
+		return false, nil, nil
+	})
+
+	// TEST4 : Restore resources
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+
+	expectedNumPreferenceExcluded := 4
+	if restore.Status.NumPreferenceExcluded != int32(expectedNumPreferenceExcluded) {
+		t.Errorf("NumPreferenceExcluded not match : Result %d / Expected %d",
+			restore.Status.NumPreferenceExcluded,
+			expectedNumPreferenceExcluded,
+		)
+	}
+	expectedExcluded := []string{
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc2,(no-storageclass)",
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc3,(pv-not-found)",
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc4,(not-bounded)",
+		"/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/cluster-admin-kube-system,(not-binded-to-ns)",
+		"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-role1,(not-binded-to-ns)",
+		"/api/v1/namespaces/default/secrets/token1,(token-secret)",
+		"/api/v1/namespaces/default/endpoints/svc1,(service-exists)",
+		"/api/v1/namespaces/default/pods/pod1,(owner-ref)",
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultExcluded], expectedExcluded)
+	expectedCreated := []string{
+		"/api/v1/persistentvolumes/pv1",
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc1",
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultCreated], expectedCreated)
+	expectedAlreadyExisted := []string{
+		"/api/v1/namespaces/ns1",
+		"/apis/apiextensions.k8s.io/v1/customresourcedefinitions/crd.include.org",
+		"/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/cluster-admin-default",
+		"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-admin",
+		"/apis/storage.k8s.io/v1/storageclasses/include-nfs-storage",
+		"/api/v1/namespaces/default/secrets/secret1",
+		"/api/v1/namespaces/default/services/svc1",
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultAlreadyExisted], expectedAlreadyExisted)
+	expectedNumFailed := 0
+	if restore.Status.NumFailed != int32(expectedNumFailed) {
+		t.Errorf("NumFailed not match : Result %d / Expected %d",
+			restore.Status.NumFailed,
+			expectedNumFailed,
+		)
+	}
+
+	// TEST5 : Restore resources from the incremental snapshot
+	restore = newConfiguredRestore("test2", "test2", "pref1", "InProgress")
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultCreated], []string{"/api/v1/namespaces/default/secrets/incremental1"})
+	for _, path := range readRestoreReport(t, restore)[resultAlreadyExisted] {
+		if path == "/api/v1/namespaces/default/services/svc1" {
+			t.Errorf("Deleted resource %s restored from parent snapshot", path)
+		}
+	}
+	if restore.Status.NumPreferenceExcluded != int32(expectedNumPreferenceExcluded) {
+		t.Errorf("NumPreferenceExcluded not match : Result %d / Expected %d",
+			restore.Status.NumPreferenceExcluded,
+			expectedNumPreferenceExcluded,
+		)
+	}
+
+	// TEST6 : Restore resources overwriting existing secrets
+	pref.Spec.RestoreOptions = []string{"overwriteExistingResources:/api/v1,secrets"}
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultUpdated], []string{"/api/v1/namespaces/default/secrets/secret1"})
+	if restore.Status.NumUpdated != 1 {
+		t.Errorf("NumUpdated not match : Result %d / Expected 1", restore.Status.NumUpdated)
+	}
+	for _, path := range readRestoreReport(t, restore)[resultAlreadyExisted] {
+		if path == "/api/v1/namespaces/default/secrets/secret1" {
+			t.Errorf("Overwritten resource %s counted as already existed", path)
+		}
+	}
+	reportFile, err := os.Open(restoreReportFile(restore))
+	if err != nil {
+		t.Fatalf("Error opening restore report : %s", err.Error())
+	}
+	items, err := loadRestoreReport(reportFile)
+	reportFile.Close()
+	if err != nil {
+		t.Fatalf("Error in loadRestoreReport : %s", err.Error())
+	}
+	for _, item := range items {
+		if item.Result == resultUpdated && len(item.Previous) == 0 {
+			t.Errorf("Previous version of overwritten resource %s not saved", item.Path)
+		}
+	}
+
+	// TEST7 : Restore resources overwriting all existing resources
+	pref.Spec.RestoreOptions = []string{"overwriteExistingResources"}
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultAlreadyExisted], []string{
+		"/api/v1/persistentvolumes/pv1",
+	})
+	if restore.Status.NumFailed != 0 {
+		t.Errorf("NumFailed not match : Result %d / Expected 0 : %v", restore.Status.NumFailed, restore.Status.Failed)
+	}
+
+	// TEST8 : Restore resources into mapped namespace
+	pref.Spec.RestoreOptions = nil
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	restore.Spec.NamespaceMappings = map[string]string{"default": "staging"}
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultCreated], []string{
+		"/api/v1/namespaces/staging/secrets/secret1",
+		"/api/v1/namespaces/staging/services/svc1",
+	})
+
+	// TEST9 : Dry-run restore
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	restore.Spec.NamespaceMappings = map[string]string{"default": "dryrun"}
+	restore.Spec.DryRun = true
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+	chkResourceList(t, readRestoreReport(t, restore)[resultCreated], []string{
+		"/api/v1/namespaces/dryrun/secrets/secret1",
+		"/api/v1/namespaces/dryrun/services/svc1",
+	})
+	if restore.Status.RestoreResourceVersion != "" {
+		t.Errorf("Marker created in dry-run : resource version %s", restore.Status.RestoreResourceVersion)
+	}
+
+	// TEST10 : Snapshot in a scope
+	snapstart = false
+	scopeSnap := newConfiguredSnapshot("test3", "InProgress")
+	scopeSnap.Spec.IncludeNamespaces = []string{"default"}
+	scopeSnap.Spec.ExcludeResources = []string{"pods"}
+	err = SnapshotWithClient(context.TODO(), scopeSnap, kubeClient, dynamicClient, nil)
+	if err != nil {
+		t.Errorf("Error in scoped snapshotWithClient : %s", err.Error())
+	}
+	if scopeSnap.Status.NumberOfContents == 0 {
+		t.Error("Nothing stored in scoped snapshot")
+	}
+	for _, path := range scopeSnap.Status.Contents {
+		if !strings.HasPrefix(path, "/api/v1/namespaces/default/") && !strings.HasPrefix(path, "/api/v1/persistentvolumes/") {
+			t.Errorf("Resource %s out of the scope stored", path)
+		}
+		if strings.Contains(path, "/pods/") {
+			t.Errorf("Excluded resource %s stored", path)
+		}
+	}
+	if scopeSnap.Status.Scope == nil || !reflect.DeepEqual(scopeSnap.Status.Scope.IncludeNamespaces, []string{"default"}) {
+		t.Errorf("Scope not recorded in status : %#v", scopeSnap.Status.Scope)
+	}
+	if !strings.Contains(readSnapshotJSON(t, "test3"), "\"scope\":{") {
+		t.Error("Scope not recorded in snapshot.json")
+	}
+
+	// TEST11 : Incremental snapshot with a different scope from the parent
+	snapstart = false
+	scopeSnap = newConfiguredSnapshot("test4", "InProgress")
+	scopeSnap.Spec.ParentSnapshot = "test1"
+	scopeSnap.Spec.IncludeNamespaces = []string{"default"}
+	err = SnapshotWithClient(context.TODO(), scopeSnap, kubeClient, dynamicClient, nil)
+	if err == nil || !strings.Contains(err.Error(), "Scope of parent snapshot test1 not matched") {
+		t.Errorf("Error scope of parent not reported : %v", err)
+	}
+
+	// TEST12 : Cancelled snapshot stops listing and leaves no file
+	cancelledCtx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	snapstart = false
+	cancelledSnap := newConfiguredSnapshot("test5", "InProgress")
+	err = SnapshotWithClient(cancelledCtx, cancelledSnap, kubeClient, dynamicClient, nil)
+	if err == nil || !strings.Contains(err.Error(), "Cancelled") {
+		t.Errorf("Error cancelled snapshot not stopped : %v", err)
+	}
+	if cancelledSnap.Status.NumberOfContents != 0 {
+		t.Errorf("Cancelled snapshot stored %d resources", cancelledSnap.Status.NumberOfContents)
+	}
+	if _, err := os.Stat("/tmp/test5.tgz"); err == nil {
+		t.Error("Snapshot file left after cancelled")
+	}
+
+	// TEST13 : Cancelled upload removes the snapshot file
+	err = UploadSnapshot(cancelledCtx, newConfiguredSnapshot("test3", "InProgress"), bucket)
+	if err == nil || !strings.Contains(err.Error(), "Cancelled") {
+		t.Errorf("Error cancelled upload not stopped : %v", err)
+	}
+	if _, err := os.Stat("/tmp/test3.tgz"); err == nil {
+		t.Error("Snapshot file left after upload cancelled")
+	}
+
+	// TEST14 : Cancelled restore stops before restoring resources
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	restore.Spec.NamespaceMappings = map[string]string{"default": "cancelled"}
+	err = restoreResources(cancelledCtx, restore, pref, kubeClient, dynamicClient)
+	if err == nil || !strings.Contains(err.Error(), "Cancelled") {
+		t.Errorf("Error cancelled restore not stopped : %v", err)
+	}
+	if restore.Status.NumCreated != 0 || len(readRestoreReport(t, restore)[resultCreated]) != 0 {
+		t.Errorf("Resources created by cancelled restore : %d", restore.Status.NumCreated)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	p := newPreference(newRestorePreference("pref1"))
+	p.dryRunCreated = make(map[string]bool)
+
+	if dryRunOption(false) != nil || !reflect.DeepEqual(dryRunOption(true), []string{metav1.DryRunAll}) {
+		t.Error("Dry-run options not match")
+	}
+
+	// Resources in namespace created in dry-run
+	ns := unstrctrdResource("", "v1", "", "ns1", "Namespace", "namespaces")
+	item := unstrctrdResource("", "v1", "ns1", "cm1", "ConfigMap", "configmaps")
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, "ns1")
+	p.setDryRunCreated(ns, false)
+	if p.isDryRunNamespaceNotFound(item, notFound) {
+		t.Error("Namespace recorded without dry-run")
+	}
+	p.setDryRunCreated(ns, true)
+	if !p.isDryRunNamespaceNotFound(item, notFound) {
+		t.Error("Namespace created in dry-run not recorded")
+	}
+	if p.isDryRunNamespaceNotFound(item, fmt.Errorf("other error")) {
+		t.Error("Other error treated as namespace not found")
+	}
+
+	// Custom resources of CRD created in dry-run
+	crd := unstrctrdResource("apiextensions.k8s.io", "v1", "", "foos.example.com", "CustomResourceDefinition", "customresourcedefinitions")
+	crd.Object["spec"] = map[string]interface{}{
+		"group": "example.com",
+		"names": map[string]interface{}{"kind": "Foo", "plural": "foos"},
+	}
+	p.setDryRunCreated(crd, true)
+	if !p.dryRunCreated[dryRunCRDKey(unstrctrdResource("example.com", "v1", "ns1", "foo1", "Foo", "foos"))] {
+		t.Error("CRD created in dry-run not recorded")
+	}
+}
+
+const kubeconfigSrc = `apiVersion: v1
+clusters:
+- cluster:
+    server: CLUSTER_URL
+  name: kubernetes
+contexts:
+- context:
+    cluster: kubernetes
+    user: user
+  name: user@kubernetes
+current-context: user@kubernetes
+kind: Config
+preferences: {}
+users:
+- name: user
+  token: TOKEN`
+
+const responseSrc = `{
+  "kind": "Status",
+  "apiVersion": "v1",
+  "metadata": {
+
+  },
+  "status": "Failure",
+  "message": "Unauthorized",
+  "reason": "Unauthorized",
+  "code": 401
+}`
+
+func TestSnapshotConfig(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+		fmt.Fprintln(w, responseSrc)
+	}))
+
+	// Test01 Unauthorized - Permanent error
+	snap := newConfiguredSnapshot("test1", "InProgress")
+	snap.Spec.Kubeconfig = strings.Replace(kubeconfigSrc, "CLUSTER_URL", ts.URL, 1)
+	err := Snapshot(context.TODO(), snap, nil)
+	fmt.Println(err.Error())
+	_, ok := err.(*backoff.PermanentError)
+	if !ok {
+		t.Errorf("Error type is not backoff.PermanentError but is %T", reflect.TypeOf(err))
+	}
+
+	// Test02 Connection refused - Error for retry
+	ts.Close()
+	err = Snapshot(context.TODO(), snap, nil)
+	fmt.Println(err.Error())
+	_, ok = err.(*backoff.PermanentError)
+	if ok {
+		t.Errorf("Error type is %T", reflect.TypeOf(err))
+	}
+}
+
+const objectstoreResponseSrc = `<?xml version="1.0" encoding="UTF-8"?>
+<Error>
+  <Code>InvalidAccessKeyId</Code>
+  <RequestId>tx00000000000000381f085-00603d964f-27854fae-default</RequestId>
+  <HostId>27854fae-default-default</HostId>
+</Error>`
+
+func TestObjectstoreConfig(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, objectstoreResponseSrc)
+	}))
+
+	// Test01 InvalidAccessKey - Permanent error
+	snap := newConfiguredSnapshot("test1", "InProgress")
+	url, _ := url.Parse(ts.URL)
+	endpoint := url.Scheme + "://" + url.Hostname() + ".nip.io:" + url.Port()
+	bucket := objectstore.NewBucket("test1", "ACCESSKEY", "SECRETKEY", endpoint, "jp-east-2", "test1", false)
+	err := UploadSnapshot(context.TODO(), snap, bucket)
+	fmt.Println(err.Error())
+	_, ok := err.(*backoff.PermanentError)
+	if !ok {
+		t.Errorf("Error type is not backoff.PermanentError but is %T", reflect.TypeOf(err))
+	}
+
+	// Test02 Connection refused - Error for retry
+	ts.Close()
+	err = UploadSnapshot(context.TODO(), snap, bucket)
+	fmt.Println(err.Error())
+	_, ok = err.(*backoff.PermanentError)
+	if ok {
+		t.Errorf("Error type is %T", reflect.TypeOf(err))
+	}
+}
+
+func TestKubeconfigSecretRef(t *testing.T) {
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubeconfig-secret",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Data: map[string][]byte{
+			"kubeconfig": []byte("secret-kubeconfig"),
+			"other":      []byte("other-kubeconfig"),
+		},
+	}
+	localClient := k8sfake.NewSimpleClientset(secret)
+	ctx := context.TODO()
+
+	// Inline kubeconfig
+	kubeconfig, err := getKubeconfig(ctx, localClient, "default", "inline-kubeconfig", nil)
+	if err != nil || kubeconfig != "inline-kubeconfig" {
+		t.Errorf("Error getting inline kubeconfig : %s %v", kubeconfig, err)
+	}
+
+	// Default key
+	ref := &clustersnapshot.KubeconfigSecretRef{Name: "kubeconfig-secret"}
+	kubeconfig, err = getKubeconfig(ctx, localClient, "default", "inline-kubeconfig", ref)
+	if err != nil || kubeconfig != "secret-kubeconfig" {
+		t.Errorf("Error getting kubeconfig from secret : %s %v", kubeconfig, err)
+	}
+
+	// Specified key
+	ref.Key = "other"
+	kubeconfig, err = getKubeconfig(ctx, localClient, "default", "", ref)
+	if err != nil || kubeconfig != "other-kubeconfig" {
+		t.Errorf("Error getting kubeconfig from secret key : %s %v", kubeconfig, err)
+	}
+
+	// Key not found
+	ref.Key = "notfound"
+	_, err = getKubeconfig(ctx, localClient, "default", "", ref)
+	if err == nil {
+		t.Error("Error key not found not reported")
+	}
+
+	// Secret not found
+	ref = &clustersnapshot.KubeconfigSecretRef{Name: "notfound"}
+	_, err = buildKubeClient(ctx, localClient, "default", "", ref)
+	if err == nil {
+		t.Error("Error secret not found not reported")
+	}
+}
+
+func TestIncludePreference(t *testing.T) {
+	pref := newRestorePreference("pref1")
+	pref.Spec.IncludeNamespaces = []string{"app1"}
+	p := newPreference(pref)
+
+	// Preferences by path
+	paths := map[string]string{
+		"/namespaces/app1.json":                               "Namespace",
+		"/namespaces/app2.json":                               "Exclude",
+		"/api/v1/namespaces/app1/configmaps/cm1.json":         "Restore",
+		"/api/v1/namespaces/app2/configmaps/cm1.json":         "Exclude",
+		"/api/v1/namespaces/app1/persistentvolumeclaims/pvc1": "PVC",
+		"/api/v1/persistentvolumes/pv1.json":                  "PV",
+		"/apis/storage.k8s.io/v1/storageclasses/sc1.json":     "Restore",
+	}
+	for path, expected := range paths {
+		if res := p.preferedToRestore(path); res != expected {
+			t.Errorf("Preference for %s not match : Result %s / Expected %s", path, res, expected)
+		}
+	}
+
+	// Dependencies of namespaced resources
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	rb := unstrctrdResource("rbac.authorization.k8s.io", "v1", "app1", "rb1", "RoleBinding", "rolebindings")
+	rb.Object["roleRef"] = map[string]interface{}{"kind": "ClusterRole", "name": "role1"}
+	writeTestItem(t, dir, "Restore", "/apis/rbac.authorization.k8s.io/v1/namespaces/app1/rolebindings/rb1", rb)
+	writeTestItem(t, dir, "Restore", "/apis/example.com/v1/namespaces/app1/foos/foo1",
+		unstrctrdResource("example.com", "v1", "app1", "foo1", "Foo", "foos"))
+	writeTestItem(t, dir, "PVC", "/api/v1/namespaces/app1/persistentvolumeclaims/pvc1",
+		convertToUnstructured(t, newPVC("app1", "pvc1", "sc1", "pv1")).(*unstructured.Unstructured))
+	err = p.initializeByDir(dir)
+	if err != nil {
+		t.Fatalf("Error in initializeByDir : %s", err.Error())
+	}
+	clusterResources := map[*unstructured.Unstructured]bool{
+		unstrctrdResource("", "v1", "", "app1", "Namespace", "namespaces"):                                          true,
+		unstrctrdResource("", "v1", "", "app2", "Namespace", "namespaces"):                                          false,
+		unstrctrdResource("storage.k8s.io", "v1", "", "sc1", "StorageClass", "storageclasses"):                      true,
+		unstrctrdResource("storage.k8s.io", "v1", "", "sc2", "StorageClass", "storageclasses"):                      false,
+		unstrctrdResource("apiextensions.k8s.io", "v1", "", "foos.example.com", "CustomResourceDefinition", "crds"): true,
+		unstrctrdResource("apiextensions.k8s.io", "v1", "", "bars.example.com", "CustomResourceDefinition", "crds"): false,
+		unstrctrdResource("", "v1", "app1", "cm1", "ConfigMap", "configmaps"):                                       true,
+	}
+	for item, expected := range clusterResources {
+		if p.isIncludedClusterResource(item, "") != expected {
+			t.Errorf("Included %s %s not match : Expected %t", item.GetKind(), item.GetName(), expected)
+		}
+	}
+	if !p.dependencies["ClusterRole/role1"] {
+		t.Error("ClusterRole referenced in RoleBinding not included")
+	}
+
+	// Label selector
+	pref.Spec.IncludeNamespaces = nil
+	pref.Spec.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app1"}}
+	err = p.initializeByDir(dir)
+	if err != nil {
+		t.Fatalf("Error in initializeByDir : %s", err.Error())
+	}
+	labeled := unstrctrdResource("", "v1", "app1", "cm1", "ConfigMap", "configmaps")
+	labeled.SetLabels(map[string]string{"app": "app1"})
+	if !p.isLabelMatched(labeled) {
+		t.Error("Labeled resource not matched")
+	}
+	if p.isLabelMatched(unstrctrdResource("", "v1", "app1", "cm2", "ConfigMap", "configmaps")) {
+		t.Error("Resource without label matched")
+	}
+	if p.dependencies["StorageClass/sc1"] {
+		t.Error("StorageClass referenced from not matched PVC included")
+	}
+}
+
+func TestNamespaceMapping(t *testing.T) {
+	mappings := map[string]string{"prod": "staging"}
+
+	// Namespaced resource
+	cm := convertToUnstructured(t, newConfiguredConfigMap("cm1", "cm1")).(*unstructured.Unstructured)
+	if mapNamespace(cm, mappings) {
+		t.Error("ConfigMap in not mapped namespace mapped")
+	}
+	cm.SetNamespace("prod")
+	if !mapNamespace(cm, mappings) || cm.GetNamespace() != "staging" {
+		t.Errorf("ConfigMap namespace not mapped : %s", cm.GetNamespace())
+	}
+
+	// Namespace
+	ns := unstrctrdResource("", "v1", "", "prod", "Namespace", "namespaces")
+	if !mapNamespace(ns, mappings) || ns.GetName() != "staging" {
+		t.Errorf("Namespace not mapped : %s", ns.GetName())
+	}
+
+	// Subjects in bindings
+	crb := convertToUnstructured(t, newClusterRoleBinding("prod")).(*unstructured.Unstructured)
+	if !mapNamespace(crb, mappings) {
+		t.Error("ClusterRoleBinding subjects not mapped")
+	}
+	subject := getUnstructuredSlice(crb.Object, "subjects")[0].(map[string]interface{})
+	if getUnstructuredString(subject, "namespace") != "staging" || crb.GetName() != "cluster-admin-prod" {
+		t.Errorf("ClusterRoleBinding not mapped correctly : %#v", crb.Object)
+	}
+}
+
+func TestRestorePVPairs(t *testing.T) {
+	pvPollInterval = 10 * time.Millisecond
+	defer func() { pvPollInterval = 5 * time.Second }()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for _, n := range []string{"1", "2", "3"} {
+		writeTestItem(t, dir, "PV", "/api/v1/persistentvolumes/pv"+n,
+			convertToUnstructured(t, newPV("pv"+n, "nfs", "default", "pvc"+n)).(*unstructured.Unstructured))
+		writeTestItem(t, dir, "PVC", "/api/v1/namespaces/default/persistentvolumeclaims/pvc"+n,
+			convertToUnstructured(t, newPVC("default", "pvc"+n, "nfs", "pv"+n)).(*unstructured.Unstructured))
+	}
+
+	res := setAPIResourceList(nil, "", "v1", "persistentvolumes", "PersistentVolume", false)
+	res = setAPIResourceList(res, "", "v1", "persistentvolumeclaims", "PersistentVolumeClaim", true)
+	sr := newServerResources(res)
+
+	// Only pv1 will be bound, and the order of PVs checked
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	checked := make([]string, 0)
+	dyn.PrependReactor("get", "persistentvolumes", func(action core.Action) (bool, runtime.Object, error) {
+		name := action.(core.GetAction).GetName()
+		checked = append(checked, name)
+		if name == "pv1" {
+			return true, convertToUnstructured(t, newPV("pv1", "nfs", "default", "pvc1")), nil
+		}
+		return false, nil, nil
+	})
+
+	pref := newRestorePreference("pref1")
+	pref.Spec.RestoreNfsStorageClasses = []string{"nfs"}
+	pref.Spec.PVBindTimeout = &metav1.Duration{Duration: 100 * time.Millisecond}
+	pref.Spec.PVParallelism = 2
+	restore := newConfiguredRestore("pv1", "snap1", "pref1", "InProgress")
+	p := newPreference(pref)
+	p.report, err = newRestoreReport(restore)
+	if err != nil {
+		t.Fatalf("Error in newRestoreReport : %s", err.Error())
+	}
+	err = restorePV(context.TODO(), dir, dyn, p, restore, sr, utils.NewNamedLog("restore:pv1"))
+	if err != nil {
+		t.Fatalf("Error in restorePV : %s", err.Error())
+	}
+	err = p.report.close()
+	if err != nil {
+		t.Fatalf("Error in close : %s", err.Error())
+	}
+
+	// Timeouts are failures of PVCs, not errors of the restore
+	if restore.Status.NumCreated != 4 || restore.Status.NumFailed != 2 {
+		t.Errorf("Counters not match : created %d failed %d", restore.Status.NumCreated, restore.Status.NumFailed)
+	}
+	chkResourceList(t, restore.Status.Failed, []string{
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc2,Timeout : waiting for PV/PVC bound pv2 in 100ms",
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc3,Timeout : waiting for PV/PVC bound pv3 in 100ms",
+	})
+
+	// PVCs not bound are left on the cluster, to be deleted on rollback
+	reportFile, err := os.Open(restoreReportFile(restore))
+	if err != nil {
+		t.Fatalf("Error opening restore report : %s", err.Error())
+	}
+	items, err := loadRestoreReport(reportFile)
+	reportFile.Close()
+	if err != nil {
+		t.Fatalf("Error in loadRestoreReport : %s", err.Error())
+	}
+	for _, item := range items {
+		if item.Result == resultFailed && !item.Created {
+			t.Errorf("Failed PVC %s not marked created", item.Path)
+		}
+	}
+	if len(items) != 6 {
+		t.Errorf("Number of resources to roll back %d not equals to 6", len(items))
+	}
+
+	// pv2 and pv3 waited concurrently
+	concurrent := false
+	for i, name := range checked {
+		if name == "pv3" {
+			for _, after := range checked[i:] {
+				if after == "pv2" {
+					concurrent = true
+				}
+			}
+		}
+	}
+	if !concurrent {
+		t.Errorf("Error PV/PVC pairs not restored concurrently : %v", checked)
+	}
+}
+
+func TestStorageClassPolicy(t *testing.T) {
+	pvPollInterval = 10 * time.Millisecond
+	defer func() { pvPollInterval = 5 * time.Second }()
+
+	pref := newRestorePreference("pref1")
+	pref.Spec.RestoreNfsStorageClasses = []string{"nfs"}
+	pref.Spec.StorageClassPolicies = []clustersnapshot.StorageClassPolicy{
+		{StorageClassName: "ceph", Policy: "reprovision"},
+		{StorageClassName: "local", Policy: "skip"},
+	}
+	pref.Spec.StorageClassMappings = map[string]string{"nfs": "nfs-new"}
+	p := newPreference(pref)
+
+	// Storage classes to restore
+	for path, expected := range map[string]string{
+		"/apis/storage.k8s.io/v1/storageclasses/nfs.json":   "Exclude",
+		"/apis/storage.k8s.io/v1/storageclasses/ceph.json":  "Restore",
+		"/apis/storage.k8s.io/v1/storageclasses/local.json": "Exclude",
+		"/apis/storage.k8s.io/v1/storageclasses/other.json": "Exclude",
+	} {
+		if result := p.preferedToRestore(path); result != expected {
+			t.Errorf("Error %s : %s / expected %s", path, result, expected)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for n, class := range map[string]string{"1": "nfs", "2": "ceph", "3": "local"} {
+		writeTestItem(t, dir, "PV", "/api/v1/persistentvolumes/pv"+n,
+			convertToUnstructured(t, newPV("pv"+n, class, "default", "pvc"+n)).(*unstructured.Unstructured))
+		writeTestItem(t, dir, "PVC", "/api/v1/namespaces/default/persistentvolumeclaims/pvc"+n,
+			convertToUnstructured(t, newPVC("default", "pvc"+n, class, "pv"+n)).(*unstructured.Unstructured))
+	}
+	res := setAPIResourceList(nil, "", "v1", "persistentvolumes", "PersistentVolume", false)
+	res = setAPIResourceList(res, "", "v1", "persistentvolumeclaims", "PersistentVolumeClaim", true)
+	sr := newServerResources(res)
+
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dyn.PrependReactor("get", "persistentvolumes", func(action core.Action) (bool, runtime.Object, error) {
+		return true, convertToUnstructured(t, newPV("pv1", "nfs-new", "default", "pvc1")), nil
+	})
+	restore := newConfiguredRestore("sc1", "snap1", "pref1", "InProgress")
+	p.report, err = newRestoreReport(restore)
+	if err != nil {
+		t.Fatalf("Error in newRestoreReport : %s", err.Error())
+	}
+	err = restorePV(context.TODO(), dir, dyn, p, restore, sr, utils.NewNamedLog("restore:sc1"))
+	if err != nil {
+		t.Fatalf("Error in restorePV : %s", err.Error())
+	}
+	err = p.report.close()
+	if err != nil {
+		t.Fatalf("Error in close : %s", err.Error())
+	}
+
+	// rebind pv1/pvc1 with mapped storage class, reprovision only pvc2, skip pvc3
+	items := readRestoreReport(t, restore)
+	chkResourceList(t, items[resultCreated], []string{
+		"/api/v1/persistentvolumes/pv1",
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc1",
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc2",
+	})
+	chkResourceList(t, items[resultExcluded], []string{
+		"/api/v1/namespaces/default/persistentvolumeclaims/pvc3,(storageclass-skipped)",
+	})
+	pvGVR := schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"}
+	pvcGVR := schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
+	for _, a := range dyn.Actions() {
+		create, ok := a.(core.CreateAction)
+		if !ok {
+			continue
+		}
+		item := create.GetObject().(*unstructured.Unstructured)
+		class, _, _ := unstructured.NestedString(item.Object, "spec", "storageClassName")
+		volumeName, _, _ := unstructured.NestedString(item.Object, "spec", "volumeName")
+		switch {
+		case a.GetResource() == pvGVR && item.GetName() == "pv1", a.GetResource() == pvcGVR && item.GetName() == "pvc1":
+			if class != "nfs-new" {
+				t.Errorf("Error storage class of %s not mapped : %s", item.GetName(), class)
+			}
+		case a.GetResource() == pvcGVR && item.GetName() == "pvc2":
+			if class != "ceph" || volumeName != "" {
+				t.Errorf("Error pvc2 not to reprovision : %s %s", class, volumeName)
+			}
+		default:
+			t.Errorf("Error %s %s created", a.GetResource().Resource, item.GetName())
+		}
+	}
+
+	// volumeClaimTemplates of StatefulSets
+	sts := unstrctrdResource("apps", "v1", "default", "sts1", "StatefulSet", "statefulsets")
+	_ = unstructured.SetNestedSlice(sts.Object, []interface{}{
+		map[string]interface{}{"spec": map[string]interface{}{"storageClassName": "nfs"}},
+		map[string]interface{}{"spec": map[string]interface{}{"storageClassName": "ceph"}},
+	}, "spec", "volumeClaimTemplates")
+	if !mapStorageClass(sts, pref.Spec.StorageClassMappings) {
+		t.Error("Error StatefulSet storage class not mapped")
+	}
+	templates, _, _ := unstructured.NestedSlice(sts.Object, "spec", "volumeClaimTemplates")
+	first, _, _ := unstructured.NestedString(templates[0].(map[string]interface{}), "spec", "storageClassName")
+	second, _, _ := unstructured.NestedString(templates[1].(map[string]interface{}), "spec", "storageClassName")
+	if first != "nfs-new" || second != "ceph" {
+		t.Errorf("Error StatefulSet storage classes : %s %s", first, second)
+	}
+}
+
+func TestVolumeSnapshots(t *testing.T) {
+	volumeSnapshotPollInterval = 10 * time.Millisecond
+	defer func() { volumeSnapshotPollInterval = 5 * time.Second }()
+
+	res := setAPIResourceList(nil, "", "v1", "persistentvolumeclaims", "PersistentVolumeClaim", true)
+	res = setAPIResourceList(res, "snapshot.storage.k8s.io", "v1", "volumesnapshots", "VolumeSnapshot", true)
+	res = setAPIResourceList(res, "snapshot.storage.k8s.io", "v1", "volumesnapshotcontents", "VolumeSnapshotContent", false)
+	sr := newServerResources(res)
+	vsGVR := schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+	vscGVR := schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshotcontents"}
+	pvcGVR := schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
+
+	// PVCs in the source cluster, pvc3 not bound
+	pending := convertToUnstructured(t, newPVC("default", "pvc3", "csi", "")).(*unstructured.Unstructured)
+	_ = unstructured.SetNestedField(pending.Object, "Pending", "status", "phase")
+	content := unstrctrdResource("snapshot.storage.k8s.io", "v1", "", "snapcontent-1", "VolumeSnapshotContent", "volumesnapshotcontents")
+	_ = unstructured.SetNestedField(content.Object, "csi.example.com", "spec", "driver")
+	_ = unstructured.SetNestedField(content.Object, "csi-class", "spec", "volumeSnapshotClassName")
+	_ = unstructured.SetNestedField(content.Object, "handle-1", "status", "snapshotHandle")
+	sch := runtime.NewScheme()
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "", Version: "v1", Kind: "PersistentVolumeClaimList"}, &unstructured.UnstructuredList{})
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshotList"}, &unstructured.UnstructuredList{})
+	dyn := dynamicfake.NewSimpleDynamicClient(sch,
+		convertToUnstructured(t, newPVC("default", "pvc1", "csi", "pv1")),
+		convertToUnstructured(t, newPVC("default", "pvc2", "nfs", "pv2")),
+		pending, content,
+	)
+	// snapshot controller makes VolumeSnapshots ready
+	dyn.PrependReactor("create", "volumesnapshots", func(action core.Action) (bool, runtime.Object, error) {
+		vs := action.(core.CreateAction).GetObject().(*unstructured.Unstructured)
+		_ = unstructured.SetNestedField(vs.Object, true, "status", "readyToUse")
+		_ = unstructured.SetNestedField(vs.Object, "snapcontent-1", "status", "boundVolumeSnapshotContentName")
+		_ = unstructured.SetNestedField(vs.Object, "1Gi", "status", "restoreSize")
+		return false, nil, nil
+	})
+
+	snapshot := newConfiguredSnapshot("snap1", "InProgress")
+	snapshot.Spec.VolumeSnapshots = &clustersnapshot.VolumeSnapshotSpec{StorageClasses: []string{"csi"}}
+	scope, err := newSnapshotScope(&snapshot.Spec)
+	if err != nil {
+		t.Fatalf("Error in newSnapshotScope : %s", err.Error())
+	}
+	blog := utils.NewNamedLog("snapshot:snap1")
+	records, err := takeVolumeSnapshots(context.TODO(), snapshot, dyn, sr, scope, blog)
+	if err != nil {
+		t.Fatalf("Error in takeVolumeSnapshots : %s", err.Error())
+	}
+	expected := []clustersnapshot.VolumeSnapshotRecord{{
+		Namespace:                 "default",
+		PVCName:                   "pvc1",
+		VolumeSnapshotName:        "snap1-pvc1",
+		VolumeSnapshotContentName: "snapcontent-1",
+		VolumeSnapshotClassName:   "csi-class",
+		Driver:                    "csi.example.com",
+		SnapshotHandle:            "handle-1",
+		RestoreSize:               "1Gi",
+	}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Error volume snapshot records : %#v", records)
+	}
+	vs, err := dyn.Resource(vsGVR).Namespace("default").Get(context.TODO(), "snap1-pvc1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error getting VolumeSnapshot : %s", err.Error())
+	}
+	if vs.GetLabels()[volumeSnapshotLabel] != "snap1" {
+		t.Errorf("Error VolumeSnapshot label : %v", vs.GetLabels())
+	}
+
+	// Failed VolumeSnapshots fail the snapshot permanently
+	dyn.PrependReactor("get", "volumesnapshots", func(action core.Action) (bool, runtime.Object, error) {
+		failed := vs.DeepCopy()
+		_ = unstructured.SetNestedField(failed.Object, false, "status", "readyToUse")
+		_ = unstructured.SetNestedField(failed.Object, "snapshot quota exceeded", "status", "error", "message")
+		return true, failed, nil
+	})
+	_, err = takeVolumeSnapshots(context.TODO(), snapshot, dyn, sr, scope, blog)
+	if _, ok := err.(*backoff.PermanentError); !ok || !strings.Contains(err.Error(), "snapshot quota exceeded") {
+		t.Errorf("Error VolumeSnapshot failure not permanent : %v", err)
+	}
+
+	// VolumeSnapshots of the snapshot deleted, restored one with the same label kept
+	restored := unstrctrdResource("snapshot.storage.k8s.io", "v1", "restored", "snap1-pvc1", "VolumeSnapshot", "volumesnapshots")
+	restored.SetLabels(map[string]string{volumeSnapshotLabel: "snap1"})
+	_ = unstructured.SetNestedField(restored.Object, "k8s-snap-vs1-restored-snap1-pvc1", "spec", "source", "volumeSnapshotContentName")
+	_, err = dyn.Resource(vsGVR).Namespace("restored").Create(context.TODO(), restored, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Error creating VolumeSnapshot : %s", err.Error())
+	}
+	err = deleteVolumeSnapshots(context.TODO(), snapshot, dyn, sr)
+	if err != nil {
+		t.Fatalf("Error in deleteVolumeSnapshots : %s", err.Error())
+	}
+	vsList, err := dyn.Resource(vsGVR).Namespace(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Error listing VolumeSnapshots : %s", err.Error())
+	}
+	if len(vsList.Items) != 1 || vsList.Items[0].GetNamespace() != "restored" {
+		t.Errorf("Error VolumeSnapshots after delete : %v", vsList.Items)
+	}
+
+	// Restore PVC from the VolumeSnapshot into a mapped namespace
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	writeTestItem(t, dir, "PVC", "/api/v1/namespaces/default/persistentvolumeclaims/pvc1",
+		convertToUnstructured(t, newPVC("default", "pvc1", "csi", "pv1")).(*unstructured.Unstructured))
+	restore := newConfiguredRestore("vs1", "snap1", "pref1", "InProgress")
+	restore.Spec.NamespaceMappings = map[string]string{"default": "restored"}
+	p := newPreference(newRestorePreference("pref1"))
+	p.volumeSnapshots = map[string]*clustersnapshot.VolumeSnapshotRecord{"default/pvc1": &records[0]}
+	p.report, err = newRestoreReport(restore)
+	if err != nil {
+		t.Fatalf("Error in newRestoreReport : %s", err.Error())
+	}
+	rdyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	err = restorePV(context.TODO(), dir, rdyn, p, restore, sr, utils.NewNamedLog("restore:vs1"))
+	if err != nil {
+		t.Fatalf("Error in restorePV : %s", err.Error())
+	}
+	err = p.report.close()
+	if err != nil {
+		t.Fatalf("Error in close : %s", err.Error())
+	}
+	if restore.Status.NumCreated != 3 || restore.Status.NumFailed != 0 {
+		t.Errorf("Counters not match : created %d failed %d %v", restore.Status.NumCreated, restore.Status.NumFailed, restore.Status.Failed)
+	}
+	// the content reported before the VolumeSnapshot to be rolled back after it
+	created := readRestoreReport(t, restore)[resultCreated]
+	expectedCreated := []string{
+		"/apis/snapshot.storage.k8s.io/v1/volumesnapshotcontents/k8s-snap-vs1-restored-snap1-pvc1",
+		"/apis/snapshot.storage.k8s.io/v1/namespaces/restored/volumesnapshots/snap1-pvc1",
+		"/api/v1/namespaces/restored/persistentvolumeclaims/pvc1",
+	}
+	if !reflect.DeepEqual(created, expectedCreated) {
+		t.Errorf("Error reported order\nResult : %v\nExpected : %v", created, expectedCreated)
+	}
+
+	vsc, err := rdyn.Resource(vscGVR).Get(context.TODO(), "k8s-snap-vs1-restored-snap1-pvc1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error getting restored VolumeSnapshotContent : %s", err.Error())
+	}
+	handle, _, _ := unstructured.NestedString(vsc.Object, "spec", "source", "snapshotHandle")
+	refNamespace, _, _ := unstructured.NestedString(vsc.Object, "spec", "volumeSnapshotRef", "namespace")
+	if handle != "handle-1" || refNamespace != "restored" {
+		t.Errorf("Error restored VolumeSnapshotContent : %#v", vsc.Object)
+	}
+	vs, err = rdyn.Resource(vsGVR).Namespace("restored").Get(context.TODO(), "snap1-pvc1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error getting restored VolumeSnapshot : %s", err.Error())
+	}
+	source, _, _ := unstructured.NestedString(vs.Object, "spec", "source", "volumeSnapshotContentName")
+	if source != vsc.GetName() {
+		t.Errorf("Error restored VolumeSnapshot source : %s", source)
+	}
+	pvc, err := rdyn.Resource(pvcGVR).Namespace("restored").Get(context.TODO(), "pvc1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error getting restored PVC : %s", err.Error())
+	}
+	dataSource, _, _ := unstructured.NestedStringMap(pvc.Object, "spec", "dataSource")
+	volumeName, _, _ := unstructured.NestedString(pvc.Object, "spec", "volumeName")
+	if dataSource["kind"] != "VolumeSnapshot" || dataSource["name"] != "snap1-pvc1" || volumeName != "" {
+		t.Errorf("Error restored PVC dataSource : %v volumeName : %s", dataSource, volumeName)
+	}
+}
+
+func TestSnapshotHooks(t *testing.T) {
+
+	blog := utils.NewNamedLog("snapshot:hooks")
+	kubeClient := k8sfake.NewSimpleClientset(
+		newPod("db", "db-0", "db", corev1.PodRunning),
+		newPod("db", "db-1", "db", corev1.PodRunning),
+		newPod("db", "db-2", "db", corev1.PodPending),
+		newPod("web", "web-0", "web", corev1.PodRunning),
+	)
+	executor := &fakeExecutor{
+		outputs: map[string]string{"db/db-0": "frozen", "db/db-1": "frozen"},
+		errors:  map[string]error{"web/web-0": fmt.Errorf("command terminated with exit code 1")},
+		delays:  map[string]time.Duration{},
+	}
+	selector := func(app string) *metav1.LabelSelector {
+		return &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}}
+	}
+
+	// Test01 : hooks run in running pods only, results recorded
+	snap := newConfiguredSnapshot("hooks", "InProgress")
+	hooks := []clustersnapshot.SnapshotHook{
+		{Name: "freeze", Namespace: "db", PodSelector: selector("db"), Command: []string{"fsfreeze", "-f", "/data"}},
+	}
+	err := runHooks(context.TODO(), snap, hooks, hookPhasePre, kubeClient, executor, blog)
+	if err != nil {
+		t.Errorf("Error in running hooks : %s", err.Error())
+	}
+	if len(snap.Status.Hooks) != 2 {
+		t.Fatalf("Number of hook results %d not equals to 2", len(snap.Status.Hooks))
+	}
+	for _, r := range snap.Status.Hooks {
+		if r.Result != hookSucceeded || r.Output != "frozen" || r.Container != "main" || r.Phase != hookPhasePre {
+			t.Errorf("Error hook result : %#v", r)
+		}
+	}
+	if !reflect.DeepEqual(executor.commands["db/db-0"], []string{"fsfreeze", "-f", "/data"}) {
+		t.Errorf("Error hook command : %v", executor.commands["db/db-0"])
+	}
+
+	// Test02 : failed hook with onError Continue
+	snap = newConfiguredSnapshot("hooks", "InProgress")
+	hooks = []clustersnapshot.SnapshotHook{
+		{Name: "flush", Namespace: "web", PodSelector: selector("web"), Command: []string{"flush"}, OnError: hookOnErrorContinue},
+		{Name: "freeze", Namespace: "db", PodSelector: selector("db"), Container: "sidecar", Command: []string{"freeze"}},
+	}
+	err = runHooks(context.TODO(), snap, hooks, hookPhasePost, kubeClient, executor, blog)
+	if err != nil {
+		t.Errorf("Error in running hooks : %s", err.Error())
+	}
+	if len(snap.Status.Hooks) != 3 || snap.Status.Hooks[0].Result != hookFailed || snap.Status.Hooks[1].Container != "sidecar" {
+		t.Errorf("Error hook results : %#v", snap.Status.Hooks)
+	}
+
+	// Test03 : failed hook with onError Fail stops hooks
+	snap = newConfiguredSnapshot("hooks", "InProgress")
+	hooks = []clustersnapshot.SnapshotHook{
+		{Name: "flush", Namespace: "web", PodSelector: selector("web"), Command: []string{"flush"}},
+		{Name: "freeze", Namespace: "db", PodSelector: selector("db"), Command: []string{"freeze"}},
+	}
+	err = runHooks(context.TODO(), snap, hooks, hookPhasePre, kubeClient, executor, blog)
+	if _, ok := err.(*backoff.PermanentError); !ok || !strings.Contains(err.Error(), "exit code 1") {
+		t.Errorf("Error hook failure not permanent : %v", err)
+	}
+	if len(snap.Status.Hooks) != 1 {
+		t.Errorf("Hooks run after failed hook : %#v", snap.Status.Hooks)
+	}
+
+	// Test04 : no running pods matched
+	snap = newConfiguredSnapshot("hooks", "InProgress")
+	hooks = []clustersnapshot.SnapshotHook{
+		{Name: "none", Namespace: "db", PodSelector: selector("none"), Command: []string{"true"}},
+	}
+	err = runHooks(context.TODO(), snap, hooks, hookPhasePre, kubeClient, executor, blog)
+	if err == nil || len(snap.Status.Hooks) != 1 || !strings.Contains(snap.Status.Hooks[0].Error, "no running pods") {
+		t.Errorf("Error hook without pods : %v %#v", err, snap.Status.Hooks)
+	}
+
+	// Test05 : timeout
+	executor.delays["db/db-0"] = 2 * time.Second
+	snap = newConfiguredSnapshot("hooks", "InProgress")
+	hooks = []clustersnapshot.SnapshotHook{
+		{Name: "slow", Namespace: "db", PodSelector: selector("db"), Command: []string{"sleep"},
+			Timeout: &metav1.Duration{Duration: 100 * time.Millisecond}},
+	}
+	err = runHooks(context.TODO(), snap, hooks, hookPhasePre, kubeClient, executor, blog)
+	if err == nil || !strings.Contains(snap.Status.Hooks[0].Error, "Timeout") || snap.Status.Hooks[1].Result != hookSucceeded {
+		t.Errorf("Error hook timeout : %v %#v", err, snap.Status.Hooks)
+	}
+
+	// Test06 : no executor
+	snap = newConfiguredSnapshot("hooks", "InProgress")
+	err = runHooks(context.TODO(), snap, hooks, hookPhasePre, kubeClient, nil, blog)
+	if err == nil || len(snap.Status.Hooks) != 1 || snap.Status.Hooks[0].Result != hookFailed {
+		t.Errorf("Error hook without executor : %v %#v", err, snap.Status.Hooks)
+	}
+}
+
+func TestSnapshotHooksOrder(t *testing.T) {
+	volumeSnapshotPollInterval = 10 * time.Millisecond
+	defer func() { volumeSnapshotPollInterval = 5 * time.Second }()
+
+	kubeClient := k8sfake.NewSimpleClientset(newPod("db", "db-0", "db", corev1.PodRunning))
+	res := setAPIResourceList(nil, "", "v1", "persistentvolumeclaims", "PersistentVolumeClaim", true)
+	res = setAPIResourceList(res, "snapshot.storage.k8s.io", "v1", "volumesnapshots", "VolumeSnapshot", true)
+	kubeClient.Discovery().(*discoveryfake.FakeDiscovery).Fake.Resources = res
+
+	sch := runtime.NewScheme()
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "", Version: "v1", Kind: "PersistentVolumeClaimList"}, &unstructured.UnstructuredList{})
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshotList"}, &unstructured.UnstructuredList{})
+	content := unstrctrdResource("snapshot.storage.k8s.io", "v1", "", "snapcontent-1", "VolumeSnapshotContent", "volumesnapshotcontents")
+	_ = unstructured.SetNestedField(content.Object, "handle-1", "status", "snapshotHandle")
+	dyn := dynamicfake.NewSimpleDynamicClient(sch, convertToUnstructured(t, newPVC("db", "data-db-0", "csi", "pv1")), content)
+
+	// pre hooks, VolumeSnapshots and post hooks in the order called
+	calls := make([]string, 0)
+	executor := &fakeExecutor{calls: &calls}
+	dyn.PrependReactor("create", "volumesnapshots", func(action core.Action) (bool, runtime.Object, error) {
+		vs := action.(core.CreateAction).GetObject().(*unstructured.Unstructured)
+		_ = unstructured.SetNestedField(vs.Object, true, "status", "readyToUse")
+		_ = unstructured.SetNestedField(vs.Object, "snapcontent-1", "status", "boundVolumeSnapshotContentName")
+		executor.mu.Lock()
+		calls = append(calls, "create "+vs.GetName())
+		executor.mu.Unlock()
+		return false, nil, nil
+	})
+
+	snap := newConfiguredSnapshot("hooks-order", "InProgress")
+	snap.Spec.VolumeSnapshots = &clustersnapshot.VolumeSnapshotSpec{StorageClasses: []string{"csi"}}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}
+	snap.Spec.PreHooks = []clustersnapshot.SnapshotHook{{Name: "freeze", Namespace: "db", PodSelector: selector, Command: []string{"freeze"}}}
+	snap.Spec.PostHooks = []clustersnapshot.SnapshotHook{{Name: "unfreeze", Namespace: "db", PodSelector: selector, Command: []string{"unfreeze"}}}
+	err := SnapshotWithClient(context.TODO(), snap, kubeClient, dyn, executor)
+	defer os.Remove("/tmp/hooks-order.tgz")
+	if err != nil {
+		t.Fatalf("Error in SnapshotWithClient : %s", err.Error())
+	}
+	expected := []string{"exec freeze", "create hooks-order-data-db-0", "exec unfreeze"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Error order of hooks and volume snapshots\nResult : %v\nExpected : %v", calls, expected)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+
+	configMap := func(name, value, rv string) *unstructured.Unstructured {
+		cm := unstrctrdResource("", "v1", "app1", name, "ConfigMap", "configmaps")
+		_ = unstructured.SetNestedField(cm.Object, value, "data", "key")
+		cm.SetResourceVersion(rv)
+		cm.SetUID(types.UID("uid-" + name + "-" + rv))
+		return cm
+	}
+	cmPath := "/api/v1/namespaces/app1/configmaps/"
+	namespace := unstrctrdResource("", "v1", "", "app1", "Namespace", "namespaces")
+	_ = unstructured.SetNestedField(namespace.Object, "Active", "status", "phase")
+
+	// base snapshot and incremental snapshot
+	base := newConfiguredSnapshot("diff-base", "Completed")
+	writeTestSnapshot(t, base, map[string]*unstructured.Unstructured{
+		"/namespaces/app1": namespace,
+		cmPath + "cm1":     configMap("cm1", "v1", "10"),
+		cmPath + "cm2":     configMap("cm2", "v1", "11"),
+		cmPath + "cm3":     configMap("cm3", "v1", "12"),
+	})
+	inc := newConfiguredSnapshot("diff-inc", "Completed")
+	inc.Spec.ParentSnapshot = "diff-base"
+	inc.Status.Deleted = []string{cmPath + "cm2"}
+	writeTestSnapshot(t, inc, map[string]*unstructured.Unstructured{
+		cmPath + "cm1": configMap("cm1", "v2", "20"),
+		cmPath + "cm3": configMap("cm3", "v1", "21"),
+		cmPath + "cm4": configMap("cm4", "v1", "22"),
+	})
+
+	// Test01 : snapshot and snapshot
+	diff := &clustersnapshot.SnapshotDiff{
+		ObjectMeta: metav1.ObjectMeta{Name: "diff1", Namespace: "default"},
+		Spec:       clustersnapshot.SnapshotDiffSpec{SnapshotName: "diff-base", TargetSnapshotName: "diff-inc"},
+	}
+	err := diffResources(diff, nil, nil)
+	if err != nil {
+		t.Fatalf("Error in diffResources : %s", err.Error())
+	}
+	if diff.Status.NumAdded != 1 || diff.Status.NumRemoved != 1 || diff.Status.NumChanged != 1 || diff.Status.NumUnchanged != 2 {
+		t.Errorf("Error diff status : %#v", diff.Status)
+	}
+	report := readDiffReport(t, diff)
+	expected := []diffReportItem{
+		{Path: cmPath + "cm1", Result: diffChanged, Fields: []diffField{{Field: "/data/key", From: "v1", To: "v2"}}},
+		{Path: cmPath + "cm2", Result: diffRemoved},
+		{Path: cmPath + "cm4", Result: diffAdded},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Error diff report : %#v", report)
+	}
+
+	// Test02 : snapshot and live cluster
+	res := setAPIResourceList(nil, "", "v1", "namespaces", "Namespace", false)
+	res = setAPIResourceList(res, "", "v1", "configmaps", "ConfigMap", true)
+	res = setAPIResourceList(res, "", "v1", "events", "Event", true)
+	kubeClient := k8sfake.NewSimpleClientset()
+	kubeClient.Discovery().(*discoveryfake.FakeDiscovery).Fake.Resources = res
+	live := namespace.DeepCopy()
+	_ = unstructured.SetNestedField(live.Object, "Terminating", "status", "phase")
+	cm1 := configMap("cm1", "v1", "30")
+	cm1.SetLabels(map[string]string{"app": "app1"})
+	sch := runtime.NewScheme()
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Version: "v1", Kind: "NamespaceList"}, &unstructured.UnstructuredList{})
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMapList"}, &unstructured.UnstructuredList{})
+	dyn := dynamicfake.NewSimpleDynamicClient(sch, live, cm1, configMap("cm5", "v1", "31"))
+
+	diff = &clustersnapshot.SnapshotDiff{
+		ObjectMeta: metav1.ObjectMeta{Name: "diff2", Namespace: "default"},
+		Spec:       clustersnapshot.SnapshotDiffSpec{SnapshotName: "diff-base", Kubeconfig: "kubeconfig"},
+	}
+	err = diffResources(diff, kubeClient, dyn)
+	if err != nil {
+		t.Fatalf("Error in diffResources : %s", err.Error())
+	}
+	report = readDiffReport(t, diff)
+	expected = []diffReportItem{
+		{Path: cmPath + "cm1", Result: diffChanged, Fields: []diffField{{Field: "/metadata/labels", To: map[string]interface{}{"app": "app1"}}}},
+		{Path: cmPath + "cm2", Result: diffRemoved},
+		{Path: cmPath + "cm3", Result: diffRemoved},
+		{Path: cmPath + "cm5", Result: diffAdded},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Error diff report : %#v", report)
+	}
+	if diff.Status.NumUnchanged != 1 || !reflect.DeepEqual(diff.Status.Removed, []string{cmPath + "cm2", cmPath + "cm3"}) {
+		t.Errorf("Error diff status : %#v", diff.Status)
+	}
+
+	// Test03 : field level differences
+	from := map[string]interface{}{"a": "x", "b": []interface{}{int64(1), int64(2)}, "c/d": map[string]interface{}{"e": true}}
+	to := map[string]interface{}{"a": "x", "b": []interface{}{int64(1), int64(3)}, "c/d": map[string]interface{}{}}
+	fields := compareFields(from, to, "", nil)
+	if !reflect.DeepEqual(fields, []diffField{{Field: "/b/1", From: int64(2), To: int64(3)}, {Field: "/c~1d/e", From: true}}) {
+		t.Errorf("Error field differences : %#v", fields)
+	}
+}
+
+func TestOfflineArchives(t *testing.T) {
+
+	cmPath := "/api/v1/namespaces/app1/configmaps/"
+	cm := unstrctrdResource("", "v1", "app1", "cm1", "ConfigMap", "configmaps")
+	_ = unstructured.SetNestedField(cm.Object, "v1", "data", "key")
+	base := newConfiguredSnapshot("offline-base", "Completed")
+	writeTestSnapshot(t, base, map[string]*unstructured.Unstructured{
+		"/namespaces/app1": unstrctrdResource("", "v1", "", "app1", "Namespace", "namespaces"),
+		cmPath + "cm1":     cm,
+	})
+	inc := newConfiguredSnapshot("offline-inc", "Completed")
+	inc.Spec.ParentSnapshot = "offline-base"
+	writeTestSnapshot(t, inc, map[string]*unstructured.Unstructured{
+		cmPath + "cm2": unstrctrdResource("", "v1", "app1", "cm2", "ConfigMap", "configmaps"),
+	})
+
+	// Test01 : contents and a resource in the archive
+	snapshot, paths, err := ArchiveContents("/tmp/offline-base.tgz")
+	if err != nil {
+		t.Fatalf("Error in ArchiveContents : %s", err.Error())
+	}
+	sort.Strings(paths)
+	if snapshot.ObjectMeta.Name != "offline-base" || !reflect.DeepEqual(paths, []string{cmPath + "cm1", "/namespaces/app1"}) {
+		t.Errorf("Error archive contents : %s %v", snapshot.ObjectMeta.Name, paths)
+	}
+	item, err := ArchiveResource("/tmp/offline-base.tgz", cmPath+"cm1")
+	if err != nil {
+		t.Fatalf("Error in ArchiveResource : %s", err.Error())
+	}
+	if !reflect.DeepEqual(item, cm) {
+		t.Errorf("Error archive resource : %#v", item)
+	}
+	_, err = ArchiveResource("/tmp/offline-base.tgz", cmPath+"cm2")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Error missing resource : %v", err)
+	}
+
+	// Test02 : load the chain from a directory and the local objectstore
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatalf("Error making dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"offline-base", "offline-inc"} {
+		if err := os.Rename("/tmp/"+name+".tgz", filepath.Join(dir, name+".tgz")); err != nil {
+			t.Fatalf("Error moving archive : %s", err.Error())
+		}
+	}
+	err = LoadArchives("offline-inc", dir)
+	if err != nil {
+		t.Fatalf("Error in LoadArchives : %s", err.Error())
+	}
+	for _, name := range []string{"offline-base", "offline-inc"} {
+		if _, err := os.Stat("/tmp/" + name + ".tgz"); err != nil {
+			t.Errorf("Archive %s not loaded : %s", name, err.Error())
+		}
+	}
+	err = LoadArchives("offline-none", dir)
+	if err == nil {
+		t.Error("Loading missing archive must fail")
+	}
+	bucket := objectstore.NewLocal("local", dir)
+	err = DownloadArchive("offline-base", filepath.Join(dir, "downloaded.tgz"), bucket)
+	if err != nil {
+		t.Fatalf("Error in DownloadArchive : %s", err.Error())
+	}
+	_, paths, err = ArchiveContents(filepath.Join(dir, "downloaded.tgz"))
+	if err != nil || len(paths) != 2 {
+		t.Errorf("Error downloaded archive : %v %v", paths, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+
+	ns := func(name string) *unstructured.Unstructured {
+		item := unstrctrdResource("", "v1", "", name, "Namespace", "namespaces")
+		_ = unstructured.SetNestedField(item.Object, "Active", "status", "phase")
+		return item
+	}
+	cm := unstrctrdResource("", "v1", "app1", "cm1", "ConfigMap", "configmaps")
+	cm.SetResourceVersion("100")
+	cm.SetUID(types.UID("uid-cm1"))
+	cm.SetAnnotations(map[string]string{lastAppliedAnnotation: "{}"})
+	_ = unstructured.SetNestedField(cm.Object, "value", "data", "key")
+	token := unstrctrdResource("", "v1", "app1", "token", "Secret", "secrets")
+	_ = unstructured.SetNestedField(token.Object, "kubernetes.io/service-account-token", "type")
+	pod := unstrctrdResource("", "v1", "app1", "pod1", "Pod", "pods")
+	pod.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "rs1", UID: "uid-rs1"}})
+	svc := unstrctrdResource("", "v1", "app1", "svc1", "Service", "services")
+	_ = unstructured.SetNestedField(svc.Object, "10.0.0.1", "spec", "clusterIP")
+	_ = unstructured.SetNestedStringSlice(svc.Object, []string{"10.0.0.1"}, "spec", "clusterIPs")
+	_ = unstructured.SetNestedSlice(svc.Object, []interface{}{map[string]interface{}{"port": int64(80)}}, "spec", "ports")
+	pv := unstrctrdResource("", "v1", "", "pv1", "PersistentVolume", "persistentvolumes")
+	_ = unstructured.SetNestedField(pv.Object, "include-nfs-storage", "spec", "storageClassName")
+	_ = unstructured.SetNestedMap(pv.Object, map[string]interface{}{"kind": "PersistentVolumeClaim", "namespace": "app1", "name": "pvc1"}, "spec", "claimRef")
+	pvc := unstrctrdResource("", "v1", "app1", "pvc1", "PersistentVolumeClaim", "persistentvolumeclaims")
+	pvc.SetAnnotations(map[string]string{"pv.kubernetes.io/bind-completed": "yes"})
+	_ = unstructured.SetNestedField(pvc.Object, "include-nfs-storage", "spec", "storageClassName")
+	_ = unstructured.SetNestedField(pvc.Object, "pv1", "spec", "volumeName")
+	_ = unstructured.SetNestedField(pvc.Object, "Bound", "status", "phase")
+	deploy := unstrctrdResource("apps", "v1", "app1", "app1", "Deployment", "deployments")
+
+	snapshot := newConfiguredSnapshot("export-snap", "Completed")
+	writeTestSnapshot(t, snapshot, map[string]*unstructured.Unstructured{
+		"/namespaces/app1":                                    ns("app1"),
+		"/namespaces/kube-system":                             ns("kube-system"),
+		"/api/v1/namespaces/app1/configmaps/cm1":              cm,
+		"/api/v1/namespaces/app1/secrets/token":               token,
+		"/api/v1/namespaces/app1/pods/pod1":                   pod,
+		"/api/v1/namespaces/app1/services/svc1":               svc,
+		"/api/v1/persistentvolumes/pv1":                       pv,
+		"/api/v1/namespaces/app1/persistentvolumeclaims/pvc1": pvc,
+		"/apis/apps/v1/namespaces/app1/deployments/app1":      deploy,
+	})
+	readYAML := func(path string) map[string]interface{} {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Error reading exported file : %s", err.Error())
+		}
+		obj := make(map[string]interface{})
+		err = yaml.Unmarshal(bytes, &obj)
+		if err != nil {
+			t.Fatalf("Error unmarshalling exported file %s : %s", path, err.Error())
+		}
+		return obj
+	}
+
+	// Test01 : files layout with namespace mapping
+	outDir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatalf("Error making dir : %s", err.Error())
+	}
+	defer os.RemoveAll(outDir)
+	restore := newConfiguredRestore("export1", "export-snap", "pref", "")
+	restore.Spec.NamespaceMappings = map[string]string{"app1": "app2"}
+	exported, err := Export(restore, newRestorePreference("pref"), outDir, ExportLayoutFiles)
+	if err != nil {
+		t.Fatalf("Error in Export : %s", err.Error())
+	}
+	if exported != 6 || restore.Status.NumExcluded != 2 || restore.Status.NumPreferenceExcluded != 1 {
+		t.Errorf("Error export status : exported %d %#v", exported, restore.Status)
+	}
+	if restore.Status.NumCreated != 0 || len(readRestoreReport(t, restore)[resultExported]) != 6 {
+		t.Errorf("Error exported resources counted as created : %d", restore.Status.NumCreated)
+	}
+	expectedFiles := []string{
+		"cluster/persistentvolume-pv1.yaml",
+		"namespaces/app2/configmap-cm1.yaml",
+		"namespaces/app2/deployment.apps-app1.yaml",
+		"namespaces/app2/namespace-app2.yaml",
+		"namespaces/app2/persistentvolumeclaim-pvc1.yaml",
+		"namespaces/app2/service-svc1.yaml",
+	}
+	files := make([]string, 0)
+	_ = filepath.Walk(outDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, strings.TrimPrefix(path, outDir+"/"))
+		}
+		return err
+	})
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Error exported files : %v", files)
+	}
+	expectedCM := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "cm1", "namespace": "app2"},
+		"data":       map[string]interface{}{"key": "value"},
+	}
+	if obj := readYAML(filepath.Join(outDir, "namespaces/app2/configmap-cm1.yaml")); !reflect.DeepEqual(obj, expectedCM) {
+		t.Errorf("Error exported configmap : %#v", obj)
+	}
+	if obj := readYAML(filepath.Join(outDir, "namespaces/app2/namespace-app2.yaml")); obj["status"] != nil {
+		t.Errorf("Error exported namespace : %#v", obj)
+	}
+	if obj := readYAML(filepath.Join(outDir, "namespaces/app2/service-svc1.yaml")); !reflect.DeepEqual(obj["spec"], map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": float64(80)}}}) {
+		t.Errorf("Error exported service : %#v", obj)
+	}
+	// PV reserved for the PVC in the mapped namespace, the PVC is bound by the reservation
+	pvSpec := readYAML(filepath.Join(outDir, "cluster/persistentvolume-pv1.yaml"))["spec"].(map[string]interface{})
+	if claimRef, _ := pvSpec["claimRef"].(map[string]interface{}); claimRef == nil || claimRef["namespace"] != "app2" {
+		t.Errorf("Error exported PV : %#v", pvSpec)
+	}
+	expectedPVC := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata":   map[string]interface{}{"name": "pvc1", "namespace": "app2"},
+		"spec":       map[string]interface{}{"storageClassName": "include-nfs-storage"},
+	}
+	if obj := readYAML(filepath.Join(outDir, "namespaces/app2/persistentvolumeclaim-pvc1.yaml")); !reflect.DeepEqual(obj, expectedPVC) {
+		t.Errorf("Error exported PVC : %#v", obj)
+	}
+	report, err := ioutil.ReadFile(restoreReportFile(restore))
+	if err != nil || !strings.Contains(string(report), `{"path":"/api/v1/namespaces/app1/secrets/token","result":"Excluded","message":"token-secret"}`) ||
+		!strings.Contains(string(report), `{"path":"/api/v1/namespaces/app2/configmaps/cm1","result":"Exported"}`) {
+		t.Errorf("Error export report : %s", string(report))
+	}
+
+	// Test02 : kustomize layout without PV claimRef
+	outDir2, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatalf("Error making dir : %s", err.Error())
+	}
+	defer os.RemoveAll(outDir2)
+	restore = newConfiguredRestore("export2", "export-snap", "pref", "")
+	_, err = Export(restore, newRestorePreference("pref"), outDir2, ExportLayoutKustomize)
+	if err != nil {
+		t.Fatalf("Error in Export : %s", err.Error())
+	}
+	expectedTop := map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  []interface{}{"cluster", "namespaces/app1"},
+	}
+	if obj := readYAML(filepath.Join(outDir2, "kustomization.yaml")); !reflect.DeepEqual(obj, expectedTop) {
+		t.Errorf("Error top kustomization : %#v", obj)
+	}
+	obj := readYAML(filepath.Join(outDir2, "namespaces/app1/kustomization.yaml"))
+	if !reflect.DeepEqual(obj["resources"], []interface{}{"configmap-cm1.yaml", "deployment.apps-app1.yaml", "namespace-app1.yaml",
+		"persistentvolumeclaim-pvc1.yaml", "service-svc1.yaml"}) {
+		t.Errorf("Error namespace kustomization : %#v", obj)
+	}
+	pvSpec = readYAML(filepath.Join(outDir2, "cluster/persistentvolume-pv1.yaml"))["spec"].(map[string]interface{})
+	if _, ok := pvSpec["claimRef"]; ok {
+		t.Errorf("Error PV claimRef not stripped : %#v", pvSpec)
+	}
+
+	// Test03 : unknown layout
+	_, err = Export(restore, newRestorePreference("pref"), outDir2, "helm")
+	if err == nil {
+		t.Error("Error unknown layout not reported")
+	}
+}
+
+// Test util funcs //////////////
+
+func writeTestItem(t *testing.T, dir, restorePref, path string, item *unstructured.Unstructured) {
+	bytes, err := item.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Error marshalling item : %s", err.Error())
+	}
+	err = os.MkdirAll(filepath.Join(dir, restorePref), 0755)
+	if err != nil {
+		t.Fatalf("Error making dir : %s", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, restorePref, strings.Replace(path, "/", "|", -1)+".json"), bytes, 0644)
+	if err != nil {
+		t.Fatalf("Error writing item : %s", err.Error())
+	}
+}
+
+func TestSnapshotScope(t *testing.T) {
+	spec := &clustersnapshot.SnapshotSpec{}
+	scope, err := newSnapshotScope(spec)
+	if err != nil {
+		t.Fatalf("Error in newSnapshotScope : %s", err.Error())
+	}
+	if scope.partial() || scope.status() != nil {
+		t.Error("Snapshot without scope is partial")
+	}
+
+	spec.IncludeNamespaces = []string{"app1"}
+	spec.ExcludeResources = []string{"secrets", "deployments.apps"}
+	spec.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app1"}}
+	scope, err = newSnapshotScope(spec)
+	if err != nil {
+		t.Fatalf("Error in newSnapshotScope : %s", err.Error())
+	}
+	if !scope.partial() || scope.status().LabelSelector != "app=app1" {
+		t.Errorf("Scope not recorded : %#v", scope.status())
+	}
+
+	resources := map[string]bool{
+		"/configmaps":                   true,
+		"/secrets":                      false,
+		"apps/deployments":              false,
+		"apps/statefulsets":             true,
+		"/namespaces":                   true,
+		"/persistentvolumes":            true,
+		"storage.k8s.io/storageclasses": false,
+	}
+	for r, expected := range resources {
+		sp := strings.Split(r, "/")
+		namespaced := !strings.Contains("namespaces persistentvolumes storageclasses", sp[1])
+		resource := metav1.APIResource{Name: sp[1], Namespaced: namespaced}
+		if scope.isIncludedResource(resource, sp[0]) != expected {
+			t.Errorf("Resource %s included %t", r, !expected)
+		}
+	}
+	if opt := scope.listOptions(metav1.APIResource{Name: "namespaces"}, ""); opt.LabelSelector != "" {
+		t.Errorf("Label selector set on listing namespaces : %s", opt.LabelSelector)
+	}
+
+	labeled := unstrctrdResource("", "v1", "app1", "cm1", "ConfigMap", "configmaps")
+	labeled.SetLabels(map[string]string{"app": "app1"})
+	pv1 := convertToUnstructured(t, newPV("pv1", "nfs", "app1", "pvc1")).(*unstructured.Unstructured)
+	pv2 := convertToUnstructured(t, newPV("pv2", "nfs", "app2", "pvc1")).(*unstructured.Unstructured)
+	items := map[*unstructured.Unstructured]bool{
+		labeled: true,
+		unstrctrdResource("", "v1", "app1", "cm2", "ConfigMap", "configmaps"): false,
+		unstrctrdResource("", "v1", "", "app1", "Namespace", "namespaces"):    true,
+		unstrctrdResource("", "v1", "", "app2", "Namespace", "namespaces"):    false,
+		pv1: true,
+		pv2: false,
+	}
+	for item, expected := range items {
+		if scope.isIncludedItem(item) != expected {
+			t.Errorf("Item %s/%s/%s included %t", item.GetKind(), item.GetNamespace(), item.GetName(), !expected)
+		}
+	}
+}
+
+func TestParentSnapshotRemoved(t *testing.T) {
+	uploadedObjects["parent1.tgz"] = []byte("parent archive")
+	snapshot := newConfiguredSnapshot("child1", "InProgress")
+	snapshot.Spec.ParentSnapshot = "parent1"
+
+	// the parent downloaded for the incremental snapshot removed also when the snapshot failed
+	err := NewClusterCmd(k8sfake.NewSimpleClientset()).Snapshot(context.TODO(), snapshot, &bucketMock{})
+	if err == nil {
+		t.Error("Snapshot with an invalid kubeconfig not failed")
+	}
+	if _, err := os.Stat("/tmp/parent1.tgz"); !os.IsNotExist(err) {
+		t.Error("Parent snapshot file not removed")
+	}
+}
+
+func TestRestoreReport(t *testing.T) {
+	restore := newConfiguredRestore("report1", "snap1", "pref1", "InProgress")
+	rlog := utils.NewNamedLog("restore:report1")
+	report, err := newRestoreReport(restore)
+	if err != nil {
+		t.Fatalf("Error in newRestoreReport : %s", err.Error())
+	}
+	report.created(restore, rlog, "/api/v1/namespaces/default/secrets/secret1")
+	longMsg := strings.Repeat("x", 400)
+	for i := 0; i < restoreFailedLimit+5; i++ {
+		report.failedWithMsg(restore, rlog, fmt.Sprintf("/api/v1/namespaces/default/secrets/failed%d", i), longMsg)
+	}
+	err = report.close()
+	if err != nil {
+		t.Fatalf("Error in close : %s", err.Error())
+	}
+
+	// Counters and first failures in status
+	if restore.Status.NumCreated != 1 || restore.Status.NumFailed != int32(restoreFailedLimit+5) {
+		t.Errorf("Counters not match : created %d failed %d", restore.Status.NumCreated, restore.Status.NumFailed)
+	}
+	if len(restore.Status.Failed) != restoreFailedLimit {
+		t.Errorf("Number of failures in status %d not equals to %d", len(restore.Status.Failed), restoreFailedLimit)
+	}
+	if len(restore.Status.Created) != 0 {
+		t.Errorf("Created resources listed in status : %v", restore.Status.Created)
+	}
+
+	// All results with full messages in the report
+	items := readRestoreReport(t, restore)
+	chkResourceList(t, items[resultCreated], []string{"/api/v1/namespaces/default/secrets/secret1"})
+	if len(items[resultFailed]) != restoreFailedLimit+5 {
+		t.Errorf("Number of failures in report %d not equals to %d", len(items[resultFailed]), restoreFailedLimit+5)
+	}
+
+	// Upload next to the snapshot
+	err = uploadRestoreReport(restore, &bucketMock{})
+	if err != nil {
+		t.Fatalf("Error in uploadRestoreReport : %s", err.Error())
+	}
+	if restore.Status.Report != "snap1.restore.report1.ndjson" || !IsRestoreReportObject(restore.Status.Report) {
+		t.Errorf("Report object name not match : %s", restore.Status.Report)
+	}
+	if !strings.Contains(string(uploadedObjects[restore.Status.Report]), longMsg) {
+		t.Error("Full message not stored in the report")
+	}
+	if IsRestoreReportObject("snap1.tgz") {
+		t.Error("Snapshot file detected as a report")
+	}
+}
+
+func TestRollback(t *testing.T) {
+
+	// resource paths
+	for path, expected := range map[string]string{
+		"/api/v1/namespaces/ns1":                                                   "namespaces,,ns1",
+		"/api/v1/namespaces/ns1/configmaps/cm1":                                    "configmaps,ns1,cm1",
+		"/apis/apps/v1/namespaces/ns1/deployments/app1":                            "deployments.apps,ns1,app1",
+		"/apis/apiextensions.k8s.io/v1/customresourcedefinitions/foos.example.com": "customresourcedefinitions.apiextensions.k8s.io,,foos.example.com",
+	} {
+		gvr, ns, name, err := apiPathResource(path)
+		if err != nil {
+			t.Errorf("Error in apiPathResource : %s", err.Error())
+			continue
+		}
+		res := gvr.GroupResource().String() + "," + ns + "," + name
+		if res != expected {
+			t.Errorf("Error resource of %s : %s / Expected %s", path, res, expected)
+		}
+	}
+	for _, path := range []string{"/api/v1", "/apis/apps/v1/namespaces/ns1/deployments", "/healthz"} {
+		if _, _, _, err := apiPathResource(path); err == nil {
+			t.Errorf("Invalid path %s accepted", path)
+		}
+	}
+
+	ns := unstrctrdResource("", "v1", "", "ns1", "Namespace", "namespaces")
+	crd := unstrctrdResource("apiextensions.k8s.io", "v1", "", "foos.example.com", "CustomResourceDefinition", "customresourcedefinitions")
+	pv := unstrctrdResource("", "v1", "", "pv1", "PersistentVolume", "persistentvolumes")
+	pvc := unstrctrdResource("", "v1", "ns1", "pvc1", "PersistentVolumeClaim", "persistentvolumeclaims")
+	unbound := unstrctrdResource("", "v1", "ns1", "pvc2", "PersistentVolumeClaim", "persistentvolumeclaims")
+	cm := unstrctrdResource("", "v1", "ns1", "cm1", "ConfigMap", "configmaps")
+	app := unstrctrdResource("apps", "v1", "ns1", "app1", "Deployment", "deployments")
+	secret := unstrctrdResource("", "v1", "default", "secret1", "Secret", "secrets")
+	_ = unstructured.SetNestedField(secret.Object, "restored", "data", "key")
+	previous := secret.DeepCopy()
+	_ = unstructured.SetNestedField(previous.Object, "previous", "data", "key")
+
+	// report in the restore order
+	restore := newConfiguredRestore("rollback1", "snap1", "pref1", "Completed")
+	rlog := utils.NewNamedLog("restore:rollback1")
+	report, err := newRestoreReport(restore)
+	if err != nil {
+		t.Fatalf("Error in newRestoreReport : %s", err.Error())
+	}
+	report.created(restore, rlog, "/api/v1/namespaces/ns1")
+	report.created(restore, rlog, "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/foos.example.com")
+	report.created(restore, rlog, "/api/v1/persistentvolumes/pv1")
+	report.created(restore, rlog, "/api/v1/namespaces/ns1/persistentvolumeclaims/pvc1")
+	report.failedAfterCreated(restore, rlog, "/api/v1/namespaces/ns1/persistentvolumeclaims/pvc2", "Timeout")
+	report.created(restore, rlog, "/api/v1/namespaces/ns1/configmaps/cm1")
+	report.created(restore, rlog, "/api/v1/namespaces/ns1/configmaps/cm2")
+	report.alreadyExist(restore, rlog, "/api/v1/namespaces/ns1/configmaps/cm3")
+	report.failedWithMsg(restore, rlog, "/api/v1/namespaces/ns1/configmaps/cm4", "Forbidden")
+	report.updated(restore, rlog, "/api/v1/namespaces/default/secrets/secret1", previous)
+	report.created(restore, rlog, "/apis/apps/v1/namespaces/ns1/deployments/app1")
+	err = report.close()
+	if err != nil {
+		t.Fatalf("Error in close : %s", err.Error())
+	}
+	err = uploadRestoreReport(restore, &bucketMock{})
+	if err != nil {
+		t.Fatalf("Error in uploadRestoreReport : %s", err.Error())
+	}
+
+	items, err := loadRollbackItems(restore, &bucketMock{})
+	if err != nil {
+		t.Fatalf("Error in loadRollbackItems : %s", err.Error())
+	}
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), ns, crd, pv, pvc, unbound, cm, app, secret)
+	err = rollbackResources(context.TODO(), restore, items, dyn)
+	if err != nil {
+		t.Fatalf("Error in rollbackResources : %s", err.Error())
+	}
+
+	// deleted in reverse order, apps first and namespaces last
+	deleted := make([]string, 0)
+	for _, action := range dyn.Actions() {
+		if action.GetVerb() == "delete" {
+			deleted = append(deleted, action.GetResource().Resource+"/"+action.(core.DeleteAction).GetName())
+		}
+	}
+	expected := []string{
+		"deployments/app1",
+		"configmaps/cm2",
+		"configmaps/cm1",
+		"persistentvolumeclaims/pvc2",
+		"persistentvolumeclaims/pvc1",
+		"persistentvolumes/pv1",
+		"customresourcedefinitions/foos.example.com",
+		"namespaces/ns1",
+	}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("Error delete order\nResult : %v\nExpected : %v", deleted, expected)
+	}
+	status := restore.Status.Rollback
+	if status.NumDeleted != 7 || status.NumNotFound != 1 || status.NumReverted != 1 || status.NumFailed != 0 {
+		t.Errorf("Counters not match : deleted %d not found %d reverted %d failed %d",
+			status.NumDeleted, status.NumNotFound, status.NumReverted, status.NumFailed)
+	}
+	if status.RollbackTimestamp.IsZero() {
+		t.Error("Rollback timestamp not set")
+	}
+
+	// overwritten secret reverted
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	reverted, err := dyn.Resource(gvr).Namespace("default").Get(context.TODO(), "secret1", metav1.GetOptions{})
 	if err != nil {
-		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+		t.Fatalf("Error getting secret1 : %s", err.Error())
 	}
-	if uploadFilename != "test1.tgz" {
-		t.Error("Error upload filename not match")
+	if data, _, _ := unstructured.NestedString(reverted.Object, "data", "key"); data != "previous" {
+		t.Errorf("Error secret1 not reverted : %s", data)
 	}
-	if getObjectInfoFilename != "test1.tgz" {
-		t.Error("Error GetObjectInfo filename not match")
+
+	// deprecated lists without the report, previous versions not known
+	restore = newConfiguredRestore("rollback2", "snap1", "pref1", "Completed")
+	restore.Status.Created = []string{"/api/v1/namespaces/ns1/configmaps/cm1"}
+	restore.Status.Updated = []string{"/api/v1/namespaces/default/secrets/secret1"}
+	items, err = loadRollbackItems(restore, nil)
+	if err != nil {
+		t.Fatalf("Error in loadRollbackItems : %s", err.Error())
 	}
-	if snap.Status.StoredFileSize != objSize {
-		t.Error("Error file size not match")
+	err = rollbackResources(context.TODO(), restore, items, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), cm, secret))
+	if err != nil {
+		t.Fatalf("Error in rollbackResources : %s", err.Error())
 	}
-	metav1ObjTime := metav1.NewTime(objTime)
-	if !snap.Status.StoredTimestamp.Equal(&metav1ObjTime) {
-		t.Error("Error timestamp not match")
+	status = restore.Status.Rollback
+	if status.NumDeleted != 1 || status.NumFailed != 1 ||
+		status.Failed[0] != "/api/v1/namespaces/default/secrets/secret1,Previous version not saved" {
+		t.Errorf("Error rollback without the report : deleted %d failed %v", status.NumDeleted, status.Failed)
 	}
 
-	pref := newRestorePreference("pref1")
-	restore := newConfiguredRestore("test1", "test2", "pref1", "InProgress")
+	// report upload failed, resources created not known
+	restore = newConfiguredRestore("rollback3", "snap1", "pref1", "Completed")
+	restore.Status.NumCreated = 3
+	_, err = loadRollbackItems(restore, nil)
+	if err == nil {
+		t.Error("Rollback without the report of created resources not failed")
+	}
 
-	// TEST3 : Download snapshot tgz
-	err = downloadSnapshot(restore, bucket)
+	// nothing to roll back in dry-run
+	restore.Spec.DryRun = true
+	err = RollbackRestore(context.TODO(), restore, nil, k8sfake.NewSimpleClientset())
+	if err == nil {
+		t.Error("Dry-run restore rolled back")
+	}
+}
+
+func TestWaitForCRDsEstablished(t *testing.T) {
+	crdPollInterval = 10 * time.Millisecond
+	defer func() { crdPollInterval = 2 * time.Second }()
+
+	newCRD := func(name, group, kind string) *unstructured.Unstructured {
+		crd := unstrctrdResource("apiextensions.k8s.io", "v1", "", name, "CustomResourceDefinition", "customresourcedefinitions")
+		_ = unstructured.SetNestedField(crd.Object, group, "spec", "group")
+		_ = unstructured.SetNestedField(crd.Object, kind, "spec", "names", "kind")
+		_ = unstructured.SetNestedSlice(crd.Object, []interface{}{
+			map[string]interface{}{"name": "v1", "served": true},
+			map[string]interface{}{"name": "v1beta1", "served": false},
+		}, "spec", "versions")
+		return crd
+	}
+	foos := newCRD("foos.example.com", "example.com", "Foo")
+	bars := newCRD("bars.example.com", "example.com", "Bar")
+	established := foos.DeepCopy()
+	setCRDEstablished(established)
+
+	restore := newConfiguredRestore("crds1", "snap1", "pref1", "InProgress")
+	restore.Spec.CRDEstablishedTimeout = &metav1.Duration{Duration: 100 * time.Millisecond}
+	rlog := utils.NewNamedLog("restore:crds1")
+	report, err := newRestoreReport(restore)
 	if err != nil {
-		t.Errorf("Error in downloadSnapshot : %s", err.Error())
+		t.Fatalf("Error in newRestoreReport : %s", err.Error())
+	}
+	defer report.close()
+	p := newPreference(newRestorePreference("pref1"))
+	p.report = report
+
+	// dry-run and other resources not recorded
+	if p.recordRestoredCRD(foos, "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/foos.example.com", resultCreated, nil, true) ||
+		p.recordRestoredCRD(unstrctrdResource("", "v1", "", "ns1", "Namespace", "namespaces"), "/api/v1/namespaces/ns1", resultCreated, nil, false) {
+		t.Error("Error dry-run CRD or other resource recorded")
 	}
-	if downloadFilename != "test2.tgz" {
-		t.Error("Error download filename not match")
+	if len(p.restoredCRDs) != 0 {
+		t.Fatalf("Error CRDs recorded : %d", len(p.restoredCRDs))
+	}
+	p.recordRestoredCRD(foos, "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/foos.example.com", resultCreated, nil, false)
+	p.recordRestoredCRD(bars, "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/bars.example.com", resultCreated, nil, false)
+	if !reflect.DeepEqual(p.restoredCRDs[0].versions, []string{"v1"}) {
+		t.Errorf("Error served versions : %v", p.restoredCRDs[0].versions)
 	}
 
-	// Delete PV/PVCs and Reactor for getting PVC to test restoring
-	err = dynamicTracker.Delete(schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"}, "", "pv1")
-	if err != nil {
-		t.Errorf("Error in delete pv : %s", err.Error())
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), established, bars)
+	crds := waitForCRDsEstablished(context.TODO(), dyn, p, restore, crdEstablishedTimeout(restore), rlog)
+	if len(crds) != 1 || crds[0].name != "foos.example.com" {
+		t.Errorf("Error established CRDs : %v", crds)
 	}
-	err = dynamicTracker.Delete(schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}, "default", "pvc1")
-	if err != nil {
-		t.Errorf("Error in delete pvc : %s", err.Error())
+	if !strings.Contains(p.notEstablishedCRDs["example.com/Bar"], "CRD bars.example.com not established in 100ms") {
+		t.Errorf("Error not established CRDs : %v", p.notEstablishedCRDs)
 	}
-	waitcnt := 1
-	dynamicClient.Fake.PrependReactor("get", "persistentvolumes", func(action core.Action) (bool, runtime.Object, error) {
-		if waitcnt > 0 {
-			waitcnt--
-		} else {
-			err = dynamicTracker.Update(
-				schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"},
-				convertToUnstructured(t, newPV("pv1", "include-nfs-storage", "default", "pvc1")),
-				"",
-			)
-			if err != nil {
-				t.Errorf("Error in update pv status : %s", err.Error())
-			}
+	if restore.Status.NumFailed != 1 || !strings.HasPrefix(restore.Status.Failed[0], "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/bars.example.com,") {
+		t.Errorf("Error not established CRD not reported : %v", restore.Status.Failed)
+	}
+	// counted once, not established CRD only as failed
+	if restore.Status.NumCreated != 1 {
+		t.Errorf("Error established CRD not reported as created : %d", restore.Status.NumCreated)
+	}
+
+	// Server resources reloaded until the custom resource served
+	kubeClient := k8sfake.NewSimpleClientset()
+	discovery := kubeClient.Discovery().(*discoveryfake.FakeDiscovery)
+	discovery.Fake.Resources = setAPIResourceList(nil, "", "v1", "namespaces", "Namespace", false)
+	calls := 0
+	discovery.Fake.PrependReactor("get", "resource", func(action core.Action) (bool, runtime.Object, error) {
+		calls++
+		if calls == 3 {
+			discovery.Fake.Resources = setAPIResourceList(discovery.Fake.Resources, "example.com", "v1", "foos", "Foo", true)
 		}
 		return false, nil, nil
 	})
+	sr, err := serverResourcesWithCRDs(discovery, crds, time.Second, rlog)
+	if err != nil {
+		t.Fatalf("Error in serverResourcesWithCRDs : %s", err.Error())
+	}
+	_, err = sr.ResourceName(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Foo"})
+	if err != nil {
+		t.Errorf("Error custom resource not in server resources : %s", err.Error())
+	}
+}
 
-	// TEST4 : Restore resources
-	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
-	err = restoreResources(restore, pref, kubeClient, dynamicClient)
+func TestSnapshotIndex(t *testing.T) {
+	index, err := newSnapshotIndex("test-index")
 	if err != nil {
-		t.Errorf("Error in restoreResources : %s", err.Error())
+		t.Fatalf("Error in newSnapshotIndex : %s", err.Error())
+	}
+	defer index.close()
+
+	ns := unstrctrdResource("", "v1", "", "ns1", "Namespace", "namespaces")
+	secret := unstrctrdResource("", "v1", "ns1", "secret1", "Secret", "secrets")
+	secret.SetResourceVersion("1")
+	svc := unstrctrdResource("", "v1", "ns1", "svc1", "Service", "services")
+	for path, item := range map[string]*unstructured.Unstructured{
+		"/api/v1/namespaces/ns1":                 ns,
+		"/api/v1/namespaces/ns1/secrets/secret1": secret,
+		"/api/v1/namespaces/ns1/services/svc1":   svc,
+	} {
+		err = index.add(path, item)
+		if err != nil {
+			t.Fatalf("Error in add : %s", err.Error())
+		}
 	}
 
-	expectedNumPreferenceExcluded := 4
-	if restore.Status.NumPreferenceExcluded != int32(expectedNumPreferenceExcluded) {
-		t.Errorf("NumPreferenceExcluded not match : Result %d / Expected %d",
-			restore.Status.NumPreferenceExcluded,
-			expectedNumPreferenceExcluded,
-		)
+	// replace and delete
+	edited := secret.DeepCopy()
+	edited.SetResourceVersion("2")
+	edited.SetLabels(map[string]string{"edited": "true"})
+	err = index.add("/api/v1/namespaces/ns1/secrets/secret1", edited)
+	if err != nil {
+		t.Fatalf("Error in add : %s", err.Error())
 	}
-	expectedExcluded := []string{
-		"/api/v1/namespaces/default/persistentvolumeclaims/pvc2,(no-storageclass)",
-		"/api/v1/namespaces/default/persistentvolumeclaims/pvc3,(pv-not-found)",
-		"/api/v1/namespaces/default/persistentvolumeclaims/pvc4,(not-bounded)",
-		"/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/cluster-admin-kube-system,(not-binded-to-ns)",
-		"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-role1,(not-binded-to-ns)",
-		"/api/v1/namespaces/default/secrets/token1,(token-secret)",
-		"/api/v1/namespaces/default/endpoints/svc1,(service-exists)",
-		"/api/v1/namespaces/default/pods/pod1,(owner-ref)",
+	if e := index.get("/api/v1/namespaces/ns1/secrets/secret1"); e == nil || e.resourceVersion != "2" {
+		t.Errorf("Replaced entry not found : %#v", e)
 	}
-	chkResourceList(t, restore.Status.Excluded, expectedExcluded)
-	expectedCreated := []string{
-		"/api/v1/persistentvolumes/pv1",
-		"/api/v1/namespaces/default/persistentvolumeclaims/pvc1",
+	index.delete("/api/v1/namespaces/ns1/services/svc1")
+	if index.get("/api/v1/namespaces/ns1/services/svc1") != nil {
+		t.Error("Deleted entry found")
 	}
-	chkResourceList(t, restore.Status.Created, expectedCreated)
-	expectedAlreadyExisted := []string{
-		"/api/v1/namespaces/ns1",
-		"/apis/apiextensions.k8s.io/v1/customresourcedefinitions/crd.include.org",
-		"/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/cluster-admin-default",
-		"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-admin",
-		"/apis/storage.k8s.io/v1/storageclasses/include-nfs-storage",
-		"/api/v1/namespaces/default/secrets/secret1",
-		"/api/v1/namespaces/default/services/svc1",
+
+	stored := make(map[string]string)
+	err = index.walk(func(entry *snapshotEntry, content []byte) error {
+		if contentDigest(content) != entry.digest {
+			t.Errorf("Digest of %s not matched", entry.itempath)
+		}
+		stored[entry.itempath] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error in walk : %s", err.Error())
 	}
-	chkResourceList(t, restore.Status.AlreadyExisted, expectedAlreadyExisted)
-	expectedNumFailed := 0
-	if restore.Status.NumFailed != int32(expectedNumFailed) {
-		t.Errorf("NumFailed not match : Result %d / Expected %d",
-			restore.Status.NumFailed,
-			expectedNumFailed,
-		)
+	if len(stored) != 2 {
+		t.Errorf("Number of stored entries %d not equals to 2", len(stored))
+	}
+	if _, ok := stored["/namespaces/ns1"]; !ok {
+		t.Errorf("Namespace not stored on top level : %v", stored)
+	}
+	if !strings.Contains(stored["/api/v1/namespaces/ns1/secrets/secret1"], "edited") {
+		t.Errorf("Replaced content not stored : %v", stored)
 	}
 }
 
-const kubeconfigSrc = `apiVersion: v1
-clusters:
-- cluster:
-    server: CLUSTER_URL
-  name: kubernetes
-contexts:
-- context:
-    cluster: kubernetes
-    user: user
-  name: user@kubernetes
-current-context: user@kubernetes
-kind: Config
-preferences: {}
-users:
-- name: user
-  token: TOKEN`
-
-const responseSrc = `{
-  "kind": "Status",
-  "apiVersion": "v1",
-  "metadata": {
-
-  },
-  "status": "Failure",
-  "message": "Unauthorized",
-  "reason": "Unauthorized",
-  "code": 401
-}`
-
-func TestSnapshotConfig(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(401)
-		fmt.Fprintln(w, responseSrc)
-	}))
-
-	// Test01 Unauthorized - Permanent error
-	snap := newConfiguredSnapshot("test1", "InProgress")
-	snap.Spec.Kubeconfig = strings.Replace(kubeconfigSrc, "CLUSTER_URL", ts.URL, 1)
-	err := Snapshot(context.TODO(), snap)
-	fmt.Println(err.Error())
-	_, ok := err.(*backoff.PermanentError)
-	if !ok {
-		t.Errorf("Error type is not backoff.PermanentError but is %T", reflect.TypeOf(err))
+// rewriteTestArchive returns the archive with the content of the entry changed
+func rewriteTestArchive(t *testing.T, archive []byte, name, path string) []byte {
+	tgz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("Error reading archive : %s", err.Error())
 	}
-
-	// Test02 Connection refused - Error for retry
-	ts.Close()
-	err = Snapshot(context.TODO(), snap)
-	fmt.Println(err.Error())
-	_, ok = err.(*backoff.PermanentError)
-	if ok {
-		t.Errorf("Error type is %T", reflect.TypeOf(err))
+	tarReader := tar.NewReader(tgz)
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive : %s", err.Error())
+		}
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			t.Fatalf("Error reading archive : %s", err.Error())
+		}
+		if header.Name == filepath.Join(name, path) {
+			content = append(content, ' ')
+			header.Size = int64(len(content))
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+		if _, err := tarWriter.Write(content); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
 	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return buf.Bytes()
 }
 
-const objectstoreResponseSrc = `<?xml version="1.0" encoding="UTF-8"?>
-<Error>
-  <Code>InvalidAccessKeyId</Code>
-  <RequestId>tx00000000000000381f085-00603d964f-27854fae-default</RequestId>
-  <HostId>27854fae-default-default</HostId>
-</Error>`
-
-func TestObjectstoreConfig(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(403)
-		fmt.Fprintln(w, objectstoreResponseSrc)
-	}))
-
-	// Test01 InvalidAccessKey - Permanent error
-	snap := newConfiguredSnapshot("test1", "InProgress")
-	url, _ := url.Parse(ts.URL)
-	endpoint := url.Scheme + "://" + url.Hostname() + ".nip.io:" + url.Port()
-	bucket := objectstore.NewBucket("test1", "ACCESSKEY", "SECRETKEY", endpoint, "jp-east-2", "test1", false)
-	err := UploadSnapshot(snap, bucket)
-	fmt.Println(err.Error())
-	_, ok := err.(*backoff.PermanentError)
-	if !ok {
-		t.Errorf("Error type is not backoff.PermanentError but is %T", reflect.TypeOf(err))
+func readSnapshotJSON(t *testing.T, name string) string {
+	snapshotFile, err := os.Open("/tmp/" + name + ".tgz")
+	if err != nil {
+		t.Fatalf("Error opening snapshot file : %s", err.Error())
 	}
-
-	// Test02 Connection refused - Error for retry
-	ts.Close()
-	err = UploadSnapshot(snap, bucket)
-	fmt.Println(err.Error())
-	_, ok = err.(*backoff.PermanentError)
-	if ok {
-		t.Errorf("Error type is %T", reflect.TypeOf(err))
+	defer snapshotFile.Close()
+	tgz, err := gzip.NewReader(snapshotFile)
+	if err != nil {
+		t.Fatalf("Error reading snapshot file : %s", err.Error())
 	}
+	defer tgz.Close()
+	tarReader := tar.NewReader(tgz)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			break
+		}
+		if header.Name == name+"/snapshot.json" {
+			bytes, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				t.Fatalf("Error reading snapshot.json : %s", err.Error())
+			}
+			return string(bytes)
+		}
+	}
+	t.Fatalf("snapshot.json not found in %s.tgz", name)
+	return ""
 }
 
-// Test util funcs //////////////
+// readRestoreReport returns paths in the restore report by results, excluded ones with the message
+func readRestoreReport(t *testing.T, restore *clustersnapshot.Restore) map[string][]string {
+	reportFile, err := os.Open(restoreReportFile(restore))
+	if err != nil {
+		t.Fatalf("Error opening restore report : %s", err.Error())
+	}
+	defer reportFile.Close()
+	report := make(map[string][]string)
+	dec := json.NewDecoder(reportFile)
+	for dec.More() {
+		var item restoreReportItem
+		err = dec.Decode(&item)
+		if err != nil {
+			t.Fatalf("Error decoding restore report : %s", err.Error())
+		}
+		path := item.Path
+		if item.Result == resultExcluded {
+			path += ",(" + item.Message + ")"
+		}
+		report[item.Result] = append(report[item.Result], path)
+	}
+	return report
+}
 
 func chkResourceList(t *testing.T, res, ref []string) {
 	notMatch := false
@@ -400,17 +2219,31 @@ type bucketMock struct {
 }
 
 var uploadFilename string
+var uploadedObjects = make(map[string][]byte)
 
 func (b bucketMock) Upload(file *os.File, filename string) error {
 	uploadFilename = filename
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	uploadedObjects[filename] = content
 	return nil
 }
 
-var downloadFilename string
+func (b bucketMock) UploadWithContext(ctx context.Context, file *os.File, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.Upload(file, filename)
+}
+
+var downloadFilenames []string
 
 func (b bucketMock) Download(file *os.File, filename string) error {
-	downloadFilename = filename
-	return nil
+	downloadFilenames = append(downloadFilenames, filename)
+	_, err := file.Write(uploadedObjects[filename])
+	return err
 }
 
 var objectInfo *objectstore.ObjectInfo
@@ -435,6 +2268,7 @@ func newDynamicClient(scheme *runtime.Scheme, rv uint64, objects ...runtime.Obje
 	codecs := serializer.NewCodecFactory(scheme)
 	dynamicTracker = NewObjectTracker(scheme, codecs.UniversalDecoder(), rv)
 	for _, obj := range objects {
+		setCRDEstablished(obj)
 		if err := dynamicTracker.Add(obj); err != nil {
 			panic(err)
 		}
@@ -444,6 +2278,12 @@ func newDynamicClient(scheme *runtime.Scheme, rv uint64, objects ...runtime.Obje
 
 	// Change the tracker with versioned
 	cs.ReactionChain = nil
+	cs.AddReactor("*", "customresourcedefinitions", func(action core.Action) (bool, runtime.Object, error) {
+		if a, ok := action.(core.CreateAction); ok {
+			setCRDEstablished(a.GetObject())
+		}
+		return false, nil, nil
+	})
 	cs.AddReactor("*", "*", core.ObjectReaction(dynamicTracker))
 	cs.WatchReactionChain = nil
 	cs.AddWatchReactor("*", func(action core.Action) (handled bool, ret watch.Interface, err error) {
@@ -459,6 +2299,17 @@ func newDynamicClient(scheme *runtime.Scheme, rv uint64, objects ...runtime.Obje
 	return cs
 }
 
+// setCRDEstablished sets the Established condition as the API server does for CRDs
+func setCRDEstablished(obj runtime.Object) {
+	crd, ok := obj.(*unstructured.Unstructured)
+	if !ok || crd.GetKind() != "CustomResourceDefinition" {
+		return
+	}
+	_ = unstructured.SetNestedSlice(crd.Object, []interface{}{
+		map[string]interface{}{"type": "Established", "status": "True"},
+	}, "status", "conditions")
+}
+
 func convertToUnstructured(t *testing.T, obj runtime.Object) runtime.Object {
 	maped, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 	if err != nil {
@@ -629,3 +2480,106 @@ func newPVC(ns, name, class, pvname string) *corev1.PersistentVolumeClaim {
 		},
 	}
 }
+
+func newPod(ns, name, app string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			Labels:    map[string]string{"app": app},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "main"}, {Name: "sidecar"}},
+		},
+		Status: corev1.PodStatus{
+			Phase: phase,
+		},
+	}
+}
+
+type fakeExecutor struct {
+	mu       sync.Mutex
+	outputs  map[string]string
+	errors   map[string]error
+	delays   map[string]time.Duration
+	commands map[string][]string
+	calls    *[]string
+}
+
+func (e *fakeExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	key := namespace + "/" + pod
+	e.mu.Lock()
+	if e.commands == nil {
+		e.commands = make(map[string][]string)
+	}
+	e.commands[key] = command
+	if e.calls != nil {
+		*e.calls = append(*e.calls, "exec "+strings.Join(command, " "))
+	}
+	delay := e.delays[key]
+	e.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		}
+	}
+	return e.outputs[key], "", e.errors[key]
+}
+
+func writeTestSnapshot(t *testing.T, snapshot *clustersnapshot.Snapshot, items map[string]*unstructured.Unstructured) {
+	file, err := os.Create("/tmp/" + snapshot.ObjectMeta.Name + ".tgz")
+	if err != nil {
+		t.Fatalf("Error creating archive : %s", err.Error())
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	write := func(path string, content []byte) {
+		hdr := &tar.Header{
+			Name:     filepath.Join(snapshot.ObjectMeta.Name, path),
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+			Mode:     0755,
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+		if _, err := tarWriter.Write(content); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+	}
+	for path, item := range items {
+		content, err := item.MarshalJSON()
+		if err != nil {
+			t.Fatalf("Error marshalling item : %s", err.Error())
+		}
+		write(path+".json", content)
+	}
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("Error marshalling snapshot : %s", err.Error())
+	}
+	write(snapshotResourceFile, content)
+	tarWriter.Close()
+	gzipWriter.Close()
+}
+
+func readDiffReport(t *testing.T, diff *clustersnapshot.SnapshotDiff) []diffReportItem {
+	content, err := ioutil.ReadFile(diffReportFile(diff))
+	if err != nil {
+		t.Fatalf("Error reading diff report : %s", err.Error())
+	}
+	items := make([]diffReportItem, 0)
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for dec.More() {
+		item := diffReportItem{}
+		if err := dec.Decode(&item); err != nil {
+			t.Fatalf("Error decoding diff report : %s", err.Error())
+		}
+		items = append(items, item)
+	}
+	return items
+}
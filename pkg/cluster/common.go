@@ -3,11 +3,14 @@ package cluster
 import (
 	"context"
 	"fmt"
+	"os"
 
+	"github.com/cenkalti/backoff"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
@@ -16,37 +19,108 @@ import (
 
 // Cluster interfaces for taking and restoring snapshot of k8s clusters
 type Cluster interface {
-	Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error
-	UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error
-	Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error
+	Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error
+	UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error
+	Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error
+	Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error
+	VerifySnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error
+	Diff(diff *cbv1alpha1.SnapshotDiff, bucket, targetBucket objectstore.Objectstore) error
+	DeleteVolumeSnapshots(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error
 }
 
 // Cmd for execute cluster commands
 type Cmd struct {
+	kubeClient kubernetes.Interface
 }
 
-// NewClusterCmd returns new Cmd
-func NewClusterCmd() *Cmd {
-	return &Cmd{}
+// NewClusterCmd returns new Cmd, kubeClient is used for reading kubeconfig secrets
+func NewClusterCmd(kubeClient kubernetes.Interface) *Cmd {
+	return &Cmd{
+		kubeClient: kubeClient,
+	}
 }
 
-// Snapshot take a snapshot
-func (c *Cmd) Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
-	return Snapshot(ctx, snapshot)
+// Snapshot take a snapshot, the parent snapshot is downloaded from the bucket for incremental snapshot
+// and removed when finished
+func (c *Cmd) Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	if snapshot.Spec.ParentSnapshot != "" {
+		defer os.Remove("/tmp/" + snapshot.Spec.ParentSnapshot + ".tgz")
+		err := downloadObject(snapshot.Spec.ParentSnapshot, bucket)
+		if err != nil {
+			return fmt.Errorf("Downloading parent snapshot %s failed : %s", snapshot.Spec.ParentSnapshot, err.Error())
+		}
+	}
+	return Snapshot(ctx, snapshot, c.kubeClient)
 }
 
 // UploadSnapshot uploads the snapshot data to the object store bucket
-func (c *Cmd) UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
-	return UploadSnapshot(snapshot, bucket)
+func (c *Cmd) UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	return UploadSnapshot(ctx, snapshot, bucket)
 }
 
 // Restore restores snapshot data on a cluster
-func (c *Cmd) Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error {
-	return Restore(restore, pref, bucket)
+func (c *Cmd) Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error {
+	return Restore(ctx, restore, pref, bucket, c.kubeClient)
 }
 
-// Setup Kubernetes client for target cluster.
-func buildKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
+// cancelled returns a permanent error not to be retried when the context is cancelled
+func cancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return backoff.Permanent(fmt.Errorf("Cancelled : %s", err.Error()))
+	}
+	return nil
+}
+
+// Rollback deletes resources created by the restore and reverts overwritten ones
+func (c *Cmd) Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+	return RollbackRestore(ctx, restore, bucket, c.kubeClient)
+}
+
+// VerifySnapshot verifies the snapshot data in the object store bucket
+func (c *Cmd) VerifySnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	return VerifySnapshot(snapshot, bucket)
+}
+
+// Diff compares the snapshot with the target snapshot or the live cluster
+func (c *Cmd) Diff(diff *cbv1alpha1.SnapshotDiff, bucket, targetBucket objectstore.Objectstore) error {
+	return Diff(diff, bucket, targetBucket, c.kubeClient)
+}
+
+// DeleteVolumeSnapshots deletes VolumeSnapshots taken by the snapshot
+func (c *Cmd) DeleteVolumeSnapshots(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
+	return DeleteVolumeSnapshots(ctx, snapshot, c.kubeClient)
+}
+
+// Get kubeconfig given inline or from the secret referenced in the namespace.
+func getKubeconfig(ctx context.Context, localClient kubernetes.Interface, namespace, kubeconfig string, ref *cbv1alpha1.KubeconfigSecretRef) (string, error) {
+	if ref == nil {
+		return kubeconfig, nil
+	}
+	if localClient == nil {
+		return "", fmt.Errorf("Cannot read kubeconfig secret %s : no client given", ref.Name)
+	}
+	key := ref.Key
+	if key == "" {
+		key = "kubeconfig"
+	}
+	secret, err := localClient.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("Cannot read kubeconfig secret %s : %s", ref.Name, err.Error())
+	}
+	data, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("Cannot read kubeconfig secret %s : key %s not found", ref.Name, key)
+	}
+	return string(data), nil
+}
+
+// Setup REST config for target cluster.
+func buildRESTConfig(ctx context.Context, localClient kubernetes.Interface, namespace, kubeconfig string, ref *cbv1alpha1.KubeconfigSecretRef) (*rest.Config, error) {
+	kubeconfig, err := getKubeconfig(ctx, localClient, namespace, kubeconfig, ref)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if Kubeconfig available.
 	if kubeconfig == "" {
 		return nil, fmt.Errorf("Cannot create Kubeconfig : Kubeconfig not given")
@@ -57,6 +131,15 @@ func buildKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error building kubeconfig: %s", err.Error())
 	}
+	return cfg, nil
+}
+
+// Setup Kubernetes client for target cluster.
+func buildKubeClient(ctx context.Context, localClient kubernetes.Interface, namespace, kubeconfig string, ref *cbv1alpha1.KubeconfigSecretRef) (*kubernetes.Clientset, error) {
+	cfg, err := buildRESTConfig(ctx, localClient, namespace, kubeconfig, ref)
+	if err != nil {
+		return nil, err
+	}
 	kubeClient, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("Error building kubernetes clientset: %s", err.Error())
@@ -65,16 +148,10 @@ func buildKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
 }
 
 // Setup Kubernetes dynamic client for target cluster.
-func buildDynamicClient(kubeconfig string) (dynamic.Interface, error) {
-	// Check if Kubeconfig available.
-	if kubeconfig == "" {
-		return nil, fmt.Errorf("Cannot create Kubeconfig : Kubeconfig not given")
-	}
-
-	// Setup Rancher Kubeconfig to access customer cluster.
-	cfg, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfig))
+func buildDynamicClient(ctx context.Context, localClient kubernetes.Interface, namespace, kubeconfig string, ref *cbv1alpha1.KubeconfigSecretRef) (dynamic.Interface, error) {
+	cfg, err := buildRESTConfig(ctx, localClient, namespace, kubeconfig, ref)
 	if err != nil {
-		return nil, fmt.Errorf("Error building kubeconfig: %s", err.Error())
+		return nil, err
 	}
 	dynamicClient, err := dynamic.NewForConfig(cfg)
 	if err != nil {
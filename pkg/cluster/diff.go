@@ -0,0 +1,427 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Results of comparing resources
+const (
+	diffAdded   = "Added"
+	diffRemoved = "Removed"
+	diffChanged = "Changed"
+)
+
+// Number of resource paths listed for each of added, removed and changed in the diff status
+const diffStatusLimit = 20
+
+// Server managed metadata ignored on comparing resources
+var diffIgnoredMetadata = []string{"resourceVersion", "uid", "managedFields", "creationTimestamp", "generation", "selfLink"}
+
+// diffField is a difference of a field, the field is a JSON pointer in the resource
+type diffField struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// diffReportItem is a line of the diff report
+type diffReportItem struct {
+	Path   string      `json:"path"`
+	Result string      `json:"result"`
+	Fields []diffField `json:"fields,omitempty"`
+}
+
+// diffReportFile returns the local report file path
+func diffReportFile(diff *cbv1alpha1.SnapshotDiff) string {
+	return "/tmp/" + diff.ObjectMeta.Name + "-diff.ndjson"
+}
+
+// DiffReportObjectName returns the report object name stored next to the snapshot
+func DiffReportObjectName(diff *cbv1alpha1.SnapshotDiff) string {
+	return diff.Spec.SnapshotName + ".diff." + diff.ObjectMeta.Name + ".ndjson"
+}
+
+// IsDiffReportObject checks the object is a snapshot diff report
+func IsDiffReportObject(name string) bool {
+	return strings.HasSuffix(name, ".ndjson") && strings.Contains(name, ".diff.")
+}
+
+// Diff compares the snapshot with the target snapshot downloaded from targetBucket, or with the live
+// cluster of the diff kubeconfig. Counters are set in the status and every difference in the report object.
+func Diff(diff *cbv1alpha1.SnapshotDiff, bucket, targetBucket objectstore.Objectstore, localClient kubernetes.Interface) error {
+	// Diff log
+	dlog := utils.NewNamedLog("diff:" + diff.ObjectMeta.Name)
+
+	err := downloadSnapshotChain(diff.Spec.SnapshotName, bucket, dlog)
+	if err != nil {
+		return err
+	}
+
+	var kubeClient kubernetes.Interface
+	var dynamicClient dynamic.Interface
+	if diff.Spec.TargetSnapshotName != "" {
+		err = downloadSnapshotChain(diff.Spec.TargetSnapshotName, targetBucket, dlog)
+		if err != nil {
+			return err
+		}
+	} else {
+		// context for building clients
+		ctx := context.TODO()
+
+		// kubeClient for external cluster.
+		kubeClient, err = buildKubeClient(ctx, localClient, diff.ObjectMeta.Namespace, diff.Spec.Kubeconfig, diff.Spec.KubeconfigSecretRef)
+		if err != nil {
+			return err
+		}
+
+		// DynamicClient for external cluster.
+		dynamicClient, err = buildDynamicClient(ctx, localClient, diff.ObjectMeta.Namespace, diff.Spec.Kubeconfig, diff.Spec.KubeconfigSecretRef)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = diffResources(diff, kubeClient, dynamicClient)
+	if err != nil {
+		os.Remove(diffReportFile(diff))
+		return err
+	}
+	return uploadDiffReport(diff, bucket)
+}
+
+// diffResources compares resources of the snapshot with the target snapshot or the live cluster
+func diffResources(diff *cbv1alpha1.SnapshotDiff, kubeClient kubernetes.Interface, dynamicClient dynamic.Interface) error {
+
+	// context for diff
+	ctx := context.TODO()
+
+	// Diff log
+	dlog := utils.NewNamedLog("diff:" + diff.ObjectMeta.Name)
+
+	from, err := loadSnapshotObjects(diff.Spec.SnapshotName)
+	if err != nil {
+		return fmt.Errorf("Loading snapshot %s failed : %s", diff.Spec.SnapshotName, err.Error())
+	}
+
+	var to map[string]*unstructured.Unstructured
+	if diff.Spec.TargetSnapshotName != "" {
+		dlog.Infof("Comparing snapshot %s with snapshot %s", diff.Spec.SnapshotName, diff.Spec.TargetSnapshotName)
+		to, err = loadSnapshotObjects(diff.Spec.TargetSnapshotName)
+		if err != nil {
+			return fmt.Errorf("Loading snapshot %s failed : %s", diff.Spec.TargetSnapshotName, err.Error())
+		}
+	} else {
+		if kubeClient == nil || dynamicClient == nil {
+			return fmt.Errorf("Neither target snapshot nor kubeconfig given")
+		}
+		dlog.Infof("Comparing snapshot %s with the live cluster", diff.Spec.SnapshotName)
+		snapshot, err := readSnapshotResource(diff.Spec.SnapshotName)
+		if err != nil {
+			return err
+		}
+		to, err = listLiveObjects(ctx, &snapshot.Spec, kubeClient, dynamicClient, dlog)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Initialize diff status
+	diff.Status.NumAdded = 0
+	diff.Status.NumRemoved = 0
+	diff.Status.NumChanged = 0
+	diff.Status.NumUnchanged = 0
+	diff.Status.Added = nil
+	diff.Status.Removed = nil
+	diff.Status.Changed = nil
+	diff.Status.Report = ""
+
+	// Report of all differences
+	reportFile, err := os.Create(diffReportFile(diff))
+	if err != nil {
+		return fmt.Errorf("Creating diff report file failed : %s", err.Error())
+	}
+	defer reportFile.Close()
+	writer := bufio.NewWriter(reportFile)
+	enc := json.NewEncoder(writer)
+
+	paths := make([]string, 0, len(from)+len(to))
+	for path := range from {
+		paths = append(paths, path)
+	}
+	for path := range to {
+		if _, ok := from[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		fromItem, inFrom := from[path]
+		toItem, inTo := to[path]
+		item := &diffReportItem{Path: path}
+		switch {
+		case !inFrom:
+			item.Result = diffAdded
+			diff.Status.NumAdded++
+			diff.Status.Added = appendLimited(diff.Status.Added, path)
+		case !inTo:
+			item.Result = diffRemoved
+			diff.Status.NumRemoved++
+			diff.Status.Removed = appendLimited(diff.Status.Removed, path)
+		default:
+			item.Fields = compareFields(fromItem.Object, toItem.Object, "", nil)
+			if len(item.Fields) == 0 {
+				diff.Status.NumUnchanged++
+				continue
+			}
+			item.Result = diffChanged
+			diff.Status.NumChanged++
+			diff.Status.Changed = appendLimited(diff.Status.Changed, path)
+		}
+		dlog.Infof("-- [%s] %s", item.Result, path)
+		err = enc.Encode(item)
+		if err != nil {
+			return fmt.Errorf("Writing diff report failed : %s", err.Error())
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("Writing diff report failed : %s", err.Error())
+	}
+
+	diff.Status.DiffTimestamp = metav1.NewTime(time.Now())
+	dlog.Infof("Diff added:%d removed:%d changed:%d unchanged:%d",
+		diff.Status.NumAdded, diff.Status.NumRemoved, diff.Status.NumChanged, diff.Status.NumUnchanged)
+	return nil
+}
+
+// appendLimited appends the path to the list in the status up to diffStatusLimit
+func appendLimited(list []string, path string) []string {
+	if len(list) >= diffStatusLimit {
+		return list
+	}
+	return append(list, path)
+}
+
+// uploadDiffReport uploads the report file next to the snapshot and links it from the diff status
+func uploadDiffReport(diff *cbv1alpha1.SnapshotDiff, bucket objectstore.Objectstore) error {
+	reportFile, err := os.Open(diffReportFile(diff))
+	if err != nil {
+		return err
+	}
+	defer reportFile.Close()
+	defer os.Remove(reportFile.Name())
+
+	objectName := DiffReportObjectName(diff)
+	err = bucket.Upload(reportFile, objectName)
+	if err != nil {
+		return fmt.Errorf("Uploading diff report %s failed : %s", objectName, err.Error())
+	}
+	diff.Status.Report = objectName
+	return nil
+}
+
+// downloadSnapshotChain downloads the snapshot and parents for incremental snapshot
+func downloadSnapshotChain(name string, bucket objectstore.Objectstore, log *utils.NamedLog) error {
+	downloaded := make(map[string]bool)
+	for name != "" && !downloaded[name] {
+		log.Infof("Downloading file %s", name+".tgz")
+		err := downloadObject(name, bucket)
+		if err != nil {
+			return err
+		}
+		downloaded[name] = true
+		snapshot, err := readSnapshotResource(name)
+		if err != nil {
+			return err
+		}
+		name = snapshot.Spec.ParentSnapshot
+	}
+	return nil
+}
+
+// loadSnapshotObjects loads resources in /tmp/[name].tgz and parents keyed by resource path
+func loadSnapshotObjects(name string) (map[string]*unstructured.Unstructured, error) {
+	chain, err := snapshotChain(name)
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]*unstructured.Unstructured)
+
+	// Load from the newest, skip resources found in newer snapshots or deleted
+	found := make(map[string]bool)
+	for _, snapshot := range chain {
+		err = walkSnapshotFile(snapshot.ObjectMeta.Name, func(path string, tarReader *tar.Reader) error {
+			if isSnapshotMetaFile(path) || found[path] {
+				return nil
+			}
+			found[path] = true
+			bytes, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return err
+			}
+			item := &unstructured.Unstructured{}
+			err = item.UnmarshalJSON(bytes)
+			if err != nil {
+				return fmt.Errorf("Unmarshalling %s failed : %s", path, err.Error())
+			}
+			objects[diffPath(strings.TrimSuffix(path, ".json"), item)] = cleanForDiff(item)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range snapshot.Status.Deleted {
+			found[path+".json"] = true
+		}
+	}
+	return objects, nil
+}
+
+// diffPath converts the path in the snapshot to the resource path of ServerResources.ResourcePath,
+// namespaces and CRDs are stored on top level in snapshots
+func diffPath(path string, item *unstructured.Unstructured) string {
+	switch {
+	case strings.HasPrefix(path, "/namespaces/") && strings.Count(path, "/") == 2:
+		return "/api/v1/namespaces/" + item.GetName()
+	case strings.HasPrefix(path, "/crds/"):
+		return "/apis/" + item.GetAPIVersion() + "/customresourcedefinitions/" + item.GetName()
+	}
+	return path
+}
+
+// listLiveObjects lists resources in the scope of the snapshot on the cluster keyed by resource path
+func listLiveObjects(ctx context.Context, spec *cbv1alpha1.SnapshotSpec,
+	kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, dlog *utils.NamedLog) (map[string]*unstructured.Unstructured, error) {
+
+	scope, err := newSnapshotScope(spec)
+	if err != nil {
+		return nil, err
+	}
+	spr, err := kubeClient.Discovery().ServerResources()
+	if err != nil {
+		return nil, fmt.Errorf("Get server preferred resources failed : %s", err.Error())
+	}
+	sr := newServerResources(spr)
+
+	objects := make(map[string]*unstructured.Unstructured)
+	for _, resourceGroup := range sr.GetResources() {
+		gv, err := schema.ParseGroupVersion(resourceGroup.GroupVersion)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse GroupVersion %s : %s", resourceGroup.GroupVersion, err.Error())
+		}
+		for _, resource := range resourceGroup.APIResources {
+
+			// resources excluded on snapshot
+			if resource.Name == "nodes" || resource.Name == "events" {
+				continue
+			}
+			if !scope.isIncludedResource(resource, gv.Group) {
+				continue
+			}
+
+			gvr := gv.WithResource(resource.Name)
+			for _, namespace := range scope.listNamespaces(resource) {
+				listOptions := scope.listOptions(resource, gv.Group)
+				listOptions.Limit = snapshotListPageSize
+				for {
+					unstructuredList, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, listOptions)
+					if err != nil {
+						return nil, fmt.Errorf("Get resource %s list failed : %s", resource.Name, err.Error())
+					}
+					for i := range unstructuredList.Items {
+						item := &unstructuredList.Items[i]
+						if !scope.isIncludedItem(item) {
+							continue
+						}
+						resourcePath, err := sr.ResourcePath(item)
+						if err != nil {
+							klog.Warningf("Cannot get resource path of %s/%s : %s", item.GetKind(), item.GetName(), err.Error())
+							continue
+						}
+						objects[resourcePath] = cleanForDiff(item)
+					}
+					listOptions.Continue = unstructuredList.GetContinue()
+					if listOptions.Continue == "" {
+						break
+					}
+				}
+			}
+		}
+	}
+	dlog.Infof("Listed %d resources on the cluster", len(objects))
+	return objects, nil
+}
+
+// cleanForDiff removes status and server managed metadata from the resource
+func cleanForDiff(item *unstructured.Unstructured) *unstructured.Unstructured {
+	item = item.DeepCopy()
+	unstructured.RemoveNestedField(item.Object, "status")
+	for _, field := range diffIgnoredMetadata {
+		unstructured.RemoveNestedField(item.Object, "metadata", field)
+	}
+	return item
+}
+
+// compareFields appends differences of JSON values to fields, the field is a JSON pointer
+func compareFields(from, to interface{}, field string, fields []diffField) []diffField {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		keys := make([]string, 0, len(fromMap)+len(toMap))
+		for key := range fromMap {
+			keys = append(keys, key)
+		}
+		for key := range toMap {
+			if _, ok := fromMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fields = compareFields(fromMap[key], toMap[key], field+"/"+escapePointer(key), fields)
+		}
+		return fields
+	}
+
+	fromSlice, fromIsSlice := from.([]interface{})
+	toSlice, toIsSlice := to.([]interface{})
+	if fromIsSlice && toIsSlice && len(fromSlice) == len(toSlice) {
+		for i := range fromSlice {
+			fields = compareFields(fromSlice[i], toSlice[i], field+"/"+strconv.Itoa(i), fields)
+		}
+		return fields
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		fields = append(fields, diffField{Field: field, From: from, To: to})
+	}
+	return fields
+}
+
+// escapePointer escapes a key for a JSON pointer
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,305 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Export layouts
+const (
+	// ExportLayoutFiles writes a YAML file per resource, in a dir per namespace
+	ExportLayoutFiles = "files"
+	// ExportLayoutKustomize adds kustomization.yaml to the top dir and dirs of ExportLayoutFiles
+	ExportLayoutKustomize = "kustomize"
+)
+
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// exportWriter writes resources into cluster/ and namespaces/[namespace]/ in the output dir
+type exportWriter struct {
+	dir   string
+	files map[string][]string
+}
+
+func newExportWriter(dir string) *exportWriter {
+	return &exportWriter{
+		dir:   dir,
+		files: make(map[string][]string),
+	}
+}
+
+// exportFileName returns [kind](.[group])-[name].yaml
+func exportFileName(item *unstructured.Unstructured) string {
+	name := strings.ToLower(item.GetKind())
+	if group := item.GroupVersionKind().Group; group != "" {
+		name += "." + group
+	}
+	return name + "-" + item.GetName() + ".yaml"
+}
+
+// write the cleaned resource as a YAML file
+func (w *exportWriter) write(item *unstructured.Unstructured) error {
+	sub := "cluster"
+	if item.GetKind() == "Namespace" {
+		sub = filepath.Join("namespaces", item.GetName())
+	} else if item.GetNamespace() != "" {
+		sub = filepath.Join("namespaces", item.GetNamespace())
+	}
+	err := os.MkdirAll(filepath.Join(w.dir, sub), 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := yaml.Marshal(cleanForExport(item).Object)
+	if err != nil {
+		return fmt.Errorf("Marshalling %s failed : %s", item.GetName(), err.Error())
+	}
+	name := exportFileName(item)
+	err = ioutil.WriteFile(filepath.Join(w.dir, sub, name), bytes, 0644)
+	if err != nil {
+		return err
+	}
+	w.files[sub] = append(w.files[sub], name)
+	return nil
+}
+
+// writeKustomizations writes kustomization.yaml listing files in each dir and dirs in the top dir
+func (w *exportWriter) writeKustomizations() error {
+	subs := make([]string, 0, len(w.files))
+	for sub, files := range w.files {
+		sort.Strings(files)
+		err := writeKustomization(filepath.Join(w.dir, sub), files)
+		if err != nil {
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+	return writeKustomization(w.dir, subs)
+}
+
+func writeKustomization(dir string, resources []string) error {
+	bytes, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  resources,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), bytes, 0644)
+}
+
+// cleanForExport removes status, server managed fields and allocated cluster IPs to make the resource applyable
+func cleanForExport(item *unstructured.Unstructured) *unstructured.Unstructured {
+	item = cleanForDiff(item)
+	annotations := item.GetAnnotations()
+	delete(annotations, lastAppliedAnnotation)
+	if len(annotations) == 0 {
+		// also annotations emptied on preparing PVCs
+		unstructured.RemoveNestedField(item.Object, "metadata", "annotations")
+	} else {
+		item.SetAnnotations(annotations)
+	}
+	spec := getUnstructuredMap(item.Object, "spec")
+	for key, value := range spec {
+		// fields cleared on preparing PVs/PVCs
+		if value == nil {
+			delete(spec, key)
+		}
+	}
+	if item.GetKind() == "Service" && spec != nil && getUnstructuredString(spec, "clusterIP") != "None" {
+		delete(spec, "clusterIP")
+		delete(spec, "clusterIPs")
+	}
+	return item
+}
+
+// serverResourcesFromDir returns ServerResources with resource names taken from paths of extracted files,
+// used to get resource paths without the cluster
+func serverResourcesFromDir(dir string) (*ServerResources, error) {
+	sr := newServerResources(nil)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		var item unstructured.Unstructured
+		err = loadItem(&item, path)
+		if err != nil {
+			return err
+		}
+		switch item.GetKind() {
+		case "Namespace":
+			sr.resourceNames[item.GroupVersionKind()] = "namespaces"
+		case "CustomResourceDefinition":
+			sr.resourceNames[item.GroupVersionKind()] = "customresourcedefinitions"
+		default:
+			sp := strings.Split(strings.TrimSuffix(info.Name(), ".json"), "|")
+			if len(sp) < 2 {
+				return fmt.Errorf("Invalid resource file name %s", info.Name())
+			}
+			sr.resourceNames[item.GroupVersionKind()] = sp[len(sp)-2]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// exportDir writes resources in the dir according to preferences
+func exportDir(dir, restorePref string, w *exportWriter, p *preference,
+	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog) error {
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, restorePref))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+
+		// Load item
+		var item unstructured.Unstructured
+		err := loadItem(&item, filepath.Join(dir, restorePref, f.Name()))
+		if err != nil {
+			return err
+		}
+		resourcePath, err := sr.ResourcePath(&item)
+		if err != nil {
+			return err
+		}
+
+		rlog.Infof("---- %s", resourcePath)
+
+		resourcePath, ok, err := p.prepareItem(&item, resourcePath, restore, sr, rlog)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = w.write(&item)
+		if err != nil {
+			return err
+		}
+		p.report.exported(restore, rlog, resourcePath)
+	}
+	return nil
+}
+
+// exportPV writes PV/PVC pairs prepared as restored
+func exportPV(dir string, w *exportWriter, p *preference,
+	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog) error {
+
+	pairs, err := loadPVPairs(dir, p, restore, sr, rlog)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if pair.pvPath != "" {
+			rlog.Infof("---- %s", pair.pvPath)
+			err = w.write(&pair.pvItem)
+			if err != nil {
+				return err
+			}
+			p.report.exported(restore, rlog, pair.pvPath)
+		}
+		rlog.Infof("---- %s", pair.pvcPath)
+		err = w.write(&pair.pvcItem)
+		if err != nil {
+			return err
+		}
+		p.report.exported(restore, rlog, pair.pvcPath)
+	}
+	return nil
+}
+
+// Export writes resources in the snapshot loaded in /tmp as applyable YAML manifests into outDir.
+// Resources are selected and sanitized with the preference and namespace mappings of the restore
+// as restored. Returns the number of exported resources, results are in the local file RestoreReportFile
+func Export(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, outDir, layout string) (int, error) {
+	if layout != ExportLayoutFiles && layout != ExportLayoutKustomize {
+		return 0, fmt.Errorf("Export layout %s not supported", layout)
+	}
+
+	// Export log
+	rlog := utils.NewNamedLog("export:" + restore.ObjectMeta.Name)
+
+	p := newPreference(pref)
+	initRestoreStatus(restore)
+
+	// Report of all resources
+	var err error
+	p.report, err = newRestoreReport(restore)
+	if err != nil {
+		return 0, err
+	}
+	defer p.report.close()
+
+	// Resolve incremental snapshots back to the base snapshot
+	chain, err := snapshotChain(restore.Spec.SnapshotName)
+	if err != nil {
+		return p.report.numExported, err
+	}
+	dir, err := extractSnapshotChain(chain, p, restore, rlog)
+	if err != nil {
+		return p.report.numExported, err
+	}
+	defer os.RemoveAll(dir)
+
+	sr, err := serverResourcesFromDir(dir)
+	if err != nil {
+		return p.report.numExported, err
+	}
+
+	// Write in the restore order
+	w := newExportWriter(outDir)
+	for _, restorePref := range []string{"Namespace", "CRD"} {
+		if p.isIn(restorePref) {
+			rlog.Infof("Export %s :", restorePref)
+			err = exportDir(dir, restorePref, w, p, restore, sr, rlog)
+			if err != nil {
+				return p.report.numExported, err
+			}
+		}
+	}
+	if p.isIn("PV") && p.isIn("PVC") {
+		rlog.Info("Export PV/PVC :")
+		err = exportPV(dir, w, p, restore, sr, rlog)
+		if err != nil {
+			return p.report.numExported, err
+		}
+	}
+	for _, restorePref := range []string{"Restore", "App"} {
+		if p.isIn(restorePref) {
+			rlog.Infof("Export %s :", restorePref)
+			err = exportDir(dir, restorePref, w, p, restore, sr, rlog)
+			if err != nil {
+				return p.report.numExported, err
+			}
+		}
+	}
+	if layout == ExportLayoutKustomize {
+		err = w.writeKustomizations()
+		if err != nil {
+			return p.report.numExported, err
+		}
+	}
+
+	rlog.Infof("Export completed into %s", outDir)
+	rlog.Infof("-- preference excluded : %d", restore.Status.NumPreferenceExcluded)
+	rlog.Infof("-- excluded            : %d", restore.Status.NumExcluded)
+	rlog.Infof("-- exported            : %d", p.report.numExported)
+	rlog.Infof("-- failed              : %d", restore.Status.NumFailed)
+
+	return p.report.numExported, nil
+}
@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Phases and results of hooks
+const (
+	hookPhasePre        = "pre"
+	hookPhasePost       = "post"
+	hookSucceeded       = "Succeeded"
+	hookFailed          = "Failed"
+	hookOnErrorFail     = "Fail"
+	hookOnErrorContinue = "Continue"
+)
+
+// Default timeout of a hook command
+const defaultHookTimeout = 30 * time.Second
+
+// Max length of hook output kept in the snapshot status
+const hookOutputLimit = 1024
+
+// PodExecutor executes commands in containers of pods
+type PodExecutor interface {
+	Exec(ctx context.Context, namespace, pod, container string, command []string) (stdout, stderr string, err error)
+}
+
+// podExecutor executes commands with the pods/exec subresource
+type podExecutor struct {
+	config     *rest.Config
+	kubeClient kubernetes.Interface
+}
+
+// NewPodExecutor returns new PodExecutor for the cluster
+func NewPodExecutor(config *rest.Config, kubeClient kubernetes.Interface) PodExecutor {
+	return &podExecutor{
+		config:     config,
+		kubeClient: kubeClient,
+	}
+}
+
+// Exec executes the command in the container and returns stdout and stderr
+func (e *podExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	req := e.kubeClient.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	transport, upgrader, err := spdy.RoundTripperFor(e.config)
+	if err != nil {
+		return "", "", err
+	}
+	exec, err := remotecommand.NewSPDYExecutorForTransports(
+		&contextRoundTripper{ctx: ctx, transport: transport},
+		&contextUpgrader{ctx: ctx, upgrader: upgrader},
+		"POST", req.URL())
+	if err != nil {
+		return "", "", err
+	}
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	return stdout.String(), stderr.String(), err
+}
+
+// contextRoundTripper sends the exec request with the context
+type contextRoundTripper struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+// RoundTrip sends the request cancelled with the context
+func (t *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
+// contextUpgrader closes the streaming connection when the context is done,
+// client-go of this version has no Executor.StreamWithContext
+type contextUpgrader struct {
+	ctx      context.Context
+	upgrader spdy.Upgrader
+}
+
+// NewConnection returns the upgraded connection closed on the context done
+func (u *contextUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-u.ctx.Done():
+			_ = conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+	return conn, nil
+}
+
+// runHooks runs hooks in all selected pods and records results in the snapshot status.
+// Failed hooks with onError Fail stop running hooks and fail the snapshot.
+func runHooks(ctx context.Context, snapshot *cbv1alpha1.Snapshot, hooks []cbv1alpha1.SnapshotHook, phase string,
+	kubeClient kubernetes.Interface, executor PodExecutor, blog *utils.NamedLog) error {
+
+	for _, hook := range hooks {
+		blog.Infof("Running %s hook %s", phase, hook.Name)
+		results, err := runHook(ctx, hook, phase, kubeClient, executor)
+		snapshot.Status.Hooks = append(snapshot.Status.Hooks, results...)
+		for _, r := range results {
+			if r.Result == hookSucceeded {
+				blog.Infof("-- %s %s/%s : %s", r.Result, r.Pod, r.Container, r.Output)
+			} else {
+				blog.Warningf("-- %s %s/%s : %s : %s", r.Result, r.Pod, r.Container, r.Error, r.Output)
+			}
+		}
+		if err != nil {
+			if hook.OnError == hookOnErrorContinue {
+				blog.Warningf("Continue on %s hook %s error : %s", phase, hook.Name, err.Error())
+				continue
+			}
+			return backoff.Permanent(fmt.Errorf("%s hook %s failed : %s", phase, hook.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// runHook runs the hook in running pods matched to the selector
+func runHook(ctx context.Context, hook cbv1alpha1.SnapshotHook, phase string,
+	kubeClient kubernetes.Interface, executor PodExecutor) ([]cbv1alpha1.HookResult, error) {
+
+	failed := func(msg string) ([]cbv1alpha1.HookResult, error) {
+		return []cbv1alpha1.HookResult{{
+			Name:      hook.Name,
+			Phase:     phase,
+			Result:    hookFailed,
+			Error:     msg,
+			Timestamp: metav1.Now(),
+		}}, fmt.Errorf("%s", msg)
+	}
+
+	if executor == nil {
+		return failed("pod exec not available")
+	}
+	selector, err := metav1.LabelSelectorAsSelector(hook.PodSelector)
+	if err != nil {
+		return failed("invalid pod selector : " + err.Error())
+	}
+	pods, err := kubeClient.CoreV1().Pods(hook.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return failed("listing pods failed : " + err.Error())
+	}
+
+	timeout := defaultHookTimeout
+	if hook.Timeout != nil && hook.Timeout.Duration > 0 {
+		timeout = hook.Timeout.Duration
+	}
+
+	results := make([]cbv1alpha1.HookResult, 0)
+	var hookErr error
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || len(pod.Spec.Containers) == 0 {
+			continue
+		}
+		container := hook.Container
+		if container == "" {
+			container = pod.Spec.Containers[0].Name
+		}
+		result := cbv1alpha1.HookResult{
+			Name:      hook.Name,
+			Phase:     phase,
+			Pod:       pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name,
+			Container: container,
+			Result:    hookSucceeded,
+		}
+		output, err := execWithTimeout(ctx, executor, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, container, hook.Command, timeout)
+		result.Timestamp = metav1.Now()
+		if len(output) > hookOutputLimit {
+			output = output[0:hookOutputLimit] + "....."
+		}
+		result.Output = output
+		if err != nil {
+			result.Result = hookFailed
+			result.Error = err.Error()
+			if hookErr == nil {
+				hookErr = fmt.Errorf("%s/%s : %s", result.Pod, container, err.Error())
+			}
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return failed(fmt.Sprintf("no running pods matched %s in namespace %s", selector.String(), hook.Namespace))
+	}
+	return results, hookErr
+}
+
+// execWithTimeout executes the command and returns combined output, the command is cancelled on timeout
+func execWithTimeout(ctx context.Context, executor PodExecutor, namespace, pod, container string,
+	command []string, timeout time.Duration) (string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout, stderr, err := executor.Exec(ctx, namespace, pod, container, command)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return stdout + stderr, fmt.Errorf("Timeout : command not finished in %s", timeout)
+	}
+	return stdout + stderr, err
+}
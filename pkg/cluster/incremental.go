@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+// Files in snapshot tgz which are not k8s resources
+const (
+	snapshotResourceFile = "/snapshot.json"
+	contentsDigestFile   = "/contents.json"
+	snapshotManifestFile = "/manifest.json"
+)
+
+func isSnapshotMetaFile(path string) bool {
+	return path == snapshotResourceFile || path == contentsDigestFile || path == snapshotManifestFile
+}
+
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// walkSnapshotFile calls fn for each regular file in /tmp/[name].tgz with path relative to snapshot root
+func walkSnapshotFile(name string, fn func(path string, tarReader *tar.Reader) error) error {
+	return walkArchive("/tmp/"+name+".tgz", name, fn)
+}
+
+// walkArchive calls fn for each regular file in the snapshot archive file with path relative to snapshot root
+func walkArchive(file, name string, fn func(path string, tarReader *tar.Reader) error) error {
+	snapshotFile, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer snapshotFile.Close()
+	tgz, err := gzip.NewReader(snapshotFile)
+	if err != nil {
+		return err
+	}
+	defer tgz.Close()
+
+	tarReader := tar.NewReader(tgz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			path := strings.Replace(header.Name, name, "", 1)
+			err = fn(path, tarReader)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSnapshotResource reads snapshot.json in /tmp/[name].tgz
+func readSnapshotResource(name string) (*cbv1alpha1.Snapshot, error) {
+	var snapshot *cbv1alpha1.Snapshot
+	err := walkSnapshotFile(name, func(path string, tarReader *tar.Reader) error {
+		if path != snapshotResourceFile {
+			return nil
+		}
+		bytes, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		snapshot = &cbv1alpha1.Snapshot{}
+		return json.Unmarshal(bytes, snapshot)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("Cannot find snapshot.json file in %s.tgz", name)
+	}
+	return snapshot, nil
+}
+
+// loadContentDigests returns digests of all resources in the snapshot including the ones stored in parents.
+// Digests are computed from stored files for snapshots without contents.json.
+func loadContentDigests(name string) (map[string]string, error) {
+	digests := make(map[string]string)
+	var stored map[string]string
+	err := walkSnapshotFile(name, func(path string, tarReader *tar.Reader) error {
+		if path == snapshotResourceFile || path == snapshotManifestFile {
+			return nil
+		}
+		bytes, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		if path == contentsDigestFile {
+			stored = make(map[string]string)
+			return json.Unmarshal(bytes, &stored)
+		}
+		digests[strings.TrimSuffix(path, ".json")] = contentDigest(bytes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		return stored, nil
+	}
+	return digests, nil
+}
+
+// snapshotChain returns snapshot resources from /tmp/[name].tgz back to the base snapshot
+func snapshotChain(name string) ([]*cbv1alpha1.Snapshot, error) {
+	chain := make([]*cbv1alpha1.Snapshot, 0)
+	for name != "" {
+		for _, s := range chain {
+			if s.ObjectMeta.Name == name {
+				return nil, fmt.Errorf("Circular parent snapshot reference %s", name)
+			}
+		}
+		snapshot, err := readSnapshotResource(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, snapshot)
+		name = snapshot.Spec.ParentSnapshot
+	}
+	return chain, nil
+}
+
+// downloadObject downloads [name].tgz into /tmp
+func downloadObject(name string, bucket objectstore.Objectstore) error {
+	return downloadObjectFile(name, "/tmp/"+name+".tgz", bucket)
+}
+
+// downloadObjectFile downloads [name].tgz into the file
+func downloadObjectFile(name, file string, bucket objectstore.Objectstore) error {
+	snapshotFile, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer snapshotFile.Close()
+	err = bucket.Download(snapshotFile, name+".tgz")
+	if err != nil {
+		return err
+	}
+	return objectstore.CheckNotEncryptedFile(snapshotFile.Name())
+}
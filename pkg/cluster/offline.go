@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// DownloadArchive downloads [name].tgz from the bucket into the file
+func DownloadArchive(name, file string, bucket objectstore.Objectstore) error {
+	return downloadObjectFile(name, file, bucket)
+}
+
+// walkArchiveFile calls fn for each regular file in the snapshot archive file with the snapshot name,
+// the name is the top directory in the archive
+func walkArchiveFile(file string, fn func(name, path string, tarReader *tar.Reader) error) error {
+	return walkArchive(file, "", func(path string, tarReader *tar.Reader) error {
+		sp := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		if len(sp) != 2 {
+			return nil
+		}
+		return fn(sp[0], "/"+sp[1], tarReader)
+	})
+}
+
+// ArchiveContents returns the snapshot resource and paths of resources stored in the snapshot archive file
+func ArchiveContents(file string) (*cbv1alpha1.Snapshot, []string, error) {
+	var snapshot *cbv1alpha1.Snapshot
+	paths := make([]string, 0)
+	err := walkArchiveFile(file, func(name, path string, tarReader *tar.Reader) error {
+		if path == snapshotResourceFile {
+			bytes, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return err
+			}
+			snapshot = &cbv1alpha1.Snapshot{}
+			return json.Unmarshal(bytes, snapshot)
+		}
+		if !isSnapshotMetaFile(path) {
+			paths = append(paths, strings.TrimSuffix(path, ".json"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshot == nil {
+		return nil, nil, fmt.Errorf("Cannot find snapshot.json file in %s", file)
+	}
+	return snapshot, paths, nil
+}
+
+// ArchiveResource returns the resource of the path stored in the snapshot archive file
+func ArchiveResource(file, resourcePath string) (*unstructured.Unstructured, error) {
+	resourcePath = strings.TrimSuffix(resourcePath, ".json") + ".json"
+	var item *unstructured.Unstructured
+	err := walkArchiveFile(file, func(name, path string, tarReader *tar.Reader) error {
+		if path != resourcePath {
+			return nil
+		}
+		bytes, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		item = &unstructured.Unstructured{}
+		return item.UnmarshalJSON(bytes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, fmt.Errorf("Resource %s not found in %s", strings.TrimSuffix(resourcePath, ".json"), file)
+	}
+	return item, nil
+}
+
+// LoadArchives copies [name].tgz and parents for incremental snapshot in the dir to be restored
+func LoadArchives(name, dir string) error {
+	loaded := make(map[string]bool)
+	for name != "" && !loaded[name] {
+		err := copyFile(filepath.Join(dir, name+".tgz"), "/tmp/"+name+".tgz")
+		if err != nil {
+			return fmt.Errorf("Loading archive of snapshot %s failed : %s", name, err.Error())
+		}
+		loaded[name] = true
+		snapshot, err := readSnapshotResource(name)
+		if err != nil {
+			return err
+		}
+		name = snapshot.Spec.ParentSnapshot
+	}
+	return nil
+}
+
+// DownloadArchives downloads [name].tgz and parents for incremental snapshot from the bucket to be restored
+func DownloadArchives(name string, bucket objectstore.Objectstore) error {
+	return downloadSnapshotChain(name, bucket, utils.NewNamedLog("download:"+name))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// RestoreOffline restores the loaded or downloaded snapshot on the cluster of the inline kubeconfig
+// without any k8s-snap resources, the report is left in the local file RestoreReportFile
+func RestoreOffline(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference) error {
+	// kubeClient for the cluster.
+	kubeClient, err := buildKubeClient(ctx, nil, "", restore.Spec.Kubeconfig, nil)
+	if err != nil {
+		return err
+	}
+
+	// DynamicClient for the cluster.
+	dynamicClient, err := buildDynamicClient(ctx, nil, "", restore.Spec.Kubeconfig, nil)
+	if err != nil {
+		return err
+	}
+
+	return restoreResources(ctx, restore, pref, kubeClient, dynamicClient)
+}
+
+// RestoreReportFile returns the local report file path of the restore
+func RestoreReportFile(restore *cbv1alpha1.Restore) string {
+	return restoreReportFile(restore)
+}
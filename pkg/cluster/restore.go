@@ -2,7 +2,6 @@ package cluster
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"io"
 	"io/ioutil"
@@ -10,6 +9,8 @@ import (
 	"path/filepath"
 	"strings"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -34,8 +35,8 @@ func loadItem(item *unstructured.Unstructured, filepath string) error {
 	return nil
 }
 
-// Create resource
-func createItem(ctx context.Context, item *unstructured.Unstructured, dyn dynamic.Interface, sr *ServerResources) (*unstructured.Unstructured, error) {
+// Dynamic client interface for the resource
+func itemResource(item *unstructured.Unstructured, dyn dynamic.Interface, sr *ServerResources) (dynamic.ResourceInterface, error) {
 	gv, err := schema.ParseGroupVersion(item.GetAPIVersion())
 	if err != nil {
 		return nil, err
@@ -47,39 +48,180 @@ func createItem(ctx context.Context, item *unstructured.Unstructured, dyn dynami
 	gvr := gv.WithResource(resource)
 	ns := item.GetNamespace()
 	if ns == "" {
-		return dyn.Resource(gvr).Create(ctx, item, metav1.CreateOptions{})
+		return dyn.Resource(gvr), nil
 	}
-	return dyn.Resource(gvr).Namespace(ns).Create(ctx, item, metav1.CreateOptions{})
+	return dyn.Resource(gvr).Namespace(ns), nil
 }
 
-func excludeWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
-	rlog.Infof("     [Excluded] %s", msg)
-	restore.Status.NumExcluded++
-	restore.Status.Excluded = append(restore.Status.Excluded, selflink+",("+msg+")")
+// Options for server-side dry-run
+func dryRunOption(dryRun bool) []string {
+	if dryRun {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
 }
 
-func alreadyExist(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
-	rlog.Info("     [Already exists]")
-	restore.Status.NumAlreadyExisted++
-	restore.Status.AlreadyExisted = append(restore.Status.AlreadyExisted, selflink)
+// Create resource
+func createItem(ctx context.Context, item *unstructured.Unstructured, dyn dynamic.Interface, sr *ServerResources, dryRun bool) (*unstructured.Unstructured, error) {
+	ri, err := itemResource(item, dyn, sr)
+	if err != nil {
+		return nil, err
+	}
+	return ri.Create(ctx, item, metav1.CreateOptions{DryRun: dryRunOption(dryRun)})
 }
 
-func created(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
-	rlog.Info("     [Created]")
-	restore.Status.NumCreated++
-	restore.Status.Created = append(restore.Status.Created, selflink)
+// Overwrite existing resource with the one in snapshot, the previous version is returned
+func updateItem(ctx context.Context, item *unstructured.Unstructured, dyn dynamic.Interface, sr *ServerResources, dryRun bool) (*unstructured.Unstructured, error) {
+	ri, err := itemResource(item, dyn, sr)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ri.Get(ctx, item.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	item.SetResourceVersion(existing.GetResourceVersion())
+	item.SetUID(existing.GetUID())
+	_, err = ri.Update(ctx, item, metav1.UpdateOptions{DryRun: dryRunOption(dryRun)})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
 }
 
-func failedWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
-	rlog.Warningf("     [Failed] %s", msg)
-	restore.Status.NumFailed++
-	if len(msg) > 300 {
-		restore.Status.Failed = append(restore.Status.Failed, selflink+","+msg[0:300]+".....")
-	} else {
-		restore.Status.Failed = append(restore.Status.Failed, selflink+","+msg)
+// Key of CRD created in dry-run for custom resources
+func dryRunCRDKey(item *unstructured.Unstructured) string {
+	gvk := item.GroupVersionKind()
+	return "CRD/" + gvk.Group + "/" + gvk.Kind
+}
+
+// Record Namespaces and CRDs created in dry-run, which resources in them cannot be created on server-side dry-run
+func (p *preference) setDryRunCreated(item *unstructured.Unstructured, dryRun bool) {
+	if !dryRun {
+		return
+	}
+	switch item.GetKind() {
+	case "Namespace":
+		p.dryRunCreated["Namespace/"+item.GetName()] = true
+	case "CustomResourceDefinition":
+		spec := getUnstructuredMap(item.Object, "spec")
+		names := getUnstructuredMap(spec, "names")
+		if names != nil {
+			p.dryRunCreated["CRD/"+getUnstructuredString(spec, "group")+"/"+getUnstructuredString(names, "kind")] = true
+		}
 	}
 }
 
+// Resource will be created in the namespace created in dry-run
+func (p *preference) isDryRunNamespaceNotFound(item *unstructured.Unstructured, err error) bool {
+	return errors.IsNotFound(err) && item.GetNamespace() != "" && p.dryRunCreated["Namespace/"+item.GetNamespace()]
+}
+
+// Map namespace of the item, the Namespace itself and subjects of bindings. Returns true if mapped.
+func mapNamespace(item *unstructured.Unstructured, mappings map[string]string) bool {
+	mapped := false
+	if to, ok := mappings[item.GetNamespace()]; ok && item.GetNamespace() != "" && to != "" {
+		item.SetNamespace(to)
+		mapped = true
+	}
+	switch item.GetKind() {
+	case "Namespace":
+		if to, ok := mappings[item.GetName()]; ok && to != "" {
+			item.SetName(to)
+			mapped = true
+		}
+	case "RoleBinding", "ClusterRoleBinding":
+		for _, sub := range getUnstructuredSlice(item.Object, "subjects") {
+			s, ok := sub.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if to, ok := mappings[getUnstructuredString(s, "namespace")]; ok && to != "" {
+				s["namespace"] = to
+				mapped = true
+			}
+		}
+	}
+	return mapped
+}
+
+// prepareItem checks filters and sanitizes the item to restore, returns the resource path
+// after namespace mapping and false when the item is excluded
+func (p *preference) prepareItem(item *unstructured.Unstructured, resourcePath string, restore *cbv1alpha1.Restore,
+	sr *ServerResources, rlog *utils.NamedLog) (string, bool, error) {
+
+	// Check include filters
+	if !p.isLabelMatched(item) {
+		p.report.excludeWithMsg(restore, rlog, resourcePath, "label-not-matched")
+		return resourcePath, false, nil
+	}
+	if !p.isIncludedClusterResource(item, resourcePath) {
+		p.report.excludeWithMsg(restore, rlog, resourcePath, "not-referenced")
+		return resourcePath, false, nil
+	}
+
+	// Check owner
+	owners := item.GetOwnerReferences()
+	if len(owners) > 0 {
+		p.report.excludeWithMsg(restore, rlog, resourcePath, "owner-ref")
+		for _, owner := range owners {
+			rlog.Infof("     owner : %s %s", owner.Kind, owner.Name)
+		}
+		return resourcePath, false, nil
+	}
+
+	// Operation for each resources
+	switch item.GetKind() {
+	case "Secret":
+		if getUnstructuredString(item.Object, "type") == "kubernetes.io/service-account-token" {
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "token-secret")
+			return resourcePath, false, nil
+		}
+	case "ClusterRole":
+		if !isInList(item.GetName(), p.includedClusterRoles) && !p.dependencies["ClusterRole/"+item.GetName()] {
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "not-binded-to-ns")
+			return resourcePath, false, nil
+		}
+	case "ClusterRoleBinding":
+		if !isInList(item.GetName(), p.includedClusterRoleBindings) {
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "not-binded-to-ns")
+			return resourcePath, false, nil
+		}
+	case "PersistentVolume":
+	case "PersistentVolumeClaim":
+		klog.Warningf("     Warning : Excluded : PVs/PVCs must not be included here")
+		return resourcePath, false, nil
+	case "Endpoints":
+		if isInList(item.GetNamespace()+"/"+item.GetName(), p.serviceList) {
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "service-exists")
+			return resourcePath, false, nil
+		}
+	case "VolumeSnapshot", "VolumeSnapshotContent":
+		// Restored with PVCs from the snapshot status
+		if _, ok := item.GetLabels()[volumeSnapshotLabel]; ok {
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "k8s-snap-volume-snapshot")
+			return resourcePath, false, nil
+		}
+	}
+
+	// Map namespaces
+	if mapNamespace(item, restore.Spec.NamespaceMappings) {
+		var err error
+		resourcePath, err = sr.ResourcePath(item)
+		if err != nil {
+			return resourcePath, false, err
+		}
+		rlog.Infof("     Namespace mapped : %s", resourcePath)
+	}
+	if mapStorageClass(item, p.pref.Spec.StorageClassMappings) {
+		rlog.Info("     StorageClass mapped")
+	}
+
+	item.SetResourceVersion("")
+	item.SetUID("")
+	return resourcePath, true, nil
+}
+
 // Restore resources according to preferences.
 func restoreDir(ctx context.Context, dir, restorePref string, dyn dynamic.Interface, p *preference,
 	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog) error {
@@ -90,6 +232,11 @@ func restoreDir(ctx context.Context, dir, restorePref string, dyn dynamic.Interf
 	}
 	for _, f := range files {
 
+		// Stop between resources on cancel
+		if err := cancelled(ctx); err != nil {
+			return err
+		}
+
 		// Load item
 		var item unstructured.Unstructured
 		err := loadItem(&item, filepath.Join(dir, restorePref, f.Name()))
@@ -98,62 +245,62 @@ func restoreDir(ctx context.Context, dir, restorePref string, dyn dynamic.Interf
 		}
 		resourcePath, err := sr.ResourcePath(&item)
 		if err != nil {
+			// CRDs not created in dry-run
+			if restore.Spec.DryRun && p.dryRunCreated[dryRunCRDKey(&item)] {
+				resourcePath = strings.TrimSuffix(strings.Replace(f.Name(), "|", "/", -1), ".json")
+				rlog.Infof("---- %s", resourcePath)
+				p.report.created(restore, rlog, resourcePath)
+				continue
+			}
+			// CRDs not established
+			if msg, ok := p.notEstablishedCRDs[crdKey(item.GroupVersionKind().Group, item.GetKind())]; ok {
+				resourcePath = strings.TrimSuffix(strings.Replace(f.Name(), "|", "/", -1), ".json")
+				rlog.Infof("---- %s", resourcePath)
+				p.report.failedWithMsg(restore, rlog, resourcePath, msg)
+				continue
+			}
 			return err
 		}
 
 		rlog.Infof("---- %s", resourcePath)
 
-		// Check owner
-		owners := item.GetOwnerReferences()
-		if len(owners) > 0 {
-			excludeWithMsg(restore, rlog, resourcePath, "owner-ref")
-			for _, owner := range owners {
-				rlog.Infof("     owner : %s %s", owner.Kind, owner.Name)
-			}
-			continue
+		// Check and prepare item, preferences are checked with original namespaces
+		overwrite := p.isOverwrite(resourcePath)
+		resourcePath, ok, err := p.prepareItem(&item, resourcePath, restore, sr, rlog)
+		if err != nil {
+			return err
 		}
-
-		// Operation for each resources
-		switch item.GetKind() {
-		case "Secret":
-			if getUnstructuredString(item.Object, "type") == "kubernetes.io/service-account-token" {
-				excludeWithMsg(restore, rlog, resourcePath, "token-secret")
-				continue
-			}
-		case "ClusterRole":
-			if !isInList(item.GetName(), p.includedClusterRoles) {
-				excludeWithMsg(restore, rlog, resourcePath, "not-binded-to-ns")
-				continue
-			}
-		case "ClusterRoleBinding":
-			if !isInList(item.GetName(), p.includedClusterRoleBindings) {
-				excludeWithMsg(restore, rlog, resourcePath, "not-binded-to-ns")
-				continue
-			}
-		case "PersistentVolume":
-		case "PersistentVolumeClaim":
-			klog.Warningf("     Warning : Excluded : PVs/PVCs must not be included here")
+		if !ok {
 			continue
-		case "Endpoints":
-			if isInList(item.GetNamespace()+"/"+item.GetName(), p.serviceList) {
-				excludeWithMsg(restore, rlog, resourcePath, "service-exists")
-				continue
-			}
 		}
 
 		// Restore item
-		item.SetResourceVersion("")
-		item.SetUID("")
-		_, err = createItem(ctx, &item, dyn, sr)
+		_, err = createItem(ctx, &item, dyn, sr, restore.Spec.DryRun)
 		if err != nil {
 			//p.cntUpCnnotRestore(err.Error())
 			if strings.Contains(err.Error(), "already exists") {
-				alreadyExist(restore, rlog, resourcePath)
+				if !overwrite {
+					if !p.recordRestoredCRD(&item, resourcePath, resultAlreadyExisted, nil, restore.Spec.DryRun) {
+						p.report.alreadyExist(restore, rlog, resourcePath)
+					}
+					continue
+				}
+				previous, err := updateItem(ctx, &item, dyn, sr, restore.Spec.DryRun)
+				if err != nil {
+					p.report.failedWithMsg(restore, rlog, resourcePath, err.Error())
+				} else if !p.recordRestoredCRD(&item, resourcePath, resultUpdated, previous, restore.Spec.DryRun) {
+					p.report.updated(restore, rlog, resourcePath, previous)
+				}
+			} else if restore.Spec.DryRun && p.isDryRunNamespaceNotFound(&item, err) {
+				p.report.created(restore, rlog, resourcePath)
 			} else {
-				failedWithMsg(restore, rlog, resourcePath, err.Error())
+				p.report.failedWithMsg(restore, rlog, resourcePath, err.Error())
 			}
 		} else {
-			created(restore, rlog, resourcePath)
+			p.setDryRunCreated(&item, restore.Spec.DryRun)
+			if !p.recordRestoredCRD(&item, resourcePath, resultCreated, nil, restore.Spec.DryRun) {
+				p.report.created(restore, rlog, resourcePath)
+			}
 		}
 	}
 	return nil
@@ -172,8 +319,87 @@ func writeFile(filepath string, tarReader *tar.Reader) error {
 	return nil
 }
 
-// Restore k8s resources
-func Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error {
+// Extract resource files in snapshot tgz into dirs according to preferences
+func extractSnapshot(name, dir string, p *preference, restore *cbv1alpha1.Restore, found map[string]bool, rlog *utils.NamedLog) error {
+	return walkSnapshotFile(name, func(path string, tarReader *tar.Reader) error {
+
+		if isSnapshotMetaFile(path) {
+			klog.Infof("-- [Snapshot resource file] %s", path)
+			return nil
+		}
+		if found[path] {
+			return nil
+		}
+		found[path] = true
+
+		restorePref := p.preferedToRestore(path)
+		if restorePref == "Exclude" {
+			p.report.preferenceExcluded(restore, rlog, strings.TrimSuffix(path, ".json"))
+			return nil
+		}
+
+		// create dir
+		fullpath := filepath.Join(dir, restorePref, strings.Replace(path, "/", "|", -1))
+		err := os.MkdirAll(filepath.Dir(fullpath), 0755)
+		if err != nil {
+			return err
+		}
+
+		// create file
+		return writeFile(fullpath, tarReader)
+	})
+}
+
+// initRestoreStatus clears results in the restore status
+func initRestoreStatus(restore *cbv1alpha1.Restore) {
+	restore.Status.NumPreferenceExcluded = 0
+	restore.Status.NumExcluded = 0
+	restore.Status.NumCreated = 0
+	restore.Status.NumUpdated = 0
+	restore.Status.NumAlreadyExisted = 0
+	restore.Status.NumFailed = 0
+	restore.Status.Excluded = nil
+	restore.Status.Created = nil
+	restore.Status.Updated = nil
+	restore.Status.AlreadyExisted = nil
+	restore.Status.Failed = nil
+	restore.Status.Report = ""
+}
+
+// extractSnapshotChain extracts resource files in the snapshot chain into a new temporary dir
+// and initializes the preference by the dir
+func extractSnapshotChain(chain []*cbv1alpha1.Snapshot, p *preference, restore *cbv1alpha1.Restore, rlog *utils.NamedLog) (string, error) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", err
+	}
+
+	// Extract from the newest, skip resources found in newer snapshots or deleted
+	found := make(map[string]bool)
+	for _, snapshot := range chain {
+		rlog.Infof("Extract files in snapshot tgz %s :", snapshot.ObjectMeta.Name)
+		err = extractSnapshot(snapshot.ObjectMeta.Name, dir, p, restore, found, rlog)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		for _, path := range snapshot.Status.Deleted {
+			found[path+".json"] = true
+		}
+	}
+
+	// Initialize preference
+	err = p.initializeByDir(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Restore downloads the snapshot with its parents and restores resources on the cluster of the restore kubeconfig.
+// On cancel it stops between resources, leaving results of resources restored so far in the report
+func Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore, localClient kubernetes.Interface) error {
 	// download snapshot tgz
 	err := downloadSnapshot(restore, bucket)
 	if err != nil {
@@ -181,43 +407,44 @@ func Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bu
 	}
 
 	// kubeClient for external cluster.
-	kubeClient, err := buildKubeClient(restore.Spec.Kubeconfig)
+	kubeClient, err := buildKubeClient(ctx, localClient, restore.ObjectMeta.Namespace, restore.Spec.Kubeconfig, restore.Spec.KubeconfigSecretRef)
 	if err != nil {
 		return err
 	}
 
 	// DynamicClient for external cluster.
-	dynamicClient, err := buildDynamicClient(restore.Spec.Kubeconfig)
+	dynamicClient, err := buildDynamicClient(ctx, localClient, restore.ObjectMeta.Namespace, restore.Spec.Kubeconfig, restore.Spec.KubeconfigSecretRef)
 	if err != nil {
 		return err
 	}
 
-	return restoreResources(restore, pref, kubeClient, dynamicClient)
+	err = restoreResources(ctx, restore, pref, kubeClient, dynamicClient)
+
+	// upload the report also for failed restore
+	if _, statErr := os.Stat(restoreReportFile(restore)); statErr == nil {
+		uploadErr := uploadRestoreReport(restore, bucket)
+		if uploadErr != nil {
+			klog.Warningf("restore:%s %s", restore.ObjectMeta.Name, uploadErr.Error())
+		}
+	}
+	return err
 }
 
 func downloadSnapshot(restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
 	// Restore log
 	rlog := utils.NewNamedLog("restore:" + restore.ObjectMeta.Name)
 
-	// Download
-	rlog.Infof("Downloading file %s", restore.Spec.SnapshotName+".tgz")
-	snapshotFile, err := os.Create("/tmp/" + restore.Spec.SnapshotName + ".tgz")
-	defer snapshotFile.Close()
-	if err != nil {
-		return err
-	}
-	return bucket.Download(snapshotFile, restore.Spec.SnapshotName+".tgz")
+	// Download the snapshot and parents for incremental snapshot
+	return downloadSnapshotChain(restore.Spec.SnapshotName, bucket, rlog)
 }
 
 func restoreResources(
+	ctx context.Context,
 	restore *cbv1alpha1.Restore,
 	pref *cbv1alpha1.RestorePreference,
 	kubeClient kubernetes.Interface,
 	dynamicClient dynamic.Interface) error {
 
-	// context for restore
-	ctx := context.TODO()
-
 	// Restore log
 	rlog := utils.NewNamedLog("restore:" + restore.ObjectMeta.Name)
 
@@ -232,81 +459,35 @@ func restoreResources(
 	p := newPreference(pref)
 
 	// Initialize restore status
-	restore.Status.NumPreferenceExcluded = 0
-	restore.Status.NumExcluded = 0
-	restore.Status.NumCreated = 0
-	restore.Status.NumUpdated = 0
-	restore.Status.NumAlreadyExisted = 0
-	restore.Status.NumFailed = 0
-	restore.Status.Excluded = nil
-	restore.Status.Created = nil
-	restore.Status.Updated = nil
-	restore.Status.AlreadyExisted = nil
-	restore.Status.Failed = nil
+	initRestoreStatus(restore)
 
-	// Read tar.gz
-	snapshotFile, err := os.Open("/tmp/" + restore.Spec.SnapshotName + ".tgz")
+	// Report of all resources
+	p.report, err = newRestoreReport(restore)
 	if err != nil {
 		return err
 	}
-	tgz, err := gzip.NewReader(snapshotFile)
-	if err != nil {
-		return err
-	}
-	defer tgz.Close()
-
-	tarReader := tar.NewReader(tgz)
+	defer p.report.close()
 
-	dir, err := ioutil.TempDir("", "")
+	// Resolve incremental snapshots back to the base snapshot
+	chain, err := snapshotChain(restore.Spec.SnapshotName)
 	if err != nil {
 		return err
 	}
+	if chain[0].Status.Scope != nil {
+		rlog.Infof("Snapshot %s is partial, resources out of the scope are not restored : %#v", restore.Spec.SnapshotName, *chain[0].Status.Scope)
+	}
 
-	rlog.Info("Extract files in snapshot tgz :")
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		if header.Typeflag == tar.TypeReg {
-			path := strings.Replace(header.Name, restore.Spec.SnapshotName, "", 1)
-
-			if path == "/snapshot.json" {
-				klog.Infof("-- [Snapshot resource file] %s", path)
-				continue
-			}
-
-			restorePref := p.preferedToRestore(path)
-			if restorePref == "Exclude" {
-				rlog.Infof("-- [%s] %s", restorePref, path)
-				//p.cntUpExcluded()
-				restore.Status.NumPreferenceExcluded++
-				continue
-			}
-
-			// create dir
-			fullpath := filepath.Join(dir, restorePref, strings.Replace(path, "/", "|", -1))
-			err := os.MkdirAll(filepath.Dir(fullpath), header.FileInfo().Mode())
-			if err != nil {
-				return err
-			}
-
-			// create file
-			err = writeFile(fullpath, tarReader)
-			if err != nil {
-				return err
-			}
-		}
+	// VolumeSnapshots taken with the snapshot
+	p.volumeSnapshots = make(map[string]*cbv1alpha1.VolumeSnapshotRecord)
+	for i, vs := range chain[0].Status.VolumeSnapshots {
+		p.volumeSnapshots[vs.Namespace+"/"+vs.PVCName] = &chain[0].Status.VolumeSnapshots[i]
 	}
 
-	// Initialize preference
-	err = p.initializeByDir(dir)
+	dir, err := extractSnapshotChain(chain, p, restore, rlog)
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(dir)
 
 	// Restore namespaces
 	if p.isIn("Namespace") {
@@ -321,15 +502,32 @@ func restoreResources(
 		rlog.Info("Restore CRDs :")
 		err = restoreDir(ctx, dir, "CRD", dynamicClient, p, restore, sr, rlog)
 		if err != nil {
+			// CRDs restored before stopped are reported without waiting
+			for _, crd := range p.restoredCRDs {
+				p.reportRestoredCRD(restore, crd, rlog)
+			}
 			return err
 		}
 	}
-	// Reload Server Resources after CRDs restored
-	spr, err = discoveryClient.ServerResources()
-	if err != nil {
-		return err
+	// Wait for restored CRDs and reload Server Resources
+	if len(p.restoredCRDs) > 0 {
+		timeout := crdEstablishedTimeout(restore)
+		rlog.Infof("Waiting for %d CRDs established :", len(p.restoredCRDs))
+		established := waitForCRDsEstablished(ctx, dynamicClient, p, restore, timeout, rlog)
+		if err := cancelled(ctx); err != nil {
+			return err
+		}
+		sr, err = serverResourcesWithCRDs(discoveryClient, established, timeout, rlog)
+		if err != nil {
+			return err
+		}
+	} else {
+		spr, err = discoveryClient.ServerResources()
+		if err != nil {
+			return err
+		}
+		sr = newServerResources(spr)
 	}
-	sr = newServerResources(spr)
 	// Restore PV/PVC
 	if p.isIn("PV") && p.isIn("PVC") {
 		rlog.Info("Restore PV/PVC :")
@@ -354,19 +552,16 @@ func restoreResources(
 			return err
 		}
 	}
-	// Remove tmp files
-	err = os.RemoveAll(dir)
-	if err != nil {
-		return err
-	}
-
 	// Generate marker name
 	markerName := "resource-version-marker-" + utils.RandString(10)
 
-	// Get end resource version
-	marker, err := ConfigMapMarker(ctx, kubeClient, markerName)
-	if err != nil {
-		return err
+	// Get end resource version, no marker for dry-run
+	marker := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Now()}}
+	if !restore.Spec.DryRun {
+		marker, err = ConfigMapMarker(ctx, kubeClient, markerName)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Timestamp and resource version
@@ -382,7 +577,11 @@ func restoreResources(
 	restore.Status.RestoreResourceVersion = marker.ObjectMeta.ResourceVersion
 
 	// result
-	rlog.Info("Restore completed")
+	if restore.Spec.DryRun {
+		rlog.Info("Restore completed (dry-run)")
+	} else {
+		rlog.Info("Restore completed")
+	}
 	rlog.Infof("-- resource version    : %s", restore.Status.RestoreResourceVersion)
 	rlog.Infof("-- timestamp           : %s", restore.Status.RestoreTimestamp)
 	rlog.Infof("-- available until     : %s", restore.Status.AvailableUntil)
@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Default timeout for restored CRDs to be established
+const defaultCRDEstablishedTimeout = 60 * time.Second
+
+// Interval to check restored CRDs and server resources
+var crdPollInterval = 2 * time.Second
+
+// restoredCRD is a CRD restored on the cluster, custom resources wait for it to be established
+type restoredCRD struct {
+	path     string
+	name     string
+	gvr      schema.GroupVersionResource
+	group    string
+	kind     string
+	versions []string
+
+	// result reported after waiting, with the previous version of the updated CRD
+	result   string
+	previous *unstructured.Unstructured
+}
+
+// crdEstablishedTimeout returns the timeout for CRDs to be established
+func crdEstablishedTimeout(restore *cbv1alpha1.Restore) time.Duration {
+	if restore.Spec.CRDEstablishedTimeout != nil && restore.Spec.CRDEstablishedTimeout.Duration > 0 {
+		return restore.Spec.CRDEstablishedTimeout.Duration
+	}
+	return defaultCRDEstablishedTimeout
+}
+
+// crdKey returns the key of custom resources of the CRD
+func crdKey(group, kind string) string {
+	return group + "/" + kind
+}
+
+// recordRestoredCRD records the CRD restored to wait for it and report the result once waited.
+// Returns false for other resources and in dry-run, to be reported at once
+func (p *preference) recordRestoredCRD(item *unstructured.Unstructured, resourcePath, result string,
+	previous *unstructured.Unstructured, dryRun bool) bool {
+
+	if dryRun || item.GetKind() != "CustomResourceDefinition" {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(item.GetAPIVersion())
+	if err != nil {
+		return false
+	}
+	crd := &restoredCRD{
+		path:     resourcePath,
+		name:     item.GetName(),
+		gvr:      gv.WithResource("customresourcedefinitions"),
+		result:   result,
+		previous: previous,
+	}
+	crd.group, _, _ = unstructured.NestedString(item.Object, "spec", "group")
+	crd.kind, _, _ = unstructured.NestedString(item.Object, "spec", "names", "kind")
+	versions, _, _ := unstructured.NestedSlice(item.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		served, found, _ := unstructured.NestedBool(version, "served")
+		name, _, _ := unstructured.NestedString(version, "name")
+		if name != "" && (served || !found) {
+			crd.versions = append(crd.versions, name)
+		}
+	}
+	// apiextensions.k8s.io/v1beta1 with a single version
+	if len(crd.versions) == 0 {
+		version, _, _ := unstructured.NestedString(item.Object, "spec", "version")
+		if version != "" {
+			crd.versions = append(crd.versions, version)
+		}
+	}
+	p.restoredCRDs = append(p.restoredCRDs, crd)
+	return true
+}
+
+// reportRestoredCRD reports the result of the CRD recorded on restoring
+func (p *preference) reportRestoredCRD(restore *cbv1alpha1.Restore, crd *restoredCRD, rlog *utils.NamedLog) {
+	rlog.Infof("---- %s", crd.path)
+	switch crd.result {
+	case resultCreated:
+		p.report.created(restore, rlog, crd.path)
+	case resultUpdated:
+		p.report.updated(restore, rlog, crd.path, crd.previous)
+	default:
+		p.report.alreadyExist(restore, rlog, crd.path)
+	}
+}
+
+// isEstablished checks the Established condition of the CRD
+func isEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForCRDsEstablished waits restored CRDs to be established and reports them,
+// CRDs never established are reported only as failed
+func waitForCRDsEstablished(ctx context.Context, dyn dynamic.Interface, p *preference,
+	restore *cbv1alpha1.Restore, timeout time.Duration, rlog *utils.NamedLog) []*restoredCRD {
+
+	pending := make(map[string]*restoredCRD)
+	for _, crd := range p.restoredCRDs {
+		pending[crd.name] = crd
+	}
+	lastErrs := make(map[string]string)
+	_ = wait.PollImmediate(crdPollInterval, timeout, func() (bool, error) {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		for name, crd := range pending {
+			item, err := dyn.Resource(crd.gvr).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				lastErrs[name] = err.Error()
+				continue
+			}
+			if isEstablished(item) {
+				rlog.Infof("---- CRD %s established", name)
+				delete(pending, name)
+			}
+		}
+		return len(pending) == 0, nil
+	})
+
+	p.notEstablishedCRDs = make(map[string]string)
+	established := make([]*restoredCRD, 0)
+	for _, crd := range p.restoredCRDs {
+		if _, ok := pending[crd.name]; !ok {
+			established = append(established, crd)
+			p.reportRestoredCRD(restore, crd, rlog)
+			continue
+		}
+		msg := fmt.Sprintf("CRD %s not established in %s", crd.name, timeout)
+		if lastErr, ok := lastErrs[crd.name]; ok {
+			msg += " : " + lastErr
+		}
+		p.notEstablishedCRDs[crdKey(crd.group, crd.kind)] = msg
+		rlog.Infof("---- %s", crd.path)
+		switch crd.result {
+		case resultCreated:
+			p.report.failedAfterCreated(restore, rlog, crd.path, msg)
+		case resultUpdated:
+			p.report.failedAfterUpdated(restore, rlog, crd.path, msg, crd.previous)
+		default:
+			p.report.failedWithMsg(restore, rlog, crd.path, msg)
+		}
+	}
+	return established
+}
+
+// serverResourcesWithCRDs reloads server resources until all versions of established CRDs are served
+func serverResourcesWithCRDs(discoveryClient discovery.DiscoveryInterface, crds []*restoredCRD,
+	timeout time.Duration, rlog *utils.NamedLog) (*ServerResources, error) {
+
+	var sr *ServerResources
+	var lastErr error
+	_ = wait.PollImmediate(crdPollInterval, timeout, func() (bool, error) {
+		spr, err := discoveryClient.ServerResources()
+		if err != nil {
+			// partial results are returned when some groups are not discovered yet
+			lastErr = err
+			if !discovery.IsGroupDiscoveryFailedError(err) || spr == nil {
+				return false, nil
+			}
+		}
+		sr = newServerResources(spr)
+		if err != nil {
+			return false, nil
+		}
+		for _, crd := range crds {
+			for _, version := range crd.versions {
+				_, err := sr.ResourceName(schema.GroupVersionKind{Group: crd.group, Version: version, Kind: crd.kind})
+				if err != nil {
+					lastErr = err
+					return false, nil
+				}
+			}
+		}
+		lastErr = nil
+		return true, nil
+	})
+	if sr == nil {
+		return nil, lastErr
+	}
+	if lastErr != nil {
+		rlog.Warningf("Server resources not fully discovered in %s : %s", timeout, lastErr.Error())
+	}
+	return sr, nil
+}
@@ -1,13 +1,16 @@
 package cluster
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog"
 )
 
@@ -25,12 +28,28 @@ func apiPathMatched(path, apiPath string) bool {
 	return false
 }
 
+// Namespace in api path, empty for cluster scoped resources
+func apiPathNamespace(path string) string {
+	sp := strings.SplitN(path, "/namespaces/", 2)
+	if len(sp) < 2 || sp[0] == "" {
+		return ""
+	}
+	return strings.Split(sp[1], "/")[0]
+}
+
 type preference struct {
 	pref                        *cbv1alpha1.RestorePreference
 	includedClusterRoles        []string
 	includedClusterRoleBindings []string
 	serviceList                 []string
 	dirs                        []os.FileInfo
+	selector                    labels.Selector
+	dependencies                map[string]bool
+	dryRunCreated               map[string]bool
+	report                      *restoreReport
+	restoredCRDs                []*restoredCRD
+	notEstablishedCRDs          map[string]string
+	volumeSnapshots             map[string]*cbv1alpha1.VolumeSnapshotRecord
 }
 
 func newPreference(pref *cbv1alpha1.RestorePreference) *preference {
@@ -48,6 +67,10 @@ func (p *preference) preferedToRestore(path string) string {
 				return "Exclude"
 			}
 		}
+		if len(p.pref.Spec.IncludeNamespaces) > 0 &&
+			!isInList(strings.TrimSuffix(strings.TrimPrefix(path, "/namespaces/"), ".json"), p.pref.Spec.IncludeNamespaces) {
+			return "Exclude"
+		}
 		return "Namespace"
 	}
 	// crds
@@ -71,12 +94,31 @@ func (p *preference) preferedToRestore(path string) string {
 			return "Exclude"
 		}
 	}
+	// check include namespaces and API pathes for namespaced resources
+	if ns := apiPathNamespace(path); ns != "" {
+		if len(p.pref.Spec.IncludeNamespaces) > 0 && !isInList(ns, p.pref.Spec.IncludeNamespaces) {
+			return "Exclude"
+		}
+		if len(p.pref.Spec.IncludeAPIPathes) > 0 && !p.isIncludedAPIPath(path) {
+			return "Exclude"
+		}
+	}
 	// check storage classes
 	if strings.Contains(path, "/storageclasses/") {
-		for _, s := range p.pref.Spec.RestoreNfsStorageClasses {
-			if strings.Contains(path, "storageclasses/"+s) {
-				return "Restore"
-			}
+		// Mapped and skipped storage classes are not restored
+		name := strings.TrimSuffix(path[strings.LastIndex(path, "/")+1:], ".json")
+		if _, ok := p.pref.Spec.StorageClassMappings[name]; ok {
+			return "Exclude"
+		}
+		switch p.storageClassPolicy(name) {
+		case pvPolicySkip:
+			return "Exclude"
+		case pvPolicyRebind, pvPolicyReprovision:
+			return "Restore"
+		}
+		// Referenced storage classes are restored with include filters
+		if p.includeFiltered() {
+			return "Restore"
 		}
 		return "Exclude"
 	}
@@ -97,15 +139,73 @@ func (p *preference) preferedToRestore(path string) string {
 	return "Restore"
 }
 
+// Restore option for overwriting existing resources.
+// "overwriteExistingResources" for all resources or "overwriteExistingResources:[prefix](,[contains])" for api pathes.
+const overwriteOption = "overwriteExistingResources"
+
+func (p *preference) isOverwrite(path string) bool {
+	for _, o := range p.pref.Spec.RestoreOptions {
+		if o == overwriteOption {
+			return true
+		}
+		if strings.HasPrefix(o, overwriteOption+":") &&
+			apiPathMatched(path, strings.TrimPrefix(o, overwriteOption+":")) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *preference) isUserNamespace(nsName string) bool {
 	for _, n := range p.pref.Spec.ExcludeNamespaces {
 		if nsName == n {
 			return false
 		}
 	}
+	if p.includeFiltered() {
+		return p.dependencies["Namespace/"+nsName]
+	}
 	return true
 }
 
+// Include filters set in preference
+func (p *preference) includeFiltered() bool {
+	return len(p.pref.Spec.IncludeNamespaces) > 0 ||
+		len(p.pref.Spec.IncludeAPIPathes) > 0 ||
+		p.pref.Spec.LabelSelector != nil
+}
+
+func (p *preference) isIncludedAPIPath(path string) bool {
+	for _, i := range p.pref.Spec.IncludeAPIPathes {
+		if apiPathMatched(path, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels of namespaced resources matched to label selector
+func (p *preference) isLabelMatched(item *unstructured.Unstructured) bool {
+	if p.selector == nil || item.GetNamespace() == "" {
+		return true
+	}
+	return p.selector.Matches(labels.Set(item.GetLabels()))
+}
+
+// Cluster scoped resources are restored with include filters only when
+// included in API pathes or referenced from restoring namespaced resources.
+func (p *preference) isIncludedClusterResource(item *unstructured.Unstructured, resourcePath string) bool {
+	if !p.includeFiltered() || item.GetNamespace() != "" {
+		return true
+	}
+	switch item.GetKind() {
+	case "ClusterRole", "ClusterRoleBinding":
+		// checked with bindings to ServiceAccounts in restoring namespaces
+		return true
+	}
+	return p.isIncludedAPIPath(resourcePath) || p.dependencies[item.GetKind()+"/"+item.GetName()]
+}
+
 func (p *preference) isIn(str string) bool {
 	for _, f := range p.dirs {
 		if str == f.Name() {
@@ -125,6 +225,30 @@ func (p *preference) initializeByDir(dir string) error {
 	p.includedClusterRoles = nil
 	p.includedClusterRoleBindings = nil
 	p.serviceList = nil
+	p.selector = nil
+	p.dependencies = nil
+	p.dryRunCreated = make(map[string]bool)
+
+	if p.includeFiltered() {
+		if p.pref.Spec.LabelSelector != nil {
+			p.selector, err = metav1.LabelSelectorAsSelector(p.pref.Spec.LabelSelector)
+			if err != nil {
+				return fmt.Errorf("Invalid label selector : %s", err.Error())
+			}
+		}
+		p.dependencies = make(map[string]bool)
+		for _, n := range p.pref.Spec.IncludeNamespaces {
+			p.dependencies["Namespace/"+n] = true
+		}
+		for _, d := range []string{"Restore", "App", "PVC"} {
+			if p.isIn(d) {
+				err = p.setDependencies(dir, d)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
 
 	if p.isIn("Restore") {
 		err = p.setIncludedClusterRoles(dir, "Restore")
@@ -197,6 +321,71 @@ func (p *preference) setIncludedClusterRoles(dir, restorePref string) error {
 	return nil
 }
 
+// Collect cluster scoped resources referenced from namespaced resources to restore
+func (p *preference) setDependencies(dir, restorePref string) error {
+	files, err := ioutil.ReadDir(filepath.Join(dir, restorePref))
+	if err != nil {
+		return err
+	}
+	klog.Infof("Dependencies : %s", restorePref)
+	for _, f := range files {
+		// Load item
+		var item unstructured.Unstructured
+		err := loadItem(&item, filepath.Join(dir, restorePref, f.Name()))
+		if err != nil {
+			return err
+		}
+		if item.GetNamespace() == "" || !p.isLabelMatched(&item) {
+			continue
+		}
+		deps := []string{"Namespace/" + item.GetNamespace()}
+
+		// Custom resources : |apis|group|version|namespaces|ns|plural|name.json
+		sp := strings.Split(strings.TrimSuffix(f.Name(), ".json"), "|")
+		if len(sp) == 8 && sp[1] == "apis" {
+			deps = append(deps, "CustomResourceDefinition/"+sp[6]+"."+sp[2])
+		}
+
+		switch item.GetKind() {
+		case "PersistentVolumeClaim":
+			spec := getUnstructuredMap(item.Object, "spec")
+			if spec != nil {
+				deps = append(deps, "StorageClass/"+getUnstructuredString(spec, "storageClassName"))
+			}
+			deps = append(deps, "StorageClass/"+item.GetAnnotations()["volume.beta.kubernetes.io/storage-class"])
+		case "StatefulSet":
+			spec := getUnstructuredMap(item.Object, "spec")
+			if spec == nil {
+				break
+			}
+			for _, t := range getUnstructuredSlice(spec, "volumeClaimTemplates") {
+				template, ok := t.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				templateSpec := getUnstructuredMap(template, "spec")
+				if templateSpec != nil {
+					deps = append(deps, "StorageClass/"+getUnstructuredString(templateSpec, "storageClassName"))
+				}
+			}
+		case "RoleBinding":
+			roleref := getUnstructuredMap(item.Object, "roleRef")
+			if roleref != nil && getUnstructuredString(roleref, "kind") == "ClusterRole" {
+				deps = append(deps, "ClusterRole/"+getUnstructuredString(roleref, "name"))
+			}
+		}
+
+		for _, d := range deps {
+			if strings.HasSuffix(d, "/") || p.dependencies[d] {
+				continue
+			}
+			p.dependencies[d] = true
+			klog.Infof("---- %s referenced in %s/%s", d, item.GetNamespace(), item.GetName())
+		}
+	}
+	return nil
+}
+
 func (p *preference) setServiceList(dir, restorePref string) error {
 	files, err := ioutil.ReadDir(filepath.Join(dir, restorePref))
 	if err != nil {
@@ -219,6 +408,23 @@ func (p *preference) setServiceList(dir, restorePref string) error {
 	return nil
 }
 
+// storageClassPolicy returns the policy for PVs/PVCs of the storage class, empty if not restored.
+// Storage classes in restoreNfsStorageClasses are rebound.
+func (p *preference) storageClassPolicy(storageClassName string) string {
+	if storageClassName == "" {
+		return ""
+	}
+	for _, s := range p.pref.Spec.StorageClassPolicies {
+		if s.StorageClassName == storageClassName {
+			return s.Policy
+		}
+	}
+	if p.isIncludedStorageClass(storageClassName) {
+		return pvPolicyRebind
+	}
+	return ""
+}
+
 func (p *preference) isIncludedStorageClass(storageClassName string) bool {
 	for _, s := range p.pref.Spec.RestoreNfsStorageClasses {
 		if strings.HasPrefix(storageClassName, s) {
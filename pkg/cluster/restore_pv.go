@@ -6,11 +6,13 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
@@ -36,143 +38,444 @@ func isPVBound(ctx context.Context, pvName string, dyn dynamic.Interface, rlog *
 	return false, nil
 }
 
-// Restore PV/PVC boundings one by one
+// Policies to restore PVs/PVCs of storage classes
+const (
+	pvPolicyRebind      = "rebind"
+	pvPolicyReprovision = "reprovision"
+	pvPolicySkip        = "skip"
+	// PVCs with CSI VolumeSnapshots in the snapshot
+	pvPolicyVolumeSnapshot = "volumesnapshot"
+)
+
+// Default timeout and parallelism for restoring PV/PVC boundings
+const (
+	defaultPVBindTimeout = 50 * time.Second
+	defaultPVParallelism = 4
+)
+
+// Interval to check PV status
+var pvPollInterval = 5 * time.Second
+
+// pvPair is a PV/PVC pair to restore and its results
+type pvPair struct {
+	pvItem       unstructured.Unstructured
+	pvcItem      unstructured.Unstructured
+	pvPath       string
+	pvcPath      string
+	pvResult     string
+	pvResultMsg  string
+	pvcResult    string
+	pvcResultMsg string
+	// PVC created but failed to be bound
+	pvcCreated bool
+
+	// CSI VolumeSnapshot to restore the PVC from
+	volumeSnapshot        *cbv1alpha1.VolumeSnapshotRecord
+	volumeSnapshotVersion string
+	vsPath                string
+	vsResult              string
+	vsResultMsg           string
+	vscPath               string
+	vscResult             string
+	vscResultMsg          string
+}
+
+// pvBindTimeout returns the timeout for a PV/PVC pair to be bound
+func pvBindTimeout(pref *cbv1alpha1.RestorePreference) time.Duration {
+	if pref.Spec.PVBindTimeout != nil && pref.Spec.PVBindTimeout.Duration > 0 {
+		return pref.Spec.PVBindTimeout.Duration
+	}
+	return defaultPVBindTimeout
+}
+
+// pvParallelism returns the number of PV/PVC pairs restored concurrently
+func pvParallelism(pref *cbv1alpha1.RestorePreference) int {
+	if pref.Spec.PVParallelism > 0 {
+		return int(pref.Spec.PVParallelism)
+	}
+	return defaultPVParallelism
+}
+
+// Restore PV/PVC boundings, pairs are restored concurrently
 func restorePV(ctx context.Context, dir string, dyn dynamic.Interface, p *preference,
 	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog) error {
 
-	pvcfiles, err := ioutil.ReadDir(filepath.Join(dir, "PVC"))
+	pairs, err := loadPVPairs(dir, p, restore, sr, rlog)
 	if err != nil {
 		return err
 	}
 
+	timeout := pvBindTimeout(p.pref)
+	parallelism := pvParallelism(p.pref)
+	rlog.Infof("Restoring %d PV/PVC pairs (parallelism:%d timeout:%s)", len(pairs), parallelism, timeout)
+
+	queue := make(chan *pvPair)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pair := range queue {
+				restorePVPair(ctx, pair, dyn, p, restore, sr, timeout, rlog)
+			}
+		}()
+	}
+	queued := 0
+	for _, pair := range pairs {
+		// Stop queueing pairs on cancel
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- pair
+		queued++
+	}
+	close(queue)
+	wg.Wait()
+
+	// Results are reported in order after all pairs done
+	for _, pair := range pairs[:queued] {
+		if pair.vscResult != "" {
+			reportPVResult(p, restore, rlog, pair.vscPath, pair.vscResult, pair.vscResultMsg, false)
+		}
+		if pair.vsResult != "" {
+			reportPVResult(p, restore, rlog, pair.vsPath, pair.vsResult, pair.vsResultMsg, false)
+		}
+		if pair.pvPath != "" {
+			reportPVResult(p, restore, rlog, pair.pvPath, pair.pvResult, pair.pvResultMsg, false)
+		}
+		if pair.pvcResult != "" {
+			reportPVResult(p, restore, rlog, pair.pvcPath, pair.pvcResult, pair.pvcResultMsg, pair.pvcCreated)
+		}
+	}
+	return cancelled(ctx)
+}
+
+// reportPVResult reports a result of PV or PVC, failures of created ones are deleted on rollback
+func reportPVResult(p *preference, restore *cbv1alpha1.Restore, rlog *utils.NamedLog, path, result, msg string, created bool) {
+	rlog.Infof("---- %s", path)
+	switch {
+	case result == resultCreated:
+		p.report.created(restore, rlog, path)
+	case result == resultAlreadyExisted:
+		p.report.alreadyExist(restore, rlog, path)
+	case created:
+		p.report.failedAfterCreated(restore, rlog, path, msg)
+	default:
+		p.report.failedWithMsg(restore, rlog, path, msg)
+	}
+}
+
+// loadPVPairs loads PVCs and PVs to bound, PVCs not to restore are reported as excluded
+func loadPVPairs(dir string, p *preference, restore *cbv1alpha1.Restore,
+	sr *ServerResources, rlog *utils.NamedLog) ([]*pvPair, error) {
+
+	pvcfiles, err := ioutil.ReadDir(filepath.Join(dir, "PVC"))
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]*pvPair, 0)
 	for _, f := range pvcfiles {
 
-		var pvcItem unstructured.Unstructured
-		var pvItem unstructured.Unstructured
+		pair := &pvPair{}
+		pvcItem := &pair.pvcItem
+		pvItem := &pair.pvItem
 
 		// Load PVC item
-		err := loadItem(&pvcItem, filepath.Join(dir, "PVC", f.Name()))
+		err := loadItem(pvcItem, filepath.Join(dir, "PVC", f.Name()))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		resourcePath, err := sr.ResourcePath(&pvcItem)
+		resourcePath, err := sr.ResourcePath(pvcItem)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		rlog.Infof("---- %s", resourcePath)
 
-		// Check storageClassName
+		// Check label selector
+		if !p.isLabelMatched(pvcItem) {
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "label-not-matched")
+			continue
+		}
+
+		// Check storageClassName and its policy
 		pvcSpec := getUnstructuredMap(pvcItem.Object, "spec")
 		if pvcSpec == nil {
-			excludeWithMsg(restore, rlog, resourcePath, "no-pvc-spec")
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "no-pvc-spec")
 			continue
 		}
-		storageClassName := getUnstructuredString(pvcSpec, "storageClassName")
-		if storageClassName == "" || !p.isIncludedStorageClass(storageClassName) {
+		policy := p.storageClassPolicy(getUnstructuredString(pvcSpec, "storageClassName"))
+		if policy == "" {
 			// Check Annotations
-			annotaionStorageClassName := pvcItem.GetAnnotations()["volume.beta.kubernetes.io/storage-class"]
-			if annotaionStorageClassName == "" || !p.isIncludedStorageClass(annotaionStorageClassName) {
-				excludeWithMsg(restore, rlog, resourcePath, "no-storageclass")
-				continue
-			}
+			policy = p.storageClassPolicy(pvcItem.GetAnnotations()["volume.beta.kubernetes.io/storage-class"])
 		}
-
-		// Check bounded and PV name
-		volumeName := getUnstructuredString(pvcSpec, "volumeName")
-		if volumeName == "" {
-			excludeWithMsg(restore, rlog, resourcePath, "not-bounded")
+		// PVCs with VolumeSnapshots are restored from them
+		if record, ok := p.volumeSnapshots[pvcItem.GetNamespace()+"/"+pvcItem.GetName()]; ok && policy != pvPolicySkip {
+			policy = pvPolicyVolumeSnapshot
+			pair.volumeSnapshot = record
+		}
+		switch policy {
+		case "":
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "no-storageclass")
+			continue
+		case pvPolicySkip:
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "storageclass-skipped")
+			continue
+		case pvPolicyRebind, pvPolicyReprovision, pvPolicyVolumeSnapshot:
+		default:
+			p.report.excludeWithMsg(restore, rlog, resourcePath, "unknown-storageclass-policy:"+policy)
 			continue
 		}
 
-		// Search the PV to bound in PV dir
-		pvfiles, err := ioutil.ReadDir(filepath.Join(dir, "PV"))
-		if err != nil {
-			return err
+		if policy == pvPolicyVolumeSnapshot {
+			pair.volumeSnapshotVersion, err = volumeSnapshotVersion(sr)
+			if err != nil {
+				p.report.failedWithMsg(restore, rlog, resourcePath, err.Error())
+				continue
+			}
 		}
-		pvFound := false
+
 		pvResourcePath := ""
-		for _, pvf := range pvfiles {
-			if strings.Contains(pvf.Name(), "|persistentvolumes|"+volumeName+".json") {
-				err := loadItem(&pvItem, filepath.Join(dir, "PV", pvf.Name()))
-				if err != nil {
-					return err
+		if policy == pvPolicyRebind {
+
+			// Check bounded and PV name
+			volumeName := getUnstructuredString(pvcSpec, "volumeName")
+			if volumeName == "" {
+				p.report.excludeWithMsg(restore, rlog, resourcePath, "not-bounded")
+				continue
+			}
+
+			// Search the PV to bound in PV dir
+			pvfiles, err := ioutil.ReadDir(filepath.Join(dir, "PV"))
+			if err != nil {
+				return nil, err
+			}
+			pvFound := false
+			for _, pvf := range pvfiles {
+				if strings.Contains(pvf.Name(), "|persistentvolumes|"+volumeName+".json") {
+					err := loadItem(pvItem, filepath.Join(dir, "PV", pvf.Name()))
+					if err != nil {
+						return nil, err
+					}
+					pvResourcePath, err = sr.ResourcePath(pvItem)
+					if err != nil {
+						return nil, err
+					}
+					pvFound = true
+					break
 				}
-				pvResourcePath, err = sr.ResourcePath(&pvItem)
-				if err != nil {
-					return err
+			}
+			if !pvFound {
+				p.report.excludeWithMsg(restore, rlog, resourcePath, "pv-not-found")
+				continue
+			}
+
+			// Prepare PV
+			pvSpec := getUnstructuredMap(pvItem.Object, "spec")
+			if pvSpec == nil {
+				p.report.excludeWithMsg(restore, rlog, pvResourcePath, "no-pv-spec")
+				continue
+			}
+			pvSpec["claimRef"] = nil
+			if to, ok := restore.Spec.NamespaceMappings[pvcItem.GetNamespace()]; ok && to != "" {
+				// Reserve the PV for the PVC in mapped namespace
+				pvSpec["claimRef"] = map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "PersistentVolumeClaim",
+					"namespace":  to,
+					"name":       pvcItem.GetName(),
 				}
-				pvFound = true
-				break
 			}
-		}
-		if !pvFound {
-			excludeWithMsg(restore, rlog, resourcePath, "pv-not-found")
-			continue
+			pvItem.Object["status"] = nil
+			pvItem.SetResourceVersion("")
+			pvItem.SetUID("")
+			mapStorageClass(pvItem, p.pref.Spec.StorageClassMappings)
 		}
 
-		// Restore PV first
-		rlog.Infof("     Restoring PV %s", pvItem.GetName())
-		pvSpec := getUnstructuredMap(pvItem.Object, "spec")
-		if pvSpec == nil {
-			excludeWithMsg(restore, rlog, pvResourcePath, "no-pv-spec")
-			continue
-		}
-		pvSpec["claimRef"] = nil
-		pvItem.Object["status"] = nil
-		pvItem.SetResourceVersion("")
-		pvItem.SetUID("")
-		_, err = createItem(ctx, &pvItem, dyn, sr)
-		if err != nil {
-			if strings.Contains(err.Error(), "already exists") {
-				alreadyExist(restore, rlog, pvResourcePath)
-			} else {
-				failedWithMsg(restore, rlog, pvResourcePath, err.Error())
+		// Prepare PVC, the dynamic provisioner creates a new volume on reprovision
+		if mapNamespace(pvcItem, restore.Spec.NamespaceMappings) {
+			resourcePath, err = sr.ResourcePath(pvcItem)
+			if err != nil {
+				return nil, err
 			}
-			continue
-		} else {
-			created(restore, rlog, pvResourcePath)
+			rlog.Infof("     Namespace mapped : %s", resourcePath)
+		}
+		if mapStorageClass(pvcItem, p.pref.Spec.StorageClassMappings) {
+			rlog.Infof("     StorageClass mapped : %s", getUnstructuredString(pvcSpec, "storageClassName"))
 		}
-
-		// Then restore PVC
-		rlog.Infof("     Restoring PVC %s", pvcItem.GetName())
 		pvcSpec["volumeName"] = nil
 		pvcItem.Object["status"] = nil
 		pvcItem.SetResourceVersion("")
 		pvcItem.SetUID("")
 		annotations := pvcItem.GetAnnotations()
 		delete(annotations, "pv.kubernetes.io/bind-completed")
+		if policy == pvPolicyReprovision || policy == pvPolicyVolumeSnapshot {
+			delete(annotations, "pv.kubernetes.io/bound-by-controller")
+			delete(annotations, "volume.beta.kubernetes.io/storage-provisioner")
+		}
 		pvcItem.SetAnnotations(annotations)
-		_, err = createItem(ctx, &pvcItem, dyn, sr)
-		if err != nil {
-			if strings.Contains(err.Error(), "already exists") {
-				alreadyExist(restore, rlog, resourcePath)
-			} else {
-				failedWithMsg(restore, rlog, resourcePath, err.Error())
+		if policy == pvPolicyVolumeSnapshot {
+			pvcSpec["dataSource"] = map[string]interface{}{
+				"apiGroup": volumeSnapshotGroup,
+				"kind":     "VolumeSnapshot",
+				"name":     pair.volumeSnapshot.VolumeSnapshotName,
 			}
-			continue
+			pair.vsPath = "/apis/" + volumeSnapshotGroup + "/" + pair.volumeSnapshotVersion + "/namespaces/" +
+				pvcItem.GetNamespace() + "/volumesnapshots/" + pair.volumeSnapshot.VolumeSnapshotName
+			pair.vscPath = "/apis/" + volumeSnapshotGroup + "/" + pair.volumeSnapshotVersion + "/volumesnapshotcontents/" +
+				volumeSnapshotContentName(restore, pvcItem.GetNamespace(), pair.volumeSnapshot)
+		}
+
+		pair.pvPath = pvResourcePath
+		pair.pvcPath = resourcePath
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// restorePVPair restores the PV then the PVC and waits for them bound, results are set in the pair
+func restorePVPair(ctx context.Context, pair *pvPair, dyn dynamic.Interface, p *preference,
+	restore *cbv1alpha1.Restore, sr *ServerResources, timeout time.Duration, rlog *utils.NamedLog) {
+
+	pvName := pair.pvItem.GetName()
+
+	// Restore the VolumeSnapshot and the PVC from it
+	if pair.volumeSnapshot != nil {
+		rlog.Infof("     Restoring VolumeSnapshot %s", pair.volumeSnapshot.VolumeSnapshotName)
+		if !restoreVolumeSnapshot(ctx, pair, dyn, p, restore, sr) {
+			return
+		}
+		rlog.Infof("     Restoring PVC %s from VolumeSnapshot", pair.pvcItem.GetName())
+		pair.pvcResult = createPVC(ctx, pair, dyn, p, restore, sr)
+		return
+	}
+
+	// Restore PV first, no PV on reprovision
+	if pair.pvPath == "" {
+		rlog.Infof("     Restoring PVC %s to reprovision", pair.pvcItem.GetName())
+		pair.pvcResult = createPVC(ctx, pair, dyn, p, restore, sr)
+		return
+	}
+	rlog.Infof("     Restoring PV %s", pvName)
+	_, err := createItem(ctx, &pair.pvItem, dyn, sr, restore.Spec.DryRun)
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			pair.pvResult = resultAlreadyExisted
 		} else {
-			created(restore, rlog, resourcePath)
+			pair.pvResult = resultFailed
+			pair.pvResultMsg = err.Error()
+		}
+		return
+	}
+	pair.pvResult = resultCreated
+
+	// Then restore PVC
+	rlog.Infof("     Restoring PVC %s", pair.pvcItem.GetName())
+	pair.pvcResult = createPVC(ctx, pair, dyn, p, restore, sr)
+	if pair.pvcResult != resultCreated || restore.Spec.DryRun {
+		// No binding in dry-run
+		return
+	}
+
+	// Wait for bound
+	var lastErr error
+	err = wait.PollImmediate(pvPollInterval, timeout, func() (bool, error) {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
 		}
+		bound, err := isPVBound(ctx, pvName, dyn, rlog)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		return bound, nil
+	})
+	if ctx.Err() != nil {
+		// not waited on cancel, the PVC is reported as created
+		rlog.Infof("     PV:%s - PVC:%s not waited for bound on cancel", pvName, pair.pvcItem.GetName())
+		return
+	}
+	if err != nil {
+		pair.pvcResult = resultFailed
+		pair.pvcCreated = true
+		pair.pvcResultMsg = fmt.Sprintf("Timeout : waiting for PV/PVC bound %s in %s", pvName, timeout)
+		if lastErr != nil {
+			pair.pvcResultMsg += " : " + lastErr.Error()
+		}
+		return
+	}
+	rlog.Infof("     PV:%s - PVC:%s bounded successfully", pvName, pair.pvcItem.GetName())
+	pair.pvcResult = resultCreated
+}
 
-		// Wait for bound
-		count := 0
-		timeout := 10
-		for {
-			if count >= timeout {
-				return fmt.Errorf("Timeout : waiting for PV/PVC bound %s", pvItem.GetName())
-			}
-			bound, err := isPVBound(ctx, pvItem.GetName(), dyn, rlog)
-			if err != nil {
-				return err
+// createPVC creates the PVC of the pair and returns the result
+func createPVC(ctx context.Context, pair *pvPair, dyn dynamic.Interface, p *preference,
+	restore *cbv1alpha1.Restore, sr *ServerResources) string {
+
+	_, err := createItem(ctx, &pair.pvcItem, dyn, sr, restore.Spec.DryRun)
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return resultAlreadyExisted
+		} else if restore.Spec.DryRun && p.isDryRunNamespaceNotFound(&pair.pvcItem, err) {
+			return resultCreated
+		}
+		pair.pvcResultMsg = err.Error()
+		return resultFailed
+	}
+	return resultCreated
+}
+
+// Map storage class names of PVs, PVCs and volumeClaimTemplates of StatefulSets. Returns true if mapped.
+func mapStorageClass(item *unstructured.Unstructured, mappings map[string]string) bool {
+	mapped := false
+	mapSpec := func(obj map[string]interface{}) {
+		spec := getUnstructuredMap(obj, "spec")
+		if spec == nil {
+			return
+		}
+		if to, ok := mappings[getUnstructuredString(spec, "storageClassName")]; ok && to != "" {
+			spec["storageClassName"] = to
+			mapped = true
+		}
+	}
+	mapAnnotation := func(annotations map[string]string) {
+		if to, ok := mappings[annotations["volume.beta.kubernetes.io/storage-class"]]; ok && to != "" {
+			annotations["volume.beta.kubernetes.io/storage-class"] = to
+			mapped = true
+		}
+	}
+
+	switch item.GetKind() {
+	case "PersistentVolume":
+		mapSpec(item.Object)
+	case "PersistentVolumeClaim":
+		mapSpec(item.Object)
+		annotations := item.GetAnnotations()
+		if annotations != nil {
+			mapAnnotation(annotations)
+			item.SetAnnotations(annotations)
+		}
+	case "StatefulSet":
+		spec := getUnstructuredMap(item.Object, "spec")
+		if spec == nil {
+			break
+		}
+		for _, t := range getUnstructuredSlice(spec, "volumeClaimTemplates") {
+			template, ok := t.(map[string]interface{})
+			if !ok {
+				continue
 			}
-			if bound {
-				rlog.Infof("     PV:%s - PVC:%s bounded successfully", pvItem.GetName(), pvcItem.GetName())
-				break
+			mapSpec(template)
+			metadata := getUnstructuredMap(template, "metadata")
+			annotations := getUnstructuredMap(metadata, "annotations")
+			if annotations != nil {
+				if to, ok := mappings[getUnstructuredString(annotations, "volume.beta.kubernetes.io/storage-class")]; ok && to != "" {
+					annotations["volume.beta.kubernetes.io/storage-class"] = to
+					mapped = true
+				}
 			}
-			time.Sleep(5 * time.Second)
-			count = count + 1
 		}
 	}
-	return nil
+	return mapped
 }
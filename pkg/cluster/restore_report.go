@@ -0,0 +1,210 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Results of restoring resources
+const (
+	resultPreferenceExcluded = "PreferenceExcluded"
+	resultExcluded           = "Excluded"
+	resultCreated            = "Created"
+	resultUpdated            = "Updated"
+	resultAlreadyExisted     = "AlreadyExisted"
+	resultFailed             = "Failed"
+	resultExported           = "Exported"
+)
+
+// Number of failures listed in the restore status and the rollback status
+const restoreFailedLimit = 20
+
+// restoreReportItem is a line of the restore report. For rollback, overwritten resources have the previous
+// version and failures of resources left on the cluster are marked created or have the previous version
+type restoreReportItem struct {
+	Path     string          `json:"path"`
+	Result   string          `json:"result"`
+	Message  string          `json:"message,omitempty"`
+	Created  bool            `json:"created,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"`
+}
+
+// restoreReport writes results of all resources into a NDJSON file
+type restoreReport struct {
+	file        *os.File
+	writer      *bufio.Writer
+	enc         *json.Encoder
+	err         error
+	numExported int
+}
+
+// restoreReportFile returns the local report file path
+func restoreReportFile(restore *cbv1alpha1.Restore) string {
+	return "/tmp/" + restore.ObjectMeta.Name + "-report.ndjson"
+}
+
+// RestoreReportObjectName returns the report object name stored next to the snapshot
+func RestoreReportObjectName(restore *cbv1alpha1.Restore) string {
+	return restore.Spec.SnapshotName + ".restore." + restore.ObjectMeta.Name + ".ndjson"
+}
+
+// IsRestoreReportObject checks the object is a restore report
+func IsRestoreReportObject(name string) bool {
+	return strings.HasSuffix(name, ".ndjson") && strings.Contains(name, ".restore.")
+}
+
+// newRestoreReport returns new restoreReport writing into the local report file
+func newRestoreReport(restore *cbv1alpha1.Restore) (*restoreReport, error) {
+	file, err := os.Create(restoreReportFile(restore))
+	if err != nil {
+		return nil, fmt.Errorf("Creating restore report file failed : %s", err.Error())
+	}
+	writer := bufio.NewWriter(file)
+	return &restoreReport{
+		file:   file,
+		writer: writer,
+		enc:    json.NewEncoder(writer),
+	}, nil
+}
+
+// add a result of a resource, nil report only counts up the status
+func (r *restoreReport) add(path, result, msg string) {
+	r.addItem(&restoreReportItem{Path: path, Result: result, Message: msg})
+}
+
+func (r *restoreReport) addItem(item *restoreReportItem) {
+	if r == nil || r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(item)
+	if r.err != nil {
+		klog.Warningf("Writing restore report failed : %s", r.err.Error())
+	}
+}
+
+// close the report file
+func (r *restoreReport) close() error {
+	if r == nil {
+		return nil
+	}
+	err := r.writer.Flush()
+	if err == nil {
+		err = r.err
+	}
+	closeErr := r.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (r *restoreReport) preferenceExcluded(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
+	rlog.Infof("-- [Exclude] %s", selflink)
+	restore.Status.NumPreferenceExcluded++
+	r.add(selflink, resultPreferenceExcluded, "")
+}
+
+func (r *restoreReport) excludeWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
+	rlog.Infof("     [Excluded] %s", msg)
+	restore.Status.NumExcluded++
+	r.add(selflink, resultExcluded, msg)
+}
+
+func (r *restoreReport) alreadyExist(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
+	rlog.Info("     [Already exists]")
+	restore.Status.NumAlreadyExisted++
+	r.add(selflink, resultAlreadyExisted, "")
+}
+
+func (r *restoreReport) updated(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string, previous *unstructured.Unstructured) {
+	rlog.Info("     [Updated]")
+	restore.Status.NumUpdated++
+	r.addItem(&restoreReportItem{Path: selflink, Result: resultUpdated, Previous: previousVersion(previous, rlog)})
+}
+
+// previousVersion returns the overwritten resource without managed fields to be saved in the report
+func previousVersion(previous *unstructured.Unstructured, rlog *utils.NamedLog) json.RawMessage {
+	if previous == nil {
+		return nil
+	}
+	previous = previous.DeepCopy()
+	unstructured.RemoveNestedField(previous.Object, "metadata", "managedFields")
+	bytes, err := previous.MarshalJSON()
+	if err != nil {
+		rlog.Warningf("     Previous version not saved : %s", err.Error())
+		return nil
+	}
+	return bytes
+}
+
+func (r *restoreReport) created(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
+	rlog.Info("     [Created]")
+	restore.Status.NumCreated++
+	r.add(selflink, resultCreated, "")
+}
+
+func (r *restoreReport) exported(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
+	rlog.Info("     [Exported]")
+	r.numExported++
+	r.add(selflink, resultExported, "")
+}
+
+func (r *restoreReport) failedWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
+	r.failedItem(restore, rlog, &restoreReportItem{Path: selflink, Result: resultFailed, Message: msg})
+}
+
+// failedAfterCreated reports the failure of the resource created on the cluster, deleted on rollback
+func (r *restoreReport) failedAfterCreated(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
+	r.failedItem(restore, rlog, &restoreReportItem{Path: selflink, Result: resultFailed, Message: msg, Created: true})
+}
+
+// failedAfterUpdated reports the failure of the resource overwritten on the cluster, reverted on rollback
+func (r *restoreReport) failedAfterUpdated(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string,
+	previous *unstructured.Unstructured) {
+	r.failedItem(restore, rlog, &restoreReportItem{Path: selflink, Result: resultFailed, Message: msg,
+		Previous: previousVersion(previous, rlog)})
+}
+
+func (r *restoreReport) failedItem(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, item *restoreReportItem) {
+	selflink, msg := item.Path, item.Message
+	rlog.Warningf("     [Failed] %s", msg)
+	restore.Status.NumFailed++
+	r.addItem(item)
+	// keep only first failures in the status
+	if len(restore.Status.Failed) >= restoreFailedLimit {
+		return
+	}
+	if len(msg) > 300 {
+		restore.Status.Failed = append(restore.Status.Failed, selflink+","+msg[0:300]+".....")
+	} else {
+		restore.Status.Failed = append(restore.Status.Failed, selflink+","+msg)
+	}
+}
+
+// uploadRestoreReport uploads the report file next to the snapshot and links it from the restore status
+func uploadRestoreReport(restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+	reportFile, err := os.Open(restoreReportFile(restore))
+	if err != nil {
+		return err
+	}
+	defer reportFile.Close()
+	defer os.Remove(reportFile.Name())
+
+	objectName := RestoreReportObjectName(restore)
+	err = bucket.Upload(reportFile, objectName)
+	if err != nil {
+		return fmt.Errorf("Uploading restore report %s failed : %s", objectName, err.Error())
+	}
+	restore.Status.Report = objectName
+	return nil
+}
@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// apiPathResource returns the resource, the namespace and the name of the API path of a resource
+func apiPathResource(path string) (schema.GroupVersionResource, string, string, error) {
+	var gv schema.GroupVersion
+	var rest []string
+	sp := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case len(sp) > 2 && sp[0] == "api":
+		gv = schema.GroupVersion{Version: sp[1]}
+		rest = sp[2:]
+	case len(sp) > 3 && sp[0] == "apis":
+		gv = schema.GroupVersion{Group: sp[1], Version: sp[2]}
+		rest = sp[3:]
+	}
+	switch {
+	case len(rest) == 2:
+		return gv.WithResource(rest[0]), "", rest[1], nil
+	case len(rest) == 4 && rest[0] == "namespaces":
+		return gv.WithResource(rest[2]), rest[1], rest[3], nil
+	}
+	return schema.GroupVersionResource{}, "", "", fmt.Errorf("Invalid resource path %s", path)
+}
+
+// loadRestoreReport returns results in the report to roll back in the restore order, created and updated
+// resources and failures of resources left on the cluster
+func loadRestoreReport(r io.Reader) ([]restoreReportItem, error) {
+	items := make([]restoreReportItem, 0)
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var item restoreReportItem
+		err := dec.Decode(&item)
+		if err != nil {
+			return nil, fmt.Errorf("Decoding restore report failed : %s", err.Error())
+		}
+		if item.Result == resultCreated || item.Result == resultUpdated || item.Created || len(item.Previous) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// loadRollbackItems downloads the report object of the restore, restores without the report
+// have created and updated resources in the deprecated status lists
+func loadRollbackItems(restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) ([]restoreReportItem, error) {
+	if restore.Status.Report == "" {
+		items := make([]restoreReportItem, 0)
+		for _, path := range restore.Status.Created {
+			items = append(items, restoreReportItem{Path: path, Result: resultCreated})
+		}
+		for _, path := range restore.Status.Updated {
+			items = append(items, restoreReportItem{Path: path, Result: resultUpdated})
+		}
+		// report upload failed after the lists deprecated
+		if len(items) == 0 && restore.Status.NumCreated+restore.Status.NumUpdated > 0 {
+			return nil, fmt.Errorf("No restore report for %d created and %d updated resources",
+				restore.Status.NumCreated, restore.Status.NumUpdated)
+		}
+		return items, nil
+	}
+
+	file, err := ioutil.TempFile("", "k8s-snap-report-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	err = bucket.Download(file, restore.Status.Report)
+	if err != nil {
+		return nil, fmt.Errorf("Downloading restore report %s failed : %s", restore.Status.Report, err.Error())
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return loadRestoreReport(file)
+}
+
+// RollbackRestore deletes resources created by the restore and reverts resources overwritten by the restore
+// to the previous versions, in reverse order of the restore : apps, other resources, PVCs/PVs, CRDs and namespaces.
+// Counters of deleted, reverted and failed resources are set in Status.Rollback
+func RollbackRestore(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore, localClient kubernetes.Interface) error {
+	if restore.Spec.DryRun {
+		return fmt.Errorf("Dry-run restore has nothing to roll back")
+	}
+
+	items, err := loadRollbackItems(restore, bucket)
+	if err != nil {
+		return err
+	}
+
+	// DynamicClient for external cluster.
+	dynamicClient, err := buildDynamicClient(ctx, localClient, restore.ObjectMeta.Namespace, restore.Spec.Kubeconfig, restore.Spec.KubeconfigSecretRef)
+	if err != nil {
+		return err
+	}
+
+	return rollbackResources(ctx, restore, items, dynamicClient)
+}
+
+// rollbackResources deletes created resources and reverts updated resources in reverse order of the items
+func rollbackResources(ctx context.Context, restore *cbv1alpha1.Restore, items []restoreReportItem, dyn dynamic.Interface) error {
+
+	// Rollback log
+	rlog := utils.NewNamedLog("rollback:" + restore.ObjectMeta.Name)
+
+	if restore.Status.Rollback == nil {
+		restore.Status.Rollback = &cbv1alpha1.RestoreRollbackStatus{}
+	}
+	status := restore.Status.Rollback
+	status.NumDeleted = 0
+	status.NumReverted = 0
+	status.NumNotFound = 0
+	status.NumFailed = 0
+	status.Failed = nil
+
+	rlog.Infof("Rollback %d resources :", len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := cancelled(ctx); err != nil {
+			return err
+		}
+		item := &items[i]
+		rlog.Infof("---- %s", item.Path)
+
+		gvr, namespace, name, err := apiPathResource(item.Path)
+		if err != nil {
+			rollbackFailed(status, rlog, item.Path, err.Error())
+			continue
+		}
+		ri := dyn.Resource(gvr).Namespace(namespace)
+
+		if item.Result == resultCreated || item.Created {
+			// dependents are deleted by the garbage collector
+			propagation := metav1.DeletePropagationBackground
+			err = ri.Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+			if errors.IsNotFound(err) {
+				rlog.Info("     [Not found]")
+				status.NumNotFound++
+			} else if err != nil {
+				rollbackFailed(status, rlog, item.Path, err.Error())
+			} else {
+				rlog.Info("     [Deleted]")
+				status.NumDeleted++
+			}
+		} else {
+			err = revertItem(ctx, ri, name, item.Previous)
+			if err != nil {
+				rollbackFailed(status, rlog, item.Path, err.Error())
+			} else {
+				rlog.Info("     [Reverted]")
+				status.NumReverted++
+			}
+		}
+	}
+
+	status.RollbackTimestamp = metav1.Now()
+	rlog.Info("Rollback completed")
+	rlog.Infof("-- deleted   : %d", status.NumDeleted)
+	rlog.Infof("-- reverted  : %d", status.NumReverted)
+	rlog.Infof("-- not found : %d", status.NumNotFound)
+	rlog.Infof("-- failed    : %d", status.NumFailed)
+
+	return nil
+}
+
+// revertItem updates the resource with the previous version, or creates it when deleted after the restore
+func revertItem(ctx context.Context, ri dynamic.ResourceInterface, name string, previous json.RawMessage) error {
+	if len(previous) == 0 {
+		return fmt.Errorf("Previous version not saved")
+	}
+	var item unstructured.Unstructured
+	err := item.UnmarshalJSON(previous)
+	if err != nil {
+		return fmt.Errorf("Loading previous version failed : %s", err.Error())
+	}
+	existing, err := ri.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		item.SetResourceVersion("")
+		item.SetUID("")
+		_, err = ri.Create(ctx, &item, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	item.SetResourceVersion(existing.GetResourceVersion())
+	_, err = ri.Update(ctx, &item, metav1.UpdateOptions{})
+	return err
+}
+
+// rollbackFailed logs and counts up the failure, listed in Status.Rollback until restoreFailedLimit
+func rollbackFailed(status *cbv1alpha1.RestoreRollbackStatus, rlog *utils.NamedLog, path, msg string) {
+	rlog.Warningf("     [Failed] %s", msg)
+	status.NumFailed++
+	if len(status.Failed) < restoreFailedLimit {
+		status.Failed = append(status.Failed, path+","+msg)
+	}
+}
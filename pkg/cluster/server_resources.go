@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"fmt"
+	"sync"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -12,6 +13,8 @@ import (
 type ServerResources struct {
 	serverResources []*metav1.APIResourceList
 	resourceNames map[schema.GroupVersionKind]string
+	// resourceNames is cached on PV/PVC restores running concurrently
+	mu sync.Mutex
 }
 
 func matchVerbs(groupVersion string, r *metav1.APIResource) bool {
@@ -30,6 +33,8 @@ func (sr *ServerResources) GetResources() []*metav1.APIResourceList {
 }
 
 func (sr *ServerResources) ResourceName(gvk schema.GroupVersionKind) (string, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 	if name, ok := sr.resourceNames[gvk]; ok {
 		return name, nil
 	}
@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -52,13 +54,13 @@ func isNewerValidResourceVersion(rv, refrv string) bool {
 	return (irv > irefrv)
 }
 
-func stopWatch(eventsWatch map[schema.GroupVersionResource]watch.Interface) {
+func stopWatch(eventsWatch map[string]watch.Interface) {
 	// Stop watch resources
-	for gvr, w := range eventsWatch {
+	for name, w := range eventsWatch {
 		if w != nil {
 			w.Stop()
 		} else {
-			klog.V(4).Infof("+++ %s watch already exited", gvr)
+			klog.V(4).Infof("+++ %s watch already exited", name)
 		}
 	}
 }
@@ -77,22 +79,29 @@ func apiPermError(error string) bool {
 	return false
 }
 
-// Snapshot k8s resources
-func Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
+// Snapshot k8s resources, localClient is used for reading the kubeconfig secret
+func Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, localClient kubernetes.Interface) error {
 
 	// kubeClient for external cluster.
-	kubeClient, err := buildKubeClient(snapshot.Spec.Kubeconfig)
+	kubeClient, err := buildKubeClient(ctx, localClient, snapshot.ObjectMeta.Namespace, snapshot.Spec.Kubeconfig, snapshot.Spec.KubeconfigSecretRef)
 	if err != nil {
 		return err
 	}
 
 	// DynamicClient for external cluster.
-	dynamicClient, err := buildDynamicClient(snapshot.Spec.Kubeconfig)
+	dynamicClient, err := buildDynamicClient(ctx, localClient, snapshot.ObjectMeta.Namespace, snapshot.Spec.Kubeconfig, snapshot.Spec.KubeconfigSecretRef)
 	if err != nil {
 		return err
 	}
 
-	return SnapshotWithClient(ctx, snapshot, kubeClient, dynamicClient)
+	// Executor of hook commands in pods of external cluster.
+	cfg, err := buildRESTConfig(ctx, localClient, snapshot.ObjectMeta.Namespace, snapshot.Spec.Kubeconfig, snapshot.Spec.KubeconfigSecretRef)
+	if err != nil {
+		return err
+	}
+	executor := NewPodExecutor(cfg, kubeClient)
+
+	return SnapshotWithClient(ctx, snapshot, kubeClient, dynamicClient, executor)
 }
 
 // SnapshotWithClient takes a snapshot of k8s resources
@@ -100,11 +109,42 @@ func SnapshotWithClient(
 	ctx context.Context,
 	snapshot *cbv1alpha1.Snapshot,
 	kubeClient kubernetes.Interface,
-	dynamicClient dynamic.Interface) error {
+	dynamicClient dynamic.Interface,
+	executor PodExecutor) error {
 
 	// Snapshot log
 	blog := utils.NewNamedLog("snapshot:" + snapshot.ObjectMeta.Name)
 
+	// Remove the snapshot file when cancelled
+	defer func() {
+		if ctx.Err() != nil {
+			os.Remove("/tmp/" + snapshot.ObjectMeta.Name + ".tgz")
+		}
+	}()
+
+	// Scope of resources
+	scope, err := newSnapshotScope(&snapshot.Spec)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+
+	// Contents of parent snapshot for incremental snapshot
+	var parentDigests map[string]string
+	if snapshot.Spec.ParentSnapshot != "" {
+		parent, err := readSnapshotResource(snapshot.Spec.ParentSnapshot)
+		if err != nil {
+			return backoff.Permanent(fmt.Errorf("Loading parent snapshot %s failed : %s", snapshot.Spec.ParentSnapshot, err.Error()))
+		}
+		if !reflect.DeepEqual(parent.Status.Scope, scope.status()) {
+			return backoff.Permanent(fmt.Errorf("Scope of parent snapshot %s not matched", snapshot.Spec.ParentSnapshot))
+		}
+		parentDigests, err = loadContentDigests(snapshot.Spec.ParentSnapshot)
+		if err != nil {
+			return backoff.Permanent(fmt.Errorf("Loading parent snapshot %s failed : %s", snapshot.Spec.ParentSnapshot, err.Error()))
+		}
+		blog.Infof("Incremental snapshot from parent %s : %d resources", snapshot.Spec.ParentSnapshot, len(parentDigests))
+	}
+
 	discoveryClient := kubeClient.Discovery()
 
 	spr, err := discoveryClient.ServerResources()
@@ -121,15 +161,42 @@ func SnapshotWithClient(
 	resources := sr.GetResources()
 
 	blog.Info("Backing up resources")
+	if scope.partial() {
+		blog.Infof("Partial snapshot : %#v", *scope.status())
+	}
 
-	eventsWatch := make(map[schema.GroupVersionResource]watch.Interface)
-	watchgvr := make(map[schema.GroupVersionResource]string)
-	snapshotList := make([]unstructured.Unstructured, 0)
+	eventsWatch := make(map[string]watch.Interface)
 	watchEventList := make([]watch.Event, 0)
+	var watchEventMu sync.Mutex
 
 	// goroutine gc
 	defer stopWatch(eventsWatch)
 
+	// Resources indexed by resource path and spooled into a file
+	index, err := newSnapshotIndex(snapshot.ObjectMeta.Name)
+	if err != nil {
+		return err
+	}
+	defer index.close()
+
+	// Pre hooks run before listing starts, post hooks run even if listing or volume snapshots failed
+	snapshot.Status.Hooks = nil
+	err = runHooks(ctx, snapshot, snapshot.Spec.PreHooks, hookPhasePre, kubeClient, executor, blog)
+	postHooksDone := false
+	defer func() {
+		if !postHooksDone {
+			// post hooks run also on cancel not to leave apps frozen
+			hookCtx := ctx
+			if ctx.Err() != nil {
+				hookCtx = context.Background()
+			}
+			_ = runHooks(hookCtx, snapshot, snapshot.Spec.PostHooks, hookPhasePost, kubeClient, executor, blog)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
 	// Generate marker name
 	markerName := "resource-version-marker-" + utils.RandString(10)
 
@@ -154,43 +221,85 @@ func SnapshotWithClient(
 				continue
 			}
 
-			// Get list of a resource
-			gvr := gv.WithResource(resource.Name)
-			unstructuredList, err := dynamicClient.Resource(gvr).List(ctx, metav1.ListOptions{})
-			if err != nil {
-				return fmt.Errorf("Get resource %s list failed : %s", resource.Name, err.Error())
+			// exclude resources out of the scope
+			if !scope.isIncludedResource(resource, gv.Group) {
+				continue
 			}
 
-			// Start watching the resource
-			watchgvr[gvr] = resourceGroup.GroupVersion + "/" + resource.Name
-			eventsWatch[gvr], err = dynamicClient.Resource(gvr).Watch(ctx, metav1.ListOptions{ResourceVersion: startRV})
-			if err != nil {
-				return fmt.Errorf("Watch resource %s list failed : %s", resource.Name, err.Error())
-			}
-			go func() {
-				klog.V(4).Infof("+++ %s watch started", watchgvr[gvr])
-				for e := range eventsWatch[gvr].ResultChan() {
-					item, ok := e.Object.(*unstructured.Unstructured)
-					if ok {
+			gvr := gv.WithResource(resource.Name)
+			listed := 0
+			for _, namespace := range scope.listNamespaces(resource) {
+
+				// Stop listing on cancel
+				if err := cancelled(ctx); err != nil {
+					return err
+				}
+
+				// Start watching the resource
+				watchName := resourceGroup.GroupVersion + "/" + resource.Name
+				if namespace != "" {
+					watchName += "@" + namespace
+				}
+				watchOptions := scope.listOptions(resource, gv.Group)
+				watchOptions.ResourceVersion = startRV
+				w, err := dynamicClient.Resource(gvr).Namespace(namespace).Watch(ctx, watchOptions)
+				if err != nil {
+					return fmt.Errorf("Watch resource %s list failed : %s", resource.Name, err.Error())
+				}
+				eventsWatch[watchName] = w
+				go func() {
+					klog.V(4).Infof("+++ %s watch started", watchName)
+					for e := range w.ResultChan() {
+						item, ok := e.Object.(*unstructured.Unstructured)
+						if ok {
+							resourcePath, _ := sr.ResourcePath(item)
+							switch e.Type {
+							case watch.Added:
+								klog.V(4).Infof("!!! Resource added : %s - rv:%s", resourcePath, item.GetResourceVersion())
+							case watch.Modified:
+								klog.V(4).Infof("!!! Resource modified : %s - rv:%s", resourcePath, item.GetResourceVersion())
+							case watch.Deleted:
+								klog.V(4).Infof("!!! Resource deleted : %s - rv:%s", resourcePath, item.GetResourceVersion())
+							}
+						}
+						watchEventMu.Lock()
+						watchEventList = append(watchEventList, e)
+						watchEventMu.Unlock()
+					}
+					klog.V(4).Infof("+++ %s watch exiting", watchName)
+				}()
+
+				// Get list of a resource by pages
+				listOptions := scope.listOptions(resource, gv.Group)
+				listOptions.Limit = snapshotListPageSize
+				for {
+					if err := cancelled(ctx); err != nil {
+						return err
+					}
+					unstructuredList, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, listOptions)
+					if err != nil {
+						return fmt.Errorf("Get resource %s list failed : %s", resource.Name, err.Error())
+					}
+					for i := range unstructuredList.Items {
+						item := &unstructuredList.Items[i]
+						if !scope.isIncludedItem(item) {
+							continue
+						}
 						resourcePath, _ := sr.ResourcePath(item)
-						switch e.Type {
-						case watch.Added:
-							klog.V(4).Infof("!!! Resource added : %s - rv:%s", resourcePath, item.GetResourceVersion())
-						case watch.Modified:
-							klog.V(4).Infof("!!! Resource modified : %s - rv:%s", resourcePath, item.GetResourceVersion())
-						case watch.Deleted:
-							klog.V(4).Infof("!!! Resource deleted : %s - rv:%s", resourcePath, item.GetResourceVersion())
+						err = index.add(resourcePath, item)
+						if err != nil {
+							return err
 						}
+						listed++
+					}
+					listOptions.Continue = unstructuredList.GetContinue()
+					if listOptions.Continue == "" {
+						break
 					}
-					watchEventList = append(watchEventList, e)
 				}
-				klog.V(4).Infof("+++ %s watch exiting", watchgvr[gvr])
-			}()
-
-			blog.Infof("-- %3d %s", len(unstructuredList.Items), resource.Name)
+			}
 
-			// Join resource list
-			snapshotList = append(snapshotList, unstructuredList.Items...)
+			blog.Infof("-- %3d %s", listed, resource.Name)
 		}
 	}
 
@@ -200,6 +309,7 @@ func SnapshotWithClient(
 		return fmt.Errorf("Making end config map marker failed : %s", err.Error())
 	}
 	endRV := marker.ObjectMeta.ResourceVersion
+
 	blog.Infof("Start resource version : %s", startRV)
 	blog.Infof("End resource version   : %s", endRV)
 
@@ -208,6 +318,8 @@ func SnapshotWithClient(
 	time.Sleep(3 * time.Second)
 
 	// Sync resources
+	watchEventMu.Lock()
+	defer watchEventMu.Unlock()
 	blog.Infof("Syncing modified resources: %d events", len(watchEventList))
 	for _, e := range watchEventList {
 		item, ok := e.Object.(*unstructured.Unstructured)
@@ -219,22 +331,23 @@ func SnapshotWithClient(
 				blog.Infof("-- [%s] rv:%s %s - %s", e.Type, item.GetResourceVersion(), resourcePath, message)
 				continue
 			}
-			targetIndex := -1
-			for i, u := range snapshotList {
-				targetItemPath, _ := sr.ResourcePath(&u)
-				if targetItemPath == resourcePath {
-					targetIndex = i
-					break
-				}
+			if !scope.isIncludedItem(item) {
+				message = "ignored, out of the snapshot scope"
+				blog.Infof("-- [%s] rv:%s %s - %s", e.Type, item.GetResourceVersion(), resourcePath, message)
+				continue
 			}
-			if targetIndex >= 0 {
-				if isNewerValidResourceVersion(item.GetResourceVersion(), snapshotList[targetIndex].GetResourceVersion()) {
+			target := index.get(resourcePath)
+			if target != nil {
+				if isNewerValidResourceVersion(item.GetResourceVersion(), target.resourceVersion) {
 					switch e.Type {
 					case watch.Added, watch.Modified:
-						snapshotList[targetIndex] = *item
+						err = index.add(resourcePath, item)
+						if err != nil {
+							return err
+						}
 						message = "applied"
 					case watch.Deleted:
-						snapshotList = append(snapshotList[:targetIndex], snapshotList[targetIndex+1:]...)
+						index.delete(resourcePath)
 						message = "deleted"
 					}
 				} else {
@@ -243,7 +356,10 @@ func SnapshotWithClient(
 			} else {
 				switch e.Type {
 				case watch.Added, watch.Modified:
-					snapshotList = append(snapshotList, *item)
+					err = index.add(resourcePath, item)
+					if err != nil {
+						return err
+					}
 					message = "added"
 				case watch.Deleted:
 					message = "already deleted"
@@ -255,6 +371,22 @@ func SnapshotWithClient(
 		}
 	}
 
+	// CSI VolumeSnapshots of PVCs
+	snapshot.Status.VolumeSnapshots = nil
+	if snapshot.Spec.VolumeSnapshots != nil {
+		snapshot.Status.VolumeSnapshots, err = takeVolumeSnapshots(ctx, snapshot, dynamicClient, sr, scope, blog)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Post hooks run after volumes are captured
+	postHooksDone = true
+	err = runHooks(ctx, snapshot, snapshot.Spec.PostHooks, hookPhasePost, kubeClient, executor, blog)
+	if err != nil {
+		return err
+	}
+
 	// snapshot file
 	snapshotFile, err := os.Create("/tmp/" + snapshot.ObjectMeta.Name + ".tgz")
 	if err != nil {
@@ -269,22 +401,23 @@ func SnapshotWithClient(
 	// Write resources into json
 	snapshot.Status.Contents = nil
 	snapshot.Status.NumberOfContents = 0
-	for _, item := range snapshotList {
+	snapshot.Status.NumberOfStoredContents = 0
+	snapshot.Status.Deleted = nil
+	snapshot.Status.Scope = scope.status()
+	digests := make(map[string]string)
+	manifest := make(map[string]string)
+	err = index.walk(func(entry *snapshotEntry, content []byte) error {
 
-		// Resources stored according to api path.
-		itempath, _ := sr.ResourcePath(&item)
-		// Namespaces and CRDs stored on top level.
-		if item.GetKind() == "Namespace" {
-			itempath = filepath.Join("/namespaces", item.GetName())
-		}
-		if item.GetKind() == "CustomResourceDefinition" {
-			itempath = filepath.Join("/crds", item.GetName())
-		}
+		itempath := entry.itempath
+		digests[itempath] = entry.digest
 
-		// snapshot item
-		content, err := item.MarshalJSON()
-		if err != nil {
-			return fmt.Errorf("Marshalling json failed : %s", err.Error())
+		// Contents
+		snapshot.Status.Contents = append(snapshot.Status.Contents, itempath)
+		snapshot.Status.NumberOfContents++
+
+		// Store only changed resources in incremental snapshot
+		if parentDigests != nil && parentDigests[itempath] == digests[itempath] {
+			return nil
 		}
 		hdr := &tar.Header{
 			Name:     filepath.Join(snapshot.ObjectMeta.Name, itempath+".json"),
@@ -299,12 +432,45 @@ func SnapshotWithClient(
 		if _, err := tarWriter.Write(content); err != nil {
 			return fmt.Errorf("Tar writer writing content failed : %s", err.Error())
 		}
+		manifest[itempath+".json"] = contentDigest(content)
+		snapshot.Status.NumberOfStoredContents++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		// Contents
-		snapshot.Status.Contents = append(snapshot.Status.Contents, itempath)
-		snapshot.Status.NumberOfContents++
+	// Resources deleted since parent snapshot
+	for itempath := range parentDigests {
+		if _, ok := digests[itempath]; !ok {
+			snapshot.Status.Deleted = append(snapshot.Status.Deleted, itempath)
+		}
+	}
+	sort.Strings(snapshot.Status.Deleted)
+	if parentDigests != nil {
+		blog.Infof("Stored %d changed resources, %d deleted since parent", snapshot.Status.NumberOfStoredContents, len(snapshot.Status.Deleted))
 	}
 
+	// Store digests of all contents as contents.json
+	contentsDigest, err := json.Marshal(digests)
+	if err != nil {
+		return fmt.Errorf("Marshalling contents.json failed : %s", err.Error())
+	}
+	hdr := &tar.Header{
+		Name:     filepath.Join(snapshot.ObjectMeta.Name, contentsDigestFile),
+		Size:     int64(len(contentsDigest)),
+		Typeflag: tar.TypeReg,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tar writer contents.json header failed : %s", err.Error())
+	}
+	if _, err := tarWriter.Write(contentsDigest); err != nil {
+		return fmt.Errorf("tar writer contents.json content failed : %s", err.Error())
+	}
+	manifest[contentsDigestFile] = contentDigest(contentsDigest)
+
 	blog.Info("Making snapshot.json")
 	snapshot.Status.SnapshotTimestamp = marker.ObjectMeta.CreationTimestamp
 	// Set expiration
@@ -324,14 +490,18 @@ func SnapshotWithClient(
 	snapshotCopy.TypeMeta.SetGroupVersionKind(cbv1alpha1.SchemeGroupVersion.WithKind("Snapshot"))
 	snapshotCopy.ObjectMeta.SetResourceVersion("")
 	snapshotCopy.ObjectMeta.SetUID("")
+	// Never store credentials in the object store, also in the applied spec and managed fields
+	snapshotCopy.Spec.Kubeconfig = ""
+	delete(snapshotCopy.ObjectMeta.Annotations, lastAppliedAnnotation)
+	snapshotCopy.ObjectMeta.ManagedFields = nil
 
 	// Store snapshot resource as snapshot.json
 	snapshotResource, err := json.Marshal(snapshotCopy)
 	if err != nil {
 		return fmt.Errorf("Marshalling snapshot.json failed : %s", err.Error())
 	}
-	hdr := &tar.Header{
-		Name:     filepath.Join(snapshot.ObjectMeta.Name, "snapshot.json"),
+	hdr = &tar.Header{
+		Name:     filepath.Join(snapshot.ObjectMeta.Name, snapshotResourceFile),
 		Size:     int64(len(snapshotResource)),
 		Typeflag: tar.TypeReg,
 		Mode:     0755,
@@ -343,6 +513,26 @@ func SnapshotWithClient(
 	if _, err := tarWriter.Write(snapshotResource); err != nil {
 		return fmt.Errorf("tar writer snapshot.json content failed : %s", err.Error())
 	}
+	manifest[snapshotResourceFile] = contentDigest(snapshotResource)
+
+	// Store digests of all entries as manifest.json for verification
+	manifestContent, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("Marshalling manifest.json failed : %s", err.Error())
+	}
+	hdr = &tar.Header{
+		Name:     filepath.Join(snapshot.ObjectMeta.Name, snapshotManifestFile),
+		Size:     int64(len(manifestContent)),
+		Typeflag: tar.TypeReg,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tar writer manifest.json header failed : %s", err.Error())
+	}
+	if _, err := tarWriter.Write(manifestContent); err != nil {
+		return fmt.Errorf("tar writer manifest.json content failed : %s", err.Error())
+	}
 
 	tarWriter.Close()
 	tgz.Close()
@@ -356,6 +546,7 @@ var obstPermErrors = []string{
 	"SignatureDoesNotMatch",
 	"InvalidAccessKeyId",
 	"NoSuchBucket",
+	objectstore.EncryptionErrorPrefix,
 }
 
 func objectstorePermError(error string) bool {
@@ -367,8 +558,9 @@ func objectstorePermError(error string) bool {
 	return false
 }
 
-// UploadSnapshot uploads a snapshot tgz file to the bucket
-func UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+// UploadSnapshot uploads a snapshot tgz file to the bucket, the upload is aborted and the file is removed
+// when the context is cancelled
+func UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
 
 	// Snapshot log
 	blog := utils.NewNamedLog("snapshot:" + snapshot.ObjectMeta.Name)
@@ -378,9 +570,20 @@ func UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstor
 	if err != nil {
 		return backoff.Permanent(fmt.Errorf("Re-opening tgz file failed : %s", err.Error()))
 	}
+	// Checksum of the archive for verification
+	checksum, err := FileChecksum(snapshotFile.Name())
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("Checksum of tgz file failed : %s", err.Error()))
+	}
+	snapshot.Status.Checksum = checksum
+
 	blog.Infof("Uploading file %s", snapshot.ObjectMeta.Name+".tgz")
-	err = bucket.Upload(snapshotFile, snapshot.ObjectMeta.Name+".tgz")
+	err = bucket.UploadWithContext(ctx, snapshotFile, snapshot.ObjectMeta.Name+".tgz")
 	if err != nil {
+		if ctx.Err() != nil {
+			os.Remove(snapshotFile.Name())
+			return cancelled(ctx)
+		}
 		if objectstorePermError(err.Error()) {
 			return backoff.Permanent(fmt.Errorf("Uploading tgz file failed : %s", err.Error()))
 		}
@@ -402,6 +605,7 @@ func UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstor
 	blog.Infof("-- num resources    : %d", snapshot.Status.NumberOfContents)
 	blog.Infof("-- stored file size : %d", snapshot.Status.StoredFileSize)
 	blog.Infof("-- stored timestamp : %s", snapshot.Status.StoredTimestamp)
+	blog.Infof("-- checksum         : %s", snapshot.Status.Checksum)
 
 	return nil
 }
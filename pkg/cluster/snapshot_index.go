@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Page size of list calls on taking a snapshot
+const snapshotListPageSize = 500
+
+// snapshotEntry is a resource listed or watched, its content is in the spool file
+type snapshotEntry struct {
+	itempath        string
+	resourceVersion string
+	digest          string
+	offset          int64
+	size            int64
+	deleted         bool
+}
+
+// snapshotIndex indexes snapshot resources by resource path,
+// contents are spooled into a file not to keep all resources in memory
+type snapshotIndex struct {
+	spool   *os.File
+	offset  int64
+	entries map[string]*snapshotEntry
+	order   []string
+}
+
+// newSnapshotIndex returns new snapshotIndex with a spool file /tmp/[name].spool
+func newSnapshotIndex(name string) (*snapshotIndex, error) {
+	spool, err := os.Create("/tmp/" + name + ".spool")
+	if err != nil {
+		return nil, fmt.Errorf("Creating spool file failed : %s", err.Error())
+	}
+	return &snapshotIndex{
+		spool:   spool,
+		entries: make(map[string]*snapshotEntry),
+	}, nil
+}
+
+// close and remove the spool file
+func (x *snapshotIndex) close() {
+	x.spool.Close()
+	os.Remove(x.spool.Name())
+}
+
+// snapshotItemPath returns the path for storing the resource in a snapshot
+func snapshotItemPath(item *unstructured.Unstructured, resourcePath string) string {
+	// Namespaces and CRDs stored on top level.
+	switch item.GetKind() {
+	case "Namespace":
+		return filepath.Join("/namespaces", item.GetName())
+	case "CustomResourceDefinition":
+		return filepath.Join("/crds", item.GetName())
+	}
+	// Resources stored according to api path.
+	return resourcePath
+}
+
+// add or replace the resource of the path
+func (x *snapshotIndex) add(resourcePath string, item *unstructured.Unstructured) error {
+	content, err := item.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("Marshalling json failed : %s", err.Error())
+	}
+	n, err := x.spool.WriteAt(content, x.offset)
+	if err != nil {
+		return fmt.Errorf("Writing spool file failed : %s", err.Error())
+	}
+	entry, ok := x.entries[resourcePath]
+	if !ok {
+		entry = &snapshotEntry{}
+		x.entries[resourcePath] = entry
+		x.order = append(x.order, resourcePath)
+	}
+	*entry = snapshotEntry{
+		itempath:        snapshotItemPath(item, resourcePath),
+		resourceVersion: item.GetResourceVersion(),
+		digest:          contentDigest(content),
+		offset:          x.offset,
+		size:            int64(n),
+	}
+	x.offset += int64(n)
+	return nil
+}
+
+// get the resource of the path, nil if not found or deleted
+func (x *snapshotIndex) get(resourcePath string) *snapshotEntry {
+	entry, ok := x.entries[resourcePath]
+	if !ok || entry.deleted {
+		return nil
+	}
+	return entry
+}
+
+// delete the resource of the path
+func (x *snapshotIndex) delete(resourcePath string) {
+	if entry, ok := x.entries[resourcePath]; ok {
+		entry.deleted = true
+	}
+}
+
+// walk calls fn for each resource in the listed order
+func (x *snapshotIndex) walk(fn func(entry *snapshotEntry, content []byte) error) error {
+	for _, resourcePath := range x.order {
+		entry := x.entries[resourcePath]
+		if entry.deleted {
+			continue
+		}
+		content := make([]byte, entry.size)
+		_, err := x.spool.ReadAt(content, entry.offset)
+		if err != nil {
+			return fmt.Errorf("Reading spool file failed : %s", err.Error())
+		}
+		err = fn(entry, content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
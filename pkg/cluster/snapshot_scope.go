@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// snapshotScope filters resources to take a snapshot
+type snapshotScope struct {
+	spec     *cbv1alpha1.SnapshotSpec
+	selector labels.Selector
+}
+
+// newSnapshotScope returns new snapshotScope for the snapshot spec
+func newSnapshotScope(spec *cbv1alpha1.SnapshotSpec) (*snapshotScope, error) {
+	s := &snapshotScope{spec: spec}
+	if spec.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(spec.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label selector : %s", err.Error())
+		}
+		s.selector = selector
+	}
+	return s, nil
+}
+
+// partial returns true if the snapshot does not cover whole cluster
+func (s *snapshotScope) partial() bool {
+	return len(s.spec.IncludeNamespaces) > 0 ||
+		len(s.spec.ExcludeNamespaces) > 0 ||
+		s.selector != nil ||
+		len(s.spec.IncludeResources) > 0 ||
+		len(s.spec.ExcludeResources) > 0
+}
+
+// status returns the scope recorded in the snapshot status, nil for whole cluster
+func (s *snapshotScope) status() *cbv1alpha1.SnapshotScope {
+	if !s.partial() {
+		return nil
+	}
+	scope := &cbv1alpha1.SnapshotScope{
+		IncludeNamespaces: s.spec.IncludeNamespaces,
+		ExcludeNamespaces: s.spec.ExcludeNamespaces,
+		IncludeResources:  s.spec.IncludeResources,
+		ExcludeResources:  s.spec.ExcludeResources,
+	}
+	if s.selector != nil {
+		scope.LabelSelector = s.selector.String()
+	}
+	return scope
+}
+
+// resourceMatched checks the resource matches with 'resource' or 'resource.group' in the list
+func resourceMatched(resource, group string, list []string) bool {
+	for _, r := range list {
+		if r == resource || (group != "" && r == resource+"."+group) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncludedResource checks the resource type is in the scope
+func (s *snapshotScope) isIncludedResource(resource metav1.APIResource, group string) bool {
+	if resourceMatched(resource.Name, group, s.spec.ExcludeResources) {
+		return false
+	}
+	if len(s.spec.IncludeResources) > 0 {
+		if resourceMatched(resource.Name, group, s.spec.IncludeResources) {
+			return true
+		}
+		// namespaces and persistentvolumes of included namespaces always follow
+		if !resource.Namespaced && len(s.spec.IncludeNamespaces) > 0 && group == "" {
+			return resource.Name == "namespaces" || resource.Name == "persistentvolumes"
+		}
+		return false
+	}
+	// cluster resources are not included with included namespaces unless listed in include resources
+	if !resource.Namespaced && len(s.spec.IncludeNamespaces) > 0 {
+		return group == "" && (resource.Name == "namespaces" || resource.Name == "persistentvolumes")
+	}
+	return true
+}
+
+// listNamespaces returns namespaces to list or watch the resource, "" for all namespaces
+func (s *snapshotScope) listNamespaces(resource metav1.APIResource) []string {
+	if resource.Namespaced && len(s.spec.IncludeNamespaces) > 0 {
+		return s.spec.IncludeNamespaces
+	}
+	return []string{""}
+}
+
+// listOptions returns list or watch options for the resource
+func (s *snapshotScope) listOptions(resource metav1.APIResource, group string) metav1.ListOptions {
+	options := metav1.ListOptions{}
+	if s.selector != nil && !isNamespaceOrPV(resource.Name, group) {
+		options.LabelSelector = s.selector.String()
+	}
+	return options
+}
+
+func isNamespaceOrPV(resource, group string) bool {
+	return group == "" && (resource == "namespaces" || resource == "persistentvolumes")
+}
+
+func (s *snapshotScope) isIncludedNamespace(namespace string) bool {
+	for _, n := range s.spec.ExcludeNamespaces {
+		if namespace == n {
+			return false
+		}
+	}
+	if len(s.spec.IncludeNamespaces) == 0 {
+		return true
+	}
+	for _, n := range s.spec.IncludeNamespaces {
+		if namespace == n {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncludedItem checks the resource is in the scope
+func (s *snapshotScope) isIncludedItem(item *unstructured.Unstructured) bool {
+	switch item.GetKind() {
+	case "Namespace":
+		return s.isIncludedNamespace(item.GetName())
+	case "PersistentVolume":
+		// PVs follow the namespace of the bound PVC
+		claimNamespace, _, _ := unstructured.NestedString(item.Object, "spec", "claimRef", "namespace")
+		if claimNamespace == "" {
+			return len(s.spec.IncludeNamespaces) == 0
+		}
+		return s.isIncludedNamespace(claimNamespace)
+	}
+	if item.GetNamespace() != "" && !s.isIncludedNamespace(item.GetNamespace()) {
+		return false
+	}
+	if s.selector != nil && !s.selector.Matches(labels.Set(item.GetLabels())) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Prefix of the archive checksum in the snapshot status
+const checksumPrefix = "sha256:"
+
+// CorruptedError is returned when a snapshot archive does not match its checksum or manifest
+type CorruptedError struct {
+	Name   string
+	Reason string
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("Snapshot archive %s.tgz corrupted : %s", e.Name, e.Reason)
+}
+
+// IsCorruptedError checks the error is a corrupted snapshot archive
+func IsCorruptedError(err error) bool {
+	_, ok := err.(*CorruptedError)
+	return ok
+}
+
+// FileChecksum returns the SHA-256 checksum of the file as stored in the snapshot status
+func FileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return checksumPrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifySnapshotFile checks the archive file of the snapshot with the checksum and the manifest in it.
+// Older archives without the checksum or the manifest are checked only for readability.
+func verifySnapshotFile(file, name, checksum string) error {
+	if checksum != "" {
+		actual, err := FileChecksum(file)
+		if err != nil {
+			return err
+		}
+		if actual != checksum {
+			return &CorruptedError{Name: name, Reason: fmt.Sprintf("checksum %s not matched with %s", actual, checksum)}
+		}
+	}
+
+	digests := make(map[string]string)
+	var manifest map[string]string
+	err := walkArchive(file, name, func(path string, tarReader *tar.Reader) error {
+		bytes, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		if path == snapshotManifestFile {
+			manifest = make(map[string]string)
+			return json.Unmarshal(bytes, &manifest)
+		}
+		digests[path] = contentDigest(bytes)
+		return nil
+	})
+	if err != nil {
+		return &CorruptedError{Name: name, Reason: "reading archive failed : " + err.Error()}
+	}
+	if manifest == nil {
+		return nil
+	}
+
+	// every entry must be in the manifest with the same digest
+	mismatched := make([]string, 0)
+	for path, digest := range manifest {
+		if digests[path] != digest {
+			mismatched = append(mismatched, path)
+		}
+	}
+	for path := range digests {
+		if _, ok := manifest[path]; !ok {
+			mismatched = append(mismatched, path)
+		}
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		msg := fmt.Sprintf("%d entries not matched with manifest", len(mismatched))
+		if len(mismatched) > 5 {
+			mismatched = mismatched[0:5]
+		}
+		return &CorruptedError{Name: name, Reason: msg + " : " + fmt.Sprint(mismatched)}
+	}
+	return nil
+}
+
+// VerifySnapshot downloads the snapshot archive and verifies it with the checksum and the manifest
+func VerifySnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	// Snapshot log
+	blog := utils.NewNamedLog("snapshot:" + snapshot.ObjectMeta.Name)
+
+	// separated from the file used by snapshots and restores
+	name := snapshot.ObjectMeta.Name
+	file := "/tmp/" + name + ".verify.tgz"
+	blog.Infof("Verifying file %s", name+".tgz")
+	err := downloadObjectFile(name, file, bucket)
+	defer os.Remove(file)
+	if err != nil {
+		return fmt.Errorf("Downloading %s.tgz for verification failed : %s", name, err.Error())
+	}
+	err = verifySnapshotFile(file, name, snapshot.Status.Checksum)
+	if err != nil {
+		return err
+	}
+	blog.Info("Verification completed")
+	return nil
+}
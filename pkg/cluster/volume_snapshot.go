@@ -0,0 +1,303 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Label of VolumeSnapshots and VolumeSnapshotContents made by k8s-snap
+const volumeSnapshotLabel = "clustersnapshot.rywt.io/snapshot"
+
+// CSI snapshot API group
+const volumeSnapshotGroup = "snapshot.storage.k8s.io"
+
+// Default timeout for VolumeSnapshots to be ready to use
+const defaultVolumeSnapshotReadyTimeout = 10 * time.Minute
+
+// Interval to check VolumeSnapshots
+var volumeSnapshotPollInterval = 5 * time.Second
+
+// volumeSnapshotVersion returns the served version of the CSI snapshot API
+func volumeSnapshotVersion(sr *ServerResources) (string, error) {
+	for _, version := range []string{"v1", "v1beta1"} {
+		_, err := sr.ResourceName(schema.GroupVersionKind{Group: volumeSnapshotGroup, Version: version, Kind: "VolumeSnapshot"})
+		if err == nil {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("VolumeSnapshot API %s not found in server resources", volumeSnapshotGroup)
+}
+
+// volumeSnapshotName returns the name of the VolumeSnapshot for the PVC in the snapshot
+func volumeSnapshotName(snapshotName, pvcName string) string {
+	name := snapshotName + "-" + pvcName
+	if len(name) > 253 {
+		name = name[0:253]
+	}
+	return name
+}
+
+// takeVolumeSnapshots creates VolumeSnapshots of selected PVCs in the scope and waits for them ready to use
+func takeVolumeSnapshots(ctx context.Context, snapshot *cbv1alpha1.Snapshot, dyn dynamic.Interface,
+	sr *ServerResources, scope *snapshotScope, blog *utils.NamedLog) ([]cbv1alpha1.VolumeSnapshotRecord, error) {
+
+	spec := snapshot.Spec.VolumeSnapshots
+	version, err := volumeSnapshotVersion(sr)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+	vsGVR := schema.GroupVersionResource{Group: volumeSnapshotGroup, Version: version, Resource: "volumesnapshots"}
+
+	// Select bound PVCs
+	listOptions := metav1.ListOptions{}
+	if spec.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(spec.LabelSelector)
+		if err != nil {
+			return nil, backoff.Permanent(fmt.Errorf("Invalid volume snapshot label selector : %s", err.Error()))
+		}
+		listOptions.LabelSelector = selector.String()
+	}
+	pvcGVR := schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
+	pvcs, err := dyn.Resource(pvcGVR).Namespace(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("Listing PVCs for volume snapshots failed : %s", err.Error())
+	}
+
+	blog.Info("Taking volume snapshots")
+	records := make([]cbv1alpha1.VolumeSnapshotRecord, 0)
+	for _, pvc := range pvcs.Items {
+		if !scope.isIncludedItem(&pvc) {
+			continue
+		}
+		phase, _, _ := unstructured.NestedString(pvc.Object, "status", "phase")
+		if phase != "Bound" {
+			continue
+		}
+		class, _, _ := unstructured.NestedString(pvc.Object, "spec", "storageClassName")
+		if class == "" {
+			class = pvc.GetAnnotations()["volume.beta.kubernetes.io/storage-class"]
+		}
+		if len(spec.StorageClasses) > 0 && !isInList(class, spec.StorageClasses) {
+			continue
+		}
+
+		// Create VolumeSnapshot, already existing one is made on the previous try
+		name := volumeSnapshotName(snapshot.ObjectMeta.Name, pvc.GetName())
+		vs := &unstructured.Unstructured{}
+		vs.SetGroupVersionKind(vsGVR.GroupVersion().WithKind("VolumeSnapshot"))
+		vs.SetName(name)
+		vs.SetNamespace(pvc.GetNamespace())
+		vs.SetLabels(map[string]string{volumeSnapshotLabel: snapshot.ObjectMeta.Name})
+		_ = unstructured.SetNestedField(vs.Object, pvc.GetName(), "spec", "source", "persistentVolumeClaimName")
+		if spec.VolumeSnapshotClassName != "" {
+			_ = unstructured.SetNestedField(vs.Object, spec.VolumeSnapshotClassName, "spec", "volumeSnapshotClassName")
+		}
+		blog.Infof("-- VolumeSnapshot %s/%s for PVC %s", pvc.GetNamespace(), name, pvc.GetName())
+		_, err := dyn.Resource(vsGVR).Namespace(pvc.GetNamespace()).Create(ctx, vs, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("Creating VolumeSnapshot %s/%s failed : %s", pvc.GetNamespace(), name, err.Error())
+		}
+		records = append(records, cbv1alpha1.VolumeSnapshotRecord{
+			Namespace:          pvc.GetNamespace(),
+			PVCName:            pvc.GetName(),
+			VolumeSnapshotName: name,
+		})
+	}
+
+	// Wait for all VolumeSnapshots ready to use
+	timeout := defaultVolumeSnapshotReadyTimeout
+	if spec.ReadyTimeout != nil && spec.ReadyTimeout.Duration > 0 {
+		timeout = spec.ReadyTimeout.Duration
+	}
+	for i := range records {
+		err := waitForVolumeSnapshot(ctx, dyn, version, &records[i], timeout, blog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// DeleteVolumeSnapshots deletes VolumeSnapshots taken by the snapshot in its cluster, localClient is used
+// for reading the kubeconfig secret
+func DeleteVolumeSnapshots(ctx context.Context, snapshot *cbv1alpha1.Snapshot, localClient kubernetes.Interface) error {
+
+	// kubeClient for external cluster.
+	kubeClient, err := buildKubeClient(ctx, localClient, snapshot.ObjectMeta.Namespace, snapshot.Spec.Kubeconfig, snapshot.Spec.KubeconfigSecretRef)
+	if err != nil {
+		return err
+	}
+
+	// DynamicClient for external cluster.
+	dynamicClient, err := buildDynamicClient(ctx, localClient, snapshot.ObjectMeta.Namespace, snapshot.Spec.Kubeconfig, snapshot.Spec.KubeconfigSecretRef)
+	if err != nil {
+		return err
+	}
+
+	spr, err := kubeClient.Discovery().ServerResources()
+	if err != nil {
+		return fmt.Errorf("Get server preferred resources failed : %s", err.Error())
+	}
+	return deleteVolumeSnapshots(ctx, snapshot, dynamicClient, newServerResources(spr))
+}
+
+// deleteVolumeSnapshots deletes VolumeSnapshots of PVCs labeled with the snapshot name, VolumeSnapshots
+// restored from the snapshot have the same label but no source PVC
+func deleteVolumeSnapshots(ctx context.Context, snapshot *cbv1alpha1.Snapshot, dyn dynamic.Interface, sr *ServerResources) error {
+	version, err := volumeSnapshotVersion(sr)
+	if err != nil {
+		// no VolumeSnapshots without the API
+		return nil
+	}
+	vsGVR := schema.GroupVersionResource{Group: volumeSnapshotGroup, Version: version, Resource: "volumesnapshots"}
+	listOptions := metav1.ListOptions{LabelSelector: volumeSnapshotLabel + "=" + snapshot.ObjectMeta.Name}
+	vsList, err := dyn.Resource(vsGVR).Namespace(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return fmt.Errorf("Listing VolumeSnapshots of snapshot %s failed : %s", snapshot.ObjectMeta.Name, err.Error())
+	}
+	for _, vs := range vsList.Items {
+		pvcName, _, _ := unstructured.NestedString(vs.Object, "spec", "source", "persistentVolumeClaimName")
+		if pvcName == "" {
+			continue
+		}
+		err = dyn.Resource(vsGVR).Namespace(vs.GetNamespace()).Delete(ctx, vs.GetName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("Deleting VolumeSnapshot %s/%s failed : %s", vs.GetNamespace(), vs.GetName(), err.Error())
+		}
+		klog.Infof("snapshot:%s VolumeSnapshot %s/%s deleted", snapshot.ObjectMeta.Name, vs.GetNamespace(), vs.GetName())
+	}
+	return nil
+}
+
+// waitForVolumeSnapshot waits for the VolumeSnapshot ready to use and records its content
+func waitForVolumeSnapshot(ctx context.Context, dyn dynamic.Interface, version string,
+	record *cbv1alpha1.VolumeSnapshotRecord, timeout time.Duration, blog *utils.NamedLog) error {
+
+	vsGVR := schema.GroupVersionResource{Group: volumeSnapshotGroup, Version: version, Resource: "volumesnapshots"}
+	var vs *unstructured.Unstructured
+	var vsErr string
+	err := wait.PollImmediate(volumeSnapshotPollInterval, timeout, func() (bool, error) {
+		var err error
+		vs, err = dyn.Resource(vsGVR).Namespace(record.Namespace).Get(ctx, record.VolumeSnapshotName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		vsErr, _, _ = unstructured.NestedString(vs.Object, "status", "error", "message")
+		if vsErr != "" {
+			return true, nil
+		}
+		ready, _, _ := unstructured.NestedBool(vs.Object, "status", "readyToUse")
+		return ready, nil
+	})
+	if vsErr != "" {
+		return backoff.Permanent(fmt.Errorf("VolumeSnapshot %s/%s failed : %s", record.Namespace, record.VolumeSnapshotName, vsErr))
+	}
+	if err != nil {
+		return fmt.Errorf("Waiting for VolumeSnapshot %s/%s ready to use failed : %s", record.Namespace, record.VolumeSnapshotName, err.Error())
+	}
+	if restoreSize, found, _ := unstructured.NestedFieldNoCopy(vs.Object, "status", "restoreSize"); found {
+		record.RestoreSize = fmt.Sprint(restoreSize)
+	}
+
+	// Snapshot handle in the bound content is restored on other clusters
+	record.VolumeSnapshotContentName, _, _ = unstructured.NestedString(vs.Object, "status", "boundVolumeSnapshotContentName")
+	vscGVR := schema.GroupVersionResource{Group: volumeSnapshotGroup, Version: version, Resource: "volumesnapshotcontents"}
+	vsc, err := dyn.Resource(vscGVR).Get(ctx, record.VolumeSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Getting VolumeSnapshotContent %s failed : %s", record.VolumeSnapshotContentName, err.Error())
+	}
+	record.Driver, _, _ = unstructured.NestedString(vsc.Object, "spec", "driver")
+	record.VolumeSnapshotClassName, _, _ = unstructured.NestedString(vsc.Object, "spec", "volumeSnapshotClassName")
+	record.SnapshotHandle, _, _ = unstructured.NestedString(vsc.Object, "status", "snapshotHandle")
+	if record.SnapshotHandle == "" {
+		return fmt.Errorf("VolumeSnapshotContent %s has no snapshot handle", record.VolumeSnapshotContentName)
+	}
+	blog.Infof("-- VolumeSnapshot %s/%s ready : content %s handle %s", record.Namespace, record.VolumeSnapshotName,
+		record.VolumeSnapshotContentName, record.SnapshotHandle)
+	return nil
+}
+
+// volumeSnapshotContentName returns the name of the VolumeSnapshotContent restored for the VolumeSnapshot in the namespace
+func volumeSnapshotContentName(restore *cbv1alpha1.Restore, namespace string, record *cbv1alpha1.VolumeSnapshotRecord) string {
+	contentName := "k8s-snap-" + restore.ObjectMeta.Name + "-" + namespace + "-" + record.VolumeSnapshotName
+	if len(contentName) > 253 {
+		contentName = contentName[0:253]
+	}
+	return contentName
+}
+
+// restoreVolumeSnapshot creates a pre-provisioned VolumeSnapshotContent with the snapshot handle and
+// a VolumeSnapshot bound to it in the namespace of the PVC. Results of both are set in the pair,
+// returns false when the PVC cannot be restored from the VolumeSnapshot.
+func restoreVolumeSnapshot(ctx context.Context, pair *pvPair, dyn dynamic.Interface, p *preference,
+	restore *cbv1alpha1.Restore, sr *ServerResources) bool {
+
+	record := pair.volumeSnapshot
+	gv := schema.GroupVersion{Group: volumeSnapshotGroup, Version: pair.volumeSnapshotVersion}
+	namespace := pair.pvcItem.GetNamespace()
+	contentName := volumeSnapshotContentName(restore, namespace, record)
+	labels := map[string]string{volumeSnapshotLabel: restore.Spec.SnapshotName}
+
+	vsc := &unstructured.Unstructured{}
+	vsc.SetGroupVersionKind(gv.WithKind("VolumeSnapshotContent"))
+	vsc.SetName(contentName)
+	vsc.SetLabels(labels)
+	_ = unstructured.SetNestedField(vsc.Object, "Retain", "spec", "deletionPolicy")
+	_ = unstructured.SetNestedField(vsc.Object, record.Driver, "spec", "driver")
+	_ = unstructured.SetNestedField(vsc.Object, record.SnapshotHandle, "spec", "source", "snapshotHandle")
+	_ = unstructured.SetNestedField(vsc.Object, namespace, "spec", "volumeSnapshotRef", "namespace")
+	_ = unstructured.SetNestedField(vsc.Object, record.VolumeSnapshotName, "spec", "volumeSnapshotRef", "name")
+	if record.VolumeSnapshotClassName != "" {
+		_ = unstructured.SetNestedField(vsc.Object, record.VolumeSnapshotClassName, "spec", "volumeSnapshotClassName")
+	}
+	_, err := createItem(ctx, vsc, dyn, sr, restore.Spec.DryRun)
+	if err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			pair.vscResult = resultFailed
+			pair.vscResultMsg = fmt.Sprintf("Creating VolumeSnapshotContent %s failed : %s", contentName, err.Error())
+			return false
+		}
+		pair.vscResult = resultAlreadyExisted
+	} else {
+		pair.vscResult = resultCreated
+	}
+
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(gv.WithKind("VolumeSnapshot"))
+	vs.SetName(record.VolumeSnapshotName)
+	vs.SetNamespace(namespace)
+	vs.SetLabels(labels)
+	_ = unstructured.SetNestedField(vs.Object, contentName, "spec", "source", "volumeSnapshotContentName")
+	if record.VolumeSnapshotClassName != "" {
+		_ = unstructured.SetNestedField(vs.Object, record.VolumeSnapshotClassName, "spec", "volumeSnapshotClassName")
+	}
+	_, err = createItem(ctx, vs, dyn, sr, restore.Spec.DryRun)
+	if err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			pair.vsResult = resultAlreadyExisted
+			return true
+		} else if restore.Spec.DryRun && p.isDryRunNamespaceNotFound(vs, err) {
+			pair.vsResult = resultCreated
+			return true
+		}
+		pair.vsResult = resultFailed
+		pair.vsResultMsg = fmt.Sprintf("Creating VolumeSnapshot %s/%s failed : %s", namespace, record.VolumeSnapshotName, err.Error())
+		return false
+	}
+	pair.vsResult = resultCreated
+	return true
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+const namespace = "k8s_snap"
+
+var (
+	// SnapshotDuration is the duration of taking and uploading snapshots
+	SnapshotDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_duration_seconds",
+		Help:      "Duration of taking and uploading snapshots by result phase.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"phase"})
+
+	// RestoreDuration is the duration of restores
+	RestoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "restore_duration_seconds",
+		Help:      "Duration of restores by result phase.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"phase"})
+
+	// SnapshotRetries counts backoff retries on snapshot operations
+	SnapshotRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshot_retries_total",
+		Help:      "Number of backoff retries on snapshot operations.",
+	}, []string{"operation"})
+
+	// ObjectstoreDuration is the latency of objectstore operations
+	ObjectstoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "objectstore_operation_duration_seconds",
+		Help:      "Latency of objectstore operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"objectstore", "operation"})
+
+	// ObjectstoreErrors counts errors of objectstore operations
+	ObjectstoreErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "objectstore_operation_errors_total",
+		Help:      "Number of errors on objectstore operations.",
+	}, []string{"objectstore", "operation"})
+
+	// Orphans is the number of orphans found on the last object sync
+	Orphans = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_orphans",
+		Help:      "Number of orphan objects and snapshots without valid objects found on the last object sync.",
+	}, []string{"kind"})
+
+	// Registry for k8s-snap metrics
+	Registry = prometheus.NewRegistry()
+)
+
+// Source provides the controller state read on scraping
+type Source interface {
+	ListSnapshots() ([]*cbv1alpha1.Snapshot, error)
+	ListRestores() ([]*cbv1alpha1.Restore, error)
+	QueueDepths() map[string]int
+}
+
+var (
+	sourceMu sync.RWMutex
+	source   Source
+)
+
+// SetSource sets the controller state source
+func SetSource(s Source) {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	source = s
+}
+
+var (
+	snapshotsDesc = prometheus.NewDesc(namespace+"_snapshots", "Number of snapshots by phase.", []string{"phase"}, nil)
+	restoresDesc  = prometheus.NewDesc(namespace+"_restores", "Number of restores by phase.", []string{"phase"}, nil)
+	fileSizeDesc  = prometheus.NewDesc(namespace+"_snapshot_stored_file_size_bytes", "Size of the stored snapshot file.", []string{"snapshot"}, nil)
+	contentsDesc  = prometheus.NewDesc(namespace+"_snapshot_contents", "Number of resources in the snapshot.", []string{"snapshot"}, nil)
+	queueDesc     = prometheus.NewDesc(namespace+"_queue_depth", "Number of items in the work queue.", []string{"queue"}, nil)
+)
+
+// stateCollector collects the controller state on scraping
+type stateCollector struct{}
+
+func (stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- snapshotsDesc
+	ch <- restoresDesc
+	ch <- fileSizeDesc
+	ch <- contentsDesc
+	ch <- queueDesc
+}
+
+func (stateCollector) Collect(ch chan<- prometheus.Metric) {
+	sourceMu.RLock()
+	s := source
+	sourceMu.RUnlock()
+	if s == nil {
+		return
+	}
+
+	snapshots, err := s.ListSnapshots()
+	if err != nil {
+		klog.Warningf("Listing snapshots for metrics failed : %s", err.Error())
+	} else {
+		phases := make(map[string]int)
+		for _, snapshot := range snapshots {
+			phases[snapshot.Status.Phase]++
+			if snapshot.Status.Phase == "Completed" {
+				ch <- prometheus.MustNewConstMetric(fileSizeDesc, prometheus.GaugeValue, float64(snapshot.Status.StoredFileSize), snapshot.ObjectMeta.Name)
+				ch <- prometheus.MustNewConstMetric(contentsDesc, prometheus.GaugeValue, float64(snapshot.Status.NumberOfContents), snapshot.ObjectMeta.Name)
+			}
+		}
+		for phase, n := range phases {
+			ch <- prometheus.MustNewConstMetric(snapshotsDesc, prometheus.GaugeValue, float64(n), phase)
+		}
+	}
+
+	restores, err := s.ListRestores()
+	if err != nil {
+		klog.Warningf("Listing restores for metrics failed : %s", err.Error())
+	} else {
+		phases := make(map[string]int)
+		for _, restore := range restores {
+			phases[restore.Status.Phase]++
+		}
+		for phase, n := range phases {
+			ch <- prometheus.MustNewConstMetric(restoresDesc, prometheus.GaugeValue, float64(n), phase)
+		}
+	}
+
+	for queue, depth := range s.QueueDepths() {
+		ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(depth), queue)
+	}
+}
+
+func init() {
+	Registry.MustRegister(
+		SnapshotDuration,
+		RestoreDuration,
+		SnapshotRetries,
+		ObjectstoreDuration,
+		ObjectstoreErrors,
+		Orphans,
+		stateCollector{},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// ObserveSince observes seconds since the start time with the label value
+func ObserveSince(h *prometheus.HistogramVec, label string, start time.Time) {
+	h.WithLabelValues(label).Observe(time.Since(start).Seconds())
+}
+
+// Handler returns the http handler for metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Checker provides health and readiness of the controller
+type Checker interface {
+	Healthz() error
+	Readyz() error
+}
+
+// checkHandler returns the http handler responding the check result
+func checkHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := check()
+		if err != nil {
+			klog.V(4).Infof("%s failed : %s", r.URL.Path, err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// NewServeMux returns the mux serving /metrics, /healthz and /readyz
+func NewServeMux(checker Checker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	if checker != nil {
+		mux.Handle("/healthz", checkHandler(checker.Healthz))
+		mux.Handle("/readyz", checkHandler(checker.Readyz))
+	}
+	return mux
+}
+
+// Serve metrics and health checks on the address until stopCh is closed
+func Serve(addr string, checker Checker, stopCh <-chan struct{}) {
+	server := &http.Server{Addr: addr, Handler: NewServeMux(checker)}
+	go func() {
+		klog.Infof("Serving metrics and health checks on %s", addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Metrics server error : %s", err.Error())
+		}
+	}()
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+}
@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+type fakeSource struct {
+	snapshots []*cbv1alpha1.Snapshot
+	restores  []*cbv1alpha1.Restore
+}
+
+func (f *fakeSource) ListSnapshots() ([]*cbv1alpha1.Snapshot, error) {
+	return f.snapshots, nil
+}
+
+func (f *fakeSource) ListRestores() ([]*cbv1alpha1.Restore, error) {
+	return f.restores, nil
+}
+
+func (f *fakeSource) QueueDepths() map[string]int {
+	return map[string]int{"snapshot": 3, "restore": 1}
+}
+
+func newSnapshot(name, phase string, size int64, contents int32) *cbv1alpha1.Snapshot {
+	return &cbv1alpha1.Snapshot{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: cbv1alpha1.SnapshotStatus{
+			Phase:            phase,
+			StoredFileSize:   size,
+			NumberOfContents: contents,
+		},
+	}
+}
+
+func TestStateCollector(t *testing.T) {
+	SetSource(&fakeSource{
+		snapshots: []*cbv1alpha1.Snapshot{
+			newSnapshot("snap1", "Completed", 1024, 10),
+			newSnapshot("snap2", "Completed", 2048, 20),
+			newSnapshot("snap3", "Failed", 0, 0),
+		},
+		restores: []*cbv1alpha1.Restore{
+			{Status: cbv1alpha1.RestoreStatus{Phase: "InProgress"}},
+		},
+	})
+	defer SetSource(nil)
+
+	expected := `
+# HELP k8s_snap_queue_depth Number of items in the work queue.
+# TYPE k8s_snap_queue_depth gauge
+k8s_snap_queue_depth{queue="restore"} 1
+k8s_snap_queue_depth{queue="snapshot"} 3
+# HELP k8s_snap_restores Number of restores by phase.
+# TYPE k8s_snap_restores gauge
+k8s_snap_restores{phase="InProgress"} 1
+# HELP k8s_snap_snapshot_contents Number of resources in the snapshot.
+# TYPE k8s_snap_snapshot_contents gauge
+k8s_snap_snapshot_contents{snapshot="snap1"} 10
+k8s_snap_snapshot_contents{snapshot="snap2"} 20
+# HELP k8s_snap_snapshot_stored_file_size_bytes Size of the stored snapshot file.
+# TYPE k8s_snap_snapshot_stored_file_size_bytes gauge
+k8s_snap_snapshot_stored_file_size_bytes{snapshot="snap1"} 1024
+k8s_snap_snapshot_stored_file_size_bytes{snapshot="snap2"} 2048
+# HELP k8s_snap_snapshots Number of snapshots by phase.
+# TYPE k8s_snap_snapshots gauge
+k8s_snap_snapshots{phase="Completed"} 2
+k8s_snap_snapshots{phase="Failed"} 1
+`
+	err := testutil.CollectAndCompare(stateCollector{}, strings.NewReader(expected))
+	if err != nil {
+		t.Errorf("Error collecting controller state : %s", err.Error())
+	}
+
+	// no source, no metrics
+	SetSource(nil)
+	if n := testutil.CollectAndCount(stateCollector{}); n != 0 {
+		t.Errorf("Error %d metrics collected without source", n)
+	}
+}
+
+func TestInstrumentObjectstore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	store := InstrumentObjectstore(objectstore.NewLocal("metrics-local", dir))
+
+	file, err := os.Create(filepath.Join(dir, "download"))
+	if err != nil {
+		t.Fatalf("Error creating file : %s", err.Error())
+	}
+	defer file.Close()
+
+	_, err = store.ListObjectInfo()
+	if err != nil {
+		t.Errorf("Error in ListObjectInfo : %s", err.Error())
+	}
+	err = store.Download(file, "notfound.tgz")
+	if err == nil {
+		t.Error("Error download not existing object succeeded")
+	}
+
+	if n := testutil.ToFloat64(ObjectstoreErrors.WithLabelValues("metrics-local", "download")); n != 1 {
+		t.Errorf("Error download errors : %f", n)
+	}
+	if n := testutil.ToFloat64(ObjectstoreErrors.WithLabelValues("metrics-local", "list_objects")); n != 0 {
+		t.Errorf("Error list errors : %f", n)
+	}
+	if n := testutil.CollectAndCount(ObjectstoreDuration); n != 2 {
+		t.Errorf("Error number of observed operations : %d", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	SnapshotRetries.WithLabelValues("upload").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Error status code %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `k8s_snap_snapshot_retries_total{operation="upload"} 1`) {
+		t.Errorf("Error retries not in metrics :\n%s", rec.Body.String())
+	}
+}
+
+type fakeChecker struct {
+	ready error
+}
+
+func (f *fakeChecker) Healthz() error {
+	return nil
+}
+
+func (f *fakeChecker) Readyz() error {
+	return f.ready
+}
+
+func TestServeMux(t *testing.T) {
+	checker := &fakeChecker{}
+	mux := NewServeMux(checker)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, _ := get("/metrics"); code != 200 {
+		t.Errorf("Error /metrics status code %d", code)
+	}
+	if code, body := get("/healthz"); code != 200 || body != "ok" {
+		t.Errorf("Error /healthz : %d %s", code, body)
+	}
+	if code, body := get("/readyz"); code != 200 || body != "ok" {
+		t.Errorf("Error /readyz : %d %s", code, body)
+	}
+	checker.ready = fmt.Errorf("Bucket not found")
+	if code, body := get("/readyz"); code != 503 || !strings.Contains(body, "Bucket not found") {
+		t.Errorf("Error /readyz not ready : %d %s", code, body)
+	}
+
+	// health checks not served without checker
+	rec := httptest.NewRecorder()
+	NewServeMux(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 404 {
+		t.Errorf("Error /readyz served without checker : %d", rec.Code)
+	}
+}
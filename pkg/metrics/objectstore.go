@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+// Instrumented objectstore observes latency and errors of operations
+type Instrumented struct {
+	objectstore.Objectstore
+}
+
+// InstrumentObjectstore returns the objectstore observed with metrics
+func InstrumentObjectstore(store objectstore.Objectstore) objectstore.Objectstore {
+	return &Instrumented{Objectstore: store}
+}
+
+// observe records the duration of the operation and counts up errors
+func (i *Instrumented) observe(operation string, start time.Time, err error) {
+	ObjectstoreDuration.WithLabelValues(i.GetName(), operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		ObjectstoreErrors.WithLabelValues(i.GetName(), operation).Inc()
+	}
+}
+
+// ChkBucket checks the bucket exists, observed as check_bucket
+func (i *Instrumented) ChkBucket() (bool, error) {
+	start := time.Now()
+	found, err := i.Objectstore.ChkBucket()
+	i.observe("check_bucket", start, err)
+	return found, err
+}
+
+// CreateBucket creates the bucket, observed as create_bucket
+func (i *Instrumented) CreateBucket() error {
+	start := time.Now()
+	err := i.Objectstore.CreateBucket()
+	i.observe("create_bucket", start, err)
+	return err
+}
+
+// Upload uploads the file, observed as upload
+func (i *Instrumented) Upload(file *os.File, filename string) error {
+	start := time.Now()
+	err := i.Objectstore.Upload(file, filename)
+	i.observe("upload", start, err)
+	return err
+}
+
+// UploadWithContext uploads the file until the context is cancelled, observed as upload
+func (i *Instrumented) UploadWithContext(ctx context.Context, file *os.File, filename string) error {
+	start := time.Now()
+	err := i.Objectstore.UploadWithContext(ctx, file, filename)
+	i.observe("upload", start, err)
+	return err
+}
+
+// Download downloads the object into the file, observed as download
+func (i *Instrumented) Download(file *os.File, filename string) error {
+	start := time.Now()
+	err := i.Objectstore.Download(file, filename)
+	i.observe("download", start, err)
+	return err
+}
+
+// Delete deletes the object, observed as delete
+func (i *Instrumented) Delete(filename string) error {
+	start := time.Now()
+	err := i.Objectstore.Delete(filename)
+	i.observe("delete", start, err)
+	return err
+}
+
+// GetObjectInfo returns info of the object, observed as get_object_info
+func (i *Instrumented) GetObjectInfo(filename string) (*objectstore.ObjectInfo, error) {
+	start := time.Now()
+	info, err := i.Objectstore.GetObjectInfo(filename)
+	i.observe("get_object_info", start, err)
+	return info, err
+}
+
+// ListObjectInfo returns info of all objects in the bucket, observed as list_objects
+func (i *Instrumented) ListObjectInfo() ([]objectstore.ObjectInfo, error) {
+	start := time.Now()
+	list, err := i.Objectstore.ListObjectInfo()
+	i.observe("list_objects", start, err)
+	return list, err
+}
@@ -0,0 +1,86 @@
+package objectstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Objectstore types
+const (
+	TypeS3    = "s3"
+	TypeLocal = "local"
+)
+
+// Config is a configuration for building an objectstore backend
+type Config struct {
+	Name      string
+	Type      string
+	AccessKey string
+	SecretKey string
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Path      string
+	Insecure  bool
+}
+
+// BackendFunc returns an objectstore backend for the config
+type BackendFunc func(config *Config) (Objectstore, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFunc)
+)
+
+// Register makes an objectstore backend available by the type name
+func Register(backendType string, fn BackendFunc) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if fn == nil {
+		panic("objectstore: Register backend func is nil")
+	}
+	if _, dup := backends[backendType]; dup {
+		panic("objectstore: Register called twice for backend " + backendType)
+	}
+	backends[backendType] = fn
+}
+
+// Backends returns sorted list of registered backend types
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	list := make([]string, 0, len(backends))
+	for t := range backends {
+		list = append(list, t)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// New returns an objectstore backend for the config type, default to s3
+func New(config *Config) (Objectstore, error) {
+	backendType := config.Type
+	if backendType == "" {
+		backendType = TypeS3
+	}
+	backendsMu.RLock()
+	fn, ok := backends[backendType]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Objectstore type %s not supported, available types : %v", backendType, Backends())
+	}
+	return fn(config)
+}
+
+func init() {
+	Register(TypeS3, func(config *Config) (Objectstore, error) {
+		return NewBucket(config.Name, config.AccessKey, config.SecretKey, config.Endpoint, config.Region, config.Bucket, config.Insecure), nil
+	})
+	Register(TypeLocal, func(config *Config) (Objectstore, error) {
+		if config.Path == "" {
+			return nil, fmt.Errorf("Path is required for objectstore type %s", TypeLocal)
+		}
+		return NewLocal(config.Name, config.Path), nil
+	})
+}
@@ -1,6 +1,7 @@
 package objectstore
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net/http"
@@ -23,6 +24,7 @@ type Objectstore interface {
 	ChkBucket() (bool, error)
 	CreateBucket() error
 	Upload(file *os.File, filename string) error
+	UploadWithContext(ctx context.Context, file *os.File, filename string) error
 	Download(file *os.File, filename string) error
 	Delete(filename string) error
 	GetObjectInfo(filename string) (*ObjectInfo, error)
@@ -162,6 +164,11 @@ func (b *Bucket) CreateBucket() error {
 
 // Upload a file to the bucket
 func (b *Bucket) Upload(file *os.File, filename string) error {
+	return b.UploadWithContext(context.Background(), file, filename)
+}
+
+// UploadWithContext uploads a file to the bucket, the upload is aborted when the context is cancelled
+func (b *Bucket) UploadWithContext(ctx context.Context, file *os.File, filename string) error {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -169,7 +176,7 @@ func (b *Bucket) Upload(file *os.File, filename string) error {
 	}
 
 	uploader := b.newUploaderfunc(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 		Bucket: aws.String(b.BucketName),
 		Key:    aws.String(filename),
 		Body:   file,
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
@@ -98,6 +99,10 @@ func (m mockUploader) Upload(input *s3manager.UploadInput, options ...func(*s3ma
 	return &s3manager.UploadOutput{}, nil
 }
 
+func (m mockUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return m.Upload(input, options...)
+}
+
 func newMockUploader(sess *session.Session) s3manageriface.UploaderAPI {
 	return mockUploader{}
 }
@@ -0,0 +1,303 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+)
+
+// Encrypted file format
+//
+//	magic(8) | key nonce(12) | wrapped data key(48) | base nonce(12) | chunks
+//	chunk : length(4) | sealed data, the last chunk is sealed with additional data "final"
+//
+// The data key is random for each object and wrapped with the key encryption key
+// derived from the encryption key secret.
+const (
+	encryptionMagic     = "K8SSNAP\x01"
+	encryptionChunkSize = 64 * 1024
+	dataKeySize         = 32
+)
+
+var finalChunk = []byte("final")
+
+// EncryptionErrorPrefix is the prefix of errors on encryption and decryption, not to retry
+const EncryptionErrorPrefix = "Encryption error"
+
+func encryptionError(format string, a ...interface{}) error {
+	return fmt.Errorf(EncryptionErrorPrefix+" : "+format, a...)
+}
+
+// Encrypted encrypts objects on upload and decrypts on download
+type Encrypted struct {
+	Objectstore
+	kek []byte
+}
+
+// NewEncrypted returns new Encrypted for the objectstore with the encryption key
+func NewEncrypted(store Objectstore, key []byte) *Encrypted {
+	kek := sha256.Sum256(key)
+	return &Encrypted{
+		Objectstore: store,
+		kek:         kek[:],
+	}
+}
+
+// Upload an encrypted file to the objectstore
+func (e *Encrypted) Upload(file *os.File, filename string) error {
+	return e.UploadWithContext(context.Background(), file, filename)
+}
+
+// UploadWithContext uploads an encrypted file to the objectstore, aborted when the context is cancelled
+func (e *Encrypted) UploadWithContext(ctx context.Context, file *os.File, filename string) error {
+	tmp, err := ioutil.TempFile("", "k8s-snap-enc-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = Encrypt(tmp, file, e.kek)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return e.Objectstore.UploadWithContext(ctx, tmp, filename)
+}
+
+// Download a file from the objectstore and decrypt it, not encrypted files are downloaded as they are
+func (e *Encrypted) Download(file *os.File, filename string) error {
+	tmp, err := ioutil.TempFile("", "k8s-snap-enc-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = e.Objectstore.Download(tmp, filename)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	encrypted, err := IsEncrypted(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		klog.Warningf("Object %s in %s is not encrypted", filename, e.GetName())
+		_, err = io.Copy(file, tmp)
+		return err
+	}
+	err = Decrypt(file, tmp, e.kek)
+	if err != nil {
+		return fmt.Errorf("Decrypting %s failed : %s", filename, err.Error())
+	}
+	return nil
+}
+
+// IsEncrypted checks the data starts with the encrypted file header
+func IsEncrypted(r io.Reader) (bool, error) {
+	magic := make([]byte, len(encryptionMagic))
+	_, err := io.ReadFull(r, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(magic) == encryptionMagic, nil
+}
+
+// IsEncryptedFile checks the file is encrypted
+func IsEncryptedFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return IsEncrypted(file)
+}
+
+// CheckNotEncryptedFile returns an error if the downloaded file is still encrypted
+func CheckNotEncryptedFile(path string) error {
+	encrypted, err := IsEncryptedFile(path)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		return encryptionError("%s is encrypted but no encryption key is configured", filepath.Base(path))
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	c := make([]byte, 8)
+	binary.BigEndian.PutUint64(c, counter)
+	for i := range c {
+		nonce[len(nonce)-8+i] ^= c[i]
+	}
+	return nonce
+}
+
+// Encrypt src into dst with a new data key wrapped by the key encryption key
+func Encrypt(dst io.Writer, src io.Reader, kek []byte) error {
+	kekGCM, err := newGCM(kek)
+	if err != nil {
+		return encryptionError("%s", err.Error())
+	}
+
+	// random data key and nonces
+	dataKey := make([]byte, dataKeySize)
+	keyNonce := make([]byte, kekGCM.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return encryptionError("%s", err.Error())
+	}
+	if _, err := io.ReadFull(rand.Reader, keyNonce); err != nil {
+		return encryptionError("%s", err.Error())
+	}
+	dataGCM, err := newGCM(dataKey)
+	if err != nil {
+		return encryptionError("%s", err.Error())
+	}
+	baseNonce := make([]byte, dataGCM.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, baseNonce); err != nil {
+		return encryptionError("%s", err.Error())
+	}
+
+	// header
+	header := bytes.NewBufferString(encryptionMagic)
+	header.Write(keyNonce)
+	header.Write(kekGCM.Seal(nil, keyNonce, dataKey, []byte(encryptionMagic)))
+	header.Write(baseNonce)
+	if _, err := dst.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	// chunks
+	buf := make([]byte, encryptionChunkSize)
+	next := make([]byte, encryptionChunkSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	for counter := uint64(0); ; counter++ {
+		m := 0
+		if n == encryptionChunkSize {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		var ad []byte
+		if m == 0 {
+			ad = finalChunk
+		}
+		sealed := dataGCM.Seal(nil, chunkNonce(baseNonce, counter), buf[:n], ad)
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(sealed)))
+		if _, err := dst.Write(length); err != nil {
+			return err
+		}
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if m == 0 {
+			return nil
+		}
+		buf, next = next, buf
+		n = m
+	}
+}
+
+// Decrypt src into dst with the key encryption key
+func Decrypt(dst io.Writer, src io.Reader, kek []byte) error {
+	kekGCM, err := newGCM(kek)
+	if err != nil {
+		return encryptionError("%s", err.Error())
+	}
+
+	// header
+	header := make([]byte, len(encryptionMagic)+kekGCM.NonceSize()+dataKeySize+kekGCM.Overhead())
+	if _, err := io.ReadFull(src, header); err != nil {
+		return encryptionError("reading header failed : %s", err.Error())
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return encryptionError("not an encrypted file")
+	}
+	keyNonce := header[len(encryptionMagic) : len(encryptionMagic)+kekGCM.NonceSize()]
+	dataKey, err := kekGCM.Open(nil, keyNonce, header[len(encryptionMagic)+kekGCM.NonceSize():], []byte(encryptionMagic))
+	if err != nil {
+		return encryptionError("wrong encryption key")
+	}
+	dataGCM, err := newGCM(dataKey)
+	if err != nil {
+		return encryptionError("%s", err.Error())
+	}
+	baseNonce := make([]byte, dataGCM.NonceSize())
+	if _, err := io.ReadFull(src, baseNonce); err != nil {
+		return encryptionError("reading header failed : %s", err.Error())
+	}
+
+	// chunks
+	length := make([]byte, 4)
+	for counter := uint64(0); ; counter++ {
+		if _, err := io.ReadFull(src, length); err != nil {
+			return encryptionError("truncated encrypted file")
+		}
+		l := binary.BigEndian.Uint32(length)
+		if l > encryptionChunkSize+uint32(dataGCM.Overhead()) {
+			return encryptionError("invalid chunk length %d", l)
+		}
+		sealed := make([]byte, l)
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return encryptionError("truncated encrypted file")
+		}
+		nonce := chunkNonce(baseNonce, counter)
+		plain, err := dataGCM.Open(nil, nonce, sealed, nil)
+		final := false
+		if err != nil {
+			plain, err = dataGCM.Open(nil, nonce, sealed, finalChunk)
+			if err != nil {
+				return encryptionError("corrupted encrypted file")
+			}
+			final = true
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
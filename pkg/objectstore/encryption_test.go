@@ -0,0 +1,128 @@
+package objectstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, kek); err != nil {
+		t.Fatalf("Error generating key : %s", err.Error())
+	}
+
+	// empty, smaller than a chunk, exactly a chunk and several chunks
+	for _, size := range []int{0, 100, encryptionChunkSize, encryptionChunkSize*3 + 7} {
+		plain := make([]byte, size)
+		io.ReadFull(rand.Reader, plain)
+
+		encrypted := &bytes.Buffer{}
+		err := Encrypt(encrypted, bytes.NewReader(plain), kek)
+		if err != nil {
+			t.Fatalf("Error encrypting %d bytes : %s", size, err.Error())
+		}
+		if ok, _ := IsEncrypted(bytes.NewReader(encrypted.Bytes())); !ok {
+			t.Errorf("Encrypted data of %d bytes not detected", size)
+		}
+		decrypted := &bytes.Buffer{}
+		err = Decrypt(decrypted, bytes.NewReader(encrypted.Bytes()), kek)
+		if err != nil {
+			t.Fatalf("Error decrypting %d bytes : %s", size, err.Error())
+		}
+		if !bytes.Equal(plain, decrypted.Bytes()) {
+			t.Errorf("Decrypted data of %d bytes not matched", size)
+		}
+
+		// truncated at a chunk boundary
+		if size > encryptionChunkSize {
+			header := len(encryptionMagic) + 12 + dataKeySize + 16 + 12
+			truncated := encrypted.Bytes()[:header+4+encryptionChunkSize+16]
+			err = Decrypt(ioutil.Discard, bytes.NewReader(truncated), kek)
+			if err == nil || !strings.Contains(err.Error(), "truncated") {
+				t.Errorf("Truncation not detected : %v", err)
+			}
+		}
+	}
+
+	// wrong key
+	encrypted := &bytes.Buffer{}
+	Encrypt(encrypted, strings.NewReader("snapshot data"), kek)
+	wrong := make([]byte, 32)
+	err := Decrypt(ioutil.Discard, bytes.NewReader(encrypted.Bytes()), wrong)
+	if err == nil || !strings.Contains(err.Error(), "wrong encryption key") {
+		t.Errorf("Wrong key not reported : %v", err)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	local := NewLocal("local", dir)
+	store := NewEncrypted(local, []byte("secret key"))
+
+	// Upload encrypted
+	src := filepath.Join(dir, ".src.tgz")
+	ioutil.WriteFile(src, []byte("snapshot data"), 0644)
+	file, _ := os.Open(src)
+	err = store.Upload(file, "test.tgz")
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error in Upload : %s", err.Error())
+	}
+	if ok, _ := IsEncryptedFile(filepath.Join(dir, "test.tgz")); !ok {
+		t.Error("Uploaded object not encrypted")
+	}
+
+	// Download decrypted
+	dst := filepath.Join(dir, ".dst.tgz")
+	file, _ = os.Create(dst)
+	err = store.Download(file, "test.tgz")
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error in Download : %s", err.Error())
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != "snapshot data" {
+		t.Errorf("Downloaded data not matched : %s", string(data))
+	}
+	if err = CheckNotEncryptedFile(dst); err != nil {
+		t.Errorf("Decrypted file reported : %s", err.Error())
+	}
+
+	// Download without key
+	file, _ = os.Create(dst)
+	local.Download(file, "test.tgz")
+	file.Close()
+	err = CheckNotEncryptedFile(dst)
+	if err == nil || !strings.Contains(err.Error(), "no encryption key") {
+		t.Errorf("Encrypted file without key not reported : %v", err)
+	}
+
+	// Download with wrong key
+	file, _ = os.Create(dst)
+	err = NewEncrypted(local, []byte("wrong key")).Download(file, "test.tgz")
+	file.Close()
+	if err == nil || !strings.Contains(err.Error(), EncryptionErrorPrefix) {
+		t.Errorf("Wrong key not reported : %v", err)
+	}
+
+	// Download not encrypted object as it is
+	file, _ = os.Open(src)
+	local.Upload(file, "plain.tgz")
+	file.Close()
+	file, _ = os.Create(dst)
+	err = store.Download(file, "plain.tgz")
+	file.Close()
+	if data, _ := ioutil.ReadFile(dst); err != nil || string(data) != "snapshot data" {
+		t.Errorf("Not encrypted object not downloaded : %v %s", err, string(data))
+	}
+}
@@ -0,0 +1,163 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local for storing objects in a local directory such as a mounted PVC
+type Local struct {
+	Name string
+	Path string
+}
+
+// NewLocal returns new Local
+func NewLocal(name, path string) *Local {
+	return &Local{
+		Name: name,
+		Path: path,
+	}
+}
+
+// GetName returns local objectstore's Name
+func (l *Local) GetName() string {
+	return l.Name
+}
+
+// GetEndpoint returns local objectstore's Endpoint
+func (l *Local) GetEndpoint() string {
+	return "file://" + l.Path
+}
+
+// GetBucketName returns local objectstore's directory
+func (l *Local) GetBucketName() string {
+	return l.Path
+}
+
+// ChkBucket checks the directory exists
+func (l *Local) ChkBucket() (bool, error) {
+	info, err := os.Stat(l.Path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("%s is not a directory", l.Path)
+	}
+	return true, nil
+}
+
+// CreateBucket creates the directory
+func (l *Local) CreateBucket() error {
+	return os.MkdirAll(l.Path, 0755)
+}
+
+// Upload a file to the directory
+func (l *Local) Upload(file *os.File, filename string) error {
+	return l.UploadWithContext(context.Background(), file, filename)
+}
+
+// UploadWithContext uploads a file to the directory, the copy is aborted when the context is cancelled
+func (l *Local) UploadWithContext(ctx context.Context, file *os.File, filename string) error {
+	// write into a temporary file and rename not to leave a partial object
+	tmp, err := ioutil.TempFile(l.Path, "."+filename+".")
+	if err != nil {
+		return fmt.Errorf("Error uploading %s to %s : %s", filename, l.Path, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, &contextReader{ctx: ctx, r: file})
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error uploading %s to %s : %s", filename, l.Path, err.Error())
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("Error uploading %s to %s : %s", filename, l.Path, err.Error())
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(l.Path, filename))
+	if err != nil {
+		return fmt.Errorf("Error uploading %s to %s : %s", filename, l.Path, err.Error())
+	}
+	return nil
+}
+
+// Download a file from the directory
+func (l *Local) Download(file *os.File, filename string) error {
+	src, err := os.Open(filepath.Join(l.Path, filename))
+	if err != nil {
+		return fmt.Errorf("Error downloading %s from %s : %s", filename, l.Path, err.Error())
+	}
+	defer src.Close()
+	_, err = io.Copy(file, src)
+	if err != nil {
+		return fmt.Errorf("Error downloading %s from %s : %s", filename, l.Path, err.Error())
+	}
+	return nil
+}
+
+// Delete a file in the directory
+func (l *Local) Delete(filename string) error {
+	err := os.Remove(filepath.Join(l.Path, filename))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error deleting %s from %s : %s", filename, l.Path, err.Error())
+	}
+	return nil
+}
+
+// GetObjectInfo gets info of a file in the directory
+func (l *Local) GetObjectInfo(filename string) (*ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(l.Path, filename))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Object %s not found in %s", filename, l.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:             filename,
+		Size:             info.Size(),
+		Timestamp:        info.ModTime(),
+		BucketConfigName: l.Name,
+	}, nil
+}
+
+// ListObjectInfo lists object info
+func (l *Local) ListObjectInfo() ([]ObjectInfo, error) {
+	files, err := ioutil.ReadDir(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	objInfoList := make([]ObjectInfo, 0)
+	for _, f := range files {
+		// skip directories and temporary files in uploading
+		if !f.Mode().IsRegular() || f.Name()[0] == '.' {
+			continue
+		}
+		objInfoList = append(objInfoList, ObjectInfo{
+			Name:             f.Name(),
+			Size:             f.Size(),
+			Timestamp:        f.ModTime(),
+			BucketConfigName: l.Name,
+		})
+	}
+	return objInfoList, nil
+}
+
+// contextReader fails reading after the context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
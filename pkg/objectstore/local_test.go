@@ -0,0 +1,135 @@
+package objectstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error making temp dir : %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Name: "local", Type: TypeLocal, Path: filepath.Join(dir, "objects")}
+	store, err := New(config)
+	if err != nil {
+		t.Fatalf("Error in New : %s", err.Error())
+	}
+
+	// Check and create directory
+	found, err := store.ChkBucket()
+	if err != nil || found {
+		t.Errorf("Error directory found before created : %t %v", found, err)
+	}
+	err = store.CreateBucket()
+	if err != nil {
+		t.Errorf("Error in CreateBucket : %s", err.Error())
+	}
+	found, err = store.ChkBucket()
+	if err != nil || !found {
+		t.Errorf("Error directory not found after created : %t %v", found, err)
+	}
+
+	// Upload
+	src := filepath.Join(dir, "src.tgz")
+	err = ioutil.WriteFile(src, []byte("snapshot data"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing file : %s", err.Error())
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("Error opening file : %s", err.Error())
+	}
+	err = store.Upload(file, "test1.tgz")
+	file.Close()
+	if err != nil {
+		t.Errorf("Error in Upload : %s", err.Error())
+	}
+
+	// Object info
+	info, err := store.GetObjectInfo("test1.tgz")
+	if err != nil {
+		t.Fatalf("Error in GetObjectInfo : %s", err.Error())
+	}
+	if info.Size != int64(len("snapshot data")) || info.BucketConfigName != "local" {
+		t.Errorf("Object info not match : %#v", info)
+	}
+	list, err := store.ListObjectInfo()
+	if err != nil || len(list) != 1 || list[0].Name != "test1.tgz" {
+		t.Errorf("Object list not match : %#v %v", list, err)
+	}
+
+	// Download
+	dst, err := os.Create(filepath.Join(dir, "dst.tgz"))
+	if err != nil {
+		t.Fatalf("Error creating file : %s", err.Error())
+	}
+	err = store.Download(dst, "test1.tgz")
+	dst.Close()
+	if err != nil {
+		t.Errorf("Error in Download : %s", err.Error())
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "dst.tgz"))
+	if string(content) != "snapshot data" {
+		t.Errorf("Downloaded content not match : %s", string(content))
+	}
+
+	// Upload cancelled
+	file, err = os.Open(src)
+	if err != nil {
+		t.Fatalf("Error opening file : %s", err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.UploadWithContext(ctx, file, "test2.tgz")
+	file.Close()
+	if err == nil {
+		t.Error("Error cancelled upload succeeded")
+	}
+	_, err = store.GetObjectInfo("test2.tgz")
+	if err == nil {
+		t.Error("Error cancelled upload left the object")
+	}
+	list, err = store.ListObjectInfo()
+	if err != nil || len(list) != 1 {
+		t.Errorf("Cancelled upload left files : %#v %v", list, err)
+	}
+
+	// Delete
+	err = store.Delete("test1.tgz")
+	if err != nil {
+		t.Errorf("Error in Delete : %s", err.Error())
+	}
+	_, err = store.GetObjectInfo("test1.tgz")
+	if err == nil {
+		t.Error("Error deleted object found")
+	}
+}
+
+func TestBackends(t *testing.T) {
+	// default type
+	store, err := New(&Config{Name: "s3", Bucket: "bucket"})
+	if err != nil {
+		t.Fatalf("Error in New : %s", err.Error())
+	}
+	if _, ok := store.(*Bucket); !ok {
+		t.Errorf("Default objectstore type is %T", store)
+	}
+
+	// local without path
+	_, err = New(&Config{Name: "local", Type: TypeLocal})
+	if err == nil {
+		t.Error("Error local objectstore without path not reported")
+	}
+
+	// unknown type
+	_, err = New(&Config{Name: "unknown", Type: "unknown"})
+	if err == nil {
+		t.Error("Error unknown objectstore type not reported")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"k8s.io/klog"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/metrics"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 )
 
@@ -91,15 +92,31 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 		return err
 	}
 
+	// cancelled before started
+	if restore.Spec.Cancel && restore.Status.Phase == "InQueue" {
+		restore, err = c.updateRestoreStatus(ctx, restore, "Cancelled", "Cancelled before started")
+		if err != nil {
+			return err
+		}
+	}
+
+	// paused restore is kept in queue
+	if !queueonly && restore.Status.Phase == "InQueue" && restore.Spec.Paused {
+		klog.Infof("restore:%s paused", name)
+		return nil
+	}
+
 	if !queueonly && restore.Status.Phase == "InQueue" {
 		restore, err = c.updateRestoreStatus(ctx, restore, "InProgress", "")
 		if err != nil {
 			return err
 		}
+		start := time.Now()
 
 		// snapshot
 		snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, restore.Spec.SnapshotName, metav1.GetOptions{})
 		if err != nil {
+			metrics.ObserveSince(metrics.RestoreDuration, "Failed", start)
 			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -107,6 +124,7 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 			return nil
 		}
 		if snapshot.Status.Phase != "Completed" {
+			metrics.ObserveSince(metrics.RestoreDuration, "Failed", start)
 			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", "Snapshot data is not in status 'Completed'")
 			if err != nil {
 				return err
@@ -116,8 +134,9 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 		restore.Status.NumSnapshotContents = snapshot.Status.NumberOfContents
 
 		// bucket
-		osConfig, err := c.cbclientset.ClustersnapshotV1alpha1().ObjectstoreConfigs(c.namespace).Get(ctx, snapshot.Spec.ObjectstoreConfig, metav1.GetOptions{})
+		bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
 		if err != nil {
+			metrics.ObserveSince(metrics.RestoreDuration, "Failed", start)
 			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -125,21 +144,21 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 			return nil
 		}
 
-		// cloud credentials secret
-		cred, err := c.kubeclientset.CoreV1().Secrets(c.namespace).Get(ctx, osConfig.Spec.CloudCredentialSecret, metav1.GetOptions{})
+		// verify the snapshot and parents before restoring
+		err = c.verifySnapshotChain(ctx, snapshot, bucket)
 		if err != nil {
-			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
+			metrics.ObserveSince(metrics.RestoreDuration, "Failed", start)
+			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", "Snapshot verification failed : "+err.Error())
 			if err != nil {
 				return err
 			}
 			return nil
 		}
-		bucket := objectstore.NewBucket(osConfig.ObjectMeta.Name, string(cred.Data["accesskey"]),
-			string(cred.Data["secretkey"]), osConfig.Spec.Endpoint, osConfig.Spec.Region, osConfig.Spec.Bucket, c.insecure)
 
 		// preference
 		pref, err := c.cbclientset.ClustersnapshotV1alpha1().RestorePreferences(c.namespace).Get(ctx, restore.Spec.RestorePreferenceName, metav1.GetOptions{})
 		if err != nil {
+			metrics.ObserveSince(metrics.RestoreDuration, "Failed", start)
 			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -147,9 +166,18 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 			return nil
 		}
 
-		// do restore
-		err = c.clusterCmd.Restore(restore, pref, bucket)
+		// do restore, stopped between resources with the cancel flag
+		runCtx, done := c.startRunning(runningRestore, key, func() bool { return c.restoreCancelRequested(namespace, name) })
+		defer done()
+		err = c.clusterCmd.Restore(runCtx, restore, pref, bucket)
+		if err != nil && runCtx.Err() != nil {
+			metrics.ObserveSince(metrics.RestoreDuration, "Cancelled", start)
+			reason := fmt.Sprintf("Cancelled after %d resources created and %d updated", restore.Status.NumCreated, restore.Status.NumUpdated)
+			_, err = c.updateRestoreStatus(ctx, restore, "Cancelled", reason)
+			return err
+		}
 		if err != nil {
+			metrics.ObserveSince(metrics.RestoreDuration, "Failed", start)
 			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
 			if err != nil {
 				return err
@@ -157,12 +185,22 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 			return nil
 		}
 
+		metrics.ObserveSince(metrics.RestoreDuration, "Completed", start)
 		restore, err = c.updateRestoreStatus(ctx, restore, "Completed", "")
 		if err != nil {
 			return err
 		}
 	}
 
+	// rollback of the finished restore, retried when interrupted
+	if !queueonly && restore.Spec.Rollback && restoreFinished(restore) &&
+		(restore.Status.Rollback == nil || restore.Status.Rollback.Phase == "InProgress") {
+		restore, err = c.rollbackRestore(ctx, restore)
+		if err != nil {
+			return err
+		}
+	}
+
 	nowTime := metav1.NewTime(time.Now())
 
 	if restore.Status.Phase == "" {
@@ -186,8 +224,8 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 		}
 	}
 
-	// expiration for failed restore
-	if restore.Status.Phase == "Failed" && restore.Status.AvailableUntil.IsZero() {
+	// expiration for failed or cancelled restore
+	if (restore.Status.Phase == "Failed" || restore.Status.Phase == "Cancelled") && restore.Status.AvailableUntil.IsZero() {
 		if !restore.Spec.AvailableUntil.IsZero() {
 			restore.Status.AvailableUntil = restore.Spec.AvailableUntil
 			restore.Status.TTL.Duration = restore.Status.AvailableUntil.Time.Sub(restore.ObjectMeta.CreationTimestamp.Time)
@@ -202,7 +240,7 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 	}
 
 	// expiration edited
-	if restore.Status.Phase == "Completed" || restore.Status.Phase == "Failed" {
+	if restoreFinished(restore) {
 		if !restore.Spec.AvailableUntil.IsZero() && !restore.Spec.AvailableUntil.Equal(&restore.Status.AvailableUntil) {
 			restore.Status.AvailableUntil = restore.Spec.AvailableUntil
 			restore, err = c.updateRestoreStatus(ctx, restore, restore.Status.Phase, restore.Status.Reason)
@@ -214,6 +252,7 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 
 	// delete expired
 	if !restore.Status.AvailableUntil.IsZero() && restore.Status.AvailableUntil.Before(&nowTime) {
+		c.deleteRestoreReport(ctx, restore)
 		err := c.cbclientset.ClustersnapshotV1alpha1().Restores(c.namespace).Delete(ctx, name, metav1.DeleteOptions{})
 		if err != nil {
 			restore, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
@@ -230,6 +269,80 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 	return nil
 }
 
+// deleteRestoreReport deletes the report object of the restore next to the snapshot
+func (c *Controller) deleteRestoreReport(ctx context.Context, restore *cbv1alpha1.Restore) {
+	if restore.Status.Report == "" {
+		return
+	}
+	snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, restore.Spec.SnapshotName, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("restore:%s cannot delete report %s : %s", restore.ObjectMeta.Name, restore.Status.Report, err.Error())
+		return
+	}
+	bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		klog.Warningf("restore:%s cannot delete report %s : %s", restore.ObjectMeta.Name, restore.Status.Report, err.Error())
+		return
+	}
+	klog.Infof("Deleting restore report %s from objectstore %s", restore.Status.Report, snapshot.Spec.ObjectstoreConfig)
+	err = bucket.Delete(restore.Status.Report)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+}
+
+// restoreFinished checks the restore is no longer in queue or in progress
+func restoreFinished(restore *cbv1alpha1.Restore) bool {
+	return restore.Status.Phase == "Completed" || restore.Status.Phase == "Failed" || restore.Status.Phase == "Cancelled"
+}
+
+// rollbackRestore deletes resources created by the restore and reverts overwritten ones,
+// the rollback phase is kept in Status.Rollback apart from the restore phase
+func (c *Controller) rollbackRestore(ctx context.Context, restore *cbv1alpha1.Restore) (*cbv1alpha1.Restore, error) {
+	if restore.Spec.DryRun {
+		return c.updateRestoreRollback(ctx, restore, "Failed", "Dry-run restore has nothing to roll back")
+	}
+	restore, err := c.updateRestoreRollback(ctx, restore, "InProgress", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// bucket of the snapshot keeping the restore report
+	var bucket objectstore.Objectstore
+	if restore.Status.Report != "" {
+		snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, restore.Spec.SnapshotName, metav1.GetOptions{})
+		if err != nil {
+			return c.updateRestoreRollback(ctx, restore, "Failed", err.Error())
+		}
+		bucket, err = c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
+		if err != nil {
+			return c.updateRestoreRollback(ctx, restore, "Failed", err.Error())
+		}
+	}
+
+	err = c.clusterCmd.Rollback(ctx, restore, bucket)
+	if err != nil {
+		return c.updateRestoreRollback(ctx, restore, "Failed", err.Error())
+	}
+	reason := ""
+	if restore.Status.Rollback.NumFailed > 0 {
+		reason = fmt.Sprintf("%d resources failed to roll back", restore.Status.Rollback.NumFailed)
+	}
+	return c.updateRestoreRollback(ctx, restore, "Completed", reason)
+}
+
+// updateRestoreRollback updates the rollback phase keeping the restore phase
+func (c *Controller) updateRestoreRollback(ctx context.Context, restore *cbv1alpha1.Restore, phase, reason string) (*cbv1alpha1.Restore, error) {
+	restoreCopy := restore.DeepCopy()
+	if restoreCopy.Status.Rollback == nil {
+		restoreCopy.Status.Rollback = &cbv1alpha1.RestoreRollbackStatus{}
+	}
+	restoreCopy.Status.Rollback.Phase = phase
+	restoreCopy.Status.Rollback.Reason = reason
+	klog.Infof("restore:%s rollback %s : %s", restore.ObjectMeta.Name, phase, reason)
+	return c.updateRestoreStatus(ctx, restoreCopy, restore.Status.Phase, restore.Status.Reason)
+}
+
 func (c *Controller) updateRestoreStatus(ctx context.Context, restore *cbv1alpha1.Restore, phase, reason string) (*cbv1alpha1.Restore, error) {
 	restoreCopy := restore.DeepCopy()
 	restoreCopy.Status.Phase = phase
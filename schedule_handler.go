@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Label on snapshots created by a schedule
+const scheduleLabel = "clustersnapshot.rywt.io/schedule"
+
+// runSnapshotScheduler checks all snapshot schedules, creates snapshots on time
+// and deletes old ones beyond the retention count.
+func (c *Controller) runSnapshotScheduler() {
+
+	schedules, err := c.scheduleLister.SnapshotSchedules(c.namespace).List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("List snapshot schedules error : %s", err.Error()))
+		return
+	}
+
+	for _, schedule := range schedules {
+		err := c.scheduleSyncHandler(schedule, time.Now())
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}
+}
+
+// scheduleSyncHandler creates a snapshot when the schedule is due, prunes old
+// snapshots and updates the Status block of the SnapshotSchedule resource.
+func (c *Controller) scheduleSyncHandler(schedule *cbv1alpha1.SnapshotSchedule, now time.Time) error {
+
+	// context for schedule
+	ctx := context.TODO()
+
+	scheduleCopy := schedule.DeepCopy()
+
+	sched, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err != nil {
+		scheduleCopy.Status.Reason = fmt.Sprintf("Invalid schedule %s : %s", schedule.Spec.Schedule, err.Error())
+		scheduleCopy.Status.NextScheduleTime = metav1.Time{}
+		return c.updateScheduleStatus(ctx, schedule, scheduleCopy)
+	}
+	scheduleCopy.Status.Reason = ""
+
+	// Find the latest missed schedule time
+	last := schedule.Status.LastScheduleTime.Time
+	if last.IsZero() {
+		last = schedule.ObjectMeta.CreationTimestamp.Time
+	}
+	var due time.Time
+	for t := sched.Next(last); !t.After(now); t = sched.Next(t) {
+		due = t
+	}
+
+	// Create a snapshot
+	if !due.IsZero() && !schedule.Spec.Suspend {
+		snapshot := newScheduledSnapshot(schedule, due)
+		_, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Create(ctx, snapshot, metav1.CreateOptions{})
+		if err != nil && !errors.IsAlreadyExists(err) {
+			scheduleCopy.Status.Reason = fmt.Sprintf("Create snapshot %s error : %s", snapshot.ObjectMeta.Name, err.Error())
+		} else {
+			klog.Infof("schedule:%s created snapshot %s", schedule.ObjectMeta.Name, snapshot.ObjectMeta.Name)
+			scheduleCopy.Status.LastScheduleTime = metav1.NewTime(due)
+			scheduleCopy.Status.LastSnapshotName = snapshot.ObjectMeta.Name
+		}
+	} else if !due.IsZero() {
+		// Skip missed schedules while suspended
+		scheduleCopy.Status.LastScheduleTime = metav1.NewTime(due)
+	}
+	scheduleCopy.Status.NextScheduleTime = metav1.NewTime(sched.Next(now))
+
+	// Last result
+	if scheduleCopy.Status.LastSnapshotName != "" {
+		snapshot, err := c.snapshotLister.Snapshots(c.namespace).Get(scheduleCopy.Status.LastSnapshotName)
+		if err == nil {
+			scheduleCopy.Status.LastSnapshotPhase = snapshot.Status.Phase
+		} else if errors.IsNotFound(err) && scheduleCopy.Status.LastSnapshotName != schedule.Status.LastSnapshotName {
+			scheduleCopy.Status.LastSnapshotPhase = ""
+		}
+	}
+
+	err = c.pruneScheduledSnapshots(ctx, schedule)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+
+	return c.updateScheduleStatus(ctx, schedule, scheduleCopy)
+}
+
+// pruneScheduledSnapshots deletes the oldest snapshots of the schedule beyond MaxSnapshots,
+// parents of incremental snapshots are kept until their children are deleted.
+func (c *Controller) pruneScheduledSnapshots(ctx context.Context, schedule *cbv1alpha1.SnapshotSchedule) error {
+	if schedule.Spec.MaxSnapshots <= 0 {
+		return nil
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{scheduleLabel: schedule.ObjectMeta.Name})
+	snapshots, err := c.snapshotLister.Snapshots(c.namespace).List(selector)
+	if err != nil {
+		return fmt.Errorf("List snapshots of schedule %s error : %s", schedule.ObjectMeta.Name, err.Error())
+	}
+	if len(snapshots) <= int(schedule.Spec.MaxSnapshots) {
+		return nil
+	}
+
+	// Newest first
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[j].ObjectMeta.CreationTimestamp.Before(&snapshots[i].ObjectMeta.CreationTimestamp)
+	})
+	pruned := make(map[string]bool)
+	for _, snapshot := range snapshots[schedule.Spec.MaxSnapshots:] {
+		// Do not delete snapshots still in process
+		if snapshot.Status.Phase != "Completed" && snapshot.Status.Phase != "Failed" && snapshot.Status.Phase != "Cancelled" {
+			continue
+		}
+		// Keep parents of incremental snapshots not pruned
+		children, err := c.childSnapshots(c.namespace, snapshot.ObjectMeta.Name)
+		if err != nil {
+			return err
+		}
+		remaining := make([]string, 0)
+		for _, child := range children {
+			if !pruned[child] {
+				remaining = append(remaining, child)
+			}
+		}
+		if len(remaining) > 0 {
+			klog.Infof("schedule:%s snapshot %s kept for incremental snapshots %s", schedule.ObjectMeta.Name,
+				snapshot.ObjectMeta.Name, strings.Join(remaining, ","))
+			continue
+		}
+		err = c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Delete(ctx, snapshot.ObjectMeta.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("Delete snapshot %s error : %s", snapshot.ObjectMeta.Name, err.Error())
+		}
+		pruned[snapshot.ObjectMeta.Name] = true
+		klog.Infof("schedule:%s pruned snapshot %s", schedule.ObjectMeta.Name, snapshot.ObjectMeta.Name)
+	}
+
+	return nil
+}
+
+func (c *Controller) updateScheduleStatus(ctx context.Context, schedule, scheduleCopy *cbv1alpha1.SnapshotSchedule) error {
+	if equality.Semantic.DeepEqual(schedule.Status, scheduleCopy.Status) {
+		return nil
+	}
+	_, err := c.cbclientset.ClustersnapshotV1alpha1().SnapshotSchedules(schedule.Namespace).Update(ctx, scheduleCopy, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to update snapshot schedule status for %s : %s", schedule.ObjectMeta.Name, err.Error())
+	}
+	return nil
+}
+
+// newScheduledSnapshot returns a snapshot resource for the scheduled time
+func newScheduledSnapshot(schedule *cbv1alpha1.SnapshotSchedule, scheduled time.Time) *cbv1alpha1.Snapshot {
+	return &cbv1alpha1.Snapshot{
+		TypeMeta: metav1.TypeMeta{APIVersion: cbv1alpha1.SchemeGroupVersion.String(), Kind: "Snapshot"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      schedule.ObjectMeta.Name + "-" + scheduled.UTC().Format("20060102-150405"),
+			Namespace: schedule.ObjectMeta.Namespace,
+			Labels: map[string]string{
+				scheduleLabel: schedule.ObjectMeta.Name,
+			},
+		},
+		Spec: cbv1alpha1.SnapshotSpec{
+			ClusterName:         schedule.Spec.ClusterName,
+			Kubeconfig:          schedule.Spec.Kubeconfig,
+			KubeconfigSecretRef: schedule.Spec.KubeconfigSecretRef,
+			ObjectstoreConfig:   schedule.Spec.ObjectstoreConfig,
+			TTL:                 schedule.Spec.TTL,
+		},
+	}
+}
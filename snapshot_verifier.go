@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+// verifierPeriod returns the period to look for snapshots to verify, at most an hour
+func verifierPeriod(verifyintervalsec int) time.Duration {
+	period := time.Duration(verifyintervalsec) * time.Second
+	if period > time.Hour {
+		return time.Hour
+	}
+	return period
+}
+
+// runSnapshotVerifier verifies completed snapshots not verified within the interval
+func (c *Controller) runSnapshotVerifier() {
+	err := c.verifySnapshots(time.Now())
+	if err != nil {
+		runtime.HandleError(err)
+	}
+}
+
+func (c *Controller) verifySnapshots(now time.Time) error {
+
+	// context for verification
+	ctx := context.TODO()
+
+	snapshots, err := c.snapshotLister.Snapshots(c.namespace).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("List snapshots error : %s", err.Error())
+	}
+
+	interval := time.Duration(c.verifyintervalsec) * time.Second
+	for _, snapshot := range snapshots {
+		if snapshot.Status.Phase != "Completed" {
+			continue
+		}
+		if !snapshot.Status.VerifiedTimestamp.IsZero() && now.Sub(snapshot.Status.VerifiedTimestamp.Time) < interval {
+			continue
+		}
+		bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig, c.kubeclientset, c.cbclientset, c.insecure)
+		if err != nil {
+			klog.Warningf("snapshot:%s cannot verify : %s", snapshot.ObjectMeta.Name, err.Error())
+			continue
+		}
+		err = c.verifySnapshot(ctx, snapshot, bucket)
+		if err != nil {
+			if !cluster.IsCorruptedError(err) {
+				klog.Warningf("snapshot:%s cannot verify : %s", snapshot.ObjectMeta.Name, err.Error())
+			}
+			continue
+		}
+		snapshot = snapshot.DeepCopy()
+		snapshot.Status.VerifiedTimestamp = metav1.NewTime(now)
+		_, err = c.updateSnapshotStatus(ctx, snapshot, snapshot.Status.Phase, snapshot.Status.Reason)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySnapshot verifies the stored snapshot, the snapshot is marked as Failed when corrupted
+func (c *Controller) verifySnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	err := c.clusterCmd.VerifySnapshot(snapshot, bucket)
+	if cluster.IsCorruptedError(err) {
+		klog.Errorf("snapshot:%s %s", snapshot.ObjectMeta.Name, err.Error())
+		_, updateErr := c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+	return err
+}
+
+// verifySnapshotChain verifies the snapshot and its parents before restoring
+func (c *Controller) verifySnapshotChain(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	verified := make(map[string]bool)
+	for {
+		err := c.verifySnapshot(ctx, snapshot, bucket)
+		if err != nil {
+			return err
+		}
+		verified[snapshot.ObjectMeta.Name] = true
+		if snapshot.Spec.ParentSnapshot == "" || verified[snapshot.Spec.ParentSnapshot] {
+			return nil
+		}
+		snapshot, err = c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, snapshot.Spec.ParentSnapshot, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("Getting parent snapshot failed : %s", err.Error())
+		}
+	}
+}